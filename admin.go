@@ -0,0 +1,324 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	cache "github.com/victorspringer/http-cache"
+	"github.com/victorspringer/http-cache/adapter/disk"
+	"github.com/victorspringer/http-cache/adapter/memory"
+	"github.com/victorspringer/http-cache/adapter/tiered"
+)
+
+// adminHandler serves the cache admin API under /admin/cache to requests
+// bearing the admin token: cache stats, the list of cached responses, and
+// purges by exact path, path prefix, path glob, tag or all at once. Purges
+// are sent on to the peers of the cluster, if any.
+type adminHandler struct {
+	token     string
+	client    *cache.Client
+	adapter   cache.Adapter
+	hot       *cache.Client
+	listLimit int
+	cluster   *invalidator
+	mux       *http.ServeMux
+}
+
+func newAdminHandler(token string, c s3Cache, listLimit int, cluster *invalidator) (*adminHandler, error) {
+	if token == "" {
+		return nil, errors.New("admin token is not set")
+	}
+	if listLimit < 1 {
+		return nil, fmt.Errorf("admin list limit %d is invalid", listLimit)
+	}
+	h := &adminHandler{
+		token:     token,
+		client:    c.client,
+		adapter:   c.adapter,
+		hot:       c.hot,
+		listLimit: listLimit,
+		cluster:   cluster,
+		mux:       http.NewServeMux(),
+	}
+	h.mux.HandleFunc("GET /admin/cache/stats", h.stats)
+	h.mux.HandleFunc("GET /admin/cache/keys", h.keys)
+	h.mux.HandleFunc("POST /admin/cache/purge", h.purge)
+	return h, nil
+}
+
+func (h *adminHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !bearerAuthorized(w, r, "admin", h.token) {
+		return
+	}
+	h.mux.ServeHTTP(w, r)
+}
+
+// bearerAuthorized reports whether a request bears a token, or responds with
+// 401 Unauthorized otherwise.
+func bearerAuthorized(w http.ResponseWriter, r *http.Request, realm, token string) bool {
+	got, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || subtle.ConstantTimeCompare([]byte(got), []byte(token)) != 1 {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="`+realm+`"`)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
+
+func (h *adminHandler) stats(w http.ResponseWriter, _ *http.Request) {
+	hits, misses := h.client.Hits(), h.client.Misses()
+	stats := map[string]any{
+		"hits_total":        hits,
+		"misses_total":      misses,
+		"hit_ratio":         0.0,
+		"expirations_total": h.client.Expirations(),
+		"tags":              tagStats(h.client),
+	}
+	if hits+misses > 0 {
+		stats["hit_ratio"] = float64(hits) / float64(hits+misses)
+	}
+	if u, ok := cacheUsage(h.adapter); ok {
+		stats["entries"] = u.entries
+		stats["bytes"] = u.bytes
+		stats["evictions_total"] = u.evictions
+	}
+	writeJSON(w, http.StatusOK, stats)
+}
+
+// adminEntry is a cached response as listed by the admin API.
+type adminEntry struct {
+	URL        string    `json:"url"`
+	Key        string    `json:"key"`
+	StatusCode int       `json:"status"`
+	Size       int64     `json:"size"`
+	Expiration time.Time `json:"expires,omitzero"`
+	Vary       []string  `json:"vary,omitempty"`
+	Negative   bool      `json:"negative,omitempty"`
+	Tags       []string  `json:"tags,omitempty"`
+}
+
+func (h *adminHandler) keys(w http.ResponseWriter, r *http.Request) {
+	match, _, err := adminMatcher(r.URL.Query(), true)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	limit := h.listLimit
+	if s := r.URL.Query().Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 {
+			http.Error(w, fmt.Sprintf("limit %q is invalid", s), http.StatusBadRequest)
+			return
+		}
+		limit = min(n, h.listLimit)
+	}
+
+	entries := []adminEntry{}
+	truncated := false
+	err = h.client.Entries(r.Context(), func(e cache.Entry) bool {
+		if !match(e) {
+			return true
+		}
+		if len(entries) == limit {
+			truncated = true
+			return false
+		}
+		entries = append(entries, adminEntry{
+			URL:        e.URL(),
+			Key:        cache.KeyAsString(e.Hash),
+			StatusCode: e.StatusCode,
+			Size:       e.Size,
+			Expiration: e.Expiration.UTC(),
+			Vary:       e.Vary,
+			Negative:   e.Negative,
+			Tags:       e.Tags,
+		})
+		return true
+	})
+	if err != nil {
+		adminError(w, "list", err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"entries": entries, "truncated": truncated})
+}
+
+func (h *adminHandler) purge(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	match, by, err := adminMatcher(r.Form, false)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	value := r.Form.Get(by)
+	n, err := purgeCache(r.Context(), s3Cache{client: h.client, adapter: h.adapter, hot: h.hot}, by, value, match)
+	if err != nil {
+		adminError(w, "purge", err)
+		return
+	}
+	result := map[string]any{"purged": n}
+	status := http.StatusOK
+	if n < 0 {
+		result["purged"], status = nil, http.StatusAccepted
+	}
+	attrs := []any{"by", by, "value", value, "purged", n}
+	if h.cluster != nil {
+		id := h.cluster.Broadcast(by, value)
+		result["id"] = id
+		attrs = append(attrs, "id", id)
+	}
+	slog.Info("cache purged", attrs...)
+	writeJSON(w, status, result)
+}
+
+// purgeCache frees the cached responses selected by match, see adminMatcher,
+// from the cache and its hot cache, if any, and returns how many were, or -1
+// if unknown.
+func purgeCache(ctx context.Context, c s3Cache, by, value string, match func(cache.Entry) bool) (int, error) {
+	n, err := purgeClient(ctx, c.client, by, value, match)
+	if err != nil || c.hot == nil {
+		return n, err
+	}
+	if by == "tag" {
+		// The tags are not sent along with the responses fetched from peers,
+		// so the hot cache is purged in full.
+		match = func(cache.Entry) bool { return true }
+	}
+	hot, err := c.hot.PurgeFunc(ctx, match)
+	if err != nil {
+		return n, fmt.Errorf("purge hot cache: %w", err)
+	}
+	if n < 0 {
+		return n, nil
+	}
+	return n + hot, nil
+}
+
+// purgeClient frees the responses selected by match cached by a client.
+func purgeClient(ctx context.Context, client *cache.Client, by, value string, match func(cache.Entry) bool) (int, error) {
+	if by == "tag" {
+		// Purged from the tag index, which also covers caches that cannot
+		// list their responses.
+		return client.PurgeTag(ctx, value), nil
+	}
+	n, err := client.PurgeFunc(ctx, match)
+	if errors.Is(err, cache.ErrNotEnumerating) && by == "path" {
+		// The response is purged by its key instead, without knowing whether
+		// it was cached, nor purging its variants.
+		client.Purge(&url.URL{Path: value})
+		return -1, nil
+	}
+	return n, err
+}
+
+// adminMatcher returns the function matching the cached responses selected by
+// one of the path, prefix, glob, tag or all parameters, along with its name.
+// If optional, no parameter selects all responses.
+func adminMatcher(params url.Values, optional bool) (func(cache.Entry) bool, string, error) {
+	var by string
+	for _, name := range []string{"path", "prefix", "glob", "tag", "all"} {
+		if params.Has(name) {
+			if by != "" {
+				return nil, "", fmt.Errorf("parameters %s and %s are exclusive", by, name)
+			}
+			by = name
+		}
+	}
+	value := params.Get(by)
+	switch by {
+	case "":
+		if !optional {
+			return nil, "", errors.New("one of the path, prefix, glob, tag or all parameters is required")
+		}
+		return func(cache.Entry) bool { return true }, "all", nil
+	case "path":
+		return func(e cache.Entry) bool { return entryPath(e) == value }, by, nil
+	case "prefix":
+		return func(e cache.Entry) bool { return strings.HasPrefix(entryPath(e), value) }, by, nil
+	case "glob":
+		if _, err := path.Match(value, ""); err != nil {
+			return nil, "", fmt.Errorf("glob %q is invalid: %w", value, err)
+		}
+		return func(e cache.Entry) bool {
+			ok, _ := path.Match(value, entryPath(e))
+			return ok
+		}, by, nil
+	case "tag":
+		if value == "" {
+			return nil, "", errors.New("tag is empty")
+		}
+		return func(e cache.Entry) bool { return slices.Contains(e.Tags, value) }, by, nil
+	default:
+		if ok, err := strconv.ParseBool(value); err != nil || !ok {
+			return nil, "", fmt.Errorf("all %q is invalid", value)
+		}
+		return func(cache.Entry) bool { return true }, by, nil
+	}
+}
+
+// entryPath returns the path of the URL of a cached response.
+func entryPath(e cache.Entry) string {
+	u, err := url.Parse(e.URL())
+	if err != nil {
+		return ""
+	}
+	return u.Path
+}
+
+func adminError(w http.ResponseWriter, action string, err error) {
+	if errors.Is(err, cache.ErrNotEnumerating) {
+		http.Error(w, "cache backend cannot list its responses", http.StatusNotImplemented)
+		return
+	}
+	slog.Error("cache admin "+action+" error", "err", err)
+	http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+// cacheUsageStats are the usage of a cache adapter.
+type cacheUsageStats struct {
+	entries   int64
+	bytes     int64
+	evictions int64
+}
+
+// cacheUsage returns the usage of a cache adapter, or false for adapters not
+// tracking it, e.g. shared ones.
+func cacheUsage(a cache.Adapter) (cacheUsageStats, bool) {
+	switch a := a.(type) {
+	case *memory.Adapter:
+		s := a.Stats()
+		return cacheUsageStats{s.Items, s.Bytes, s.Evicted}, true
+	case *disk.Adapter:
+		s := a.Stats()
+		return cacheUsageStats{s.Items, s.Bytes, s.Evicted}, true
+	case *tiered.Adapter:
+		l1, l2 := a.Tiers()
+		u1, ok1 := cacheUsage(l1)
+		u2, ok2 := cacheUsage(l2)
+		if !ok1 || !ok2 {
+			return cacheUsageStats{}, false
+		}
+		// Responses evicted from L1 are demoted rather than lost.
+		return cacheUsageStats{u1.entries + u2.entries, u1.bytes + u2.bytes, u2.evictions}, true
+	}
+	return cacheUsageStats{}, false
+}
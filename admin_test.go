@@ -0,0 +1,243 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	cache "github.com/victorspringer/http-cache"
+	"github.com/victorspringer/http-cache/adapter/memory"
+)
+
+const testAdminToken = "secret"
+
+// plainAdapter hides the optional interfaces of an adapter, e.g. to stand for
+// one that cannot list its responses.
+type plainAdapter struct {
+	cache.Adapter
+}
+
+// newTestAdmin returns an admin handler, and the cached handler of an origin
+// serving its path, tagged by the tags query parameter, both sharing a cache.
+func newTestAdmin(t *testing.T, adapter cache.Adapter) (http.Handler, http.Handler) {
+	t.Helper()
+	client, err := cache.NewClient(
+		cache.ClientWithAdapter(adapter),
+		cache.ClientWithTTL(time.Minute),
+		cache.ClientWithTags(cache.SurrogateKeyHeader, 100),
+	)
+	require.NoError(t, err)
+	origin := client.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(cache.SurrogateKeyHeader, r.URL.Query().Get("tags"))
+		_, _ = w.Write([]byte(r.URL.Path))
+	}))
+	admin, err := newAdminHandler(testAdminToken, s3Cache{client: client, adapter: adapter}, 2, nil)
+	require.NoError(t, err)
+	return admin, origin
+}
+
+func newTestMemoryAdapter(t *testing.T) *memory.Adapter {
+	t.Helper()
+	a, err := memory.NewAdapter(memory.AdapterWithAlgorithm(memory.LRU), memory.AdapterWithCapacity(100))
+	require.NoError(t, err)
+	return a.(*memory.Adapter)
+}
+
+func adminRequest(t *testing.T, h http.Handler, method, target string) (*httptest.ResponseRecorder, map[string]any) {
+	t.Helper()
+	r := httptest.NewRequest(method, target, nil)
+	r.Header.Set("Authorization", "Bearer "+testAdminToken)
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	var body map[string]any
+	if w.Header().Get("Content-Type") == "application/json" {
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &body))
+	}
+	return w, body
+}
+
+func warmTestPaths(h http.Handler, paths ...string) {
+	for _, p := range paths {
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, p, nil))
+	}
+}
+
+func TestNewAdminHandler_Errors(t *testing.T) {
+	t.Parallel()
+	_, err := newAdminHandler("", s3Cache{}, 1, nil)
+	require.Error(t, err)
+	_, err = newAdminHandler(testAdminToken, s3Cache{}, 0, nil)
+	require.Error(t, err)
+}
+
+func TestAdminHandler_Unauthorized(t *testing.T) {
+	t.Parallel()
+	admin, _ := newTestAdmin(t, newTestMemoryAdapter(t))
+	for _, auth := range []string{"", "Bearer wrong", testAdminToken} {
+		r := httptest.NewRequest(http.MethodGet, "/admin/cache/stats", nil)
+		if auth != "" {
+			r.Header.Set("Authorization", auth)
+		}
+		w := httptest.NewRecorder()
+		admin.ServeHTTP(w, r)
+		assert.Equal(t, http.StatusUnauthorized, w.Code, auth)
+		assert.NotEmpty(t, w.Header().Get("WWW-Authenticate"))
+	}
+}
+
+func TestAdminHandler_Stats(t *testing.T) {
+	t.Parallel()
+	admin, origin := newTestAdmin(t, newTestMemoryAdapter(t))
+	warmTestPaths(origin, "/a.txt", "/b.txt", "/a.txt", "/a.txt")
+
+	w, body := adminRequest(t, admin, http.MethodGet, "/admin/cache/stats")
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.InDelta(t, 2, body["hits_total"], 0)
+	assert.InDelta(t, 2, body["misses_total"], 0)
+	assert.InDelta(t, 0.5, body["hit_ratio"], 0)
+	assert.InDelta(t, 2, body["entries"], 0)
+	assert.Greater(t, body["bytes"], 0.0)
+	assert.InDelta(t, 0, body["evictions_total"], 0)
+	assert.Contains(t, body, "tags")
+
+	admin, _ = newTestAdmin(t, plainAdapter{newTestMemoryAdapter(t)})
+	_, body = adminRequest(t, admin, http.MethodGet, "/admin/cache/stats")
+	assert.NotContains(t, body, "entries")
+}
+
+func TestAdminHandler_Keys(t *testing.T) {
+	t.Parallel()
+	admin, origin := newTestAdmin(t, newTestMemoryAdapter(t))
+	warmTestPaths(origin, "/assets/app.js", "/assets/app.css?v=1", "/index.html")
+
+	tests := []struct {
+		name      string
+		query     string
+		want      []string
+		truncated bool
+	}{
+		{"lists up to the list limit", "", nil, true},
+		{"filters by path", "?path=/index.html", []string{"/index.html"}, false},
+		{"filters by prefix", "?prefix=/assets/", []string{"/assets/app.css?v=1", "/assets/app.js"}, false},
+		{"filters by glob", "?glob=/assets/*.js", []string{"/assets/app.js"}, false},
+		{"limits the entries", "?prefix=/assets/&limit=1", nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w, body := adminRequest(t, admin, http.MethodGet, "/admin/cache/keys"+tt.query)
+			require.Equal(t, http.StatusOK, w.Code)
+			assert.Equal(t, tt.truncated, body["truncated"])
+			entries := body["entries"].([]any)
+			var urls []string
+			for _, e := range entries {
+				e := e.(map[string]any)
+				assert.InDelta(t, http.StatusOK, e["status"], 0)
+				assert.Greater(t, e["size"], 0.0)
+				assert.NotEmpty(t, e["key"])
+				assert.NotEmpty(t, e["expires"])
+				urls = append(urls, e["url"].(string))
+			}
+			if tt.want != nil {
+				assert.ElementsMatch(t, tt.want, urls)
+			} else {
+				assert.NotEmpty(t, urls)
+			}
+		})
+	}
+
+	for _, query := range []string{"?limit=0", "?glob=[", "?path=/a&prefix=/b"} {
+		w, _ := adminRequest(t, admin, http.MethodGet, "/admin/cache/keys"+query)
+		assert.Equal(t, http.StatusBadRequest, w.Code, query)
+	}
+}
+
+func TestAdminHandler_Purge(t *testing.T) {
+	t.Parallel()
+	adapter := newTestMemoryAdapter(t)
+	admin, origin := newTestAdmin(t, adapter)
+	warmTestPaths(origin, "/assets/app.js", "/assets/app.css", "/assets/img/logo.png", "/index.html", "/about.html")
+
+	tests := []struct {
+		query  string
+		purged float64
+		left   int
+	}{
+		{"path=/index.html", 1, 4},
+		{"glob=/assets/*.css", 1, 3},
+		{"prefix=/assets/", 2, 1},
+		{"all=true", 1, 0},
+	}
+	for _, tt := range tests {
+		w, body := adminRequest(t, admin, http.MethodPost, "/admin/cache/purge?"+tt.query)
+		require.Equal(t, http.StatusOK, w.Code, tt.query)
+		assert.InDelta(t, tt.purged, body["purged"], 0, tt.query)
+		assert.Equal(t, tt.left, adapter.Len(), tt.query)
+	}
+
+	for _, query := range []string{"", "all=false", "path=/a&all=true"} {
+		w, _ := adminRequest(t, admin, http.MethodPost, "/admin/cache/purge?"+query)
+		assert.Equal(t, http.StatusBadRequest, w.Code, query)
+	}
+
+	r := httptest.NewRequest(http.MethodPost, "/admin/cache/purge", strings.NewReader(url.Values{"path": {"/about.html"}}.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.Header.Set("Authorization", "Bearer "+testAdminToken)
+	w := httptest.NewRecorder()
+	admin.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusOK, w.Code)
+}
+
+func TestAdminHandler_NotEnumerating(t *testing.T) {
+	t.Parallel()
+	adapter := newTestMemoryAdapter(t)
+	admin, origin := newTestAdmin(t, plainAdapter{adapter})
+	warmTestPaths(origin, "/index.html", "/about.html")
+
+	w, _ := adminRequest(t, admin, http.MethodGet, "/admin/cache/keys")
+	assert.Equal(t, http.StatusNotImplemented, w.Code)
+	w, _ = adminRequest(t, admin, http.MethodPost, "/admin/cache/purge?prefix=/")
+	assert.Equal(t, http.StatusNotImplemented, w.Code)
+
+	w, body := adminRequest(t, admin, http.MethodPost, "/admin/cache/purge?path=/index.html")
+	assert.Equal(t, http.StatusAccepted, w.Code)
+	assert.Contains(t, body, "purged")
+	assert.Nil(t, body["purged"])
+	assert.Equal(t, 1, adapter.Len())
+}
+
+func TestAdminHandler_Tags(t *testing.T) {
+	t.Parallel()
+	adapter := newTestMemoryAdapter(t)
+	admin, origin := newTestAdmin(t, adapter)
+	warmTestPaths(origin, "/app.js?tags=release-1+js", "/app.css?tags=release-1", "/index.html?tags=release-2")
+
+	w, body := adminRequest(t, admin, http.MethodGet, "/admin/cache/keys?tag=release-1")
+	require.Equal(t, http.StatusOK, w.Code)
+	entries := body["entries"].([]any)
+	require.Len(t, entries, 2)
+	for _, e := range entries {
+		assert.Contains(t, e.(map[string]any)["tags"], "release-1")
+	}
+
+	w, body = adminRequest(t, admin, http.MethodPost, "/admin/cache/purge?tag=release-1")
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.InDelta(t, 2, body["purged"], 0)
+	assert.Equal(t, 1, adapter.Len())
+
+	w, _ = adminRequest(t, admin, http.MethodPost, "/admin/cache/purge?tag=")
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	adapter = newTestMemoryAdapter(t)
+	admin, origin = newTestAdmin(t, plainAdapter{adapter})
+	warmTestPaths(origin, "/app.js?tags=release-1", "/index.html")
+	w, body = adminRequest(t, admin, http.MethodPost, "/admin/cache/purge?tag=release-1")
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.InDelta(t, 1, body["purged"], 0)
+	assert.Equal(t, 1, adapter.Len())
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"slices"
+	"strings"
+)
+
+// hostResolver is the subset of net.Resolver used to discover peers.
+type hostResolver interface {
+	LookupHost(ctx context.Context, host string) ([]string, error)
+}
+
+// clusterPeers finds the base URLs of the replicas of the cluster: a static
+// list, and the addresses a DNS name resolves to, e.g. those of a Kubernetes
+// headless service, on the given port. The replica itself may be among them.
+type clusterPeers struct {
+	static   []string
+	dnsHost  string
+	dnsPort  string
+	resolver hostResolver
+}
+
+func newClusterPeers(static []string, dns string) (*clusterPeers, error) {
+	if len(static) == 0 && dns == "" {
+		return nil, errors.New("cluster peers are not set")
+	}
+	p := &clusterPeers{resolver: net.DefaultResolver}
+	for _, peer := range static {
+		u, err := url.Parse(peer)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("cluster peer %q is not a valid url", peer)
+		}
+		p.static = append(p.static, strings.TrimSuffix(u.String(), "/"))
+	}
+	if dns != "" {
+		host, port, err := net.SplitHostPort(dns)
+		if err != nil || host == "" || port == "" {
+			return nil, fmt.Errorf("cluster peers dns %q is not a host:port", dns)
+		}
+		p.dnsHost, p.dnsPort = host, port
+	}
+	return p, nil
+}
+
+// Peers returns the base URLs of the peers, sorted and without duplicates.
+func (p *clusterPeers) Peers(ctx context.Context) ([]string, error) {
+	peers := slices.Clone(p.static)
+	if p.dnsHost != "" {
+		addrs, err := p.resolver.LookupHost(ctx, p.dnsHost)
+		if err != nil {
+			return nil, fmt.Errorf("resolve cluster peers: %w", err)
+		}
+		for _, addr := range addrs {
+			peers = append(peers, "http://"+net.JoinHostPort(addr, p.dnsPort))
+		}
+	}
+	slices.Sort(peers)
+	return slices.Compact(peers), nil
+}
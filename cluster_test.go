@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type hostResolverFunc func(ctx context.Context, host string) ([]string, error)
+
+func (f hostResolverFunc) LookupHost(ctx context.Context, host string) ([]string, error) {
+	return f(ctx, host)
+}
+
+func TestClusterPeers(t *testing.T) {
+	t.Parallel()
+	p, err := newClusterPeers([]string{"http://10.0.0.2:8080/", "http://10.0.0.1:8080"}, "peers.local:8080")
+	require.NoError(t, err)
+	p.resolver = hostResolverFunc(func(_ context.Context, host string) ([]string, error) {
+		assert.Equal(t, "peers.local", host)
+		return []string{"10.0.0.1", "fd00::1"}, nil
+	})
+	peers, err := p.Peers(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, []string{"http://10.0.0.1:8080", "http://10.0.0.2:8080", "http://[fd00::1]:8080"}, peers)
+
+	p.resolver = hostResolverFunc(func(context.Context, string) ([]string, error) {
+		return nil, errors.New("no such host")
+	})
+	_, err = p.Peers(context.Background())
+	require.ErrorContains(t, err, "no such host")
+}
+
+func TestNewClusterPeers_Errors(t *testing.T) {
+	t.Parallel()
+	for _, tt := range []struct {
+		static []string
+		dns    string
+	}{
+		{nil, ""},
+		{[]string{"10.0.0.1:8080"}, ""},
+		{[]string{"ftp://10.0.0.1"}, ""},
+		{nil, "peers.local"},
+		{nil, ":8080"},
+	} {
+		_, err := newClusterPeers(tt.static, tt.dns)
+		assert.Error(t, err, tt)
+	}
+}
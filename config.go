@@ -10,15 +10,84 @@ import (
 const envPrefix = "APP"
 
 type Config struct {
-	ServerHost           string        `split_words:"true" required:"true" default:"0.0.0.0"`
-	ServerPort           uint16        `split_words:"true" required:"true" default:"8080"`
-	S3Bucket             string        `split_words:"true" required:"true"`
-	S3Region             string        `split_words:"true" required:"false"`
-	S3EndpointURL        string        `split_words:"true" required:"false"`
-	S3UsePathStyle       bool          `split_words:"true" required:"false"`
-	CachingCapacityItems int           `split_words:"true" required:"true" default:"1024"`
-	CachingCapacityBytes int           `split_words:"true" required:"true" default:"52428800"` // 50 MiB
-	CachingTTL           time.Duration `split_words:"true" required:"true" default:"10m"`      // 10 minutes
+	ServerHost                   string        `split_words:"true" required:"true" default:"0.0.0.0"`
+	ServerPort                   uint16        `split_words:"true" required:"true" default:"8080"`
+	S3Bucket                     string        `split_words:"true" required:"true"`
+	S3Region                     string        `split_words:"true" required:"false"`
+	S3EndpointURL                string        `split_words:"true" required:"false"`
+	S3UsePathStyle               bool          `split_words:"true" required:"false"`
+	S3MaxConcurrency             int           `split_words:"true" required:"true" default:"64"`
+	S3MaxQueue                   int           `split_words:"true" required:"true" default:"256"`
+	S3QueueTimeout               time.Duration `split_words:"true" required:"true" default:"5s"` // 5 seconds
+	CachingBackend               string        `split_words:"true" required:"true" default:"memory"`
+	CachingCapacityItems         int           `split_words:"true" required:"true" default:"1024"`
+	CachingCapacityBytes         int           `split_words:"true" required:"true" default:"52428800"` // 50 MiB
+	CachingAlgorithm             string        `split_words:"true" required:"true" default:"lru"`
+	CachingDiskDirectory         string        `split_words:"true" required:"false"`
+	CachingDiskCapacityBytes     int64         `split_words:"true" required:"true" default:"10737418240"` // 10 GiB
+	CachingRedisAddrs            []string      `split_words:"true" required:"false"`
+	CachingRedisMasterName       string        `split_words:"true" required:"false"`
+	CachingRedisCluster          bool          `split_words:"true" required:"false"`
+	CachingRedisUsername         string        `split_words:"true" required:"false"`
+	CachingRedisPassword         string        `split_words:"true" required:"false"`
+	CachingRedisDB               int           `split_words:"true" required:"false"`
+	CachingRedisTLS              bool          `split_words:"true" required:"false"`
+	CachingRedisKeyPrefix        string        `split_words:"true" required:"true" default:"go-serve-s3:"`
+	CachingRedisTimeout          time.Duration `split_words:"true" required:"true" default:"1s"` // 1 second
+	CachingMemcachedServers      []string      `split_words:"true" required:"false"`
+	CachingMemcachedKeyPrefix    string        `split_words:"true" required:"true" default:"go-serve-s3:"`
+	CachingMemcachedMaxItemBytes int           `split_words:"true" required:"true" default:"1048576"` // 1 MiB
+	CachingMemcachedTimeout      time.Duration `split_words:"true" required:"true" default:"1s"`      // 1 second
+	CachingTieredL2              string        `split_words:"true" required:"true" default:"disk"`
+	CachingTieredPromoteHits     int           `split_words:"true" required:"true" default:"2"`
+	CachingTieredMaxL1Bytes      int           `split_words:"true" required:"true" default:"1048576"` // 1 MiB
+	CachingAdapterTimeout        time.Duration `split_words:"true" required:"true" default:"500ms"`   // 500 milliseconds
+	CachingSweepInterval         time.Duration `split_words:"true" required:"true" default:"1m"`      // 1 minute
+	CachingSnapshotFile          string        `split_words:"true" required:"false"`
+	CachingSnapshotInterval      time.Duration `split_words:"true" required:"false"`
+	CachingWarmFile              string        `split_words:"true" required:"false"`
+	CachingWarmManifest          string        `split_words:"true" required:"false"`
+	CachingWarmPrefix            string        `split_words:"true" required:"false"`
+	CachingWarmMaxPaths          int           `split_words:"true" required:"true" default:"1000"`
+	CachingWarmConcurrency       int           `split_words:"true" required:"true" default:"4"`
+	CachingWarmReadyTimeout      time.Duration `split_words:"true" required:"false"`
+	CachingTTL                   time.Duration `split_words:"true" required:"true" default:"10m"` // 10 minutes
+	CachingMaxTTL                time.Duration `split_words:"true" required:"false"`
+	CachingStaleWhileRevalidate  time.Duration `split_words:"true" required:"false"`
+	CachingStaleIfError          time.Duration `split_words:"true" required:"false"`
+	CachingNegativeTTL           time.Duration `split_words:"true" required:"false"`
+	CachingNegativeCapacityItems int           `split_words:"true" required:"true" default:"1024"`
+	CachingNegativeCapacityBytes int           `split_words:"true" required:"true" default:"1048576"` // 1 MiB
+	CachingCoalesceWait          time.Duration `split_words:"true" required:"false"`
+	CachingKeyIgnoreQuery        bool          `split_words:"true" required:"false"`
+	CachingKeyQueryAllow         []string      `split_words:"true" required:"false"`
+	CachingKeyQueryDeny          []string      `split_words:"true" required:"false"`
+	CachingKeyHost               bool          `split_words:"true" required:"false"`
+	CachingKeyHeaders            []string      `split_words:"true" required:"false"`
+	CachingKeyVary               bool          `split_words:"true" required:"false"`
+	CachingKeyNormalizePath      bool          `split_words:"true" required:"false"`
+	CachingKeyHash               string        `split_words:"true" required:"true" default:"fnv64a"`
+	CachingRulesFile             string        `split_words:"true" required:"false"`
+	CachingHashedAssetsImmutable bool          `split_words:"true" required:"false"`
+	CachingTagHeader             string        `split_words:"true" required:"false"`
+	CachingTagMetadata           string        `split_words:"true" required:"true" default:"surrogate-key"`
+	CachingTagMaxKeys            int           `split_words:"true" required:"true" default:"100000"`
+	CachingDebugHeaders          bool          `split_words:"true" required:"false"`
+	CachingDebugToken            string        `split_words:"true" required:"false"`
+	AdminToken                   string        `split_words:"true" required:"false"`
+	AdminListLimit               int           `split_words:"true" required:"true" default:"1000"`
+	ClusterPeers                 []string      `split_words:"true" required:"false"`
+	ClusterPeersDNS              string        `split_words:"true" required:"false"`
+	ClusterToken                 string        `split_words:"true" required:"false"`
+	ClusterTimeout               time.Duration `split_words:"true" required:"true" default:"2s"` // 2 seconds
+	ClusterRetries               int           `split_words:"true" required:"true" default:"5"`
+	ClusterRetryInterval         time.Duration `split_words:"true" required:"true" default:"1s"` // 1 second
+	ClusterPeerCache             bool          `split_words:"true" required:"false"`
+	ClusterSelf                  string        `split_words:"true" required:"false"`
+	ClusterPeerRefresh           time.Duration `split_words:"true" required:"true" default:"30s"` // 30 seconds
+	ClusterHotCacheItems         int           `split_words:"true" required:"true" default:"1024"`
+	ClusterHotCacheBytes         int           `split_words:"true" required:"true" default:"10485760"` // 10 MiB
+	ClusterHotCacheTTL           time.Duration `split_words:"true" required:"true" default:"1m"`       // 1 minute
 }
 
 func NewConfigFromEnv() (Config, error) {
@@ -15,23 +15,157 @@ func TestNewConfigFromEnv(t *testing.T) {
 	t.Setenv("APP_S3_REGION", "us-west-1")
 	t.Setenv("APP_S3_ENDPOINT_URL", "http://127.0.0.1:9090")
 	t.Setenv("APP_S3_USE_PATH_STYLE", "true")
+	t.Setenv("APP_S3_MAX_CONCURRENCY", "16")
+	t.Setenv("APP_S3_MAX_QUEUE", "32")
+	t.Setenv("APP_S3_QUEUE_TIMEOUT", "2s")
+	t.Setenv("APP_CACHING_BACKEND", "tiered")
 	t.Setenv("APP_CACHING_CAPACITY_ITEMS", "512")
 	t.Setenv("APP_CACHING_CAPACITY_BYTES", "26214400")
+	t.Setenv("APP_CACHING_ALGORITHM", "w-tinylfu")
+	t.Setenv("APP_CACHING_DISK_DIRECTORY", "/var/cache/go-serve-s3")
+	t.Setenv("APP_CACHING_DISK_CAPACITY_BYTES", "1073741824")
+	t.Setenv("APP_CACHING_REDIS_ADDRS", "redis-1:6379,redis-2:6379")
+	t.Setenv("APP_CACHING_REDIS_MASTER_NAME", "mymaster")
+	t.Setenv("APP_CACHING_REDIS_CLUSTER", "true")
+	t.Setenv("APP_CACHING_REDIS_USERNAME", "cache")
+	t.Setenv("APP_CACHING_REDIS_PASSWORD", "secret")
+	t.Setenv("APP_CACHING_REDIS_DB", "2")
+	t.Setenv("APP_CACHING_REDIS_TLS", "true")
+	t.Setenv("APP_CACHING_REDIS_KEY_PREFIX", "assets:")
+	t.Setenv("APP_CACHING_REDIS_TIMEOUT", "250ms")
+	t.Setenv("APP_CACHING_MEMCACHED_SERVERS", "memcached-1:11211,memcached-2:11211")
+	t.Setenv("APP_CACHING_MEMCACHED_KEY_PREFIX", "assets:")
+	t.Setenv("APP_CACHING_MEMCACHED_MAX_ITEM_BYTES", "2097152")
+	t.Setenv("APP_CACHING_MEMCACHED_TIMEOUT", "500ms")
+	t.Setenv("APP_CACHING_TIERED_L2", "redis")
+	t.Setenv("APP_CACHING_TIERED_PROMOTE_HITS", "3")
+	t.Setenv("APP_CACHING_TIERED_MAX_L1_BYTES", "65536")
+	t.Setenv("APP_CACHING_ADAPTER_TIMEOUT", "200ms")
+	t.Setenv("APP_CACHING_SWEEP_INTERVAL", "10s")
+	t.Setenv("APP_CACHING_SNAPSHOT_FILE", "/var/cache/go-serve-s3.snapshot")
+	t.Setenv("APP_CACHING_SNAPSHOT_INTERVAL", "5m")
+	t.Setenv("APP_CACHING_WARM_FILE", "/etc/go-serve-s3/warm.txt")
+	t.Setenv("APP_CACHING_WARM_MANIFEST", "warm/manifest.txt")
+	t.Setenv("APP_CACHING_WARM_PREFIX", "assets/")
+	t.Setenv("APP_CACHING_WARM_MAX_PATHS", "500")
+	t.Setenv("APP_CACHING_WARM_CONCURRENCY", "8")
+	t.Setenv("APP_CACHING_WARM_READY_TIMEOUT", "30s")
 	t.Setenv("APP_CACHING_TTL", "42m42s")
+	t.Setenv("APP_CACHING_MAX_TTL", "24h")
+	t.Setenv("APP_CACHING_NEGATIVE_TTL", "15s")
+	t.Setenv("APP_CACHING_NEGATIVE_CAPACITY_ITEMS", "64")
+	t.Setenv("APP_CACHING_NEGATIVE_CAPACITY_BYTES", "65536")
+	t.Setenv("APP_CACHING_COALESCE_WAIT", "0s")
+	t.Setenv("APP_CACHING_STALE_WHILE_REVALIDATE", "1m")
+	t.Setenv("APP_CACHING_STALE_IF_ERROR", "24h")
+	t.Setenv("APP_CACHING_KEY_QUERY_DENY", "utm_*,fbclid")
+	t.Setenv("APP_CACHING_KEY_HOST", "true")
+	t.Setenv("APP_CACHING_KEY_HEADERS", "Accept-Language")
+	t.Setenv("APP_CACHING_KEY_VARY", "true")
+	t.Setenv("APP_CACHING_KEY_NORMALIZE_PATH", "true")
+	t.Setenv("APP_CACHING_KEY_HASH", "sha256")
+	t.Setenv("APP_CACHING_RULES_FILE", "/etc/go-serve-s3/rules.json")
+	t.Setenv("APP_CACHING_HASHED_ASSETS_IMMUTABLE", "true")
+	t.Setenv("APP_CACHING_TAG_HEADER", "Cache-Tag")
+	t.Setenv("APP_CACHING_TAG_METADATA", "cache-tag")
+	t.Setenv("APP_CACHING_TAG_MAX_KEYS", "1000")
+	t.Setenv("APP_CACHING_DEBUG_HEADERS", "true")
+	t.Setenv("APP_CACHING_DEBUG_TOKEN", "secret")
+	t.Setenv("APP_ADMIN_TOKEN", "admin-secret")
+	t.Setenv("APP_ADMIN_LIST_LIMIT", "100")
+	t.Setenv("APP_CLUSTER_PEERS", "http://10.0.0.1:8080,http://10.0.0.2:8080")
+	t.Setenv("APP_CLUSTER_PEERS_DNS", "go-serve-s3-headless:8080")
+	t.Setenv("APP_CLUSTER_TOKEN", "cluster-secret")
+	t.Setenv("APP_CLUSTER_TIMEOUT", "5s")
+	t.Setenv("APP_CLUSTER_RETRIES", "3")
+	t.Setenv("APP_CLUSTER_RETRY_INTERVAL", "500ms")
+	t.Setenv("APP_CLUSTER_PEER_CACHE", "true")
+	t.Setenv("APP_CLUSTER_SELF", "http://10.0.0.1:8080")
+	t.Setenv("APP_CLUSTER_PEER_REFRESH", "1m")
+	t.Setenv("APP_CLUSTER_HOT_CACHE_ITEMS", "256")
+	t.Setenv("APP_CLUSTER_HOT_CACHE_BYTES", "1048576")
+	t.Setenv("APP_CLUSTER_HOT_CACHE_TTL", "30s")
 
 	actual, err := NewConfigFromEnv()
 	require.NoError(t, err)
 
 	assert.Equal(t, Config{
-		ServerHost:           "127.0.0.1",
-		ServerPort:           3000,
-		S3Bucket:             "test-bucket",
-		S3Region:             "us-west-1",
-		S3EndpointURL:        "http://127.0.0.1:9090",
-		S3UsePathStyle:       true,
-		CachingCapacityItems: 512,
-		CachingCapacityBytes: 25 * 1024 * 1024,
-		CachingTTL:           42*time.Minute + 42*time.Second,
+		ServerHost:                   "127.0.0.1",
+		ServerPort:                   3000,
+		S3Bucket:                     "test-bucket",
+		S3Region:                     "us-west-1",
+		S3EndpointURL:                "http://127.0.0.1:9090",
+		S3UsePathStyle:               true,
+		S3MaxConcurrency:             16,
+		S3MaxQueue:                   32,
+		S3QueueTimeout:               2 * time.Second,
+		CachingBackend:               "tiered",
+		CachingCapacityItems:         512,
+		CachingCapacityBytes:         25 * 1024 * 1024,
+		CachingAlgorithm:             "w-tinylfu",
+		CachingDiskDirectory:         "/var/cache/go-serve-s3",
+		CachingDiskCapacityBytes:     1024 * 1024 * 1024,
+		CachingRedisAddrs:            []string{"redis-1:6379", "redis-2:6379"},
+		CachingRedisMasterName:       "mymaster",
+		CachingRedisCluster:          true,
+		CachingRedisUsername:         "cache",
+		CachingRedisPassword:         "secret",
+		CachingRedisDB:               2,
+		CachingRedisTLS:              true,
+		CachingRedisKeyPrefix:        "assets:",
+		CachingRedisTimeout:          250 * time.Millisecond,
+		CachingMemcachedServers:      []string{"memcached-1:11211", "memcached-2:11211"},
+		CachingMemcachedKeyPrefix:    "assets:",
+		CachingMemcachedMaxItemBytes: 2 * 1024 * 1024,
+		CachingMemcachedTimeout:      500 * time.Millisecond,
+		CachingTieredL2:              "redis",
+		CachingTieredPromoteHits:     3,
+		CachingTieredMaxL1Bytes:      64 * 1024,
+		CachingAdapterTimeout:        200 * time.Millisecond,
+		CachingSweepInterval:         10 * time.Second,
+		CachingSnapshotFile:          "/var/cache/go-serve-s3.snapshot",
+		CachingSnapshotInterval:      5 * time.Minute,
+		CachingWarmFile:              "/etc/go-serve-s3/warm.txt",
+		CachingWarmManifest:          "warm/manifest.txt",
+		CachingWarmPrefix:            "assets/",
+		CachingWarmMaxPaths:          500,
+		CachingWarmConcurrency:       8,
+		CachingWarmReadyTimeout:      30 * time.Second,
+		CachingTTL:                   42*time.Minute + 42*time.Second,
+		CachingMaxTTL:                24 * time.Hour,
+		CachingNegativeTTL:           15 * time.Second,
+		CachingNegativeCapacityItems: 64,
+		CachingNegativeCapacityBytes: 64 * 1024,
+		CachingCoalesceWait:          0,
+		CachingStaleWhileRevalidate:  time.Minute,
+		CachingStaleIfError:          24 * time.Hour,
+		CachingKeyQueryDeny:          []string{"utm_*", "fbclid"},
+		CachingKeyHost:               true,
+		CachingKeyHeaders:            []string{"Accept-Language"},
+		CachingKeyVary:               true,
+		CachingKeyNormalizePath:      true,
+		CachingKeyHash:               "sha256",
+		CachingRulesFile:             "/etc/go-serve-s3/rules.json",
+		CachingHashedAssetsImmutable: true,
+		CachingTagHeader:             "Cache-Tag",
+		CachingTagMetadata:           "cache-tag",
+		CachingTagMaxKeys:            1000,
+		CachingDebugHeaders:          true,
+		CachingDebugToken:            "secret",
+		AdminToken:                   "admin-secret",
+		AdminListLimit:               100,
+		ClusterPeers:                 []string{"http://10.0.0.1:8080", "http://10.0.0.2:8080"},
+		ClusterPeersDNS:              "go-serve-s3-headless:8080",
+		ClusterToken:                 "cluster-secret",
+		ClusterTimeout:               5 * time.Second,
+		ClusterRetries:               3,
+		ClusterRetryInterval:         500 * time.Millisecond,
+		ClusterPeerCache:             true,
+		ClusterSelf:                  "http://10.0.0.1:8080",
+		ClusterPeerRefresh:           time.Minute,
+		ClusterHotCacheItems:         256,
+		ClusterHotCacheBytes:         1048576,
+		ClusterHotCacheTTL:           30 * time.Second,
 	}, actual)
 }
 
@@ -43,9 +177,78 @@ func TestNewConfigFromEnv_Defaults(t *testing.T) {
 
 	assert.Equal(t, "0.0.0.0", cfg.ServerHost)
 	assert.Equal(t, uint16(8080), cfg.ServerPort)
+	assert.Equal(t, 64, cfg.S3MaxConcurrency)
+	assert.Equal(t, 256, cfg.S3MaxQueue)
+	assert.Equal(t, 5*time.Second, cfg.S3QueueTimeout)
+	assert.Equal(t, "memory", cfg.CachingBackend)
 	assert.Equal(t, 1024, cfg.CachingCapacityItems)
 	assert.Equal(t, 50*1024*1024, cfg.CachingCapacityBytes)
+	assert.Equal(t, "lru", cfg.CachingAlgorithm)
+	assert.Empty(t, cfg.CachingDiskDirectory)
+	assert.Equal(t, int64(10*1024*1024*1024), cfg.CachingDiskCapacityBytes)
+	assert.Empty(t, cfg.CachingRedisAddrs)
+	assert.Empty(t, cfg.CachingRedisMasterName)
+	assert.False(t, cfg.CachingRedisCluster)
+	assert.Empty(t, cfg.CachingRedisUsername)
+	assert.Empty(t, cfg.CachingRedisPassword)
+	assert.Zero(t, cfg.CachingRedisDB)
+	assert.False(t, cfg.CachingRedisTLS)
+	assert.Equal(t, "go-serve-s3:", cfg.CachingRedisKeyPrefix)
+	assert.Equal(t, time.Second, cfg.CachingRedisTimeout)
+	assert.Empty(t, cfg.CachingMemcachedServers)
+	assert.Equal(t, "go-serve-s3:", cfg.CachingMemcachedKeyPrefix)
+	assert.Equal(t, 1024*1024, cfg.CachingMemcachedMaxItemBytes)
+	assert.Equal(t, time.Second, cfg.CachingMemcachedTimeout)
+	assert.Equal(t, "disk", cfg.CachingTieredL2)
+	assert.Equal(t, 2, cfg.CachingTieredPromoteHits)
+	assert.Equal(t, 1024*1024, cfg.CachingTieredMaxL1Bytes)
+	assert.Equal(t, 500*time.Millisecond, cfg.CachingAdapterTimeout)
+	assert.Equal(t, time.Minute, cfg.CachingSweepInterval)
+	assert.Empty(t, cfg.CachingSnapshotFile)
+	assert.Zero(t, cfg.CachingSnapshotInterval)
+	assert.Empty(t, cfg.CachingWarmFile)
+	assert.Empty(t, cfg.CachingWarmManifest)
+	assert.Empty(t, cfg.CachingWarmPrefix)
+	assert.Equal(t, 1000, cfg.CachingWarmMaxPaths)
+	assert.Equal(t, 4, cfg.CachingWarmConcurrency)
+	assert.Zero(t, cfg.CachingWarmReadyTimeout)
 	assert.Equal(t, 10*time.Minute, cfg.CachingTTL)
+	assert.Zero(t, cfg.CachingMaxTTL)
+	assert.Zero(t, cfg.CachingNegativeTTL)
+	assert.Equal(t, 1024, cfg.CachingNegativeCapacityItems)
+	assert.Equal(t, 1024*1024, cfg.CachingNegativeCapacityBytes)
+	assert.Zero(t, cfg.CachingCoalesceWait)
+	assert.Zero(t, cfg.CachingStaleWhileRevalidate)
+	assert.Zero(t, cfg.CachingStaleIfError)
+	assert.False(t, cfg.CachingKeyIgnoreQuery)
+	assert.Empty(t, cfg.CachingKeyQueryAllow)
+	assert.Empty(t, cfg.CachingKeyQueryDeny)
+	assert.False(t, cfg.CachingKeyHost)
+	assert.Empty(t, cfg.CachingKeyHeaders)
+	assert.False(t, cfg.CachingKeyVary)
+	assert.False(t, cfg.CachingKeyNormalizePath)
+	assert.Equal(t, "fnv64a", cfg.CachingKeyHash)
+	assert.Empty(t, cfg.CachingRulesFile)
+	assert.False(t, cfg.CachingHashedAssetsImmutable)
+	assert.Empty(t, cfg.CachingTagHeader)
+	assert.Equal(t, "surrogate-key", cfg.CachingTagMetadata)
+	assert.Equal(t, 100000, cfg.CachingTagMaxKeys)
+	assert.False(t, cfg.CachingDebugHeaders)
+	assert.Empty(t, cfg.CachingDebugToken)
+	assert.Empty(t, cfg.AdminToken)
+	assert.Equal(t, 1000, cfg.AdminListLimit)
+	assert.Empty(t, cfg.ClusterPeers)
+	assert.Empty(t, cfg.ClusterPeersDNS)
+	assert.Empty(t, cfg.ClusterToken)
+	assert.Equal(t, 2*time.Second, cfg.ClusterTimeout)
+	assert.Equal(t, 5, cfg.ClusterRetries)
+	assert.Equal(t, time.Second, cfg.ClusterRetryInterval)
+	assert.False(t, cfg.ClusterPeerCache)
+	assert.Empty(t, cfg.ClusterSelf)
+	assert.Equal(t, 30*time.Second, cfg.ClusterPeerRefresh)
+	assert.Equal(t, 1024, cfg.ClusterHotCacheItems)
+	assert.Equal(t, 10*1024*1024, cfg.ClusterHotCacheBytes)
+	assert.Equal(t, time.Minute, cfg.ClusterHotCacheTTL)
 }
 
 func TestNewConfigFromEnv_Errors(t *testing.T) {
@@ -69,6 +272,20 @@ func TestNewConfigFromEnv_Errors(t *testing.T) {
 		require.Error(t, err)
 	})
 
+	t.Run("invalid s3 max concurrency", func(t *testing.T) {
+		t.Setenv("APP_S3_BUCKET", "test-bucket")
+		t.Setenv("APP_S3_MAX_CONCURRENCY", "invalid")
+		_, err := NewConfigFromEnv()
+		require.Error(t, err)
+	})
+
+	t.Run("invalid s3 queue timeout", func(t *testing.T) {
+		t.Setenv("APP_S3_BUCKET", "test-bucket")
+		t.Setenv("APP_S3_QUEUE_TIMEOUT", "invalid")
+		_, err := NewConfigFromEnv()
+		require.Error(t, err)
+	})
+
 	t.Run("invalid caching capacity items", func(t *testing.T) {
 		t.Setenv("APP_S3_BUCKET", "test-bucket")
 		t.Setenv("APP_CACHING_CAPACITY_ITEMS", "invalid")
@@ -89,4 +306,46 @@ func TestNewConfigFromEnv_Errors(t *testing.T) {
 		_, err := NewConfigFromEnv()
 		require.Error(t, err)
 	})
+
+	t.Run("invalid caching stale while revalidate", func(t *testing.T) {
+		t.Setenv("APP_S3_BUCKET", "test-bucket")
+		t.Setenv("APP_CACHING_STALE_WHILE_REVALIDATE", "invalid")
+		_, err := NewConfigFromEnv()
+		require.Error(t, err)
+	})
+
+	t.Run("invalid caching stale if error", func(t *testing.T) {
+		t.Setenv("APP_S3_BUCKET", "test-bucket")
+		t.Setenv("APP_CACHING_STALE_IF_ERROR", "invalid")
+		_, err := NewConfigFromEnv()
+		require.Error(t, err)
+	})
+
+	t.Run("invalid caching negative TTL", func(t *testing.T) {
+		t.Setenv("APP_S3_BUCKET", "test-bucket")
+		t.Setenv("APP_CACHING_NEGATIVE_TTL", "invalid")
+		_, err := NewConfigFromEnv()
+		require.Error(t, err)
+	})
+
+	t.Run("invalid caching negative capacity items", func(t *testing.T) {
+		t.Setenv("APP_S3_BUCKET", "test-bucket")
+		t.Setenv("APP_CACHING_NEGATIVE_CAPACITY_ITEMS", "invalid")
+		_, err := NewConfigFromEnv()
+		require.Error(t, err)
+	})
+
+	t.Run("invalid caching coalesce wait", func(t *testing.T) {
+		t.Setenv("APP_S3_BUCKET", "test-bucket")
+		t.Setenv("APP_CACHING_COALESCE_WAIT", "invalid")
+		_, err := NewConfigFromEnv()
+		require.Error(t, err)
+	})
+
+	t.Run("invalid caching sweep interval", func(t *testing.T) {
+		t.Setenv("APP_S3_BUCKET", "test-bucket")
+		t.Setenv("APP_CACHING_SWEEP_INTERVAL", "invalid")
+		_, err := NewConfigFromEnv()
+		require.Error(t, err)
+	})
 }
@@ -2,59 +2,303 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
+	"errors"
+	"expvar"
 	"fmt"
+	"io/fs"
 	"log/slog"
 	"net/http"
+	"slices"
+	"strings"
+	"time"
 
 	awsConfig "github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/jszwec/s3fs/v2"
 	cache "github.com/victorspringer/http-cache"
+	"github.com/victorspringer/http-cache/adapter/disk"
+	"github.com/victorspringer/http-cache/adapter/memcached"
 	"github.com/victorspringer/http-cache/adapter/memory"
+	"github.com/victorspringer/http-cache/adapter/redis"
+	"github.com/victorspringer/http-cache/adapter/tiered"
 )
 
 type Handler struct {
 	http.Handler
+	warmer          *warmer
+	invalidator     *invalidator
+	peerCache       *peerCache
+	snapshotAdapter *memory.Adapter
+	snapshotFile    string
+	memoryAdapters  []*memory.Adapter
 }
 
 func NewHandler(cfg Config) (*Handler, error) {
+	h := &Handler{}
 	mux := http.NewServeMux()
 	mux.HandleFunc("GET /health", healthHandler)
-	s3ContentHandler, err := s3Handler(cfg)
+	mux.HandleFunc("GET /ready", h.readyHandler)
+	s3ContentHandler, s3Cache, err := s3Handler(cfg)
 	if err != nil {
 		return nil, fmt.Errorf("create s3 handler: %w", err)
 	}
 	mux.Handle("GET /", s3ContentHandler)
-	return &Handler{Handler: withRecovery(mux)}, nil
+	if pc, ok := s3ContentHandler.(*peerCache); ok {
+		mux.Handle("GET /cluster/fetch/", pc.FetchHandler())
+		h.peerCache = pc
+		pc.Start(cfg.ClusterPeerRefresh)
+	}
+	if len(cfg.ClusterPeers) > 0 || cfg.ClusterPeersDNS != "" {
+		if h.invalidator, err = newCacheInvalidator(cfg, s3Cache); err != nil {
+			return nil, fmt.Errorf("create cluster invalidator: %w", err)
+		}
+		mux.Handle("POST /cluster/purge", h.invalidator)
+		metrics.Set("cluster_invalidation", expvar.Func(h.invalidator.Stats))
+	}
+	if cfg.AdminToken != "" {
+		admin, err := newAdminHandler(cfg.AdminToken, s3Cache, cfg.AdminListLimit, h.invalidator)
+		if err != nil {
+			return nil, fmt.Errorf("create admin handler: %w", err)
+		}
+		mux.Handle("GET /admin/cache/", admin)
+		mux.Handle("POST /admin/cache/", admin)
+		mux.HandleFunc("GET /debug/vars", func(w http.ResponseWriter, r *http.Request) {
+			if bearerAuthorized(w, r, "admin", cfg.AdminToken) {
+				expvar.Handler().ServeHTTP(w, r)
+			}
+		})
+	}
+	h.Handler = withRecovery(mux)
+	h.memoryAdapters = s3Cache.memoryAdapters
+	if cfg.CachingSnapshotFile != "" {
+		if m := snapshotAdapter(s3Cache.adapter); m != nil {
+			restoreCacheSnapshot(m, cfg.CachingSnapshotFile)
+			h.snapshotAdapter, h.snapshotFile = m, cfg.CachingSnapshotFile
+		}
+	}
+	if _, ok := cacheUsage(s3Cache.adapter); ok && cfg.CachingTagHeader != "" {
+		// Local caches may hold tagged responses from a previous run.
+		go indexCacheTags(s3Cache.client)
+	}
+	if cfg.CachingWarmFile != "" || cfg.CachingWarmManifest != "" || cfg.CachingWarmPrefix != "" {
+		if h.warmer, err = newCacheWarmer(cfg, h.Handler); err != nil {
+			return nil, fmt.Errorf("create cache warmer: %w", err)
+		}
+		metrics.Set("cache_warmer", expvar.Func(h.warmer.Stats))
+		h.warmer.Start(cfg.CachingWarmReadyTimeout)
+	}
+	return h, nil
+}
+
+// Close stops cache warming, if still running, the purges being sent to peers
+// and the peer refresh, saves a snapshot of the memory cache, if enabled, so
+// that it is restored on the next start, and then stops the sweepers and
+// background snapshots of the memory caches.
+func (h *Handler) Close() error {
+	if h.warmer != nil {
+		h.warmer.Stop()
+	}
+	if h.invalidator != nil {
+		h.invalidator.Stop()
+	}
+	if h.peerCache != nil {
+		h.peerCache.Stop()
+	}
+	defer func() {
+		for _, m := range h.memoryAdapters {
+			m.Close()
+		}
+	}()
+	if h.snapshotAdapter == nil {
+		return nil
+	}
+	if err := h.snapshotAdapter.SaveSnapshot(h.snapshotFile); err != nil {
+		return fmt.Errorf("save cache snapshot: %w", err)
+	}
+	slog.Info("cache snapshot saved", "path", h.snapshotFile, "items", h.snapshotAdapter.Len())
+	return nil
 }
 
 func healthHandler(w http.ResponseWriter, _ *http.Request) {
 	_, _ = fmt.Fprint(w, "OK")
 }
 
-func s3Handler(cfg Config) (http.Handler, error) {
-	memoryAdapter, err := memory.NewAdapter(
-		memory.AdapterWithAlgorithm(memory.LRU),
-		memory.AdapterWithCapacity(cfg.CachingCapacityItems),
-		memory.AdapterWithStorageCapacity(cfg.CachingCapacityBytes),
-	)
+// readyHandler reports the handler ready once cache warming, if enabled, no
+// longer gates readiness.
+func (h *Handler) readyHandler(w http.ResponseWriter, r *http.Request) {
+	if h.warmer != nil && !h.warmer.Ready() {
+		http.Error(w, "Warming", http.StatusServiceUnavailable)
+		return
+	}
+	healthHandler(w, r)
+}
+
+// s3Cache is the cache in front of the S3 handler.
+type s3Cache struct {
+	client  *cache.Client
+	adapter cache.Adapter
+	// hot is the hot cache of the paths owned by other replicas, if any.
+	hot *cache.Client
+	// memoryAdapters are the memory adapters of the caches, to be closed on
+	// shutdown.
+	memoryAdapters []*memory.Adapter
+}
+
+func s3Handler(cfg Config) (http.Handler, s3Cache, error) {
+	var sweepOpts []memory.AdapterOptions
+	if cfg.CachingSweepInterval > 0 {
+		sweepOpts = append(sweepOpts, memory.AdapterWithSweepInterval(cfg.CachingSweepInterval))
+	}
+	cacheAdapter, err := newCacheAdapter(cfg, sweepOpts)
 	if err != nil {
-		return nil, fmt.Errorf("create memory adapter: %w", err)
+		return nil, s3Cache{}, err
 	}
-	cacheClient, err := cache.NewClient(
-		cache.ClientWithAdapter(memoryAdapter),
+	c := s3Cache{adapter: cacheAdapter}
+	if m := snapshotAdapter(cacheAdapter); m != nil {
+		c.memoryAdapters = append(c.memoryAdapters, m)
+	}
+	keyHash, err := cacheKeyHash(cfg.CachingKeyHash)
+	if err != nil {
+		return nil, s3Cache{}, err
+	}
+	cacheOpts := []cache.ClientOption{
+		cache.ClientWithAdapter(cacheAdapter),
 		cache.ClientWithTTL(cfg.CachingTTL),
+		cache.ClientWithMaxTTL(cfg.CachingMaxTTL),
+		cache.ClientWithStaleWhileRevalidate(cfg.CachingStaleWhileRevalidate),
+		cache.ClientWithStaleIfError(cfg.CachingStaleIfError),
 		cache.ClientWithMethods([]string{http.MethodGet}),
 		cache.ClientWithExpiresHeader(),
+		cache.ClientWithKeyPolicy(cache.KeyPolicy{
+			IgnoreQuery:   cfg.CachingKeyIgnoreQuery,
+			QueryAllow:    cfg.CachingKeyQueryAllow,
+			QueryDeny:     cfg.CachingKeyQueryDeny,
+			Host:          cfg.CachingKeyHost,
+			Headers:       cfg.CachingKeyHeaders,
+			Vary:          cfg.CachingKeyVary,
+			NormalizePath: cfg.CachingKeyNormalizePath,
+		}),
+		cache.ClientWithKeyHash(keyHash),
+		cache.ClientWithAdapterTimeout(cfg.CachingAdapterTimeout),
+		cache.ClientWithAdapterErrorHandler(func(err error) {
+			slog.Warn("cache adapter error", "error", err)
+		}),
+	}
+	if cfg.CachingNegativeTTL > 0 {
+		negativeAdapter, err := memory.NewAdapter(append([]memory.AdapterOptions{
+			memory.AdapterWithAlgorithm(memory.LRU),
+			memory.AdapterWithCapacity(cfg.CachingNegativeCapacityItems),
+			memory.AdapterWithStorageCapacity(cfg.CachingNegativeCapacityBytes),
+		}, sweepOpts...)...)
+		if err != nil {
+			return nil, s3Cache{}, fmt.Errorf("create negative memory adapter: %w", err)
+		}
+		c.memoryAdapters = append(c.memoryAdapters, negativeAdapter.(*memory.Adapter))
+		cacheOpts = append(cacheOpts, cache.ClientWithNegativeCaching(negativeAdapter, cfg.CachingNegativeTTL))
+	}
+	if cfg.CachingCoalesceWait > 0 {
+		cacheOpts = append(cacheOpts, cache.ClientWithCoalescing(cfg.CachingCoalesceWait))
+	}
+	if cfg.CachingDebugHeaders || cfg.CachingDebugToken != "" {
+		cacheOpts = append(cacheOpts, cache.ClientWithDebugHeaders(cfg.CachingDebugToken))
+	}
+	cacheRules, err := loadCacheRules(cfg.CachingRulesFile, cfg.CachingHashedAssetsImmutable)
+	if err != nil {
+		return nil, s3Cache{}, fmt.Errorf("load cache rules: %w", err)
+	}
+	if len(cacheRules) > 0 {
+		cacheOpts = append(cacheOpts, cache.ClientWithRules(cacheRules...))
+	}
+	if cfg.CachingTagHeader != "" {
+		cacheOpts = append(cacheOpts, cache.ClientWithTags(cfg.CachingTagHeader, cfg.CachingTagMaxKeys))
+	} else if slices.ContainsFunc(cacheRules, func(r cache.Rule) bool { return len(r.Tags) > 0 }) {
+		return nil, s3Cache{}, errors.New("cache rule tags require a cache tag header")
+	}
+	cacheClient, err := cache.NewClient(cacheOpts...)
+	if err != nil {
+		return nil, s3Cache{}, fmt.Errorf("create cache client: %w", err)
+	}
+	c.client = cacheClient
+	s3Limiter, err := newLimiter(cfg.S3MaxConcurrency, cfg.S3MaxQueue, cfg.S3QueueTimeout)
+	if err != nil {
+		return nil, s3Cache{}, fmt.Errorf("create s3 limiter: %w", err)
+	}
+	s3Client, err := newS3Client(cfg)
+	if err != nil {
+		return nil, s3Cache{}, err
+	}
+	s3FS := s3fs.New(s3Client, cfg.S3Bucket, s3fs.WithReadSeeker)
+	metrics.Set("s3_limiter", expvar.Func(s3Limiter.Stats))
+	metrics.Set("cache_key_collisions", expvar.Func(func() any { return cacheClient.Collisions() }))
+	metrics.Set("cache_corrupt_entries", expvar.Func(func() any { return cacheClient.Corrupted() }))
+	metrics.Set("cache_adapter_errors", expvar.Func(func() any { return cacheClient.AdapterErrors() }))
+	metrics.Set("cache_hits", expvar.Func(func() any { return cacheClient.Hits() }))
+	metrics.Set("cache_misses", expvar.Func(func() any { return cacheClient.Misses() }))
+	metrics.Set("cache_tags", expvar.Func(func() any { return tagStats(cacheClient) }))
+	setCacheMetrics(cacheAdapter)
+	s3Origin := withLimiter(s3Limiter, &objectHandler{
+		client:      s3Client,
+		bucket:      cfg.S3Bucket,
+		next:        http.FileServer(http.FS(s3FS)),
+		tagHeader:   cfg.CachingTagHeader,
+		tagMetadata: strings.ToLower(cfg.CachingTagMetadata),
+	})
+	if cfg.ClusterPeerCache {
+		pc, hotAdapter, err := newClusterPeerCache(cfg, cacheClient.Middleware(s3Origin), s3Origin)
+		if err != nil {
+			return nil, s3Cache{}, fmt.Errorf("create peer cache: %w", err)
+		}
+		c.hot = pc.hotCache
+		c.memoryAdapters = append(c.memoryAdapters, hotAdapter)
+		metrics.Set("cluster_peer_cache", expvar.Func(pc.Stats))
+		return pc, c, nil
+	}
+	return cacheClient.Middleware(s3Origin), c, nil
+}
+
+// newClusterPeerCache returns a peer cache serving the paths this replica
+// owns with owned, and the others from their owner through a small memory
+// hot cache, along with the adapter of the hot cache.
+func newClusterPeerCache(cfg Config, owned, origin http.Handler) (*peerCache, *memory.Adapter, error) {
+	peers, err := newClusterPeers(cfg.ClusterPeers, cfg.ClusterPeersDNS)
+	if err != nil {
+		return nil, nil, err
+	}
+	hotAdapter, err := memory.NewAdapter(
+		memory.AdapterWithAlgorithm(memory.LRU),
+		memory.AdapterWithCapacity(cfg.ClusterHotCacheItems),
+		memory.AdapterWithStorageCapacity(cfg.ClusterHotCacheBytes),
 	)
 	if err != nil {
-		return nil, fmt.Errorf("create cache client: %w", err)
+		return nil, nil, fmt.Errorf("create hot memory adapter: %w", err)
+	}
+	hotOpts := []cache.ClientOption{
+		cache.ClientWithAdapter(hotAdapter),
+		cache.ClientWithTTL(cfg.ClusterHotCacheTTL),
+		cache.ClientWithMaxTTL(cfg.ClusterHotCacheTTL),
+		cache.ClientWithMethods([]string{http.MethodGet}),
+	}
+	if cfg.CachingCoalesceWait > 0 {
+		hotOpts = append(hotOpts, cache.ClientWithCoalescing(cfg.CachingCoalesceWait))
+	}
+	hot, err := cache.NewClient(hotOpts...)
+	if err != nil {
+		return nil, nil, fmt.Errorf("create hot cache client: %w", err)
+	}
+	pc, err := newPeerCache(cfg.ClusterSelf, cfg.ClusterToken, peers, hot, owned, origin, cfg.ClusterTimeout)
+	if err != nil {
+		return nil, nil, err
 	}
+	return pc, hotAdapter.(*memory.Adapter), nil
+}
+
+func newS3Client(cfg Config) (*s3.Client, error) {
 	awsCfg, err := awsConfig.LoadDefaultConfig(context.Background())
 	if err != nil {
 		return nil, fmt.Errorf("load aws config: %w", err)
 	}
-	s3Client := s3.NewFromConfig(awsCfg, func(o *s3.Options) {
+	return s3.NewFromConfig(awsCfg, func(o *s3.Options) {
 		o.DisableLogOutputChecksumValidationSkipped = true
 		if cfg.S3Region != "" {
 			o.Region = cfg.S3Region
@@ -63,15 +307,259 @@ func s3Handler(cfg Config) (http.Handler, error) {
 			o.BaseEndpoint = &cfg.S3EndpointURL
 		}
 		o.UsePathStyle = cfg.S3UsePathStyle
-	})
-	s3FS := s3fs.New(s3Client, cfg.S3Bucket, s3fs.WithReadSeeker)
-	return cacheClient.Middleware(http.FileServer(http.FS(s3FS))), nil
+	}), nil
+}
+
+// newCacheWarmer returns a warmer requesting the paths to warm through next.
+func newCacheWarmer(cfg Config, next http.Handler) (*warmer, error) {
+	sources := warmSources{
+		file:     cfg.CachingWarmFile,
+		manifest: cfg.CachingWarmManifest,
+		prefix:   cfg.CachingWarmPrefix,
+		bucket:   cfg.S3Bucket,
+	}
+	if sources.manifest != "" || sources.prefix != "" {
+		s3Client, err := newS3Client(cfg)
+		if err != nil {
+			return nil, err
+		}
+		sources.client = s3Client
+	}
+	return newWarmer(next, sources, cfg.CachingWarmConcurrency, cfg.CachingWarmMaxPaths)
+}
+
+// newCacheInvalidator returns an invalidator propagating the purges of a
+// cache to the peers of the cluster.
+func newCacheInvalidator(cfg Config, c s3Cache) (*invalidator, error) {
+	peers, err := newClusterPeers(cfg.ClusterPeers, cfg.ClusterPeersDNS)
+	if err != nil {
+		return nil, err
+	}
+	return newInvalidator(cfg.ClusterToken, peers, c, cfg.ClusterTimeout, cfg.ClusterRetries, cfg.ClusterRetryInterval)
+}
+
+func newCacheAdapter(cfg Config, sweepOpts []memory.AdapterOptions) (cache.Adapter, error) {
+	switch strings.ToLower(cfg.CachingBackend) {
+	case "", "memory":
+		return newMemoryAdapter(cfg, sweepOpts)
+	case "disk":
+		return newDiskAdapter(cfg)
+	case "redis":
+		return newRedisAdapter(cfg)
+	case "memcached":
+		return newMemcachedAdapter(cfg)
+	case "tiered":
+		return newTieredAdapter(cfg, sweepOpts)
+	default:
+		return nil, fmt.Errorf("unknown cache backend %q", cfg.CachingBackend)
+	}
+}
+
+func newMemoryAdapter(cfg Config, sweepOpts []memory.AdapterOptions) (cache.Adapter, error) {
+	algorithm, err := cacheAlgorithm(cfg.CachingAlgorithm)
+	if err != nil {
+		return nil, err
+	}
+	memoryOpts := append([]memory.AdapterOptions{
+		memory.AdapterWithAlgorithm(algorithm),
+		memory.AdapterWithCapacity(cfg.CachingCapacityItems),
+		memory.AdapterWithStorageCapacity(cfg.CachingCapacityBytes),
+	}, sweepOpts...)
+	if cfg.CachingSnapshotFile != "" && cfg.CachingSnapshotInterval > 0 {
+		memoryOpts = append(memoryOpts, memory.AdapterWithSnapshot(cfg.CachingSnapshotFile, cfg.CachingSnapshotInterval))
+	}
+	memoryAdapter, err := memory.NewAdapter(memoryOpts...)
+	if err != nil {
+		return nil, fmt.Errorf("create memory adapter: %w", err)
+	}
+	return memoryAdapter, nil
+}
+
+func newDiskAdapter(cfg Config) (cache.Adapter, error) {
+	diskAdapter, err := disk.NewAdapter(
+		disk.AdapterWithDirectory(cfg.CachingDiskDirectory),
+		disk.AdapterWithCapacity(cfg.CachingDiskCapacityBytes),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("create disk adapter: %w", err)
+	}
+	return diskAdapter, nil
+}
+
+func newRedisAdapter(cfg Config) (cache.Adapter, error) {
+	redisOpts := []redis.AdapterOptions{
+		redis.AdapterWithAddrs(cfg.CachingRedisAddrs...),
+		redis.AdapterWithDB(cfg.CachingRedisDB),
+		redis.AdapterWithKeyPrefix(cfg.CachingRedisKeyPrefix),
+		redis.AdapterWithTimeout(cfg.CachingRedisTimeout),
+	}
+	if cfg.CachingRedisMasterName != "" {
+		redisOpts = append(redisOpts, redis.AdapterWithMasterName(cfg.CachingRedisMasterName))
+	}
+	if cfg.CachingRedisCluster {
+		redisOpts = append(redisOpts, redis.AdapterWithCluster())
+	}
+	if cfg.CachingRedisPassword != "" {
+		redisOpts = append(redisOpts, redis.AdapterWithAuth(cfg.CachingRedisUsername, cfg.CachingRedisPassword))
+	}
+	if cfg.CachingRedisTLS {
+		redisOpts = append(redisOpts, redis.AdapterWithTLS(&tls.Config{MinVersion: tls.VersionTLS12}))
+	}
+	redisAdapter, err := redis.NewAdapter(redisOpts...)
+	if err != nil {
+		return nil, fmt.Errorf("create redis adapter: %w", err)
+	}
+	return redisAdapter, nil
+}
+
+func newMemcachedAdapter(cfg Config) (cache.Adapter, error) {
+	memcachedAdapter, err := memcached.NewAdapter(
+		memcached.AdapterWithServers(cfg.CachingMemcachedServers...),
+		memcached.AdapterWithKeyPrefix(cfg.CachingMemcachedKeyPrefix),
+		memcached.AdapterWithMaxItemSize(cfg.CachingMemcachedMaxItemBytes),
+		memcached.AdapterWithTimeout(cfg.CachingMemcachedTimeout),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("create memcached adapter: %w", err)
+	}
+	return memcachedAdapter, nil
+}
+
+func newTieredAdapter(cfg Config, sweepOpts []memory.AdapterOptions) (cache.Adapter, error) {
+	l1, err := newMemoryAdapter(cfg, sweepOpts)
+	if err != nil {
+		return nil, err
+	}
+	var l2 cache.Adapter
+	switch strings.ToLower(cfg.CachingTieredL2) {
+	case "", "disk":
+		l2, err = newDiskAdapter(cfg)
+	case "redis":
+		l2, err = newRedisAdapter(cfg)
+	case "memcached":
+		l2, err = newMemcachedAdapter(cfg)
+	default:
+		err = fmt.Errorf("unknown cache L2 backend %q", cfg.CachingTieredL2)
+	}
+	if err != nil {
+		return nil, err
+	}
+	admission := tiered.AdmitAlways()
+	if cfg.CachingTieredPromoteHits > 1 {
+		admission = tiered.AdmitAfterHits(cfg.CachingTieredPromoteHits)
+	}
+	tieredAdapter, err := tiered.NewAdapter(
+		tiered.AdapterWithL1(l1),
+		tiered.AdapterWithL2(l2),
+		tiered.AdapterWithAdmission(admission),
+		tiered.AdapterWithMaxL1Size(cfg.CachingTieredMaxL1Bytes),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("create tiered adapter: %w", err)
+	}
+	return tieredAdapter, nil
+}
+
+// snapshotAdapter returns the memory adapter of a cache adapter, either
+// itself or its L1, or nil if there is none.
+func snapshotAdapter(a cache.Adapter) *memory.Adapter {
+	switch a := a.(type) {
+	case *memory.Adapter:
+		return a
+	case *tiered.Adapter:
+		l1, _ := a.Tiers()
+		return snapshotAdapter(l1)
+	default:
+		return nil
+	}
+}
+
+// restoreCacheSnapshot loads the snapshot file of a memory adapter, if any.
+// The cache starts empty, or partly filled, if it cannot be loaded.
+func restoreCacheSnapshot(m *memory.Adapter, path string) {
+	n, err := m.LoadSnapshot(path)
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+	case err != nil:
+		slog.Warn("cache snapshot restore failed", "path", path, "items", n, "err", err)
+	default:
+		slog.Info("cache snapshot restored", "path", path, "items", n)
+	}
+}
+
+// indexCacheTags adds the tags of the responses already cached to the tag
+// index, so that they can be purged by tag.
+func indexCacheTags(c *cache.Client) {
+	start := time.Now()
+	n, err := c.IndexTags(context.Background())
+	if err != nil {
+		slog.Warn("cache tags indexing failed", "items", n, "err", err)
+		return
+	}
+	slog.Info("cache tags indexed", "items", n, "duration", time.Since(start))
+}
+
+// tagStats returns the usage of the tag index of a cache client suitable for
+// expvar.
+func tagStats(c *cache.Client) map[string]any {
+	s := c.TagStats()
+	return map[string]any{
+		"tags":          s.Tags,
+		"keys":          s.Keys,
+		"dropped_total": s.Dropped,
+	}
+}
+
+// setCacheMetrics exposes the counters of a cache adapter and of its tiers.
+func setCacheMetrics(a cache.Adapter) {
+	switch a := a.(type) {
+	case *memory.Adapter:
+		metrics.Set("cache_memory", expvar.Func(func() any { return a.Stats() }))
+	case *disk.Adapter:
+		metrics.Set("cache_disk", expvar.Func(func() any { return a.Stats() }))
+	case *redis.Adapter:
+		metrics.Set("cache_redis", expvar.Func(func() any { return a.Stats() }))
+	case *memcached.Adapter:
+		metrics.Set("cache_memcached", expvar.Func(func() any { return a.Stats() }))
+	case *tiered.Adapter:
+		metrics.Set("cache_tiered", expvar.Func(func() any { return a.Stats() }))
+		l1, l2 := a.Tiers()
+		setCacheMetrics(l1)
+		setCacheMetrics(l2)
+	}
+}
+
+func cacheAlgorithm(name string) (memory.Algorithm, error) {
+	if name == "" {
+		return memory.LRU, nil
+	}
+	for _, alg := range []memory.Algorithm{memory.LRU, memory.LFU, memory.WTinyLFU, memory.GDSF} {
+		if strings.EqualFold(name, string(alg)) {
+			return alg, nil
+		}
+	}
+	return "", fmt.Errorf("unknown cache algorithm %q", name)
+}
+
+func cacheKeyHash(name string) (cache.KeyHash, error) {
+	switch name {
+	case "", "fnv64a":
+		return cache.HashFNV64a, nil
+	case "sha256":
+		return cache.HashSHA256, nil
+	default:
+		return nil, fmt.Errorf("unknown cache key hash %q", name)
+	}
 }
 
 func withRecovery(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		defer func() {
 			if err := recover(); err != nil {
+				if err == http.ErrAbortHandler {
+					// The response is cut short on purpose, after it started.
+					panic(err)
+				}
 				slog.Error("http handler panic recovered", "method", r.Method, "path", r.URL.Path, "error", err)
 				http.Error(w, "Internal Server Error", http.StatusInternalServerError)
 			}
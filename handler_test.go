@@ -1,9 +1,15 @@
 package main
 
 import (
+	"io"
 	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -13,6 +19,11 @@ import (
 	"github.com/stretchr/testify/require"
 	tc "github.com/testcontainers/testcontainers-go"
 	tcMinio "github.com/testcontainers/testcontainers-go/modules/minio"
+	"github.com/victorspringer/http-cache/adapter/disk"
+	"github.com/victorspringer/http-cache/adapter/memcached"
+	"github.com/victorspringer/http-cache/adapter/memory"
+	"github.com/victorspringer/http-cache/adapter/redis"
+	"github.com/victorspringer/http-cache/adapter/tiered"
 )
 
 const (
@@ -54,15 +65,30 @@ func setupMinio(t *testing.T) *minio.Client {
 
 func TestNewHandler(t *testing.T) {
 	setupMinio(t)
+	t.Setenv("APP_ADMIN_TOKEN", testAdminToken)
 	cfg, err := NewConfigFromEnv()
 	require.NoError(t, err)
 
 	serverHandler, err := NewHandler(cfg)
 	require.NoError(t, err)
-	handler := serverHandler.ServeHTTP
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		r.Header.Set("Authorization", "Bearer "+testAdminToken)
+		serverHandler.ServeHTTP(w, r)
+	}
 
 	assert.HTTPSuccess(t, handler, http.MethodGet, "/health", nil)
 	assert.HTTPError(t, handler, http.MethodPost, "/health", nil)
+	assert.HTTPSuccess(t, handler, http.MethodGet, "/ready", nil)
+
+	assert.HTTPSuccess(t, handler, http.MethodGet, "/debug/vars", nil)
+	assert.HTTPBodyContains(t, handler, http.MethodGet, "/debug/vars", nil, "s3_limiter")
+	assert.HTTPBodyContains(t, handler, http.MethodGet, "/debug/vars", nil, "cache_key_collisions")
+	assert.HTTPBodyContains(t, handler, http.MethodGet, "/debug/vars", nil, "cache_corrupt_entries")
+	assert.HTTPBodyContains(t, handler, http.MethodGet, "/debug/vars", nil, "cache_adapter_errors")
+	assert.HTTPBodyContains(t, handler, http.MethodGet, "/debug/vars", nil, "cache_hits")
+	assert.HTTPBodyContains(t, handler, http.MethodGet, "/debug/vars", nil, "cache_misses")
+	assert.HTTPBodyContains(t, handler, http.MethodGet, "/debug/vars", nil, "cache_tags")
+	assert.HTTPBodyContains(t, handler, http.MethodGet, "/debug/vars", nil, "cache_memory")
 
 	assert.HTTPSuccess(t, handler, http.MethodGet, "/", nil)
 	assert.HTTPError(t, handler, http.MethodPost, "/", nil)
@@ -77,6 +103,84 @@ func TestNewHandler(t *testing.T) {
 	assert.HTTPRedirect(t, handler, http.MethodPost, "/../invalid.txt", nil)
 }
 
+func TestNewHandler_Admin(t *testing.T) {
+	t.Setenv("APP_S3_BUCKET", bucketName)
+	t.Setenv("APP_S3_REGION", region)
+	t.Setenv("APP_ADMIN_TOKEN", testAdminToken)
+	cfg, err := NewConfigFromEnv()
+	require.NoError(t, err)
+
+	h, err := NewHandler(cfg)
+	require.NoError(t, err)
+	defer h.Close()
+
+	w, body := adminRequest(t, h, http.MethodGet, "/admin/cache/stats")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.NotEmpty(t, body)
+	w, _ = adminRequest(t, h, http.MethodPost, "/admin/cache/purge?all=true")
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	w, _ = adminRequest(t, h, http.MethodGet, "/debug/vars")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), "cache_hits")
+	assert.HTTPStatusCode(t, h.ServeHTTP, http.MethodGet, "/debug/vars", nil, http.StatusUnauthorized)
+}
+
+func TestNewHandler_CoalescedAbort(t *testing.T) {
+	var s3Requests atomic.Int64
+	release := make(chan struct{})
+	s3 := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		s3Requests.Add(1)
+		w.Header().Set("Content-Length", "1024")
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write([]byte("partial"))
+		w.(http.Flusher).Flush()
+		<-release
+		panic(http.ErrAbortHandler)
+	}))
+	defer s3.Close()
+	t.Setenv("APP_S3_BUCKET", bucketName)
+	t.Setenv("APP_S3_REGION", region)
+	t.Setenv("APP_S3_ENDPOINT_URL", s3.URL)
+	t.Setenv("APP_S3_USE_PATH_STYLE", "true")
+	t.Setenv("APP_CACHING_COALESCE_WAIT", "1m")
+	t.Setenv("AWS_ACCESS_KEY_ID", minioUser)
+	t.Setenv("AWS_SECRET_ACCESS_KEY", minioPassword)
+	cfg, err := NewConfigFromEnv()
+	require.NoError(t, err)
+	h, err := NewHandler(cfg)
+	require.NoError(t, err)
+	defer h.Close()
+	server := httptest.NewServer(h)
+	defer server.Close()
+
+	bodies, errs := make([]string, 2), make([]error, 2)
+	var wg sync.WaitGroup
+	for i := range bodies {
+		wg.Go(func() {
+			resp, err := http.Get(server.URL + "/" + objectName)
+			if err != nil {
+				errs[i] = err
+				return
+			}
+			defer resp.Body.Close()
+			body, err := io.ReadAll(resp.Body)
+			bodies[i], errs[i] = string(body), err
+		})
+	}
+	require.Eventually(t, func() bool { return s3Requests.Load() == 1 }, 5*time.Second, time.Millisecond)
+	// Gives the other request the time to join the flight of the first one.
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	assert.Equal(t, int64(1), s3Requests.Load())
+	for i := range bodies {
+		require.Error(t, errs[i], "the response is aborted")
+		assert.NotContains(t, bodies[i], "Internal Server Error")
+	}
+}
+
 func TestHealthHandler(t *testing.T) {
 	t.Parallel()
 	url := "/health"
@@ -89,7 +193,7 @@ func TestS3Handler(t *testing.T) {
 	cfg, err := NewConfigFromEnv()
 	require.NoError(t, err)
 
-	s3HTTPHandler, err := s3Handler(cfg)
+	s3HTTPHandler, _, err := s3Handler(cfg)
 	require.NoError(t, err)
 	handler := s3HTTPHandler.ServeHTTP
 
@@ -147,7 +251,7 @@ func TestS3Handler_Errors(t *testing.T) {
 			CachingCapacityItems: -1,
 			CachingCapacityBytes: 50 * 1024 * 1024,
 		}
-		_, err := s3Handler(cfg)
+		_, _, err := s3Handler(cfg)
 		assert.Error(t, err)
 	})
 
@@ -157,7 +261,7 @@ func TestS3Handler_Errors(t *testing.T) {
 			CachingCapacityItems: 1024,
 			CachingCapacityBytes: -1,
 		}
-		_, err := s3Handler(cfg)
+		_, _, err := s3Handler(cfg)
 		assert.Error(t, err)
 	})
 
@@ -168,7 +272,143 @@ func TestS3Handler_Errors(t *testing.T) {
 			CachingCapacityBytes: 50 * 1024 * 1024,
 			CachingTTL:           0,
 		}
-		_, err := s3Handler(cfg)
+		_, _, err := s3Handler(cfg)
+		assert.Error(t, err)
+	})
+
+	t.Run("invalid caching max TTL", func(t *testing.T) {
+		t.Parallel()
+		cfg := Config{
+			CachingCapacityItems: 1024,
+			CachingCapacityBytes: 50 * 1024 * 1024,
+			CachingTTL:           10 * time.Minute,
+			CachingMaxTTL:        -1,
+		}
+		_, _, err := s3Handler(cfg)
+		assert.Error(t, err)
+	})
+
+	t.Run("invalid caching stale while revalidate", func(t *testing.T) {
+		t.Parallel()
+		cfg := Config{
+			CachingCapacityItems:        1024,
+			CachingCapacityBytes:        50 * 1024 * 1024,
+			CachingTTL:                  10 * time.Minute,
+			CachingStaleWhileRevalidate: -1,
+		}
+		_, _, err := s3Handler(cfg)
+		assert.Error(t, err)
+	})
+
+	t.Run("invalid caching negative capacity items", func(t *testing.T) {
+		t.Parallel()
+		cfg := Config{
+			CachingCapacityItems:         1024,
+			CachingCapacityBytes:         50 * 1024 * 1024,
+			CachingTTL:                   10 * time.Minute,
+			CachingNegativeTTL:           time.Minute,
+			CachingNegativeCapacityItems: -1,
+			CachingNegativeCapacityBytes: 1024 * 1024,
+		}
+		_, _, err := s3Handler(cfg)
+		assert.Error(t, err)
+	})
+
+	t.Run("invalid caching key policy", func(t *testing.T) {
+		t.Parallel()
+		cfg := Config{
+			CachingCapacityItems:  1024,
+			CachingCapacityBytes:  50 * 1024 * 1024,
+			CachingTTL:            10 * time.Minute,
+			CachingKeyIgnoreQuery: true,
+			CachingKeyQueryAllow:  []string{"v"},
+		}
+		_, _, err := s3Handler(cfg)
+		assert.Error(t, err)
+	})
+
+	t.Run("invalid caching algorithm", func(t *testing.T) {
+		t.Parallel()
+		cfg := Config{
+			CachingCapacityItems: 1024,
+			CachingCapacityBytes: 50 * 1024 * 1024,
+			CachingAlgorithm:     "fifo",
+			CachingTTL:           10 * time.Minute,
+		}
+		_, _, err := s3Handler(cfg)
+		assert.Error(t, err)
+	})
+
+	t.Run("invalid caching backend", func(t *testing.T) {
+		t.Parallel()
+		cfg := Config{
+			CachingBackend:       "redis",
+			CachingCapacityItems: 1024,
+			CachingCapacityBytes: 50 * 1024 * 1024,
+			CachingTTL:           10 * time.Minute,
+		}
+		_, _, err := s3Handler(cfg)
+		assert.Error(t, err)
+	})
+
+	t.Run("invalid caching disk directory", func(t *testing.T) {
+		t.Parallel()
+		cfg := Config{
+			CachingBackend:           "disk",
+			CachingDiskCapacityBytes: 1024 * 1024,
+			CachingTTL:               10 * time.Minute,
+		}
+		_, _, err := s3Handler(cfg)
+		assert.Error(t, err)
+	})
+
+	t.Run("invalid caching key hash", func(t *testing.T) {
+		t.Parallel()
+		cfg := Config{
+			CachingCapacityItems: 1024,
+			CachingCapacityBytes: 50 * 1024 * 1024,
+			CachingTTL:           10 * time.Minute,
+			CachingKeyHash:       "md5",
+		}
+		_, _, err := s3Handler(cfg)
+		assert.Error(t, err)
+	})
+
+	t.Run("invalid caching rules file", func(t *testing.T) {
+		t.Parallel()
+		cfg := Config{
+			CachingCapacityItems: 1024,
+			CachingCapacityBytes: 50 * 1024 * 1024,
+			CachingTTL:           10 * time.Minute,
+			CachingRulesFile:     "/non-existent/rules.json",
+		}
+		_, _, err := s3Handler(cfg)
+		assert.Error(t, err)
+	})
+
+	t.Run("cache rule tags without tag header", func(t *testing.T) {
+		t.Parallel()
+		rulesFile := filepath.Join(t.TempDir(), "rules.json")
+		require.NoError(t, os.WriteFile(rulesFile, []byte(`[{"path": "/assets/*", "tags": ["assets"]}]`), 0o600))
+		cfg := Config{
+			CachingCapacityItems: 1024,
+			CachingCapacityBytes: 50 * 1024 * 1024,
+			CachingTTL:           10 * time.Minute,
+			CachingRulesFile:     rulesFile,
+		}
+		_, _, err := s3Handler(cfg)
+		assert.ErrorContains(t, err, "tag header")
+	})
+
+	t.Run("invalid s3 max concurrency", func(t *testing.T) {
+		t.Parallel()
+		cfg := Config{
+			CachingCapacityItems: 1024,
+			CachingCapacityBytes: 50 * 1024 * 1024,
+			CachingTTL:           10 * time.Minute,
+			S3MaxConcurrency:     0,
+		}
+		_, _, err := s3Handler(cfg)
 		assert.Error(t, err)
 	})
 
@@ -178,12 +418,176 @@ func TestS3Handler_Errors(t *testing.T) {
 			CachingCapacityItems: 1024,
 			CachingCapacityBytes: 50 * 1024 * 1024,
 			CachingTTL:           10 * time.Minute,
+			S3MaxConcurrency:     64,
+			S3MaxQueue:           256,
+			S3QueueTimeout:       5 * time.Second,
 		}
-		_, err := s3Handler(cfg)
+		_, _, err := s3Handler(cfg)
 		assert.Error(t, err)
 	})
 }
 
+func TestNewCacheAdapter(t *testing.T) {
+	t.Run("memory backend", func(t *testing.T) {
+		t.Parallel()
+		cfg := Config{CachingCapacityItems: 1024, CachingCapacityBytes: 50 * 1024 * 1024}
+		adapter, err := newCacheAdapter(cfg, nil)
+		require.NoError(t, err)
+		assert.IsType(t, &memory.Adapter{}, adapter)
+	})
+
+	t.Run("disk backend", func(t *testing.T) {
+		t.Parallel()
+		cfg := Config{
+			CachingBackend:           "disk",
+			CachingDiskDirectory:     t.TempDir(),
+			CachingDiskCapacityBytes: 1024 * 1024,
+		}
+		adapter, err := newCacheAdapter(cfg, nil)
+		require.NoError(t, err)
+		assert.IsType(t, &disk.Adapter{}, adapter)
+	})
+
+	t.Run("redis backend", func(t *testing.T) {
+		t.Parallel()
+		cfg := Config{
+			CachingBackend:        "redis",
+			CachingRedisAddrs:     []string{"127.0.0.1:6379"},
+			CachingRedisPassword:  "secret",
+			CachingRedisTLS:       true,
+			CachingRedisKeyPrefix: "go-serve-s3:",
+			CachingRedisTimeout:   time.Second,
+		}
+		adapter, err := newCacheAdapter(cfg, nil)
+		require.NoError(t, err)
+		assert.IsType(t, &redis.Adapter{}, adapter)
+	})
+
+	t.Run("invalid redis backend", func(t *testing.T) {
+		t.Parallel()
+		cfg := Config{CachingBackend: "redis", CachingRedisTimeout: time.Second}
+		_, err := newCacheAdapter(cfg, nil)
+		assert.Error(t, err)
+	})
+
+	t.Run("memcached backend", func(t *testing.T) {
+		t.Parallel()
+		cfg := Config{
+			CachingBackend:               "memcached",
+			CachingMemcachedServers:      []string{"127.0.0.1:11211", "127.0.0.1:11212"},
+			CachingMemcachedKeyPrefix:    "go-serve-s3:",
+			CachingMemcachedMaxItemBytes: 1024 * 1024,
+			CachingMemcachedTimeout:      time.Second,
+		}
+		adapter, err := newCacheAdapter(cfg, nil)
+		require.NoError(t, err)
+		assert.IsType(t, &memcached.Adapter{}, adapter)
+	})
+
+	t.Run("invalid memcached backend", func(t *testing.T) {
+		t.Parallel()
+		cfg := Config{
+			CachingBackend:               "memcached",
+			CachingMemcachedMaxItemBytes: 1024 * 1024,
+			CachingMemcachedTimeout:      time.Second,
+		}
+		_, err := newCacheAdapter(cfg, nil)
+		assert.Error(t, err)
+	})
+
+	t.Run("tiered backend", func(t *testing.T) {
+		t.Parallel()
+		cfg := Config{
+			CachingBackend:           "tiered",
+			CachingCapacityItems:     1024,
+			CachingCapacityBytes:     50 * 1024 * 1024,
+			CachingDiskDirectory:     t.TempDir(),
+			CachingDiskCapacityBytes: 1024 * 1024,
+			CachingTieredL2:          "disk",
+			CachingTieredPromoteHits: 2,
+			CachingTieredMaxL1Bytes:  1024 * 1024,
+		}
+		adapter, err := newCacheAdapter(cfg, nil)
+		require.NoError(t, err)
+		require.IsType(t, &tiered.Adapter{}, adapter)
+		l1, l2 := adapter.(*tiered.Adapter).Tiers()
+		assert.IsType(t, &memory.Adapter{}, l1)
+		assert.IsType(t, &disk.Adapter{}, l2)
+	})
+
+	t.Run("invalid tiered L2 backend", func(t *testing.T) {
+		t.Parallel()
+		cfg := Config{
+			CachingBackend:          "tiered",
+			CachingCapacityItems:    1024,
+			CachingCapacityBytes:    50 * 1024 * 1024,
+			CachingTieredL2:         "memory",
+			CachingTieredMaxL1Bytes: 1024 * 1024,
+		}
+		_, err := newCacheAdapter(cfg, nil)
+		assert.Error(t, err)
+	})
+}
+
+func TestCacheSnapshot(t *testing.T) {
+	t.Parallel()
+	path := filepath.Join(t.TempDir(), "cache.snapshot")
+	cfg := Config{
+		CachingCapacityItems:    1024,
+		CachingCapacityBytes:    50 * 1024 * 1024,
+		CachingSnapshotFile:     path,
+		CachingSnapshotInterval: time.Hour,
+	}
+	adapter, err := newCacheAdapter(cfg, nil)
+	require.NoError(t, err)
+	m := snapshotAdapter(adapter)
+	require.NotNil(t, m)
+	defer m.Close()
+	m.Set(1, []byte("value"), time.Now().Add(time.Minute))
+
+	h := &Handler{snapshotAdapter: m, snapshotFile: path, memoryAdapters: []*memory.Adapter{m}}
+	require.NoError(t, h.Close())
+	assert.NoError(t, h.Close(), "closing twice")
+
+	restored, err := newCacheAdapter(cfg, nil)
+	require.NoError(t, err)
+	defer restored.(*memory.Adapter).Close()
+	restoreCacheSnapshot(restored.(*memory.Adapter), path)
+	value, ok := restored.Get(1)
+	assert.True(t, ok)
+	assert.Equal(t, []byte("value"), value)
+
+	missing, err := newCacheAdapter(cfg, nil)
+	require.NoError(t, err)
+	defer missing.(*memory.Adapter).Close()
+	restoreCacheSnapshot(missing.(*memory.Adapter), filepath.Join(t.TempDir(), "missing.snapshot"))
+	assert.Zero(t, missing.(*memory.Adapter).Len())
+
+	assert.NoError(t, (&Handler{}).Close())
+}
+
+func TestSnapshotAdapter(t *testing.T) {
+	t.Parallel()
+	cfg := Config{
+		CachingBackend:           "tiered",
+		CachingCapacityItems:     1024,
+		CachingCapacityBytes:     50 * 1024 * 1024,
+		CachingDiskDirectory:     t.TempDir(),
+		CachingDiskCapacityBytes: 1024 * 1024,
+		CachingTieredL2:          "disk",
+		CachingTieredMaxL1Bytes:  1024 * 1024,
+	}
+	adapter, err := newCacheAdapter(cfg, nil)
+	require.NoError(t, err)
+	l1, _ := adapter.(*tiered.Adapter).Tiers()
+	assert.Same(t, l1, snapshotAdapter(adapter))
+
+	cfg.CachingBackend = "disk"
+	adapter, err = newCacheAdapter(cfg, nil)
+	require.NoError(t, err)
+	assert.Nil(t, snapshotAdapter(adapter))
+}
+
 func TestWithRecovery(t *testing.T) {
 	t.Run("normal handler", func(t *testing.T) {
 		t.Parallel()
@@ -200,4 +604,14 @@ func TestWithRecovery(t *testing.T) {
 		})).ServeHTTP
 		assert.HTTPStatusCode(t, handler, http.MethodGet, "/", nil, http.StatusInternalServerError)
 	})
+
+	t.Run("aborted handler", func(t *testing.T) {
+		t.Parallel()
+		handler := withRecovery(http.HandlerFunc(func(_ http.ResponseWriter, _ *http.Request) {
+			panic(http.ErrAbortHandler)
+		})).ServeHTTP
+		assert.PanicsWithValue(t, http.ErrAbortHandler, func() {
+			handler(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+		})
+	})
 }
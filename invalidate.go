@@ -0,0 +1,268 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// purgeIDsCapacity is how many purge IDs are remembered to drop redeliveries.
+const purgeIDsCapacity = 10000
+
+// errPeerRejected is returned when a peer rejects a purge, which is not retried.
+var errPeerRejected = errors.New("peer rejected purge")
+
+// purgeEvent is a purge made on a replica, sent to its peers so that they
+// purge their own cache alike. Its ID makes redeliveries idempotent.
+type purgeEvent struct {
+	ID    string `json:"id"`
+	By    string `json:"by"`
+	Value string `json:"value"`
+}
+
+// invalidator propagates the cache purges made on this replica to its peers,
+// by an authenticated POST to their /cluster/purge endpoint, and applies the
+// purges received from them. Deliveries are retried with exponential backoff
+// until they succeed, are rejected or run out of retries, so that each peer
+// receives a purge at least once while this replica runs. Peers drop the
+// purges they have already applied, including their own.
+type invalidator struct {
+	token         string
+	peers         *clusterPeers
+	client        *http.Client
+	retries       int
+	retryInterval time.Duration
+	cache         s3Cache
+	seen          *purgeIDs
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+
+	peerCount  atomic.Int64
+	broadcasts atomic.Int64
+	delivered  atomic.Int64
+	retried    atomic.Int64
+	failed     atomic.Int64
+	received   atomic.Int64
+	duplicates atomic.Int64
+}
+
+func newInvalidator(token string, peers *clusterPeers, c s3Cache, timeout time.Duration, retries int, retryInterval time.Duration) (*invalidator, error) {
+	if token == "" {
+		return nil, errors.New("cluster token is not set")
+	}
+	if timeout <= 0 {
+		return nil, fmt.Errorf("cluster timeout %v is invalid", timeout)
+	}
+	if retries < 0 {
+		return nil, fmt.Errorf("cluster retries %d is invalid", retries)
+	}
+	if retryInterval <= 0 {
+		return nil, fmt.Errorf("cluster retry interval %v is invalid", retryInterval)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	return &invalidator{
+		token:         token,
+		peers:         peers,
+		client:        &http.Client{Timeout: timeout},
+		retries:       retries,
+		retryInterval: retryInterval,
+		cache:         c,
+		seen:          newPurgeIDs(purgeIDsCapacity),
+		ctx:           ctx,
+		cancel:        cancel,
+	}, nil
+}
+
+// Broadcast sends a purge made on this replica to its peers in the
+// background, and returns its ID.
+func (inv *invalidator) Broadcast(by, value string) string {
+	e := purgeEvent{ID: newPurgeID(), By: by, Value: value}
+	inv.seen.add(e.ID)
+	inv.broadcasts.Add(1)
+	inv.wg.Go(func() {
+		var peers []string
+		err := inv.retry(inv.ctx, func(ctx context.Context) error {
+			var err error
+			peers, err = inv.peers.Peers(ctx)
+			return err
+		})
+		if err != nil {
+			inv.failed.Add(1)
+			slog.Error("cluster purge not sent", "id", e.ID, "err", err)
+			return
+		}
+		inv.peerCount.Store(int64(len(peers)))
+		for _, peer := range peers {
+			inv.wg.Go(func() { inv.deliver(peer, e) })
+		}
+	})
+	return e.ID
+}
+
+// deliver sends a purge to a peer, with retries.
+func (inv *invalidator) deliver(peer string, e purgeEvent) {
+	body, err := json.Marshal(e)
+	if err != nil {
+		inv.failed.Add(1)
+		slog.Error("cluster purge not sent", "id", e.ID, "peer", peer, "err", err)
+		return
+	}
+	err = inv.retry(inv.ctx, func(ctx context.Context) error {
+		return inv.post(ctx, peer+"/cluster/purge", body)
+	})
+	if err != nil {
+		inv.failed.Add(1)
+		slog.Error("cluster purge not delivered", "id", e.ID, "peer", peer, "err", err)
+		return
+	}
+	inv.delivered.Add(1)
+}
+
+func (inv *invalidator) post(ctx context.Context, target string, body []byte) error {
+	r, err := http.NewRequestWithContext(ctx, http.MethodPost, target, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("%w: %w", errPeerRejected, err)
+	}
+	r.Header.Set("Content-Type", "application/json")
+	r.Header.Set("Authorization", "Bearer "+inv.token)
+	resp, err := inv.client.Do(r)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, resp.Body)
+	switch {
+	case resp.StatusCode < 300:
+		return nil
+	case resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests:
+		return fmt.Errorf("peer responded %s", resp.Status)
+	default:
+		return fmt.Errorf("%w: peer responded %s", errPeerRejected, resp.Status)
+	}
+}
+
+// retry calls f until it succeeds, fails with errPeerRejected, or has been
+// retried inv.retries times, doubling the interval between calls.
+func (inv *invalidator) retry(ctx context.Context, f func(ctx context.Context) error) error {
+	interval := inv.retryInterval
+	for attempt := 0; ; attempt++ {
+		err := f(ctx)
+		if err == nil || attempt == inv.retries || errors.Is(err, errPeerRejected) {
+			return err
+		}
+		inv.retried.Add(1)
+		select {
+		case <-time.After(interval):
+		case <-ctx.Done():
+			return errors.Join(err, ctx.Err())
+		}
+		interval *= 2
+	}
+}
+
+// ServeHTTP applies a purge received from a peer, unless already applied.
+func (inv *invalidator) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !bearerAuthorized(w, r, "cluster", inv.token) {
+		return
+	}
+	var e purgeEvent
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64<<10)).Decode(&e); err != nil || e.ID == "" {
+		http.Error(w, "invalid purge event", http.StatusBadRequest)
+		return
+	}
+	match, by, err := adminMatcher(url.Values{e.By: {e.Value}}, false)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !inv.seen.add(e.ID) {
+		inv.duplicates.Add(1)
+		writeJSON(w, http.StatusOK, map[string]any{"id": e.ID, "duplicate": true})
+		return
+	}
+	n, err := purgeCache(r.Context(), inv.cache, by, e.Value, match)
+	if err != nil {
+		// Forgotten, so that the purge is applied when delivered again.
+		inv.seen.remove(e.ID)
+		adminError(w, "cluster purge", err)
+		return
+	}
+	inv.received.Add(1)
+	slog.Info("cache purged by peer", "id", e.ID, "by", by, "value", e.Value, "purged", n)
+	writeJSON(w, http.StatusOK, map[string]any{"id": e.ID, "purged": n})
+}
+
+// Stop cancels the pending deliveries and waits for them to return.
+func (inv *invalidator) Stop() {
+	inv.cancel()
+	inv.wg.Wait()
+}
+
+// Stats returns a snapshot of the invalidator counters suitable for expvar.
+func (inv *invalidator) Stats() any {
+	return map[string]any{
+		"peers":            inv.peerCount.Load(),
+		"broadcasts_total": inv.broadcasts.Load(),
+		"delivered_total":  inv.delivered.Load(),
+		"retries_total":    inv.retried.Load(),
+		"failed_total":     inv.failed.Load(),
+		"received_total":   inv.received.Load(),
+		"duplicates_total": inv.duplicates.Load(),
+	}
+}
+
+func newPurgeID() string {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// purgeIDs is the set of the most recent purge IDs, up to a capacity.
+type purgeIDs struct {
+	mu    sync.Mutex
+	ids   map[string]struct{}
+	order []string
+	next  int
+}
+
+func newPurgeIDs(capacity int) *purgeIDs {
+	return &purgeIDs{ids: map[string]struct{}{}, order: make([]string, 0, capacity)}
+}
+
+// add adds an ID, forgetting the oldest one if full, and reports whether it
+// was not already in the set.
+func (p *purgeIDs) add(id string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, ok := p.ids[id]; ok {
+		return false
+	}
+	if len(p.order) < cap(p.order) {
+		p.order = append(p.order, id)
+	} else {
+		delete(p.ids, p.order[p.next])
+		p.order[p.next] = id
+		p.next = (p.next + 1) % len(p.order)
+	}
+	p.ids[id] = struct{}{}
+	return true
+}
+
+func (p *purgeIDs) remove(id string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.ids, id)
+}
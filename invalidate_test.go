@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	cache "github.com/victorspringer/http-cache"
+	"github.com/victorspringer/http-cache/adapter/memory"
+)
+
+const testClusterToken = "cluster-secret"
+
+// testNode is an in-process replica with its own memory cache, serving the
+// admin API, the cluster purge endpoint and a cached origin.
+type testNode struct {
+	server      *httptest.Server
+	adapter     *memory.Adapter
+	invalidator *invalidator
+	origin      http.Handler
+	// failures is the number of purges received to fail with 503 before
+	// applying them.
+	failures atomic.Int64
+}
+
+// newTestCluster starts replicas that are peers of each other, themselves
+// included.
+func newTestCluster(t *testing.T, n int) []*testNode {
+	t.Helper()
+	nodes := make([]*testNode, n)
+	var urls []string
+	for i := range nodes {
+		node := &testNode{}
+		node.server = httptest.NewUnstartedServer(nil)
+		urls = append(urls, "http://"+node.server.Listener.Addr().String())
+		nodes[i] = node
+	}
+	peers, err := newClusterPeers(urls, "")
+	require.NoError(t, err)
+	for _, node := range nodes {
+		node.adapter = newTestMemoryAdapter(t)
+		client, err := cache.NewClient(cache.ClientWithAdapter(node.adapter), cache.ClientWithTTL(time.Minute))
+		require.NoError(t, err)
+		c := s3Cache{client: client, adapter: node.adapter}
+		node.origin = client.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, _ = w.Write([]byte(r.URL.Path))
+		}))
+		node.invalidator, err = newInvalidator(testClusterToken, peers, c, time.Second, 3, 10*time.Millisecond)
+		require.NoError(t, err)
+		admin, err := newAdminHandler(testAdminToken, c, 10, node.invalidator)
+		require.NoError(t, err)
+
+		mux := http.NewServeMux()
+		mux.Handle("/admin/cache/", admin)
+		mux.HandleFunc("POST /cluster/purge", func(w http.ResponseWriter, r *http.Request) {
+			if node.failures.Add(-1) >= 0 {
+				http.Error(w, "Service Unavailable", http.StatusServiceUnavailable)
+				return
+			}
+			node.invalidator.ServeHTTP(w, r)
+		})
+		node.server.Config.Handler = mux
+		node.server.Start()
+		t.Cleanup(func() {
+			node.invalidator.Stop()
+			node.server.Close()
+		})
+	}
+	return nodes
+}
+
+func postPurgeEvent(t *testing.T, node *testNode, token string, e purgeEvent) (int, map[string]any) {
+	t.Helper()
+	body, err := json.Marshal(e)
+	require.NoError(t, err)
+	r := httptest.NewRequest(http.MethodPost, "/cluster/purge", bytes.NewReader(body))
+	r.Header.Set("Authorization", "Bearer "+token)
+	w := httptest.NewRecorder()
+	node.invalidator.ServeHTTP(w, r)
+	var result map[string]any
+	if w.Header().Get("Content-Type") == "application/json" {
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &result))
+	}
+	return w.Code, result
+}
+
+func TestInvalidator_Broadcast(t *testing.T) {
+	t.Parallel()
+	nodes := newTestCluster(t, 3)
+	for _, node := range nodes {
+		warmTestPaths(node.origin, "/index.html", "/assets/app.js", "/assets/app.css")
+	}
+	nodes[2].failures.Store(2)
+
+	w, body := adminRequest(t, nodes[0].server.Config.Handler, http.MethodPost, "/admin/cache/purge?prefix=/assets/")
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.InDelta(t, 2, body["purged"], 0)
+	assert.NotEmpty(t, body["id"])
+
+	for _, node := range nodes {
+		require.Eventually(t, func() bool { return node.adapter.Len() == 1 }, 5*time.Second, 10*time.Millisecond)
+	}
+	require.Eventually(t, func() bool {
+		return nodes[0].invalidator.Stats().(map[string]any)["delivered_total"] == int64(3)
+	}, 5*time.Second, 10*time.Millisecond)
+	stats := nodes[0].invalidator.Stats().(map[string]any)
+	assert.Equal(t, int64(3), stats["peers"])
+	assert.Equal(t, int64(1), stats["broadcasts_total"])
+	assert.Equal(t, int64(2), stats["retries_total"])
+	assert.Equal(t, int64(0), stats["failed_total"])
+	// Its own purge is dropped as already applied.
+	assert.Equal(t, int64(1), stats["duplicates_total"])
+	assert.Equal(t, int64(1), nodes[1].invalidator.Stats().(map[string]any)["received_total"])
+}
+
+func TestInvalidator_GivesUp(t *testing.T) {
+	t.Parallel()
+	nodes := newTestCluster(t, 2)
+	nodes[1].failures.Store(100)
+
+	nodes[0].invalidator.Broadcast("all", "true")
+	require.Eventually(t, func() bool {
+		return nodes[0].invalidator.Stats().(map[string]any)["failed_total"] == int64(1)
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, int64(3), nodes[0].invalidator.Stats().(map[string]any)["retries_total"])
+}
+
+func TestInvalidator_ServeHTTP(t *testing.T) {
+	t.Parallel()
+	nodes := newTestCluster(t, 1)
+	node := nodes[0]
+	warmTestPaths(node.origin, "/index.html", "/about.html")
+
+	status, result := postPurgeEvent(t, node, testClusterToken, purgeEvent{ID: "1", By: "path", Value: "/index.html"})
+	require.Equal(t, http.StatusOK, status)
+	assert.InDelta(t, 1, result["purged"], 0)
+	assert.Equal(t, 1, node.adapter.Len())
+
+	warmTestPaths(node.origin, "/index.html")
+	status, result = postPurgeEvent(t, node, testClusterToken, purgeEvent{ID: "1", By: "path", Value: "/index.html"})
+	require.Equal(t, http.StatusOK, status)
+	assert.Equal(t, true, result["duplicate"])
+	assert.Equal(t, 2, node.adapter.Len())
+
+	status, _ = postPurgeEvent(t, node, "wrong", purgeEvent{ID: "2", By: "all", Value: "true"})
+	assert.Equal(t, http.StatusUnauthorized, status)
+	status, _ = postPurgeEvent(t, node, testClusterToken, purgeEvent{By: "all", Value: "true"})
+	assert.Equal(t, http.StatusBadRequest, status)
+	status, _ = postPurgeEvent(t, node, testClusterToken, purgeEvent{ID: "3", By: "host", Value: "example.com"})
+	assert.Equal(t, http.StatusBadRequest, status)
+	assert.Equal(t, 2, node.adapter.Len())
+}
+
+func TestNewInvalidator_Errors(t *testing.T) {
+	t.Parallel()
+	peers, err := newClusterPeers([]string{"http://10.0.0.1:8080"}, "")
+	require.NoError(t, err)
+	_, err = newInvalidator("", peers, s3Cache{}, time.Second, 1, time.Second)
+	require.Error(t, err)
+	_, err = newInvalidator(testClusterToken, peers, s3Cache{}, 0, 1, time.Second)
+	require.Error(t, err)
+	_, err = newInvalidator(testClusterToken, peers, s3Cache{}, time.Second, -1, time.Second)
+	require.Error(t, err)
+	_, err = newInvalidator(testClusterToken, peers, s3Cache{}, time.Second, 1, 0)
+	require.Error(t, err)
+}
+
+func TestPurgeIDs(t *testing.T) {
+	t.Parallel()
+	ids := newPurgeIDs(2)
+	assert.True(t, ids.add("a"))
+	assert.False(t, ids.add("a"))
+	assert.True(t, ids.add("b"))
+	assert.True(t, ids.add("c"))
+	assert.True(t, ids.add("a"), "the oldest id is forgotten")
+	assert.False(t, ids.add("c"))
+	ids.remove("c")
+	assert.True(t, ids.add("c"))
+}
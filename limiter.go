@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	errQueueFull    = errors.New("queue is full")
+	errQueueTimeout = errors.New("queue wait timed out")
+)
+
+// limiter is a bulkhead that bounds the number of in-flight requests to a
+// downstream dependency and queues the excess for a limited amount of time.
+type limiter struct {
+	slots        chan struct{}
+	maxQueue     int64
+	queueTimeout time.Duration
+
+	inFlight  atomic.Int64
+	queued    atomic.Int64
+	admitted  atomic.Int64
+	rejected  atomic.Int64
+	timedOut  atomic.Int64
+	waitTotal atomic.Int64 // nanoseconds
+	waitMax   atomic.Int64 // nanoseconds
+}
+
+func newLimiter(maxConcurrency, maxQueue int, queueTimeout time.Duration) (*limiter, error) {
+	if maxConcurrency < 1 {
+		return nil, fmt.Errorf("limiter max concurrency %d is invalid", maxConcurrency)
+	}
+	if maxQueue < 0 {
+		return nil, fmt.Errorf("limiter max queue %d is invalid", maxQueue)
+	}
+	if queueTimeout < 0 {
+		return nil, fmt.Errorf("limiter queue timeout %v is invalid", queueTimeout)
+	}
+	return &limiter{
+		slots:        make(chan struct{}, maxConcurrency),
+		maxQueue:     int64(maxQueue),
+		queueTimeout: queueTimeout,
+	}, nil
+}
+
+// acquire takes a slot, waiting in the queue if all slots are busy. The
+// returned func must be called to give the slot back.
+func (l *limiter) acquire(ctx context.Context) (func(), error) {
+	select {
+	case l.slots <- struct{}{}:
+		return l.admit(), nil
+	default:
+	}
+
+	if l.queued.Add(1) > l.maxQueue {
+		l.queued.Add(-1)
+		l.rejected.Add(1)
+		return nil, errQueueFull
+	}
+	start := time.Now()
+	defer func() {
+		l.queued.Add(-1)
+		l.observeWait(time.Since(start))
+	}()
+
+	timer := time.NewTimer(l.queueTimeout)
+	defer timer.Stop()
+	select {
+	case l.slots <- struct{}{}:
+		return l.admit(), nil
+	case <-timer.C:
+		l.timedOut.Add(1)
+		return nil, errQueueTimeout
+	case <-ctx.Done():
+		l.timedOut.Add(1)
+		return nil, fmt.Errorf("wait in queue: %w", ctx.Err())
+	}
+}
+
+func (l *limiter) admit() func() {
+	l.admitted.Add(1)
+	l.inFlight.Add(1)
+	return func() {
+		l.inFlight.Add(-1)
+		<-l.slots
+	}
+}
+
+func (l *limiter) observeWait(d time.Duration) {
+	l.waitTotal.Add(int64(d))
+	for {
+		cur := l.waitMax.Load()
+		if int64(d) <= cur || l.waitMax.CompareAndSwap(cur, int64(d)) {
+			return
+		}
+	}
+}
+
+// Stats returns a snapshot of the limiter counters suitable for expvar.
+func (l *limiter) Stats() any {
+	return map[string]any{
+		"max_concurrency":          cap(l.slots),
+		"max_queue":                l.maxQueue,
+		"in_flight":                l.inFlight.Load(),
+		"queue_depth":              l.queued.Load(),
+		"admitted_total":           l.admitted.Load(),
+		"rejected_total":           l.rejected.Load(),
+		"timed_out_total":          l.timedOut.Load(),
+		"queue_wait_seconds_total": time.Duration(l.waitTotal.Load()).Seconds(),
+		"queue_wait_seconds_max":   time.Duration(l.waitMax.Load()).Seconds(),
+	}
+}
+
+// withLimiter runs next within a limiter slot. The slot is released as soon
+// as next starts responding, once the downstream dependency has answered, so
+// that slow clients do not hold it while the response is copied to them.
+func withLimiter(l *limiter, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		release, err := l.acquire(r.Context())
+		if err != nil {
+			slog.Warn("http request shed by limiter", "method", r.Method, "path", r.URL.Path, "error", err)
+			w.Header().Set("Retry-After", "1")
+			http.Error(w, "Service Unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		rw := &limiterResponseWriter{ResponseWriter: w, release: sync.OnceFunc(release)}
+		defer rw.release()
+		next.ServeHTTP(rw, r)
+	})
+}
+
+// limiterResponseWriter releases a limiter slot when the response starts.
+type limiterResponseWriter struct {
+	http.ResponseWriter
+	release func()
+}
+
+func (rw *limiterResponseWriter) WriteHeader(status int) {
+	rw.release()
+	rw.ResponseWriter.WriteHeader(status)
+}
+
+func (rw *limiterResponseWriter) Write(b []byte) (int, error) {
+	rw.release()
+	return rw.ResponseWriter.Write(b)
+}
+
+func (rw *limiterResponseWriter) Unwrap() http.ResponseWriter {
+	return rw.ResponseWriter
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewLimiter_Errors(t *testing.T) {
+	t.Parallel()
+	_, err := newLimiter(0, 1, time.Second)
+	require.Error(t, err)
+	_, err = newLimiter(1, -1, time.Second)
+	require.Error(t, err)
+	_, err = newLimiter(1, 1, -time.Second)
+	require.Error(t, err)
+}
+
+func TestWithLimiter(t *testing.T) {
+	t.Run("admits up to max concurrency", func(t *testing.T) {
+		t.Parallel()
+		l, err := newLimiter(2, 0, time.Second)
+		require.NoError(t, err)
+		handler := withLimiter(l, http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+			w.WriteHeader(http.StatusOK)
+		})).ServeHTTP
+
+		assert.HTTPStatusCode(t, handler, http.MethodGet, "/", nil, http.StatusOK)
+		assert.HTTPStatusCode(t, handler, http.MethodGet, "/", nil, http.StatusOK)
+		assert.Equal(t, int64(2), l.admitted.Load())
+		assert.Equal(t, int64(0), l.inFlight.Load())
+	})
+
+	t.Run("sheds load when queue is full", func(t *testing.T) {
+		t.Parallel()
+		l, err := newLimiter(1, 0, time.Second)
+		require.NoError(t, err)
+		unblock, running := blockingHandler(l)
+		defer close(unblock)
+		<-running
+
+		rec := httptest.NewRecorder()
+		withLimiter(l, http.NotFoundHandler()).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+		assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+		assert.Equal(t, "1", rec.Header().Get("Retry-After"))
+		assert.Equal(t, int64(1), l.rejected.Load())
+	})
+
+	t.Run("sheds load when queue wait times out", func(t *testing.T) {
+		t.Parallel()
+		l, err := newLimiter(1, 1, 10*time.Millisecond)
+		require.NoError(t, err)
+		unblock, running := blockingHandler(l)
+		defer close(unblock)
+		<-running
+
+		rec := httptest.NewRecorder()
+		withLimiter(l, http.NotFoundHandler()).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+		assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+		assert.Equal(t, int64(1), l.timedOut.Load())
+		assert.Equal(t, int64(0), l.queued.Load())
+		assert.GreaterOrEqual(t, l.waitMax.Load(), int64(10*time.Millisecond))
+	})
+
+	t.Run("queued request proceeds once a slot frees up", func(t *testing.T) {
+		t.Parallel()
+		l, err := newLimiter(1, 1, time.Second)
+		require.NoError(t, err)
+		unblock, running := blockingHandler(l)
+		<-running
+
+		var wg sync.WaitGroup
+		rec := httptest.NewRecorder()
+		wg.Go(func() {
+			withLimiter(l, http.NotFoundHandler()).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+		})
+		require.Eventually(t, func() bool { return l.queued.Load() == 1 }, time.Second, time.Millisecond)
+		close(unblock)
+		wg.Wait()
+
+		assert.Equal(t, http.StatusNotFound, rec.Code)
+		assert.Equal(t, int64(2), l.admitted.Load())
+		assert.Equal(t, int64(0), l.queued.Load())
+	})
+
+	t.Run("streams large responses", func(t *testing.T) {
+		// Not parallel, so that the memory allocated is the handler's only.
+		l, err := newLimiter(1, 0, time.Second)
+		require.NoError(t, err)
+		const size = 64 << 20
+		handler := withLimiter(l, http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+			chunk := make([]byte, 32<<10)
+			for range size / len(chunk) {
+				_, _ = w.Write(chunk)
+			}
+		}))
+
+		w := &countingResponseWriter{header: http.Header{}}
+		var before, after runtime.MemStats
+		runtime.ReadMemStats(&before)
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+		runtime.ReadMemStats(&after)
+
+		assert.Equal(t, int64(size), w.written)
+		assert.Less(t, after.TotalAlloc-before.TotalAlloc, uint64(size/8))
+		assert.Equal(t, int64(0), l.inFlight.Load())
+	})
+
+	t.Run("releases the slot before writing to the client", func(t *testing.T) {
+		t.Parallel()
+		l, err := newLimiter(1, 0, time.Second)
+		require.NoError(t, err)
+		handler := withLimiter(l, http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+			w.Header().Set("Content-Type", "text/plain")
+			w.WriteHeader(http.StatusCreated)
+			_, _ = w.Write([]byte("hello"))
+		}))
+
+		w := &slowResponseWriter{ResponseRecorder: httptest.NewRecorder(), unblock: make(chan struct{})}
+		var wg sync.WaitGroup
+		wg.Go(func() { handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil)) })
+		require.Eventually(t, func() bool { return w.writing.Load() }, time.Second, time.Millisecond)
+		assert.Equal(t, int64(0), l.inFlight.Load())
+		close(w.unblock)
+		wg.Wait()
+
+		assert.Equal(t, http.StatusCreated, w.Code)
+		assert.Equal(t, "text/plain", w.Header().Get("Content-Type"))
+		assert.Equal(t, "hello", w.Body.String())
+	})
+}
+
+// slowResponseWriter is a client that blocks on writes until unblock is
+// closed.
+type slowResponseWriter struct {
+	*httptest.ResponseRecorder
+	unblock chan struct{}
+	writing atomic.Bool
+}
+
+func (w *slowResponseWriter) Write(b []byte) (int, error) {
+	w.writing.Store(true)
+	<-w.unblock
+	return w.ResponseRecorder.Write(b)
+}
+
+func TestLimiter_Stats(t *testing.T) {
+	t.Parallel()
+	l, err := newLimiter(4, 8, time.Second)
+	require.NoError(t, err)
+
+	stats, ok := l.Stats().(map[string]any)
+	require.True(t, ok)
+	assert.Equal(t, 4, stats["max_concurrency"])
+	assert.Equal(t, int64(8), stats["max_queue"])
+	assert.Equal(t, int64(0), stats["in_flight"])
+	assert.Equal(t, int64(0), stats["queue_depth"])
+}
+
+// blockingHandler occupies one limiter slot until unblock is closed.
+func blockingHandler(l *limiter) (unblock, running chan struct{}) {
+	unblock, running = make(chan struct{}), make(chan struct{})
+	handler := withLimiter(l, http.HandlerFunc(func(_ http.ResponseWriter, _ *http.Request) {
+		close(running)
+		<-unblock
+	}))
+	go handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+	return unblock, running
+}
+
+// countingResponseWriter discards a response, only counting its size.
+type countingResponseWriter struct {
+	header  http.Header
+	written int64
+}
+
+func (w *countingResponseWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *countingResponseWriter) WriteHeader(int) {}
+
+func (w *countingResponseWriter) Write(b []byte) (int, error) {
+	w.written += int64(len(b))
+	return len(b), nil
+}
@@ -0,0 +1,6 @@
+package main
+
+import "expvar"
+
+// metrics is the root of the runtime counters exposed at /debug/vars.
+var metrics = expvar.NewMap("go_serve_s3")
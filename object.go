@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"log/slog"
+	"mime"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	awsHttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	cache "github.com/victorspringer/http-cache"
+)
+
+// objectGetter is the subset of the S3 client used by objectHandler.
+type objectGetter interface {
+	GetObject(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error)
+}
+
+// objectHandler serves S3 objects with a single GetObject call, passing the
+// object metadata (ETag, Cache-Control, etc.) on to the response and letting
+// S3 answer conditional requests. Directories, range requests and missing
+// keys without a file extension, which may be directories, are left to next.
+// The cache tags of an object, if any, are read from its tagMetadata user
+// metadata and sent in the tagHeader header.
+type objectHandler struct {
+	client      objectGetter
+	bucket      string
+	next        http.Handler
+	tagHeader   string
+	tagMetadata string
+}
+
+func (h *objectHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, "/")
+	if r.Method != http.MethodGet || r.Header.Get("Range") != "" ||
+		name == "" || strings.HasSuffix(name, "/") || path.Base(name) == "index.html" || !fs.ValidPath(name) {
+		h.next.ServeHTTP(w, r)
+		return
+	}
+
+	in := &s3.GetObjectInput{Bucket: &h.bucket, Key: &name}
+	if v := r.Header.Get("If-None-Match"); v != "" {
+		in.IfNoneMatch = &v
+	} else if t, err := http.ParseTime(r.Header.Get("If-Modified-Since")); err == nil {
+		in.IfModifiedSince = &t
+	}
+	start := time.Now()
+	out, err := h.client.GetObject(r.Context(), in)
+	if cache.Debugging(r.Context()) {
+		w.Header().Add("Server-Timing", cache.ServerTiming("s3", time.Since(start), "S3 time to first byte"))
+	}
+	if err != nil {
+		if respErr, ok := errors.AsType[*awsHttp.ResponseError](err); ok {
+			switch code := respErr.HTTPStatusCode(); {
+			case code == http.StatusNotModified:
+				for _, k := range []string{"Etag", "Last-Modified", "Cache-Control", "Expires"} {
+					if v := respErr.Response.Header.Get(k); v != "" {
+						w.Header().Set(k, v)
+					}
+				}
+				w.WriteHeader(http.StatusNotModified)
+				return
+			case code < http.StatusInternalServerError && path.Ext(name) == "":
+				// Not an object, possibly a directory; fs.FS semantics apply.
+				h.next.ServeHTTP(w, r)
+				return
+			case code == http.StatusNotFound:
+				http.Error(w, "404 page not found", http.StatusNotFound)
+				return
+			case code < http.StatusInternalServerError:
+				http.Error(w, strconv.Itoa(code)+" "+http.StatusText(code), code)
+				return
+			}
+		}
+		slog.Error("s3 get object failed", "key", name, "err", err)
+		http.Error(w, "500 Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	defer func() { _ = out.Body.Close() }()
+
+	header := w.Header()
+	if ctype := objectContentType(name, out.ContentType); ctype != "" {
+		header.Set("Content-Type", ctype)
+	}
+	header.Set("Accept-Ranges", "bytes")
+	setHeader(header, "Etag", out.ETag)
+	setHeader(header, "Cache-Control", out.CacheControl)
+	setHeader(header, "Expires", out.ExpiresString)
+	setHeader(header, "Content-Encoding", out.ContentEncoding)
+	setHeader(header, "Content-Disposition", out.ContentDisposition)
+	setHeader(header, "Content-Language", out.ContentLanguage)
+	if v := out.Metadata[h.tagMetadata]; h.tagHeader != "" && v != "" {
+		header.Set(h.tagHeader, v)
+	}
+	if out.LastModified != nil {
+		header.Set("Last-Modified", out.LastModified.UTC().Format(http.TimeFormat))
+	}
+	if out.ContentLength != nil {
+		header.Set("Content-Length", strconv.FormatInt(*out.ContentLength, 10))
+	}
+	w.WriteHeader(http.StatusOK)
+	if _, err := io.Copy(w, out.Body); err != nil {
+		// Aborted, so that the truncated response is neither cached nor
+		// taken for a complete one by the client.
+		slog.Warn("s3 object copy interrupted", "key", name, "err", err)
+		panic(http.ErrAbortHandler)
+	}
+}
+
+// objectContentType returns the Content-Type set on the object at upload,
+// unless it is the generic default of S3, in which case it is derived from
+// the file extension, or left empty to be sniffed, as http.FileServer does.
+func objectContentType(name string, contentType *string) string {
+	if contentType != nil && *contentType != "" &&
+		*contentType != "binary/octet-stream" && *contentType != "application/octet-stream" {
+		return *contentType
+	}
+	return mime.TypeByExtension(path.Ext(name))
+}
+
+func setHeader(h http.Header, key string, value *string) {
+	if value != nil && *value != "" {
+		h.Set(key, *value)
+	}
+}
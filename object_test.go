@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	awsHttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	smithyHttp "github.com/aws/smithy-go/transport/http"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	cache "github.com/victorspringer/http-cache"
+)
+
+type objectGetterFunc func(ctx context.Context, params *s3.GetObjectInput) (*s3.GetObjectOutput, error)
+
+func (f objectGetterFunc) GetObject(ctx context.Context, params *s3.GetObjectInput, _ ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
+	return f(ctx, params)
+}
+
+// nopAdapter is a cache.Adapter that never caches anything.
+type nopAdapter struct{}
+
+func (*nopAdapter) Get(uint64) ([]byte, bool)     { return nil, false }
+func (*nopAdapter) Set(uint64, []byte, time.Time) {}
+func (*nopAdapter) Release(uint64)                {}
+
+func s3ResponseError(statusCode int, header http.Header) error {
+	return &awsHttp.ResponseError{
+		ResponseError: &smithyHttp.ResponseError{
+			Response: &smithyHttp.Response{Response: &http.Response{StatusCode: statusCode, Header: header}},
+			Err:      errors.New(http.StatusText(statusCode)),
+		},
+	}
+}
+
+func TestObjectHandler(t *testing.T) {
+	const etag = `"0123456789abcdef"`
+	lastModified := time.Date(2026, 10, 1, 12, 0, 0, 0, time.UTC)
+	fallback := http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	})
+	client := objectGetterFunc(func(_ context.Context, params *s3.GetObjectInput) (*s3.GetObjectOutput, error) {
+		switch *params.Key {
+		case objectName:
+			if params.IfNoneMatch != nil && *params.IfNoneMatch == etag {
+				return nil, s3ResponseError(http.StatusNotModified, http.Header{"Etag": []string{etag}})
+			}
+			return &s3.GetObjectOutput{
+				Body:          io.NopCloser(strings.NewReader(objectContent)),
+				ContentLength: new(int64(len(objectContent))),
+				ContentType:   new("binary/octet-stream"),
+				ETag:          new(etag),
+				CacheControl:  new("max-age=60"),
+				LastModified:  &lastModified,
+				Metadata:      map[string]string{"surrogate-key": "release-1 text"},
+			}, nil
+		case "broken.txt":
+			return nil, s3ResponseError(http.StatusServiceUnavailable, http.Header{})
+		default:
+			return nil, s3ResponseError(http.StatusNotFound, http.Header{})
+		}
+	})
+	handler := &objectHandler{client: client, bucket: bucketName, next: fallback, tagHeader: "Surrogate-Key", tagMetadata: "surrogate-key"}
+
+	t.Run("get existing object", func(t *testing.T) {
+		t.Parallel()
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/"+objectName, nil))
+
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.Equal(t, objectContent, rec.Body.String())
+		assert.Equal(t, "text/plain; charset=utf-8", rec.Header().Get("Content-Type"))
+		assert.Equal(t, etag, rec.Header().Get("Etag"))
+		assert.Equal(t, "max-age=60", rec.Header().Get("Cache-Control"))
+		assert.Equal(t, lastModified.Format(http.TimeFormat), rec.Header().Get("Last-Modified"))
+		assert.Equal(t, "release-1 text", rec.Header().Get("Surrogate-Key"))
+	})
+
+	t.Run("get not modified object", func(t *testing.T) {
+		t.Parallel()
+		req := httptest.NewRequest(http.MethodGet, "/"+objectName, nil)
+		req.Header.Set("If-None-Match", etag)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+
+		assert.Equal(t, http.StatusNotModified, rec.Code)
+		assert.Empty(t, rec.Body.String())
+		assert.Equal(t, etag, rec.Header().Get("Etag"))
+	})
+
+	t.Run("get object with debug headers", func(t *testing.T) {
+		t.Parallel()
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/"+objectName, nil))
+		assert.Empty(t, rec.Header().Get("Server-Timing"))
+
+		cacheClient, err := cache.NewClient(
+			cache.ClientWithAdapter(&nopAdapter{}),
+			cache.ClientWithTTL(time.Minute),
+			cache.ClientWithDebugHeaders(""),
+		)
+		require.NoError(t, err)
+		rec = httptest.NewRecorder()
+		cacheClient.Middleware(handler).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/"+objectName, nil))
+		assert.Equal(t, "MISS", rec.Header().Get("X-Cache"))
+		assert.Contains(t, rec.Header().Values("Server-Timing")[0], `s3;dur=`)
+	})
+
+	t.Run("get missing object", func(t *testing.T) {
+		t.Parallel()
+		assert.HTTPStatusCode(t, handler.ServeHTTP, http.MethodGet, "/non-existent.txt", nil, http.StatusNotFound)
+		assert.HTTPStatusCode(t, handler.ServeHTTP, http.MethodGet, "/non-existent", nil, http.StatusTeapot)
+	})
+
+	t.Run("get object with s3 failure", func(t *testing.T) {
+		t.Parallel()
+		assert.HTTPStatusCode(t, handler.ServeHTTP, http.MethodGet, "/broken.txt", nil, http.StatusInternalServerError)
+	})
+
+	t.Run("delegates directories and ranges", func(t *testing.T) {
+		t.Parallel()
+		assert.HTTPStatusCode(t, handler.ServeHTTP, http.MethodGet, "/", nil, http.StatusTeapot)
+		assert.HTTPStatusCode(t, handler.ServeHTTP, http.MethodGet, "/dir/", nil, http.StatusTeapot)
+		assert.HTTPStatusCode(t, handler.ServeHTTP, http.MethodGet, "/dir/index.html", nil, http.StatusTeapot)
+		assert.HTTPStatusCode(t, handler.ServeHTTP, http.MethodHead, "/"+objectName, nil, http.StatusTeapot)
+
+		req := httptest.NewRequest(http.MethodGet, "/"+objectName, nil)
+		req.Header.Set("Range", "bytes=0-1")
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		assert.Equal(t, http.StatusTeapot, rec.Code)
+	})
+}
+
+func TestObjectContentType(t *testing.T) {
+	t.Parallel()
+	assert.Equal(t, "image/avif", objectContentType("a.png", new("image/avif")))
+	assert.Equal(t, "image/png", objectContentType("a.png", new("binary/octet-stream")))
+	assert.Equal(t, "image/png", objectContentType("a.png", nil))
+	assert.Empty(t, objectContentType("a", new("application/octet-stream")))
+}
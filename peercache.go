@@ -0,0 +1,228 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	cache "github.com/victorspringer/http-cache"
+	"github.com/victorspringer/http-cache/hashring"
+)
+
+// peerFetchKey is the context key of the peerFetch of a request.
+type peerFetchKey struct{}
+
+// peerFetch is a request being fetched from the peer owning it.
+type peerFetch struct {
+	owner string
+	in    *http.Request
+}
+
+// peerCache spreads the cache over the replicas of the cluster. Each path is
+// owned by a replica chosen by consistent hashing, which serves it through its
+// own cache, from S3 on a miss. Other replicas fetch it from the owner over
+// the authenticated /cluster/fetch endpoint, keeping it in a small hot cache,
+// and fall back to S3 if the owner fails.
+type peerCache struct {
+	self   string
+	token  string
+	peers  *clusterPeers
+	owned  http.Handler
+	origin http.Handler
+	// hot serves the paths of other replicas through hotCache.
+	hot      http.Handler
+	hotCache *cache.Client
+	proxy    *httputil.ReverseProxy
+
+	mu   sync.RWMutex
+	ring *hashring.Ring
+
+	cancel   context.CancelFunc
+	finished chan struct{}
+
+	ownedRequests atomic.Int64
+	fetched       atomic.Int64
+	fallbacks     atomic.Int64
+	served        atomic.Int64
+}
+
+// newPeerCache returns a peer cache serving the paths this replica owns with
+// owned, and the others from their owner through the hot cache, or origin.
+// self is the base URL of this replica as listed among peers.
+func newPeerCache(self, token string, peers *clusterPeers, hot *cache.Client, owned, origin http.Handler, timeout time.Duration) (*peerCache, error) {
+	u, err := url.Parse(self)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("cluster self %q is not a valid url", self)
+	}
+	if token == "" {
+		return nil, errors.New("cluster token is not set")
+	}
+	if timeout <= 0 {
+		return nil, fmt.Errorf("cluster timeout %v is invalid", timeout)
+	}
+	pc := &peerCache{
+		self:     strings.TrimSuffix(u.String(), "/"),
+		token:    token,
+		peers:    peers,
+		owned:    owned,
+		origin:   origin,
+		hotCache: hot,
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.ResponseHeaderTimeout = timeout
+	pc.proxy = &httputil.ReverseProxy{
+		Rewrite:        pc.rewrite,
+		Transport:      transport,
+		ModifyResponse: pc.checkResponse,
+		ErrorHandler:   pc.fallback,
+	}
+	pc.hot = hot.Middleware(http.HandlerFunc(pc.fetch))
+	pc.refresh(context.Background())
+	return pc, nil
+}
+
+// Start refreshes the peers every interval in the background.
+func (pc *peerCache) Start(interval time.Duration) {
+	ctx, cancel := context.WithCancel(context.Background())
+	pc.cancel = cancel
+	pc.finished = make(chan struct{})
+	go func() {
+		defer close(pc.finished)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				pc.refresh(ctx)
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+// Stop stops refreshing the peers.
+func (pc *peerCache) Stop() {
+	if pc.cancel == nil {
+		return
+	}
+	pc.cancel()
+	<-pc.finished
+}
+
+// refresh rebuilds the hash ring from the current peers, this replica
+// included. If the peers cannot be found, the ring is left as is.
+func (pc *peerCache) refresh(ctx context.Context) {
+	peers, err := pc.peers.Peers(ctx)
+	if err != nil {
+		slog.Warn("cluster peers not refreshed", "err", err)
+		if pc.currentRing() != nil {
+			return
+		}
+	}
+	if !slices.Contains(peers, pc.self) {
+		peers = append(peers, pc.self)
+		slices.Sort(peers)
+	}
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	if pc.ring == nil || !slices.Equal(pc.ring.Nodes(), peers) {
+		slog.Info("cluster peers changed", "peers", peers)
+		pc.ring = hashring.New(peers...)
+	}
+}
+
+func (pc *peerCache) currentRing() *hashring.Ring {
+	pc.mu.RLock()
+	defer pc.mu.RUnlock()
+	return pc.ring
+}
+
+// owner returns the base URL of the replica owning a request, by its path.
+func (pc *peerCache) owner(r *http.Request) string {
+	// The ring holds this replica at least.
+	ring := pc.currentRing()
+	i, _ := ring.Locate(r.URL.Path)
+	return ring.Nodes()[i]
+}
+
+func (pc *peerCache) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if pc.owner(r) == pc.self {
+		pc.ownedRequests.Add(1)
+		pc.owned.ServeHTTP(w, r)
+		return
+	}
+	pc.hot.ServeHTTP(w, r)
+}
+
+// fetch serves a request missed by the hot cache from its owner.
+func (pc *peerCache) fetch(w http.ResponseWriter, r *http.Request) {
+	owner := pc.owner(r)
+	if owner == pc.self {
+		// The ring has changed meanwhile.
+		pc.origin.ServeHTTP(w, r)
+		return
+	}
+	pc.proxy.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), peerFetchKey{}, peerFetch{owner, r})))
+}
+
+func (pc *peerCache) rewrite(pr *httputil.ProxyRequest) {
+	target, _ := url.Parse(pr.In.Context().Value(peerFetchKey{}).(peerFetch).owner + "/cluster/fetch")
+	pr.SetURL(target)
+	pr.Out.Header.Set("Authorization", "Bearer "+pc.token)
+}
+
+// checkResponse fails the responses of an owner in error, which are served
+// from S3 instead.
+func (pc *peerCache) checkResponse(resp *http.Response) error {
+	if resp.StatusCode >= http.StatusInternalServerError {
+		return fmt.Errorf("peer responded %s", resp.Status)
+	}
+	pc.fetched.Add(1)
+	return nil
+}
+
+// fallback serves a request from S3 when its owner fails, given the request
+// sent to the owner.
+func (pc *peerCache) fallback(w http.ResponseWriter, out *http.Request, err error) {
+	if out.Context().Err() != nil {
+		return
+	}
+	f := out.Context().Value(peerFetchKey{}).(peerFetch)
+	pc.fallbacks.Add(1)
+	slog.Warn("cluster peer fetch failed", "peer", f.owner, "path", f.in.URL.Path, "err", err)
+	pc.origin.ServeHTTP(w, f.in)
+}
+
+// FetchHandler returns the handler of the /cluster/fetch endpoint, serving
+// the requests of peers for the paths this replica owns through its cache.
+func (pc *peerCache) FetchHandler() http.Handler {
+	owned := http.StripPrefix("/cluster/fetch", pc.owned)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !bearerAuthorized(w, r, "cluster", pc.token) {
+			return
+		}
+		pc.served.Add(1)
+		owned.ServeHTTP(w, r)
+	})
+}
+
+// Stats returns a snapshot of the peer cache counters suitable for expvar.
+func (pc *peerCache) Stats() any {
+	return map[string]any{
+		"peers":          len(pc.currentRing().Nodes()),
+		"owned_total":    pc.ownedRequests.Load(),
+		"fetched_total":  pc.fetched.Load(),
+		"fallback_total": pc.fallbacks.Load(),
+		"served_total":   pc.served.Load(),
+	}
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	cache "github.com/victorspringer/http-cache"
+	"github.com/victorspringer/http-cache/adapter/memory"
+)
+
+// testPeer is an in-process replica in peer cache mode, in front of a shared
+// S3 stand-in, also serving the admin API and the cluster purge endpoint.
+type testPeer struct {
+	server      *httptest.Server
+	main        *memory.Adapter
+	hot         *memory.Adapter
+	pc          *peerCache
+	invalidator *invalidator
+}
+
+// newTestPeerCluster starts replicas that are peers of each other, and returns
+// them along with the number of requests to S3 per path.
+func newTestPeerCluster(t *testing.T, n int) ([]*testPeer, map[string]*atomic.Int64) {
+	t.Helper()
+	s3Requests := map[string]*atomic.Int64{}
+	for i := range 10 {
+		s3Requests[fmt.Sprintf("/%d.txt", i)] = &atomic.Int64{}
+	}
+	origin := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if c := s3Requests[r.URL.Path]; c != nil {
+			c.Add(1)
+		}
+		_, _ = io.WriteString(w, r.URL.RequestURI())
+	})
+
+	nodes := make([]*testPeer, n)
+	var urls []string
+	for i := range nodes {
+		nodes[i] = &testPeer{server: httptest.NewUnstartedServer(nil)}
+		urls = append(urls, "http://"+nodes[i].server.Listener.Addr().String())
+	}
+	peers, err := newClusterPeers(urls, "")
+	require.NoError(t, err)
+	for i, node := range nodes {
+		node.main = newTestMemoryAdapter(t)
+		node.hot = newTestMemoryAdapter(t)
+		mainClient, err := cache.NewClient(cache.ClientWithAdapter(node.main), cache.ClientWithTTL(time.Minute))
+		require.NoError(t, err)
+		hotClient, err := cache.NewClient(cache.ClientWithAdapter(node.hot), cache.ClientWithTTL(time.Minute))
+		require.NoError(t, err)
+		node.pc, err = newPeerCache(urls[i], testClusterToken, peers, hotClient, mainClient.Middleware(origin), origin, time.Second)
+		require.NoError(t, err)
+		c := s3Cache{client: mainClient, adapter: node.main, hot: hotClient}
+		node.invalidator, err = newInvalidator(testClusterToken, peers, c, time.Second, 3, 10*time.Millisecond)
+		require.NoError(t, err)
+		admin, err := newAdminHandler(testAdminToken, c, 10, node.invalidator)
+		require.NoError(t, err)
+
+		mux := http.NewServeMux()
+		mux.Handle("GET /", node.pc)
+		mux.Handle("GET /cluster/fetch/", node.pc.FetchHandler())
+		mux.Handle("POST /cluster/purge", node.invalidator)
+		mux.Handle("GET /admin/cache/", admin)
+		mux.Handle("POST /admin/cache/", admin)
+		node.server.Config.Handler = mux
+		node.server.Start()
+		t.Cleanup(func() {
+			node.invalidator.Stop()
+			node.server.Close()
+		})
+	}
+	return nodes, s3Requests
+}
+
+func getBody(t *testing.T, target string) (int, string) {
+	t.Helper()
+	resp, err := http.Get(target)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	return resp.StatusCode, string(body)
+}
+
+func TestPeerCache(t *testing.T) {
+	t.Parallel()
+	nodes, s3Requests := newTestPeerCluster(t, 3)
+
+	for path := range s3Requests {
+		for _, node := range nodes {
+			status, body := getBody(t, node.server.URL+path+"?v=1")
+			require.Equal(t, http.StatusOK, status)
+			assert.Equal(t, path+"?v=1", body)
+		}
+	}
+
+	mainEntries, hotEntries := 0, 0
+	var owned, fetched, served int64
+	for _, node := range nodes {
+		mainEntries += node.main.Len()
+		hotEntries += node.hot.Len()
+		stats := node.pc.Stats().(map[string]any)
+		assert.Equal(t, 3, stats["peers"])
+		assert.Equal(t, int64(0), stats["fallback_total"])
+		owned += stats["owned_total"].(int64)
+		fetched += stats["fetched_total"].(int64)
+		served += stats["served_total"].(int64)
+	}
+	for path, n := range s3Requests {
+		assert.Equal(t, int64(1), n.Load(), "S3 requests for %s", path)
+	}
+	assert.Equal(t, len(s3Requests), mainEntries, "paths cached by their owner only")
+	assert.Equal(t, 2*len(s3Requests), hotEntries, "paths cached by the other replicas")
+	assert.Equal(t, int64(len(s3Requests)), owned)
+	assert.Equal(t, int64(2*len(s3Requests)), fetched)
+	assert.Equal(t, fetched, served)
+
+	for _, node := range nodes {
+		for path := range s3Requests {
+			getBody(t, node.server.URL+path+"?v=1")
+		}
+	}
+	for path, n := range s3Requests {
+		assert.Equal(t, int64(1), n.Load(), "S3 requests for %s once cached", path)
+	}
+}
+
+func TestPeerCache_Purge(t *testing.T) {
+	t.Parallel()
+	nodes, s3Requests := newTestPeerCluster(t, 3)
+	for path := range s3Requests {
+		for _, node := range nodes {
+			getBody(t, node.server.URL+path)
+		}
+	}
+	entries := func(adapter func(*testPeer) *memory.Adapter) int {
+		n := 0
+		for _, node := range nodes {
+			n += adapter(node).Len()
+		}
+		return n
+	}
+	hotEntries := func() int { return entries(func(p *testPeer) *memory.Adapter { return p.hot }) }
+	mainEntries := func() int { return entries(func(p *testPeer) *memory.Adapter { return p.main }) }
+	require.Equal(t, 2*len(s3Requests), hotEntries())
+
+	w, _ := adminRequest(t, nodes[0].server.Config.Handler, http.MethodPost, "/admin/cache/purge?path=/1.txt")
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Eventually(t, func() bool {
+		return hotEntries() == 2*(len(s3Requests)-1) && mainEntries() == len(s3Requests)-1
+	}, 5*time.Second, 10*time.Millisecond)
+	for _, node := range nodes {
+		if node.server.URL != nodes[0].pc.owner(httptest.NewRequest(http.MethodGet, "/1.txt", nil)) {
+			getBody(t, node.server.URL+"/1.txt")
+		}
+	}
+	assert.Equal(t, int64(2), s3Requests["/1.txt"].Load(), "S3 requests once purged from every cache")
+
+	w, _ = adminRequest(t, nodes[1].server.Config.Handler, http.MethodPost, "/admin/cache/purge?tag=release-1")
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Eventually(t, func() bool { return hotEntries() == 0 }, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestPeerCache_OwnerDown(t *testing.T) {
+	t.Parallel()
+	nodes, s3Requests := newTestPeerCluster(t, 2)
+	nodes[1].server.Close()
+
+	for path := range s3Requests {
+		status, body := getBody(t, nodes[0].server.URL+path)
+		require.Equal(t, http.StatusOK, status)
+		assert.Equal(t, path, body)
+	}
+	stats := nodes[0].pc.Stats().(map[string]any)
+	assert.Positive(t, stats["fallback_total"])
+	assert.Equal(t, int64(len(s3Requests)), stats["owned_total"].(int64)+stats["fallback_total"].(int64))
+	assert.Zero(t, stats["fetched_total"])
+}
+
+func TestPeerCache_FetchUnauthorized(t *testing.T) {
+	t.Parallel()
+	nodes, _ := newTestPeerCluster(t, 1)
+	status, _ := getBody(t, nodes[0].server.URL+"/cluster/fetch/0.txt")
+	assert.Equal(t, http.StatusUnauthorized, status)
+}
+
+func TestNewPeerCache_Errors(t *testing.T) {
+	t.Parallel()
+	peers, err := newClusterPeers([]string{"http://10.0.0.1:8080"}, "")
+	require.NoError(t, err)
+	hot, err := cache.NewClient(cache.ClientWithAdapter(newTestMemoryAdapter(t)), cache.ClientWithTTL(time.Minute))
+	require.NoError(t, err)
+	next := http.NotFoundHandler()
+	_, err = newPeerCache("10.0.0.1:8080", testClusterToken, peers, hot, next, next, time.Second)
+	require.Error(t, err)
+	_, err = newPeerCache("http://10.0.0.1:8080", "", peers, hot, next, next, time.Second)
+	require.Error(t, err)
+	_, err = newPeerCache("http://10.0.0.1:8080", testClusterToken, peers, hot, next, next, 0)
+	require.Error(t, err)
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"time"
+
+	cache "github.com/victorspringer/http-cache"
+)
+
+// cacheRule is the JSON representation of a cache.Rule in the rules file.
+type cacheRule struct {
+	Path         string   `json:"path"`
+	PathRegexp   string   `json:"path_regexp"`
+	ContentType  string   `json:"content_type"`
+	MinSize      int64    `json:"min_size"`
+	MaxSize      int64    `json:"max_size"`
+	TTL          string   `json:"ttl"`
+	NoCache      bool     `json:"no_cache"`
+	NoStore      bool     `json:"no_store"`
+	CacheControl string   `json:"cache_control"`
+	Tags         []string `json:"tags"`
+}
+
+// loadCacheRules reads the cache rules from a JSON file, if any, preceded by
+// the preset for content-hashed assets if enabled.
+func loadCacheRules(file string, hashedAssets bool) ([]cache.Rule, error) {
+	var rules []cache.Rule
+	if hashedAssets {
+		rules = append(rules, cache.HashedAssetsRule)
+	}
+	if file == "" {
+		return rules, nil
+	}
+
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("read cache rules: %w", err)
+	}
+	var raw []cacheRule
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, fmt.Errorf("parse cache rules: %w", err)
+	}
+	for i, r := range raw {
+		rule := cache.Rule{
+			Path:         r.Path,
+			ContentType:  r.ContentType,
+			MinSize:      r.MinSize,
+			MaxSize:      r.MaxSize,
+			NoCache:      r.NoCache,
+			NoStore:      r.NoStore,
+			CacheControl: r.CacheControl,
+			Tags:         r.Tags,
+		}
+		if r.PathRegexp != "" {
+			if rule.PathRegexp, err = regexp.Compile(r.PathRegexp); err != nil {
+				return nil, fmt.Errorf("parse cache rule %d path regexp: %w", i, err)
+			}
+		}
+		if r.TTL != "" {
+			if rule.TTL, err = time.ParseDuration(r.TTL); err != nil {
+				return nil, fmt.Errorf("parse cache rule %d ttl: %w", i, err)
+			}
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	cache "github.com/victorspringer/http-cache"
+)
+
+func TestLoadCacheRules(t *testing.T) {
+	writeRules := func(t *testing.T, content string) string {
+		t.Helper()
+		file := filepath.Join(t.TempDir(), "rules.json")
+		require.NoError(t, os.WriteFile(file, []byte(content), 0o600))
+		return file
+	}
+
+	t.Run("no rules", func(t *testing.T) {
+		t.Parallel()
+		rules, err := loadCacheRules("", false)
+		require.NoError(t, err)
+		assert.Empty(t, rules)
+	})
+
+	t.Run("rules file with hashed assets preset", func(t *testing.T) {
+		t.Parallel()
+		file := writeRules(t, `[
+			{"path": "/*.html", "no_cache": true},
+			{"path_regexp": "^/downloads/", "content_type": "application/zip", "min_size": 1048576, "no_store": true},
+			{"content_type": "image/", "max_size": 65536, "ttl": "1h", "cache_control": "public, max-age=3600", "tags": ["images"]}
+		]`)
+		rules, err := loadCacheRules(file, true)
+		require.NoError(t, err)
+		require.Len(t, rules, 4)
+
+		assert.Equal(t, cache.HashedAssetsRule.CacheControl, rules[0].CacheControl)
+		assert.Equal(t, "/*.html", rules[1].Path)
+		assert.True(t, rules[1].NoCache)
+		assert.True(t, rules[2].PathRegexp.MatchString("/downloads/a.zip"))
+		assert.Equal(t, "application/zip", rules[2].ContentType)
+		assert.Equal(t, int64(1048576), rules[2].MinSize)
+		assert.True(t, rules[2].NoStore)
+		assert.Equal(t, int64(65536), rules[3].MaxSize)
+		assert.Equal(t, time.Hour, rules[3].TTL)
+		assert.Equal(t, "public, max-age=3600", rules[3].CacheControl)
+		assert.Equal(t, []string{"images"}, rules[3].Tags)
+	})
+
+	t.Run("errors", func(t *testing.T) {
+		t.Parallel()
+		_, err := loadCacheRules(filepath.Join(t.TempDir(), "missing.json"), false)
+		require.Error(t, err)
+		_, err = loadCacheRules(writeRules(t, `{}`), false)
+		require.Error(t, err)
+		_, err = loadCacheRules(writeRules(t, `[{"path_regexp": "("}]`), false)
+		require.Error(t, err)
+		_, err = loadCacheRules(writeRules(t, `[{"ttl": "forever"}]`), false)
+		require.Error(t, err)
+	})
+}
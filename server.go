@@ -4,6 +4,7 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"io"
 	"log/slog"
 	"net"
 	"net/http"
@@ -57,4 +58,9 @@ func (s *Server) Stop() {
 	if err := s.Shutdown(ctx); err != nil {
 		slog.Error("http server shutdown error", "err", err)
 	}
+	if c, ok := s.Handler.(io.Closer); ok {
+		if err := c.Close(); err != nil {
+			slog.Error("http handler close error", "err", err)
+		}
+	}
 }
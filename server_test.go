@@ -39,6 +39,30 @@ func TestServer_Start_Stop(t *testing.T) {
 	server.Stop()
 }
 
+type closingHandler struct {
+	http.Handler
+	closed bool
+}
+
+func (h *closingHandler) Close() error {
+	h.closed = true
+	return nil
+}
+
+func TestServer_Stop_ClosesHandler(t *testing.T) {
+	t.Parallel()
+	cfg := Config{
+		ServerHost: "localhost",
+		ServerPort: 0,
+	}
+	handler := &closingHandler{Handler: http.NewServeMux()}
+	server := NewServer(cfg, handler)
+
+	require.NoError(t, server.Start())
+	server.Stop()
+	assert.True(t, handler.closed)
+}
+
 func TestServer_Start_AddressAlreadyInUse(t *testing.T) {
 	t.Parallel()
 	var lc net.ListenConfig
@@ -0,0 +1,162 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// AdapterV2 is the version of the Adapter interface taking a context, which
+// bounds how long an operation may take, and returning errors, so that a
+// failing backend is told apart from a cache miss. Adapters may implement
+// both interfaces. Adapters implementing only Adapter are used through
+// UpgradeAdapter.
+type AdapterV2 interface {
+	// GetContext retrieves the cached response by a given key. It also
+	// returns true or false, whether it exists or not, and an error if it
+	// could not be retrieved.
+	GetContext(ctx context.Context, key uint64) ([]byte, bool, error)
+
+	// SetContext caches a response for a given key until an expiration
+	// date.
+	SetContext(ctx context.Context, key uint64, response []byte, expiration time.Time) error
+
+	// ReleaseContext frees cache for a given key.
+	ReleaseContext(ctx context.Context, key uint64) error
+}
+
+// UpgradeAdapter returns a as an AdapterV2. Adapters implementing only Adapter
+// are wrapped, and their operations fail with the error of the context if it
+// is done before they start, but cannot be interrupted once started.
+func UpgradeAdapter(a Adapter) AdapterV2 {
+	switch a := a.(type) {
+	case nil:
+		return nil
+	case AdapterV2:
+		return a
+	default:
+		return adapterV1{a}
+	}
+}
+
+// adapterV1 is the AdapterV2 shim of an Adapter.
+type adapterV1 struct {
+	Adapter
+}
+
+func (a adapterV1) GetContext(ctx context.Context, key uint64) ([]byte, bool, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, false, err
+	}
+	b, ok := a.Get(key)
+	return b, ok, nil
+}
+
+func (a adapterV1) SetContext(ctx context.Context, key uint64, response []byte, expiration time.Time) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	a.Set(key, response, expiration)
+	return nil
+}
+
+func (a adapterV1) ReleaseContext(ctx context.Context, key uint64) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	a.Release(key)
+	return nil
+}
+
+// unwrapAdapter returns the adapter wrapped by UpgradeAdapter, if any, so that
+// the optional interfaces it implements are found.
+func unwrapAdapter(a AdapterV2) interface{} {
+	if a, ok := a.(adapterV1); ok {
+		return a.Adapter
+	}
+	return a
+}
+
+// adapterContext returns the context of an adapter operation made on behalf
+// of a request with a given context, limited to the adapter timeout, if set.
+func (c *Client) adapterContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if c.adapterTimeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, c.adapterTimeout)
+}
+
+// set caches a response in an adapter on behalf of a request with a given
+// context. Writes are not canceled along with the request.
+func (c *Client) set(ctx context.Context, a AdapterV2, key uint64, response []byte, expiration time.Time) {
+	ctx, cancel := c.adapterContext(context.WithoutCancel(ctx))
+	defer cancel()
+	c.adapterFailed(a.SetContext(ctx, key, response, expiration))
+}
+
+// releaseFrom frees the cached response for a given key from an adapter on
+// behalf of a request with a given context. Writes are not canceled along
+// with the request.
+func (c *Client) releaseFrom(ctx context.Context, a AdapterV2, key uint64) {
+	ctx, cancel := c.adapterContext(context.WithoutCancel(ctx))
+	defer cancel()
+	c.adapterFailed(a.ReleaseContext(ctx, key))
+}
+
+// adapterFailed records an error of an adapter operation, if any, after which
+// the request is served as if the response were not cached.
+func (c *Client) adapterFailed(err error) {
+	if err == nil {
+		return
+	}
+	c.adapterErrors.Add(1)
+	if c.adapterErrorHandler != nil {
+		c.adapterErrorHandler(err)
+	}
+}
+
+// AdapterErrors returns the number of adapter operations that have failed,
+// e.g. timed out.
+func (c *Client) AdapterErrors() int64 {
+	return c.adapterErrors.Load()
+}
+
+// ClientWithAdapterV2 sets the adapter type for the HTTP cache middleware
+// client, in place of ClientWithAdapter.
+func ClientWithAdapterV2(a AdapterV2) ClientOption {
+	return func(c *Client) error {
+		c.adapter = a
+		return nil
+	}
+}
+
+// ClientWithAdapterTimeout sets the time limit of each adapter operation,
+// beyond which a response is served as if it were not cached. Optional
+// setting. If not set, operations are only limited by the request context
+// and the adapter itself.
+func ClientWithAdapterTimeout(timeout time.Duration) ClientOption {
+	return func(c *Client) error {
+		if timeout <= 0 {
+			return fmt.Errorf("cache client adapter timeout %v is invalid", timeout)
+		}
+
+		c.adapterTimeout = timeout
+
+		return nil
+	}
+}
+
+// ClientWithAdapterErrorHandler sets a function called with the error of every
+// failed adapter operation, e.g. to log it. Optional setting.
+func ClientWithAdapterErrorHandler(f func(err error)) ClientOption {
+	return func(c *Client) error {
+		if f == nil {
+			return errors.New("cache client adapter error handler is not set")
+		}
+
+		c.adapterErrorHandler = f
+
+		return nil
+	}
+}
@@ -0,0 +1,406 @@
+package disk
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	cache "github.com/victorspringer/http-cache"
+)
+
+// tempPrefix is the prefix of the files responses are written to before
+// being renamed into place.
+const tempPrefix = "tmp-"
+
+// Adapter is the disk adapter data structure. Cached responses are stored as
+// files in a directory, named after their key and expiration, and evicted in
+// least recently used order once the capacity is reached. The index of the
+// files is kept in memory, and rebuilt by scanning the directory on startup,
+// in the order the files were written.
+//
+// Files are written to a temporary file first and renamed into place, so
+// that readers never see a partial one. They are not synced to disk, a file
+// torn by a crash is detected as corrupt by the client and dropped.
+type Adapter struct {
+	dir      string
+	capacity int64
+
+	mu    sync.Mutex
+	items map[uint64]*list.Element
+	lru   *list.List
+	size  int64
+
+	evicted  atomic.Int64
+	released atomic.Int64
+	failed   atomic.Int64
+}
+
+// item is a cached response file.
+type item struct {
+	key        uint64
+	expiration time.Time
+	size       int64
+}
+
+// AdapterOptions is used to set Adapter settings.
+type AdapterOptions func(a *Adapter) error
+
+// Stats are the counters of a disk adapter.
+type Stats struct {
+	// Items and Bytes are the number and the size of cached responses.
+	Items int64 `json:"items"`
+	Bytes int64 `json:"bytes"`
+
+	// Evicted is the number of cached responses evicted to stay within the
+	// capacity.
+	Evicted int64 `json:"evicted_total"`
+
+	// Released is the number of cached responses released by the client.
+	Released int64 `json:"released_total"`
+
+	// Failed is the number of file operations that have failed.
+	Failed int64 `json:"failed_total"`
+}
+
+// Get implements the cache Adapter interface Get method.
+func (a *Adapter) Get(key uint64) ([]byte, bool) {
+	name, ok := a.touch(key)
+	if !ok {
+		return nil, false
+	}
+	b, err := os.ReadFile(name)
+	if err != nil {
+		a.forget(key, name)
+		return nil, false
+	}
+	return b, true
+}
+
+// Open implements the cache StreamingAdapter interface Open method.
+func (a *Adapter) Open(key uint64) (cache.EntryReader, int64, bool) {
+	name, ok := a.touch(key)
+	if !ok {
+		return nil, 0, false
+	}
+	f, err := os.Open(name)
+	if err != nil {
+		a.forget(key, name)
+		return nil, 0, false
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, 0, false
+	}
+	return f, info.Size(), true
+}
+
+// Set implements the cache Adapter interface Set method.
+func (a *Adapter) Set(key uint64, response []byte, expiration time.Time) {
+	size := int64(len(response))
+	if size > a.capacity {
+		a.Release(key)
+		return
+	}
+
+	f, err := os.CreateTemp(a.dir, tempPrefix+"*")
+	if err != nil {
+		a.failed.Add(1)
+		return
+	}
+	_, err = f.Write(response)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	it := &item{key: key, expiration: expiration, size: size}
+	if err == nil {
+		err = os.Rename(f.Name(), a.path(it))
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		a.failed.Add(1)
+		return
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if e, ok := a.items[key]; ok {
+		a.remove(e, it)
+	}
+	e := a.lru.PushFront(it)
+	a.items[key] = e
+	a.size += size
+	a.shrink(e)
+}
+
+// Release implements the cache Adapter interface Release method.
+func (a *Adapter) Release(key uint64) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if e, ok := a.items[key]; ok {
+		a.remove(e, nil)
+		a.released.Add(1)
+	}
+}
+
+// Range implements the cache EnumeratingAdapter interface Range method.
+// Expired responses are skipped, and the order of eviction is left as is.
+func (a *Adapter) Range(ctx context.Context, f func(key uint64, entry cache.EntryReader, size int64) bool) error {
+	now := time.Now()
+	a.mu.Lock()
+	items := make([]item, 0, len(a.items))
+	for _, e := range a.items {
+		if it := e.Value.(*item); it.expiration.IsZero() || it.expiration.After(now) {
+			items = append(items, *it)
+		}
+	}
+	a.mu.Unlock()
+
+	for i := range items {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		file, err := os.Open(a.path(&items[i]))
+		if err != nil {
+			// Released or replaced meanwhile.
+			continue
+		}
+		more := f(items[i].key, file, items[i].size)
+		file.Close()
+		if !more {
+			return nil
+		}
+	}
+	return nil
+}
+
+// Len returns the number of cached responses.
+func (a *Adapter) Len() int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return len(a.items)
+}
+
+// Stats returns a snapshot of the adapter counters.
+func (a *Adapter) Stats() Stats {
+	a.mu.Lock()
+	items, size := len(a.items), a.size
+	a.mu.Unlock()
+	return Stats{
+		Items:    int64(items),
+		Bytes:    size,
+		Evicted:  a.evicted.Load(),
+		Released: a.released.Load(),
+		Failed:   a.failed.Load(),
+	}
+}
+
+// touch marks the cached response for a given key as the most recently used,
+// and returns the name of its file.
+func (a *Adapter) touch(key uint64) (string, bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	e, ok := a.items[key]
+	if !ok {
+		return "", false
+	}
+	a.lru.MoveToFront(e)
+	return a.path(e.Value.(*item)), true
+}
+
+// forget removes the item for a given key from the index if its file, with a
+// given name, cannot be read, e.g. because it has been replaced concurrently
+// with its eviction.
+func (a *Adapter) forget(key uint64, name string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if e, ok := a.items[key]; ok && a.path(e.Value.(*item)) == name {
+		a.remove(e, nil)
+		a.failed.Add(1)
+	}
+}
+
+// remove removes an item from the index and its file, unless it has just
+// been replaced by another one with the same name.
+func (a *Adapter) remove(e *list.Element, replacement *item) {
+	it := e.Value.(*item)
+	a.lru.Remove(e)
+	delete(a.items, it.key)
+	a.size -= it.size
+	if replacement == nil || a.path(it) != a.path(replacement) {
+		if err := os.Remove(a.path(it)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			a.failed.Add(1)
+		}
+	}
+}
+
+// shrink evicts the least recently used responses but a given one, if any,
+// until the adapter is back within its capacity.
+func (a *Adapter) shrink(keep *list.Element) {
+	for e := a.lru.Back(); e != nil && a.size > a.capacity; {
+		prev := e.Prev()
+		if e != keep {
+			a.remove(e, nil)
+			a.evicted.Add(1)
+		}
+		e = prev
+	}
+}
+
+// path returns the name of the file of an item, in one of 256 directories
+// by the first byte of its key.
+func (a *Adapter) path(it *item) string {
+	var exp int64
+	if !it.expiration.IsZero() {
+		exp = it.expiration.UnixNano()
+	}
+	return filepath.Join(a.dir, fmt.Sprintf("%02x", it.key>>56), fmt.Sprintf("%016x-%x", it.key, exp))
+}
+
+// parseName parses the name of a response file into its key and expiration.
+func parseName(name string) (uint64, time.Time, bool) {
+	k, e, ok := strings.Cut(name, "-")
+	if !ok || len(k) != 16 {
+		return 0, time.Time{}, false
+	}
+	key, err := strconv.ParseUint(k, 16, 64)
+	if err != nil {
+		return 0, time.Time{}, false
+	}
+	exp, err := strconv.ParseInt(e, 16, 64)
+	if err != nil {
+		return 0, time.Time{}, false
+	}
+	if exp == 0 {
+		return key, time.Time{}, true
+	}
+	return key, time.Unix(0, exp), true
+}
+
+// load rebuilds the index from the files in the directory, removing the
+// temporary files left by an interrupted write, the expired responses and
+// all but the last written file of a response.
+func (a *Adapter) load() error {
+	temps, err := filepath.Glob(filepath.Join(a.dir, tempPrefix+"*"))
+	if err != nil {
+		return err
+	}
+	for _, name := range temps {
+		os.Remove(name)
+	}
+
+	type file struct {
+		item
+		modTime time.Time
+	}
+	var files []file
+	now := time.Now()
+	for i := 0; i < 256; i++ {
+		dir := filepath.Join(a.dir, fmt.Sprintf("%02x", i))
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return err
+		}
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			key, expiration, ok := parseName(entry.Name())
+			if !ok || !entry.Type().IsRegular() {
+				continue
+			}
+			name := filepath.Join(dir, entry.Name())
+			info, err := entry.Info()
+			if err != nil {
+				continue
+			}
+			if !expiration.IsZero() && expiration.Before(now) {
+				os.Remove(name)
+				continue
+			}
+			files = append(files, file{item{key, expiration, info.Size()}, info.ModTime()})
+		}
+	}
+
+	// Oldest first, so that the last one pushed to the front is the most
+	// recently written.
+	sort.Slice(files, func(i, j int) bool { return files[i].modTime.Before(files[j].modTime) })
+	for i := range files {
+		f := &files[i]
+		if e, ok := a.items[f.key]; ok {
+			a.remove(e, nil)
+		}
+		it := f.item
+		a.items[f.key] = a.lru.PushFront(&it)
+		a.size += f.size
+	}
+	a.shrink(nil)
+	return nil
+}
+
+// NewAdapter initializes disk adapter, loading the responses cached in its
+// directory.
+func NewAdapter(opts ...AdapterOptions) (cache.Adapter, error) {
+	a := &Adapter{
+		items: make(map[uint64]*list.Element),
+		lru:   list.New(),
+	}
+
+	for _, opt := range opts {
+		if err := opt(a); err != nil {
+			return nil, err
+		}
+	}
+
+	if a.dir == "" {
+		return nil, errors.New("disk adapter directory is not set")
+	}
+	if a.capacity == 0 {
+		return nil, errors.New("disk adapter capacity is not set")
+	}
+
+	if err := a.load(); err != nil {
+		return nil, fmt.Errorf("disk adapter failed to load %s: %w", a.dir, err)
+	}
+
+	return a, nil
+}
+
+// AdapterWithDirectory sets the directory the responses are cached in, which
+// is created if it does not exist. It should not be used for anything else.
+func AdapterWithDirectory(dir string) AdapterOptions {
+	return func(a *Adapter) error {
+		if dir == "" {
+			return errors.New("disk adapter requires a directory")
+		}
+
+		a.dir = dir
+
+		return nil
+	}
+}
+
+// AdapterWithCapacity sets the maximum number of cached bytes.
+func AdapterWithCapacity(cap int64) AdapterOptions {
+	return func(a *Adapter) error {
+		if cap <= 0 {
+			return errors.New("disk adapter requires a capacity greater than 0")
+		}
+
+		a.capacity = cap
+
+		return nil
+	}
+}
@@ -0,0 +1,364 @@
+package disk
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	cache "github.com/victorspringer/http-cache"
+)
+
+func newTestAdapter(t *testing.T, dir string, capacity int64) *Adapter {
+	t.Helper()
+	a, err := NewAdapter(AdapterWithDirectory(dir), AdapterWithCapacity(capacity))
+	if err != nil {
+		t.Fatalf("NewAdapter() error = %v", err)
+	}
+	return a.(*Adapter)
+}
+
+func response(value string, expiration time.Time) []byte {
+	return cache.Response{Value: []byte(value), Expiration: expiration}.Bytes()
+}
+
+func TestGet(t *testing.T) {
+	a := newTestAdapter(t, t.TempDir(), 1<<20)
+	a.Set(14974843192121052621, response("value 1", time.Now().Add(time.Minute)), time.Now().Add(time.Minute))
+
+	tests := []struct {
+		name string
+		key  uint64
+		want []byte
+		ok   bool
+	}{
+		{
+			"returns right response",
+			14974843192121052621,
+			[]byte("value 1"),
+			true,
+		},
+		{
+			"not found",
+			123,
+			nil,
+			false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b, ok := a.Get(tt.key)
+			if ok != tt.ok {
+				t.Errorf("disk.Get() ok = %v, tt.ok %v", ok, tt.ok)
+				return
+			}
+			got := cache.BytesToResponse(b).Value
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("disk.Get() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSet(t *testing.T) {
+	dir := t.TempDir()
+	a := newTestAdapter(t, dir, 1<<20)
+
+	tests := []struct {
+		name       string
+		key        uint64
+		value      string
+		expiration time.Time
+	}{
+		{
+			"sets a response cache",
+			1,
+			"value 1",
+			time.Now().Add(time.Minute),
+		},
+		{
+			"sets a response cache without expiration",
+			2,
+			"value 2",
+			time.Time{},
+		},
+		{
+			"replaces a response cache with another expiration",
+			1,
+			"value 3",
+			time.Now().Add(time.Hour),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a.Set(tt.key, response(tt.value, tt.expiration), tt.expiration)
+			b, ok := a.Get(tt.key)
+			if !ok {
+				t.Fatalf("disk.Get() ok = false after Set")
+			}
+			if got := string(cache.BytesToResponse(b).Value); got != tt.value {
+				t.Errorf("disk.Get() = %v, want %v", got, tt.value)
+			}
+		})
+	}
+
+	names, err := filepath.Glob(filepath.Join(dir, "*", "*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(names) != 2 {
+		t.Errorf("files = %v, want 2", names)
+	}
+}
+
+func TestRelease(t *testing.T) {
+	dir := t.TempDir()
+	a := newTestAdapter(t, dir, 1<<20)
+	a.Set(1, response("value 1", time.Time{}), time.Time{})
+
+	tests := []struct {
+		name string
+		key  uint64
+	}{
+		{
+			"removes cached response",
+			1,
+		},
+		{
+			"key does not exist",
+			2,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a.Release(tt.key)
+			if _, ok := a.Get(tt.key); ok {
+				t.Errorf("disk.Release() error; key %v should not be found", tt.key)
+			}
+		})
+	}
+
+	names, _ := filepath.Glob(filepath.Join(dir, "*", "*"))
+	if len(names) != 0 {
+		t.Errorf("files = %v, want none", names)
+	}
+	if s := a.Stats(); s.Released != 1 || s.Items != 0 || s.Bytes != 0 {
+		t.Errorf("disk.Stats() = %+v", s)
+	}
+}
+
+func TestEvict(t *testing.T) {
+	size := int64(len(response("value 1", time.Time{})))
+	a := newTestAdapter(t, t.TempDir(), 3*size)
+	for key := uint64(1); key <= 3; key++ {
+		a.Set(key, response("value 1", time.Time{}), time.Time{})
+	}
+	a.Get(1)
+	a.Set(4, response("value 1", time.Time{}), time.Time{})
+	a.Set(5, response(string(make([]byte, 4*size)), time.Time{}), time.Time{})
+
+	tests := []struct {
+		name string
+		key  uint64
+		ok   bool
+	}{
+		{"keeps recently used response", 1, true},
+		{"evicts least recently used response", 2, false},
+		{"keeps response", 3, true},
+		{"keeps last set response", 4, true},
+		{"does not set response larger than capacity", 5, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, ok := a.Get(tt.key); ok != tt.ok {
+				t.Errorf("disk.Get(%v) ok = %v, want %v", tt.key, ok, tt.ok)
+			}
+		})
+	}
+
+	if s := a.Stats(); s.Evicted != 1 || s.Bytes != 3*size {
+		t.Errorf("disk.Stats() = %+v", s)
+	}
+}
+
+func TestOpen(t *testing.T) {
+	a := newTestAdapter(t, t.TempDir(), 1<<20)
+	b := response("value 1", time.Time{})
+	a.Set(1, b, time.Time{})
+
+	f, size, ok := a.Open(1)
+	if !ok {
+		t.Fatal("disk.Open() ok = false")
+	}
+	defer f.Close()
+	if size != int64(len(b)) {
+		t.Errorf("disk.Open() size = %v, want %v", size, len(b))
+	}
+	got, err := io.ReadAll(io.NewSectionReader(f, 0, size))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, b) {
+		t.Errorf("disk.Open() = %v, want %v", got, b)
+	}
+
+	if _, _, ok := a.Open(2); ok {
+		t.Error("disk.Open() ok = true for missing key")
+	}
+}
+
+func TestRange(t *testing.T) {
+	a := newTestAdapter(t, t.TempDir(), 1<<20)
+	a.Set(1, response("value 1", time.Time{}), time.Time{})
+	a.Set(2, response("value 2", time.Now().Add(time.Minute)), time.Now().Add(time.Minute))
+	a.Set(3, response("value 3", time.Now().Add(-time.Minute)), time.Now().Add(-time.Minute))
+
+	got := map[uint64]string{}
+	err := a.Range(context.Background(), func(key uint64, entry cache.EntryReader, size int64) bool {
+		b, err := io.ReadAll(io.NewSectionReader(entry, 0, size))
+		if err != nil {
+			t.Errorf("disk.Range() entry read error = %v", err)
+		}
+		got[key] = string(cache.BytesToResponse(b).Value)
+		return true
+	})
+	if err != nil {
+		t.Fatalf("disk.Range() error = %v", err)
+	}
+	if want := map[uint64]string{1: "value 1", 2: "value 2"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("disk.Range() = %v, want %v", got, want)
+	}
+
+	n := 0
+	a.Range(context.Background(), func(uint64, cache.EntryReader, int64) bool {
+		n++
+		return false
+	})
+	if n != 1 {
+		t.Errorf("disk.Range() listed %v responses after f returned false, want 1", n)
+	}
+}
+
+func TestLoad(t *testing.T) {
+	dir := t.TempDir()
+	a := newTestAdapter(t, dir, 1<<20)
+	a.Set(1, response("value 1", time.Time{}), time.Time{})
+	a.Set(2, response("value 2", time.Now().Add(time.Hour)), time.Now().Add(time.Hour))
+	a.Set(3, response("value 3", time.Now().Add(time.Hour)), time.Now().Add(time.Hour))
+	for i, key := range []uint64{1, 2, 3} {
+		written := time.Now().Add(time.Duration(i-3) * time.Second)
+		if err := os.Chtimes(a.path(a.items[key].Value.(*item)), written, written); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// An interrupted write, an expired response and an older file of the
+	// response for key 1, left by a crash.
+	if err := os.WriteFile(filepath.Join(dir, tempPrefix+"1"), []byte("partial"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	expired := &item{key: 4, expiration: time.Now().Add(-time.Hour)}
+	if err := os.WriteFile(a.path(expired), response("value 4", expired.expiration), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	stale := &item{key: 1, expiration: time.Now().Add(time.Minute)}
+	if err := os.WriteFile(a.path(stale), response("stale", stale.expiration), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	past := time.Now().Add(-time.Minute)
+	if err := os.Chtimes(a.path(stale), past, past); err != nil {
+		t.Fatal(err)
+	}
+
+	size := int64(len(response("value 1", time.Time{})))
+	b := newTestAdapter(t, dir, 2*size)
+
+	tests := []struct {
+		name string
+		key  uint64
+		want string
+		ok   bool
+	}{
+		{"evicts least recently written response", 1, "", false},
+		{"loads response", 2, "value 2", true},
+		{"loads last written response", 3, "value 3", true},
+		{"removes expired response", 4, "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, ok := b.Get(tt.key)
+			if ok != tt.ok {
+				t.Fatalf("disk.Get(%v) ok = %v, want %v", tt.key, ok, tt.ok)
+			}
+			if got := string(cache.BytesToResponse(r).Value); ok && got != tt.want {
+				t.Errorf("disk.Get(%v) = %v, want %v", tt.key, got, tt.want)
+			}
+		})
+	}
+
+	names, _ := filepath.Glob(filepath.Join(dir, "*", "*"))
+	if len(names) != 2 {
+		t.Errorf("files = %v, want 2", names)
+	}
+	if temps, _ := filepath.Glob(filepath.Join(dir, tempPrefix+"*")); len(temps) != 0 {
+		t.Errorf("temporary files = %v, want none", temps)
+	}
+}
+
+func TestNewAdapter(t *testing.T) {
+	tests := []struct {
+		name    string
+		opts    []AdapterOptions
+		wantErr bool
+	}{
+		{
+			"returns new Adapter",
+			[]AdapterOptions{
+				AdapterWithDirectory(filepath.Join(t.TempDir(), "cache")),
+				AdapterWithCapacity(1 << 20),
+			},
+			false,
+		},
+		{
+			"returns error",
+			[]AdapterOptions{
+				AdapterWithCapacity(1 << 20),
+			},
+			true,
+		},
+		{
+			"returns error",
+			[]AdapterOptions{
+				AdapterWithDirectory(t.TempDir()),
+			},
+			true,
+		},
+		{
+			"returns error",
+			[]AdapterOptions{
+				AdapterWithDirectory(""),
+				AdapterWithCapacity(1 << 20),
+			},
+			true,
+		},
+		{
+			"returns error",
+			[]AdapterOptions{
+				AdapterWithDirectory(t.TempDir()),
+				AdapterWithCapacity(0),
+			},
+			true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewAdapter(tt.opts...)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("NewAdapter() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
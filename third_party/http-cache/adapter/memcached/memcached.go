@@ -0,0 +1,324 @@
+package memcached
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/rand"
+	"sync/atomic"
+	"time"
+
+	"github.com/bradfitz/gomemcache/memcache"
+	cache "github.com/victorspringer/http-cache"
+)
+
+const (
+	// defaultMaxItemSize is the largest item memcached stores, unless
+	// started with another -I setting.
+	defaultMaxItemSize = 1 << 20
+
+	// itemOverhead is the part of the largest item kept for its key and
+	// memcached's own header.
+	itemOverhead = 1 << 10
+
+	// maxRelativeExpiration is the longest expiration memcached accepts in
+	// seconds from now, beyond which it takes a Unix time instead.
+	maxRelativeExpiration = 30 * 24 * time.Hour
+
+	// defaultTimeout is the time limit of a memcached command, unless set
+	// otherwise.
+	defaultTimeout = time.Second
+)
+
+// Adapter is the memcached adapter data structure. Cached responses are
+// spread over the servers by consistent hashing, under their key and a
+// prefix, and expire in memcached along with them. Responses larger than the
+// largest item memcached stores are split into chunks, each its own item.
+//
+// A chunked response is stored as a head item, holding the first chunk and
+// flagged with the number of chunks, and items holding the others, under keys
+// derived from the head key and a generation drawn at random for each Set,
+// so that chunks of different versions are never mixed. The head is set last
+// and is the only item released, chunks no longer referenced are left for
+// memcached to evict or expire.
+//
+// It implements cache.AdapterV2. As the memcached client does not take a
+// context, commands are limited by the adapter timeout, and the context is
+// only checked before each of them.
+type Adapter struct {
+	client    *memcache.Client
+	selector  memcache.ServerSelector
+	prefix    string
+	chunkSize int
+
+	timeout      time.Duration
+	maxIdleConns int
+
+	failed     atomic.Int64
+	incomplete atomic.Int64
+}
+
+// AdapterOptions is used to set Adapter settings.
+type AdapterOptions func(a *Adapter) error
+
+// Stats are the counters of a memcached adapter.
+type Stats struct {
+	// Failed is the number of memcached commands that have failed, e.g.
+	// timed out, other than for a missing response.
+	Failed int64 `json:"failed_total"`
+
+	// Incomplete is the number of chunked responses missing chunks, e.g.
+	// evicted by memcached, which are treated as not cached.
+	Incomplete int64 `json:"incomplete_total"`
+}
+
+// Get implements the cache Adapter interface Get method.
+func (a *Adapter) Get(key uint64) ([]byte, bool) {
+	b, ok, _ := a.GetContext(context.Background(), key)
+	return b, ok
+}
+
+// GetContext implements the cache AdapterV2 interface GetContext method.
+func (a *Adapter) GetContext(ctx context.Context, key uint64) ([]byte, bool, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, false, err
+	}
+	head, err := a.client.Get(a.key(key))
+	if err != nil {
+		return nil, false, a.fail(err)
+	}
+	if head.Flags <= 1 {
+		return head.Value, true, nil
+	}
+
+	if len(head.Value) < 8 {
+		a.incomplete.Add(1)
+		return nil, false, nil
+	}
+	gen := binary.BigEndian.Uint64(head.Value)
+	keys := make([]string, head.Flags-1)
+	for i := range keys {
+		keys[i] = a.chunkKey(key, gen, i+1)
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, false, err
+	}
+	chunks, err := a.client.GetMulti(keys)
+	if err != nil {
+		return nil, false, a.fail(err)
+	}
+	b := append([]byte(nil), head.Value[8:]...)
+	for _, k := range keys {
+		chunk, ok := chunks[k]
+		if !ok {
+			a.incomplete.Add(1)
+			return nil, false, nil
+		}
+		b = append(b, chunk.Value...)
+	}
+	return b, true, nil
+}
+
+// Set implements the cache Adapter interface Set method. Responses expire in
+// memcached at their expiration, if any.
+func (a *Adapter) Set(key uint64, response []byte, expiration time.Time) {
+	a.SetContext(context.Background(), key, response, expiration)
+}
+
+// SetContext implements the cache AdapterV2 interface SetContext method.
+// Responses expire in memcached at their expiration, if any.
+func (a *Adapter) SetContext(ctx context.Context, key uint64, response []byte, expiration time.Time) error {
+	exp, ok := expirationOf(expiration, time.Now())
+	if !ok {
+		return a.ReleaseContext(ctx, key)
+	}
+
+	if len(response) <= a.chunkSize {
+		return a.set(ctx, &memcache.Item{Key: a.key(key), Value: response, Expiration: exp})
+	}
+
+	n := (len(response) + a.chunkSize - 1) / a.chunkSize
+	gen := rand.Uint64()
+	for i := n - 1; i >= 1; i-- {
+		end := (i + 1) * a.chunkSize
+		if end > len(response) {
+			end = len(response)
+		}
+		chunk := &memcache.Item{Key: a.chunkKey(key, gen, i), Value: response[i*a.chunkSize : end], Expiration: exp}
+		if err := a.set(ctx, chunk); err != nil {
+			return err
+		}
+	}
+	head := make([]byte, 8, 8+a.chunkSize)
+	binary.BigEndian.PutUint64(head, gen)
+	head = append(head, response[:a.chunkSize]...)
+	return a.set(ctx, &memcache.Item{Key: a.key(key), Value: head, Flags: uint32(n), Expiration: exp})
+}
+
+// Release implements the cache Adapter interface Release method.
+func (a *Adapter) Release(key uint64) {
+	a.ReleaseContext(context.Background(), key)
+}
+
+// ReleaseContext implements the cache AdapterV2 interface ReleaseContext
+// method.
+func (a *Adapter) ReleaseContext(ctx context.Context, key uint64) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return a.fail(a.client.Delete(a.key(key)))
+}
+
+// Stats returns a snapshot of the adapter counters.
+func (a *Adapter) Stats() Stats {
+	return Stats{
+		Failed:     a.failed.Load(),
+		Incomplete: a.incomplete.Load(),
+	}
+}
+
+// Close closes the idle connections of the adapter.
+func (a *Adapter) Close() error {
+	return a.client.Close()
+}
+
+func (a *Adapter) set(ctx context.Context, item *memcache.Item) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return a.fail(a.client.Set(item))
+}
+
+// fail counts an error of a memcached command, and returns it unless it is
+// for a missing response.
+func (a *Adapter) fail(err error) error {
+	if err == nil || errors.Is(err, memcache.ErrCacheMiss) {
+		return nil
+	}
+	a.failed.Add(1)
+	return err
+}
+
+func (a *Adapter) key(key uint64) string {
+	return a.prefix + cache.KeyAsString(key)
+}
+
+func (a *Adapter) chunkKey(key uint64, gen uint64, i int) string {
+	return fmt.Sprintf("%s.%016x.%d", a.key(key), gen, i)
+}
+
+// expirationOf returns the memcached expiration of a response expiring at a
+// given time, 0 if it does not, or false if it has already expired.
+func expirationOf(expiration, now time.Time) (int32, bool) {
+	if expiration.IsZero() {
+		return 0, true
+	}
+	ttl := expiration.Sub(now)
+	switch {
+	case ttl <= 0:
+		return 0, false
+	case ttl <= maxRelativeExpiration:
+		return int32((ttl + time.Second - 1) / time.Second), true
+	default:
+		return int32(expiration.Unix()), true
+	}
+}
+
+// NewAdapter initializes memcached adapter.
+func NewAdapter(opts ...AdapterOptions) (cache.Adapter, error) {
+	a := &Adapter{
+		chunkSize: defaultMaxItemSize - itemOverhead,
+		timeout:   defaultTimeout,
+	}
+
+	for _, opt := range opts {
+		if err := opt(a); err != nil {
+			return nil, err
+		}
+	}
+
+	if a.selector == nil {
+		return nil, errors.New("memcached adapter servers are not set")
+	}
+
+	a.client = memcache.NewFromSelector(a.selector)
+	a.client.Timeout = a.timeout
+	a.client.MaxIdleConns = a.maxIdleConns
+
+	return a, nil
+}
+
+// AdapterWithServers sets the addresses of the memcached servers, as
+// host:port or the path of a Unix socket, which the responses are spread
+// over by consistent hashing.
+func AdapterWithServers(servers ...string) AdapterOptions {
+	return func(a *Adapter) error {
+		if len(servers) == 0 {
+			return errors.New("memcached adapter requires at least one server")
+		}
+
+		r, err := newRing(servers...)
+		if err != nil {
+			return fmt.Errorf("memcached adapter servers are invalid: %w", err)
+		}
+		a.selector = r
+
+		return nil
+	}
+}
+
+// AdapterWithKeyPrefix sets the prefix of the memcached keys of the cached
+// responses, e.g. to share servers with other applications. Optional
+// setting.
+func AdapterWithKeyPrefix(prefix string) AdapterOptions {
+	return func(a *Adapter) error {
+		a.prefix = prefix
+
+		return nil
+	}
+}
+
+// AdapterWithMaxItemSize sets the largest item the servers store, as set by
+// their -I setting, above which responses are chunked. Optional setting. If
+// not set, it is 1 MiB, memcached's default.
+func AdapterWithMaxItemSize(size int) AdapterOptions {
+	return func(a *Adapter) error {
+		if size <= 2*itemOverhead {
+			return fmt.Errorf("memcached adapter requires a maximum item size greater than %v", 2*itemOverhead)
+		}
+
+		a.chunkSize = size - itemOverhead
+
+		return nil
+	}
+}
+
+// AdapterWithTimeout sets the time limit of a memcached command, beyond
+// which responses are treated as not cached. Optional setting. If not set,
+// it is 1 second.
+func AdapterWithTimeout(timeout time.Duration) AdapterOptions {
+	return func(a *Adapter) error {
+		if timeout <= 0 {
+			return errors.New("memcached adapter requires a timeout greater than 0")
+		}
+
+		a.timeout = timeout
+
+		return nil
+	}
+}
+
+// AdapterWithMaxIdleConns sets the maximum number of idle connections kept
+// open per server. Optional setting. If not set, it is 2.
+func AdapterWithMaxIdleConns(n int) AdapterOptions {
+	return func(a *Adapter) error {
+		if n <= 0 {
+			return errors.New("memcached adapter requires a maximum number of idle connections greater than 0")
+		}
+
+		a.maxIdleConns = n
+
+		return nil
+	}
+}
@@ -0,0 +1,472 @@
+package memcached
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	cache "github.com/victorspringer/http-cache"
+)
+
+// fakeServer is a memcached stand-in speaking the subset of the text protocol
+// used by the adapter, and rejecting items larger than maxItemSize.
+type fakeServer struct {
+	ln          net.Listener
+	maxItemSize int
+
+	mu    sync.Mutex
+	items map[string]fakeItem
+}
+
+type fakeItem struct {
+	flags   uint32
+	exptime int32
+	value   []byte
+}
+
+func newFakeServer(t *testing.T, maxItemSize int) *fakeServer {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &fakeServer{ln: ln, maxItemSize: maxItemSize, items: make(map[string]fakeItem)}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *fakeServer) addr() string {
+	return s.ln.Addr().String()
+}
+
+func (s *fakeServer) item(key string) (fakeItem, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	it, ok := s.items[key]
+	return it, ok
+}
+
+func (s *fakeServer) len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.items)
+}
+
+func (s *fakeServer) remove(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.items, key)
+}
+
+func (s *fakeServer) serve(conn net.Conn) {
+	defer conn.Close()
+	rw := bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn))
+	for {
+		line, err := rw.ReadString('\n')
+		if err != nil {
+			return
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			return
+		}
+		s.mu.Lock()
+		switch fields[0] {
+		case "get", "gets":
+			for _, key := range fields[1:] {
+				if it, ok := s.items[key]; ok {
+					fmt.Fprintf(rw, "VALUE %s %d %d 1\r\n%s\r\n", key, it.flags, len(it.value), it.value)
+				}
+			}
+			rw.WriteString("END\r\n")
+		case "set":
+			flags, _ := strconv.ParseUint(fields[2], 10, 32)
+			exptime, _ := strconv.ParseInt(fields[3], 10, 32)
+			size, _ := strconv.Atoi(fields[4])
+			value := make([]byte, size+2)
+			if _, err := io.ReadFull(rw, value); err != nil {
+				s.mu.Unlock()
+				return
+			}
+			if len(fields[1])+size > s.maxItemSize {
+				rw.WriteString("SERVER_ERROR object too large for cache\r\n")
+				break
+			}
+			s.items[fields[1]] = fakeItem{uint32(flags), int32(exptime), value[:size]}
+			rw.WriteString("STORED\r\n")
+		case "delete":
+			if _, ok := s.items[fields[1]]; ok {
+				delete(s.items, fields[1])
+				rw.WriteString("DELETED\r\n")
+			} else {
+				rw.WriteString("NOT_FOUND\r\n")
+			}
+		default:
+			rw.WriteString("ERROR\r\n")
+		}
+		s.mu.Unlock()
+		if err := rw.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+func newTestAdapter(t *testing.T, opts ...AdapterOptions) *Adapter {
+	t.Helper()
+	a, err := NewAdapter(opts...)
+	if err != nil {
+		t.Fatalf("NewAdapter() error = %v", err)
+	}
+	t.Cleanup(func() { a.(*Adapter).Close() })
+	return a.(*Adapter)
+}
+
+func TestGet(t *testing.T) {
+	s := newFakeServer(t, defaultMaxItemSize)
+	a := newTestAdapter(t, AdapterWithServers(s.addr()))
+	a.Set(1, cache.Response{Value: []byte("value 1")}.Bytes(), time.Now().Add(1*time.Minute))
+	a.Set(2, cache.Response{Value: []byte("value 2")}.Bytes(), time.Time{})
+
+	tests := []struct {
+		name string
+		key  uint64
+		want []byte
+		ok   bool
+	}{
+		{
+			"returns right response",
+			1,
+			[]byte("value 1"),
+			true,
+		},
+		{
+			"returns right response",
+			2,
+			[]byte("value 2"),
+			true,
+		},
+		{
+			"key does not exist",
+			3,
+			nil,
+			false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b, ok := a.Get(tt.key)
+			if ok != tt.ok {
+				t.Errorf("memcached.Get() ok = %v, tt.ok %v", ok, tt.ok)
+				return
+			}
+			got := cache.BytesToResponse(b).Value
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("memcached.Get() = %v, want %v", string(got), string(tt.want))
+			}
+		})
+	}
+	if s := a.Stats(); s != (Stats{}) {
+		t.Errorf("memcached.Stats() = %+v, want none", s)
+	}
+}
+
+func TestSet(t *testing.T) {
+	s := newFakeServer(t, defaultMaxItemSize)
+	a := newTestAdapter(t, AdapterWithServers(s.addr()), AdapterWithKeyPrefix("cache:"))
+	now := time.Now()
+
+	tests := []struct {
+		name        string
+		key         uint64
+		expiration  time.Time
+		wantExptime int32
+		wantStored  bool
+	}{
+		{
+			"sets a response cache without expiration",
+			1,
+			time.Time{},
+			0,
+			true,
+		},
+		{
+			"sets a response cache with a relative expiration",
+			2,
+			now.Add(90 * time.Second),
+			90,
+			true,
+		},
+		{
+			"sets a response cache with an absolute expiration",
+			3,
+			now.Add(60 * 24 * time.Hour),
+			int32(now.Add(60 * 24 * time.Hour).Unix()),
+			true,
+		},
+		{
+			"does not set an expired response cache",
+			4,
+			now.Add(-1 * time.Minute),
+			0,
+			false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a.Set(tt.key, []byte("value"), tt.expiration)
+			it, ok := s.item("cache:" + cache.KeyAsString(tt.key))
+			if ok != tt.wantStored {
+				t.Fatalf("memcached.Set() stored = %v, want %v", ok, tt.wantStored)
+			}
+			if it.exptime != tt.wantExptime {
+				t.Errorf("memcached.Set() exptime = %v, want %v", it.exptime, tt.wantExptime)
+			}
+		})
+	}
+}
+
+func TestChunking(t *testing.T) {
+	s := newFakeServer(t, 4096)
+	a := newTestAdapter(t, AdapterWithServers(s.addr()), AdapterWithMaxItemSize(4096))
+
+	large := cache.Response{Value: bytes.Repeat([]byte("0123456789"), 1000)}.Bytes()
+	a.Set(1, large, time.Now().Add(1*time.Minute))
+	if n := s.len(); n != 4 {
+		t.Errorf("memcached.Set() stored %v items, want 4", n)
+	}
+	got, ok := a.Get(1)
+	if !ok || !bytes.Equal(got, large) {
+		t.Fatalf("memcached.Get() ok = %v, equal = %v", ok, bytes.Equal(got, large))
+	}
+
+	// A new version replaces the head, leaving the chunks of the old one
+	// unreferenced.
+	small := cache.Response{Value: []byte("value")}.Bytes()
+	a.Set(1, small, time.Now().Add(1*time.Minute))
+	if got, ok := a.Get(1); !ok || !bytes.Equal(got, small) {
+		t.Errorf("memcached.Get() = %v, %v, want new version", got, ok)
+	}
+
+	// A response missing a chunk, e.g. evicted, is not cached.
+	a.Set(2, large, time.Now().Add(1*time.Minute))
+	head, _ := s.item(cache.KeyAsString(2))
+	s.remove(fmt.Sprintf("%s.%016x.%d", cache.KeyAsString(2), head.value[:8], 2))
+	if _, ok := a.Get(2); ok {
+		t.Error("memcached.Get() ok = true with a missing chunk")
+	}
+	if st := a.Stats(); st.Incomplete != 1 {
+		t.Errorf("memcached.Stats() incomplete = %v, want 1", st.Incomplete)
+	}
+}
+
+func TestRelease(t *testing.T) {
+	s := newFakeServer(t, defaultMaxItemSize)
+	a := newTestAdapter(t, AdapterWithServers(s.addr()))
+	for key := uint64(1); key <= 3; key++ {
+		a.Set(key, []byte("value"), time.Now().Add(1*time.Minute))
+	}
+
+	tests := []struct {
+		name string
+		key  uint64
+	}{
+		{
+			"removes cached response from store",
+			1,
+		},
+		{
+			"removes cached response from store",
+			2,
+		},
+		{
+			"key does not exist",
+			4,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a.Release(tt.key)
+			if _, ok := a.Get(tt.key); ok {
+				t.Errorf("memcached.Release() error; key %v should not be found", tt.key)
+			}
+		})
+	}
+	if st := a.Stats(); st.Failed != 0 {
+		t.Errorf("memcached.Stats() failed = %v, want 0", st.Failed)
+	}
+}
+
+func TestServers(t *testing.T) {
+	servers := []*fakeServer{newFakeServer(t, defaultMaxItemSize), newFakeServer(t, defaultMaxItemSize)}
+	a := newTestAdapter(t, AdapterWithServers(servers[0].addr(), servers[1].addr()))
+	b := newTestAdapter(t, AdapterWithServers(servers[0].addr(), servers[1].addr()))
+
+	for key := uint64(0); key < 100; key++ {
+		a.Set(key, []byte("value"), time.Time{})
+	}
+	for _, s := range servers {
+		if n := s.len(); n < 20 {
+			t.Errorf("server %v holds %v responses out of 100", s.addr(), n)
+		}
+	}
+	for key := uint64(0); key < 100; key++ {
+		if _, ok := b.Get(key); !ok {
+			t.Errorf("memcached.Get() missed key %v set by another adapter", key)
+		}
+	}
+}
+
+func TestRing(t *testing.T) {
+	all, err := newRing("10.0.0.1:11211", "10.0.0.2:11211", "10.0.0.3:11211")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fewer, err := newRing("10.0.0.1:11211", "10.0.0.2:11211")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	moved, counts := 0, map[string]int{}
+	for i := 0; i < 3000; i++ {
+		key := cache.KeyAsString(uint64(i) * 0x9e3779b97f4a7c15)
+		before, _ := all.PickServer(key)
+		after, _ := fewer.PickServer(key)
+		counts[before.String()]++
+		if before.String() != "10.0.0.3:11211" && before.String() != after.String() {
+			moved++
+		}
+	}
+	if moved != 0 {
+		t.Errorf("removing a server moved %v keys of the other servers", moved)
+	}
+	for server, n := range counts {
+		if n < 700 || n > 1300 {
+			t.Errorf("server %v picked for %v keys out of 3000", server, n)
+		}
+	}
+}
+
+func TestFailed(t *testing.T) {
+	s := newFakeServer(t, defaultMaxItemSize)
+	a := newTestAdapter(t, AdapterWithServers(s.addr()), AdapterWithTimeout(100*time.Millisecond))
+	s.ln.Close()
+
+	a.Set(1, []byte("value"), time.Time{})
+	if _, ok := a.Get(1); ok {
+		t.Error("memcached.Get() ok = true with the server down")
+	}
+	if st := a.Stats(); st.Failed != 2 {
+		t.Errorf("memcached.Stats() failed = %v, want 2", st.Failed)
+	}
+}
+
+func TestContext(t *testing.T) {
+	s := newFakeServer(t, defaultMaxItemSize)
+	a := newTestAdapter(t, AdapterWithServers(s.addr()))
+	ctx := context.Background()
+
+	if err := a.SetContext(ctx, 1, []byte("value 1"), time.Time{}); err != nil {
+		t.Fatalf("memcached.SetContext() error = %v", err)
+	}
+	if b, ok, err := a.GetContext(ctx, 1); !ok || err != nil || string(b) != "value 1" {
+		t.Errorf("memcached.GetContext() = %q, %v, %v, want value 1", b, ok, err)
+	}
+	if _, ok, err := a.GetContext(ctx, 2); ok || err != nil {
+		t.Errorf("memcached.GetContext() of a missing key = %v, %v, want no error", ok, err)
+	}
+	if err := a.ReleaseContext(ctx, 2); err != nil {
+		t.Errorf("memcached.ReleaseContext() of a missing key error = %v", err)
+	}
+
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	if err := a.SetContext(canceled, 2, []byte("value 2"), time.Time{}); !errors.Is(err, context.Canceled) {
+		t.Errorf("memcached.SetContext() with a canceled context error = %v, want %v", err, context.Canceled)
+	}
+	if _, ok, err := a.GetContext(canceled, 1); ok || !errors.Is(err, context.Canceled) {
+		t.Errorf("memcached.GetContext() with a canceled context = %v, %v, want %v", ok, err, context.Canceled)
+	}
+
+}
+
+func TestNewAdapter(t *testing.T) {
+	tests := []struct {
+		name    string
+		opts    []AdapterOptions
+		wantErr bool
+	}{
+		{
+			"returns new Adapter",
+			[]AdapterOptions{
+				AdapterWithServers("127.0.0.1:11211", "127.0.0.1:11212"),
+				AdapterWithKeyPrefix("cache:"),
+				AdapterWithMaxItemSize(8 << 20),
+				AdapterWithTimeout(time.Second),
+				AdapterWithMaxIdleConns(8),
+			},
+			false,
+		},
+		{
+			"returns error",
+			[]AdapterOptions{},
+			true,
+		},
+		{
+			"returns error",
+			[]AdapterOptions{
+				AdapterWithServers(),
+			},
+			true,
+		},
+		{
+			"returns error",
+			[]AdapterOptions{
+				AdapterWithServers("not an address"),
+			},
+			true,
+		},
+		{
+			"returns error",
+			[]AdapterOptions{
+				AdapterWithServers("127.0.0.1:11211"),
+				AdapterWithMaxItemSize(1024),
+			},
+			true,
+		},
+		{
+			"returns error",
+			[]AdapterOptions{
+				AdapterWithServers("127.0.0.1:11211"),
+				AdapterWithTimeout(0),
+			},
+			true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewAdapter(tt.opts...)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("NewAdapter() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,51 @@
+package memcached
+
+import (
+	"net"
+
+	"github.com/bradfitz/gomemcache/memcache"
+	"github.com/victorspringer/http-cache/hashring"
+)
+
+// ring is a consistent hashing memcache.ServerSelector, so that adding or
+// removing a server only moves the keys it holds.
+type ring struct {
+	servers []net.Addr
+	hash    *hashring.Ring
+}
+
+func newRing(servers ...string) (*ring, error) {
+	var list memcache.ServerList
+	if err := list.SetServers(servers...); err != nil {
+		return nil, err
+	}
+	r := &ring{}
+	list.Each(func(addr net.Addr) error {
+		r.servers = append(r.servers, addr)
+		return nil
+	})
+	// Servers are placed on the ring as configured, rather than as
+	// resolved, so that keys stay put when an address changes.
+	r.hash = hashring.New(servers...)
+	return r, nil
+}
+
+// PickServer implements the memcache.ServerSelector interface PickServer
+// method.
+func (r *ring) PickServer(key string) (net.Addr, error) {
+	i, ok := r.hash.Locate(key)
+	if !ok {
+		return nil, memcache.ErrNoServers
+	}
+	return r.servers[i], nil
+}
+
+// Each implements the memcache.ServerSelector interface Each method.
+func (r *ring) Each(f func(net.Addr) error) error {
+	for _, addr := range r.servers {
+		if err := f(addr); err != nil {
+			return err
+		}
+	}
+	return nil
+}
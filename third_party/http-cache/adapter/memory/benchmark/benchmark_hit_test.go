@@ -0,0 +1,72 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	cache "github.com/victorspringer/http-cache"
+	"github.com/victorspringer/http-cache/adapter/memory"
+)
+
+// BenchmarkHTTPCacheMiddlewareHit measures the cache hit path of the
+// middleware, which only decodes the cached response.
+func BenchmarkHTTPCacheMiddlewareHit(b *testing.B) {
+	handler := initHTTPCacheMiddleware(b, 1)
+	r := httptest.NewRequest(http.MethodGet, "/0", nil)
+	handler.ServeHTTP(httptest.NewRecorder(), r)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		handler.ServeHTTP(httptest.NewRecorder(), r)
+	}
+}
+
+// BenchmarkHTTPCacheMiddlewareHitParallel measures cache hits spread over
+// many keys from concurrent requests, contending for the adapter locks.
+func BenchmarkHTTPCacheMiddlewareHitParallel(b *testing.B) {
+	const keys = 1024
+	handler := initHTTPCacheMiddleware(b, keys)
+	requests := make([]*http.Request, keys)
+	for i := range requests {
+		requests[i] = httptest.NewRequest(http.MethodGet, "/"+strconv.Itoa(i), nil)
+		handler.ServeHTTP(httptest.NewRecorder(), requests[i])
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		counter := 0
+		for pb.Next() {
+			handler.ServeHTTP(httptest.NewRecorder(), requests[counter%keys].Clone(requests[0].Context()))
+			counter++
+		}
+	})
+}
+
+func initHTTPCacheMiddleware(b *testing.B, entries int) http.Handler {
+	if entries < 2 {
+		entries = 2
+	}
+	adapter, err := memory.NewAdapter(
+		memory.AdapterWithCapacity(entries),
+		memory.AdapterWithAlgorithm(memory.LRU),
+	)
+	if err != nil {
+		b.Fatal(err)
+	}
+	client, err := cache.NewClient(
+		cache.ClientWithAdapter(adapter),
+		cache.ClientWithTTL(1*time.Minute),
+	)
+	if err != nil {
+		b.Fatal(err)
+	}
+	body := value()
+	return client.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(body)
+	}))
+}
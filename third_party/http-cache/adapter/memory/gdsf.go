@@ -0,0 +1,77 @@
+package memory
+
+import "container/heap"
+
+// entryOverhead is the cost of an entry beyond the size of its value, so
+// that empty ones do not have an infinite priority.
+const entryOverhead = 64
+
+// gdsf implements Greedy Dual-Size Frequency. Entries are evicted in
+// ascending order of priority, the clock at their last access plus their
+// number of accesses divided by their size, so that a large entry does not
+// flush many small and frequently used ones. The clock is raised to the
+// priority of each evicted entry, which ages out entries no longer used.
+type gdsf struct {
+	entries entryHeap
+	clock   float64
+}
+
+func (g *gdsf) prioritize(e *entry) {
+	e.priority = g.clock + float64(e.hits)/float64(len(e.value)+entryOverhead)
+}
+
+func (g *gdsf) insert(e *entry) {
+	e.hits = 1
+	g.prioritize(e)
+	heap.Push(&g.entries, e)
+}
+
+func (g *gdsf) remove(e *entry) {
+	heap.Remove(&g.entries, e.index)
+}
+
+func (g *gdsf) touch(e *entry) {
+	e.hits++
+	g.prioritize(e)
+	heap.Fix(&g.entries, e.index)
+}
+
+func (g *gdsf) miss(uint64) {}
+
+// victim returns the entry with the lowest priority, even the one being set,
+// which is how GDSF declines to admit an entry not worth its size.
+func (g *gdsf) victim(uint64) *entry {
+	if len(g.entries) == 0 {
+		return nil
+	}
+	e := g.entries[0]
+	g.clock = e.priority
+	return e
+}
+
+// entryHeap is a binary min-heap of entries by priority, implementing
+// heap.Interface.
+type entryHeap []*entry
+
+func (h entryHeap) Len() int           { return len(h) }
+func (h entryHeap) Less(i, j int) bool { return h[i].priority < h[j].priority }
+
+func (h entryHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index, h[j].index = i, j
+}
+
+func (h *entryHeap) Push(x interface{}) {
+	e := x.(*entry)
+	e.index = len(*h)
+	*h = append(*h, e)
+}
+
+func (h *entryHeap) Pop() interface{} {
+	old := *h
+	e := old[len(old)-1]
+	old[len(old)-1] = nil
+	*h = old[:len(old)-1]
+	e.index = -1
+	return e
+}
@@ -25,9 +25,11 @@ SOFTWARE.
 package memory
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	cache "github.com/victorspringer/http-cache"
@@ -48,15 +50,45 @@ const (
 
 	// MFU is the constant for Most Frequently Used.
 	MFU Algorithm = "MFU"
+
+	// WTinyLFU is the constant for Window TinyLFU, which only admits
+	// entries accessed more often than the ones they replace.
+	WTinyLFU Algorithm = "W-TinyLFU"
+
+	// GDSF is the constant for Greedy Dual-Size Frequency, which favors
+	// small and frequently used entries.
+	GDSF Algorithm = "GDSF"
 )
 
-// Adapter is the memory adapter data structure.
+// defaultShards is the number of shards of an adapter, unless set otherwise.
+const defaultShards = 16
+
+// Adapter is the memory adapter data structure. Entries are spread over
+// shards, each with its own lock and eviction order, while the capacity
+// limits apply to the adapter as a whole. Accesses are tracked by the
+// adapter, so that cache hits never have to rewrite the cached responses.
 type Adapter struct {
-	mutex     sync.RWMutex
 	capacity  int
 	algorithm Algorithm
-	store     map[uint64][]byte
+	numShards int
+	shards    []*shard
+	items     atomic.Int64
 	storage   storageControl
+
+	expired  atomic.Int64
+	evicted  atomic.Int64
+	released atomic.Int64
+	onExpire atomic.Value
+	onEvict  atomic.Value
+
+	snapshots       atomic.Int64
+	snapshotsFailed atomic.Int64
+
+	sweepInterval    time.Duration
+	snapshotPath     string
+	snapshotInterval time.Duration
+	stop             chan struct{}
+	closeOnce        sync.Once
 }
 
 // AdapterOptions is used to set Adapter settings.
@@ -64,110 +96,142 @@ type AdapterOptions func(a *Adapter) error
 
 // Get implements the cache Adapter interface Get method.
 func (a *Adapter) Get(key uint64) ([]byte, bool) {
-	a.mutex.RLock()
-	response, ok := a.store[key]
-	a.mutex.RUnlock()
-
-	if ok {
-		return response, true
+	s := a.shard(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e, ok := s.items[key]
+	if !ok {
+		s.miss(key)
+		return nil, false
 	}
-
-	return nil, false
+	s.touch(e)
+	return e.value, true
 }
 
 // Set implements the cache Adapter interface Set method.
 func (a *Adapter) Set(key uint64, response []byte, expiration time.Time) {
-	a.mutex.Lock()
-	defer a.mutex.Unlock()
-
-	if _, ok := a.store[key]; ok {
-		// Known key, overwrite previous item.
-		a.store[key] = response
+	if !a.storage.canCache(len(response)) {
+		a.Release(key)
 		return
 	}
 
-	// New key, make sure we have the capacity.
-	if len(a.store) == a.capacity {
-		a.evict()
-	}
-
-	// now evict based on storage
-	for a.storage.shouldEvict(len(response)) {
-		a.evict()
+	s := a.shard(key)
+	s.mu.Lock()
+	if e, ok := s.items[key]; ok {
+		// Known key, overwrite previous item.
+		a.storage.add(len(response) - len(e.value))
+		e.value = response
+		s.setExpiration(e, expiration)
+		s.touch(e)
+	} else {
+		s.insert(&entry{key: key, value: response, expiration: expiration})
+		a.items.Add(1)
+		a.storage.add(len(response))
 	}
+	s.mu.Unlock()
 
-	a.store[key] = response
-	a.storage.add(len(response))
+	a.shrink(key)
 }
 
 // Release implements the Adapter interface Release method.
 func (a *Adapter) Release(key uint64) {
-	var sz int
-	a.mutex.RLock()
-	b, ok := a.store[key]
-	if ok {
-		sz = len(b)
-	}
-	a.mutex.RUnlock()
-
-	if ok {
-		a.mutex.Lock()
-		delete(a.store, key)
-		a.storage.del(sz)
-		a.mutex.Unlock()
+	s := a.shard(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if e, ok := s.items[key]; ok {
+		s.remove(e)
+		a.items.Add(-1)
+		a.storage.add(-len(e.value))
+		a.released.Add(1)
 	}
 }
 
-// evict removes a single entry from the store. It assumes that the caller holds
-// the write lock.
-func (a *Adapter) evict() {
-	selectedKey := uint64(0)
-	lastAccess := time.Now()
-	frequency := 2147483647
-
-	if a.algorithm == MRU {
-		lastAccess = time.Time{}
-	} else if a.algorithm == MFU {
-		frequency = 0
-	}
+// OnEvict implements the cache EvictingAdapter interface OnEvict method.
+func (a *Adapter) OnEvict(f func(key uint64, response []byte, expiration time.Time)) {
+	a.onEvict.Store(f)
+}
 
-	var sz int
-	var hit bool
-	for k, v := range a.store {
-		r := cache.BytesToResponse(v)
-		switch a.algorithm {
-		case LRU:
-			if r.LastAccess.Before(lastAccess) {
-				selectedKey = k
-				lastAccess = r.LastAccess
-				sz, hit = len(v), true
-			}
-		case MRU:
-			if r.LastAccess.After(lastAccess) ||
-				r.LastAccess.Equal(lastAccess) {
-				selectedKey = k
-				lastAccess = r.LastAccess
-				sz, hit = len(v), true
+// Range implements the cache EnumeratingAdapter interface Range method.
+// Expired responses not swept yet are skipped. Shards are copied one at a
+// time, see WriteSnapshot.
+func (a *Adapter) Range(ctx context.Context, f func(key uint64, entry cache.EntryReader, size int64) bool) error {
+	var entries []snapshotEntry
+	for _, s := range a.shards {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		now := time.Now()
+		entries = entries[:0]
+		s.mu.Lock()
+		for _, e := range s.items {
+			if e.expiration.IsZero() || e.expiration.After(now) {
+				entries = append(entries, snapshotEntry{e.key, e.value, e.expiration})
 			}
-		case LFU:
-			if r.Frequency < frequency {
-				selectedKey = k
-				frequency = r.Frequency
-				sz, hit = len(v), true
+		}
+		s.mu.Unlock()
+
+		for _, e := range entries {
+			if !f(e.key, cache.NewEntryReader(e.value), int64(len(e.value))) {
+				return nil
 			}
-		case MFU:
-			if r.Frequency >= frequency {
-				selectedKey = k
-				frequency = r.Frequency
-				sz, hit = len(v), true
+		}
+	}
+	return nil
+}
+
+// Len returns the number of cached responses.
+func (a *Adapter) Len() int {
+	return int(a.items.Load())
+}
+
+func (a *Adapter) shardIndex(key uint64) int {
+	return int(key % uint64(len(a.shards)))
+}
+
+func (a *Adapter) shard(key uint64) *shard {
+	return a.shards[a.shardIndex(key)]
+}
+
+func (a *Adapter) overCapacity() bool {
+	return (a.capacity > 0 && a.Len() > a.capacity) || a.storage.exceeded()
+}
+
+// shrink evicts entries until the adapter is back within its capacity,
+// starting with the shard of the entry that has just been set, which is
+// kept unless the policy rejects it.
+func (a *Adapter) shrink(keep uint64) {
+	onEvict, _ := a.onEvict.Load().(func(key uint64, response []byte, expiration time.Time))
+	i := a.shardIndex(keep)
+	for tried := 0; tried < len(a.shards) && a.overCapacity(); {
+		if e := a.evict(a.shards[i], keep); e != nil {
+			if onEvict != nil {
+				onEvict(e.key, e.value, e.expiration)
 			}
+			tried = 0
+			continue
 		}
+		i = (i + 1) % len(a.shards)
+		tried++
 	}
+}
 
-	if hit {
-		a.storage.del(sz)
+// evict removes a single entry from a shard as per the algorithm of the
+// adapter, and returns it, or nil if there is none to remove.
+func (a *Adapter) evict(s *shard, keep uint64) *entry {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e := s.victim(keep)
+	if e == nil {
+		return nil
 	}
-	delete(a.store, selectedKey)
+	s.remove(e)
+	a.items.Add(-1)
+	a.storage.add(-len(e.value))
+	a.evicted.Add(1)
+	return e
 }
 
 // NewAdapter initializes memory adapter.
@@ -188,11 +252,22 @@ func NewAdapter(opts ...AdapterOptions) (cache.Adapter, error) {
 		return nil, errors.New("memory adapter caching algorithm is not set")
 	}
 
-	a.mutex = sync.RWMutex{}
-	if a.capacity > 0 {
-		a.store = make(map[uint64][]byte, a.capacity)
-	} else {
-		a.store = make(map[uint64][]byte, 4) //just init with something
+	if a.numShards == 0 {
+		a.numShards = defaultShards
+	}
+	a.shards = make([]*shard, a.numShards)
+	for i := range a.shards {
+		a.shards[i] = newShard(a.algorithm, a.capacity/a.numShards)
+	}
+
+	if a.sweepInterval > 0 || a.snapshotInterval > 0 {
+		a.stop = make(chan struct{})
+	}
+	if a.sweepInterval > 0 {
+		go a.sweepEvery(a.sweepInterval)
+	}
+	if a.snapshotInterval > 0 {
+		go a.snapshotEvery(a.snapshotPath, a.snapshotInterval)
 	}
 
 	return a, nil
@@ -202,6 +277,12 @@ func NewAdapter(opts ...AdapterOptions) (cache.Adapter, error) {
 // response to be evicted when the capacity is reached.
 func AdapterWithAlgorithm(alg Algorithm) AdapterOptions {
 	return func(a *Adapter) error {
+		switch alg {
+		case LRU, MRU, LFU, MFU, WTinyLFU, GDSF:
+		default:
+			return fmt.Errorf("memory adapter caching algorithm %q is unknown", alg)
+		}
+
 		a.algorithm = alg
 		return nil
 	}
@@ -228,16 +309,31 @@ func AdapterWithStorageCapacity(cap int) AdapterOptions {
 		}
 
 		a.storage = storageControl{
-			max: cap,
+			max: int64(cap),
+		}
+
+		return nil
+	}
+}
+
+// AdapterWithShards sets the number of independently locked shards the
+// cached responses are spread over. Eviction order is kept per shard, so
+// more shards mean less contention but a coarser eviction order.
+func AdapterWithShards(n int) AdapterOptions {
+	return func(a *Adapter) error {
+		if n <= 0 {
+			return errors.New("memory adapter requires a number of shards greater than 0")
 		}
 
+		a.numShards = n
+
 		return nil
 	}
 }
 
 type storageControl struct {
-	max int
-	cur int
+	max int64
+	cur atomic.Int64
 }
 
 func (s *storageControl) active() bool {
@@ -245,34 +341,18 @@ func (s *storageControl) active() bool {
 }
 
 func (s *storageControl) add(v int) {
-	if v >= 0 {
-		s.cur += v // if you roll over an int64, well... sorry?
-	}
+	s.cur.Add(int64(v))
 }
 
-func (s *storageControl) del(v int) {
-	if v >= 0 {
-		if s.cur = s.cur - v; s.cur < 0 {
-			s.cur = 0 // safety check it
-		}
-	}
-}
-
-// storageShouldEvict will return true if the proposed new bytes plus current exceeds our max
-// we will NOT evict our max is set to 0 (e.g. we are not tracking total bytes)
-func (s *storageControl) shouldEvict(newBytes int) bool {
-	if s.max <= 0 {
-		return false // basically "we have no opinion"
-	}
-	if next := (s.cur + newBytes); next < 0 || next > s.max {
-		return true
-	}
-	return false
+// exceeded returns true if the current bytes exceed our max. We will NOT
+// evict if our max is set to 0 (e.g. we are not tracking total bytes).
+func (s *storageControl) exceeded() bool {
+	return s.max > 0 && s.cur.Load() > s.max
 }
 
 func (s *storageControl) canCache(newBytes int) bool {
 	if s.max <= 0 {
 		return true // we have no opinion
 	}
-	return s.max >= newBytes
+	return s.max >= int64(newBytes)
 }
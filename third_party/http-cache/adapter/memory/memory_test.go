@@ -1,6 +1,13 @@
 package memory
 
 import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"path/filepath"
 	"reflect"
 	"sync"
 	"testing"
@@ -9,20 +16,21 @@ import (
 	cache "github.com/victorspringer/http-cache"
 )
 
-func TestGet(t *testing.T) {
-	a := &Adapter{
-		mutex:     sync.RWMutex{},
-		capacity:  2,
-		algorithm: LRU,
-		store: map[uint64][]byte{
-			14974843192121052621: cache.Response{
-				Value:      []byte("value 1"),
-				Expiration: time.Now(),
-				LastAccess: time.Now(),
-				Frequency:  1,
-			}.Bytes(),
-		},
+func newTestAdapter(t *testing.T, opts ...AdapterOptions) *Adapter {
+	t.Helper()
+	a, err := NewAdapter(opts...)
+	if err != nil {
+		t.Fatalf("NewAdapter() error = %v", err)
 	}
+	return a.(*Adapter)
+}
+
+func TestGet(t *testing.T) {
+	a := newTestAdapter(t, AdapterWithCapacity(2), AdapterWithAlgorithm(LRU))
+	a.Set(14974843192121052621, cache.Response{
+		Value:      []byte("value 1"),
+		Expiration: time.Now(),
+	}.Bytes(), time.Now())
 
 	tests := []struct {
 		name string
@@ -59,12 +67,7 @@ func TestGet(t *testing.T) {
 }
 
 func TestSet(t *testing.T) {
-	a := &Adapter{
-		mutex:     sync.RWMutex{},
-		capacity:  2,
-		algorithm: LRU,
-		store:     make(map[uint64][]byte),
-	}
+	a := newTestAdapter(t, AdapterWithCapacity(2), AdapterWithAlgorithm(LRU))
 
 	tests := []struct {
 		name     string
@@ -95,26 +98,31 @@ func TestSet(t *testing.T) {
 				Expiration: time.Now().Add(1 * time.Minute),
 			},
 		},
+		{
+			"overwrites a response cache",
+			3,
+			cache.Response{
+				Value:      []byte("value 4"),
+				Expiration: time.Now().Add(1 * time.Minute),
+			},
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			a.Set(tt.key, tt.response.Bytes(), tt.response.Expiration)
-			if cache.BytesToResponse(a.store[tt.key]).Value == nil {
-				t.Errorf(
-					"memory.Set() error = store[%v] response is not %s", tt.key, tt.response.Value,
-				)
+			b, _ := a.Get(tt.key)
+			if got := cache.BytesToResponse(b).Value; !reflect.DeepEqual(got, tt.response.Value) {
+				t.Errorf("memory.Set() error = store[%v] response is %s, not %s", tt.key, got, tt.response.Value)
+			}
+			if a.Len() > 2 {
+				t.Errorf("memory.Set() error = store length is %v, max 2", a.Len())
 			}
 		})
 	}
 
 	t.Run("set is thread safe", func(t *testing.T) {
 		maxSize := 2
-		a := &Adapter{
-			mutex:     sync.RWMutex{},
-			capacity:  maxSize,
-			algorithm: LRU,
-			store:     make(map[uint64][]byte),
-		}
+		a := newTestAdapter(t, AdapterWithCapacity(maxSize), AdapterWithAlgorithm(LRU))
 
 		var wg sync.WaitGroup
 		for i := 0; i < 100; i++ {
@@ -124,36 +132,29 @@ func TestSet(t *testing.T) {
 			go func() {
 				defer wg.Done()
 				a.Set(i, nil, time.Now().Add(1*time.Hour))
+				a.Get(i)
 			}()
 		}
 
 		wg.Wait()
 
-		if maxSize < len(a.store) {
-			t.Errorf("cache became too big, max: %d, actual size: %d", maxSize, len(a.store))
+		if maxSize < a.Len() {
+			t.Errorf("cache became too big, max: %d, actual size: %d", maxSize, a.Len())
+		}
+		count := 0
+		for _, s := range a.shards {
+			count += len(s.items)
+		}
+		if count != a.Len() {
+			t.Errorf("cache length is %d, but %d items are stored", a.Len(), count)
 		}
 	})
 }
 
 func TestRelease(t *testing.T) {
-	a := &Adapter{
-		mutex:     sync.RWMutex{},
-		capacity:  2,
-		algorithm: LRU,
-		store: map[uint64][]byte{
-			14974843192121052621: cache.Response{
-				Expiration: time.Now().Add(1 * time.Minute),
-				Value:      []byte("value 1"),
-			}.Bytes(),
-			14974839893586167988: cache.Response{
-				Expiration: time.Now(),
-				Value:      []byte("value 2"),
-			}.Bytes(),
-			14974840993097796199: cache.Response{
-				Expiration: time.Now(),
-				Value:      []byte("value 3"),
-			}.Bytes(),
-		},
+	a := newTestAdapter(t, AdapterWithCapacity(4), AdapterWithAlgorithm(LRU))
+	for _, key := range []uint64{14974843192121052621, 14974839893586167988, 14974840993097796199} {
+		a.Set(key, cache.Response{Value: []byte("value")}.Bytes(), time.Now())
 	}
 
 	tests := []struct {
@@ -174,12 +175,21 @@ func TestRelease(t *testing.T) {
 			1,
 			false,
 		},
+		{
+			"ignores unknown key",
+			123,
+			1,
+			false,
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			a.Release(tt.key)
-			if len(a.store) > tt.storeLength {
-				t.Errorf("memory.Release() error; store length = %v, want 0", len(a.store))
+			if a.Len() != tt.storeLength {
+				t.Errorf("memory.Release() error; store length = %v, want %v", a.Len(), tt.storeLength)
+			}
+			if _, ok := a.Get(tt.key); ok {
+				t.Errorf("memory.Release() error; key %v is still cached", tt.key)
 			}
 		})
 	}
@@ -189,88 +199,431 @@ func TestEvict(t *testing.T) {
 	tests := []struct {
 		name      string
 		algorithm Algorithm
+		want      uint64
 	}{
 		{
 			"lru removes third cached response",
 			LRU,
+			3,
 		},
 		{
 			"mru removes first cached response",
 			MRU,
+			1,
 		},
 		{
 			"lfu removes second cached response",
 			LFU,
+			2,
 		},
 		{
 			"mfu removes third cached response",
 			MFU,
+			3,
+		},
+		{
+			"w-tinylfu removes second cached response",
+			WTinyLFU,
+			2,
+		},
+		{
+			"gdsf removes second cached response",
+			GDSF,
+			2,
 		},
 	}
-	count := 0
 	for _, tt := range tests {
-		count++
-
-		a := &Adapter{
-			mutex:     sync.RWMutex{},
-			capacity:  2,
-			algorithm: tt.algorithm,
-			store: map[uint64][]byte{
-				14974843192121052621: cache.Response{
-					Value:      []byte("value 1"),
-					Expiration: time.Now().Add(1 * time.Minute),
-					LastAccess: time.Now().Add(-1 * time.Minute),
-					Frequency:  2,
-				}.Bytes(),
-				14974839893586167988: cache.Response{
-					Value:      []byte("value 2"),
-					Expiration: time.Now().Add(1 * time.Minute),
-					LastAccess: time.Now().Add(-2 * time.Minute),
-					Frequency:  1,
-				}.Bytes(),
-				14974840993097796199: cache.Response{
-					Value:      []byte("value 3"),
-					Expiration: time.Now().Add(1 * time.Minute),
-					LastAccess: time.Now().Add(-3 * time.Minute),
-					Frequency:  3,
-				}.Bytes(),
-			},
-		}
 		t.Run(tt.name, func(t *testing.T) {
-			a.evict()
+			a := newTestAdapter(t, AdapterWithCapacity(4), AdapterWithAlgorithm(tt.algorithm), AdapterWithShards(1))
 
-			if count == 1 {
-				if _, ok := a.store[14974840993097796199]; ok {
-					t.Errorf("lru is not working properly")
-					return
-				}
-			} else if count == 2 {
-				if _, ok := a.store[14974843192121052621]; ok {
-					t.Errorf("mru is not working properly")
-					return
+			// Response 1 is the most recently used and response 3 the
+			// least, while response 3 is the most frequently used and
+			// response 2 the least.
+			a.Set(3, []byte("value 3"), time.Now())
+			a.Get(3)
+			a.Get(3)
+			a.Set(2, []byte("value 2"), time.Now())
+			a.Set(1, []byte("value 1"), time.Now())
+			a.Get(1)
+
+			if a.evict(a.shards[0], 0) == nil {
+				t.Fatalf("memory.evict() = nil, want an entry")
+			}
+			if _, ok := a.Get(tt.want); ok {
+				t.Errorf("%v is not working properly, key %v is still cached", tt.algorithm, tt.want)
+			}
+			if a.Len() != 2 {
+				t.Errorf("memory.evict() error; store length = %v, want 2", a.Len())
+			}
+		})
+	}
+
+	t.Run("keeps the response being set", func(t *testing.T) {
+		a := newTestAdapter(t, AdapterWithCapacity(2), AdapterWithAlgorithm(MRU), AdapterWithShards(1))
+		a.Set(1, []byte("value 1"), time.Now())
+		a.Set(2, []byte("value 2"), time.Now())
+		a.Set(3, []byte("value 3"), time.Now())
+
+		if _, ok := a.Get(3); !ok {
+			t.Error("mru evicted the response being set")
+		}
+		if _, ok := a.Get(2); ok {
+			t.Error("mru is not working properly, key 2 is still cached")
+		}
+	})
+
+	t.Run("evicts from other shards", func(t *testing.T) {
+		a := newTestAdapter(t, AdapterWithCapacity(2), AdapterWithAlgorithm(LRU), AdapterWithShards(4))
+		a.Set(1, []byte("value 1"), time.Now())
+		a.Set(2, []byte("value 2"), time.Now())
+		a.Set(3, []byte("value 3"), time.Now())
+
+		if a.Len() != 2 {
+			t.Errorf("memory.Set() error; store length = %v, want 2", a.Len())
+		}
+		if _, ok := a.Get(3); !ok {
+			t.Error("memory.Set() evicted the response being set")
+		}
+	})
+}
+
+func TestOnEvict(t *testing.T) {
+	a := newTestAdapter(t, AdapterWithCapacity(2), AdapterWithAlgorithm(LRU), AdapterWithShards(1))
+	type eviction struct {
+		key        uint64
+		response   string
+		expiration time.Time
+	}
+	var evicted []eviction
+	a.OnEvict(func(key uint64, response []byte, expiration time.Time) {
+		evicted = append(evicted, eviction{key, string(response), expiration})
+	})
+
+	expiration := time.Now().Add(time.Minute)
+	a.Set(1, []byte("value 1"), expiration)
+	a.Set(2, []byte("value 2"), time.Time{})
+	a.Set(3, []byte("value 3"), time.Time{})
+	a.Release(2)
+
+	want := []eviction{{1, "value 1", expiration}}
+	if !reflect.DeepEqual(evicted, want) {
+		t.Errorf("memory.OnEvict() reported %+v, want %+v", evicted, want)
+	}
+}
+
+func TestAdmission(t *testing.T) {
+	tests := []struct {
+		name      string
+		algorithm Algorithm
+		wantHot   bool
+	}{
+		{
+			"lru evicts frequently used responses during a scan",
+			LRU,
+			false,
+		},
+		{
+			"w-tinylfu keeps frequently used responses during a scan",
+			WTinyLFU,
+			true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := newTestAdapter(t, AdapterWithCapacity(10), AdapterWithAlgorithm(tt.algorithm), AdapterWithShards(1))
+			for key := uint64(1); key <= 6; key++ {
+				a.Set(key, []byte("value"), time.Now())
+			}
+			for i := 0; i < 5; i++ {
+				for key := uint64(1); key <= 5; key++ {
+					a.Get(key)
 				}
-			} else if count == 3 {
-				if _, ok := a.store[14974839893586167988]; ok {
-					t.Errorf("lfu is not working properly")
-					return
+			}
+			for key := uint64(100); key < 200; key++ {
+				if _, ok := a.Get(key); !ok {
+					a.Set(key, []byte("value"), time.Now())
 				}
-			} else {
-				if count == 4 {
-					if _, ok := a.store[14974840993097796199]; ok {
-						t.Errorf("mfu is not working properly")
-					}
+			}
+
+			for key := uint64(1); key <= 5; key++ {
+				if _, ok := a.Get(key); ok != tt.wantHot {
+					t.Errorf("%v: key %v cached = %v, want %v", tt.algorithm, key, ok, tt.wantHot)
 				}
 			}
 		})
 	}
+
+	t.Run("gdsf does not flush small responses for a large one", func(t *testing.T) {
+		a := newTestAdapter(t, AdapterWithCapacity(64), AdapterWithAlgorithm(GDSF), AdapterWithStorageCapacity(1000), AdapterWithShards(1))
+		small := make([]byte, 50)
+		for key := uint64(1); key <= 10; key++ {
+			a.Set(key, small, time.Now())
+			a.Get(key)
+		}
+		a.Set(100, make([]byte, 600), time.Now())
+
+		if _, ok := a.Get(100); ok {
+			t.Error("gdsf admitted the large response")
+		}
+		if a.Len() != 10 {
+			t.Errorf("gdsf evicted small responses, %v left", a.Len())
+		}
+	})
+}
+
+// TestHitRatio replays a synthetic trace of a file server, with a skewed
+// popularity of small files, scans of files requested once and a few large
+// files, and compares the hit ratios of the algorithms.
+func TestHitRatio(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping trace replay in short mode")
+	}
+
+	type request struct {
+		key  uint64
+		size int
+	}
+	rnd := rand.New(rand.NewSource(1))
+	zipf := rand.NewZipf(rnd, 1.1, 1, 4999)
+	sizes := make([]int, 5000)
+	for i := range sizes {
+		sizes[i] = 1<<10 + rnd.Intn(15<<10)
+	}
+	var trace []request
+	scan := uint64(1 << 32)
+	for len(trace) < 200000 {
+		switch n := rnd.Intn(1000); {
+		case n == 0:
+			for i := 0; i < 1000; i++ {
+				trace = append(trace, request{scan, 4 << 10})
+				scan++
+			}
+		case n < 5:
+			trace = append(trace, request{uint64(1<<31 + rnd.Intn(20)), 1 << 20})
+		default:
+			key := zipf.Uint64()
+			trace = append(trace, request{key, sizes[key]})
+		}
+	}
+
+	value := make([]byte, 1<<20)
+	ratios := make(map[Algorithm]float64)
+	for _, alg := range []Algorithm{LRU, LFU, WTinyLFU, GDSF} {
+		a := newTestAdapter(t, AdapterWithCapacity(100000), AdapterWithAlgorithm(alg), AdapterWithStorageCapacity(8<<20))
+		hits := 0
+		for _, r := range trace {
+			if _, ok := a.Get(r.key); ok {
+				hits++
+				continue
+			}
+			a.Set(r.key, value[:r.size], time.Time{})
+		}
+		ratios[alg] = float64(hits) / float64(len(trace))
+		t.Logf("%v hit ratio: %.3f", alg, ratios[alg])
+	}
+
+	for _, alg := range []Algorithm{WTinyLFU, GDSF} {
+		if ratios[alg] <= ratios[LRU] {
+			t.Errorf("%v hit ratio %.3f is not better than LRU %.3f", alg, ratios[alg], ratios[LRU])
+		}
+	}
+}
+
+func TestSweep(t *testing.T) {
+	a := newTestAdapter(t, AdapterWithCapacity(1000), AdapterWithAlgorithm(LRU), AdapterWithShards(2))
+	var expired []uint64
+	a.OnExpire(func(key uint64) { expired = append(expired, key) })
+
+	now := time.Now()
+	for key := uint64(1); key <= 200; key++ {
+		a.Set(key, []byte("value"), now.Add(-time.Minute))
+	}
+	a.Set(201, []byte("value"), now.Add(time.Minute))
+	a.Set(202, []byte("value"), time.Time{})
+	a.Set(1, []byte("value"), now.Add(time.Minute))
+	a.Set(2, []byte("value"), time.Time{})
+	a.Release(3)
+
+	a.sweep(now)
+
+	if a.Len() != 4 {
+		t.Errorf("memory.sweep() error; store length = %v, want 4", a.Len())
+	}
+	for _, key := range []uint64{1, 2, 201, 202} {
+		if _, ok := a.Get(key); !ok {
+			t.Errorf("memory.sweep() released unexpired key %v", key)
+		}
+	}
+	if len(expired) != 197 {
+		t.Errorf("memory.sweep() reported %v expirations, want 197", len(expired))
+	}
+	want := Stats{Items: 4, Bytes: 20, Expired: 197, Released: 1}
+	if got := a.Stats(); got != want {
+		t.Errorf("memory.Stats() = %+v, want %+v", got, want)
+	}
+
+	a.Set(203, []byte("value"), now.Add(-time.Minute))
+	if _, ok := a.Get(203); !ok {
+		t.Error("memory.Get() missed an expired key before it was swept")
+	}
+}
+
+func TestSweepInterval(t *testing.T) {
+	a := newTestAdapter(t, AdapterWithCapacity(4), AdapterWithAlgorithm(LRU), AdapterWithSweepInterval(time.Millisecond))
+	defer a.Close()
+	a.Set(1, []byte("value"), time.Now().Add(10*time.Millisecond))
+	a.Set(2, []byte("value"), time.Now().Add(time.Hour))
+
+	deadline := time.Now().Add(time.Second)
+	for a.Len() > 1 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if _, ok := a.Get(1); ok {
+		t.Error("expired key 1 was not swept")
+	}
+	if _, ok := a.Get(2); !ok {
+		t.Error("unexpired key 2 was swept")
+	}
+	a.Close()
+}
+
+func TestSnapshot(t *testing.T) {
+	a := newTestAdapter(t, AdapterWithCapacity(1000), AdapterWithAlgorithm(LRU), AdapterWithShards(4))
+	now := time.Now()
+	for key := uint64(1); key <= 100; key++ {
+		a.Set(key, []byte(fmt.Sprintf("value %d", key)), now.Add(time.Minute))
+	}
+	a.Set(101, []byte("value 101"), time.Time{})
+	a.Set(102, []byte("value 102"), now.Add(-time.Minute))
+	a.Set(103, []byte("value 103"), now.Add(50*time.Millisecond))
+
+	path := filepath.Join(t.TempDir(), "cache.snapshot")
+	if err := a.SaveSnapshot(path); err != nil {
+		t.Fatalf("memory.SaveSnapshot() error = %v", err)
+	}
+	if s := a.Stats(); s.Snapshots != 1 || s.SnapshotsFailed != 0 {
+		t.Errorf("memory.Stats() = %+v, want 1 snapshot", s)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	b := newTestAdapter(t, AdapterWithCapacity(1000), AdapterWithAlgorithm(LFU))
+	n, err := b.LoadSnapshot(path)
+	if err != nil {
+		t.Fatalf("memory.LoadSnapshot() error = %v", err)
+	}
+	if n != 101 || b.Len() != 101 {
+		t.Errorf("memory.LoadSnapshot() = %v, length = %v, want 101", n, b.Len())
+	}
+	for key := uint64(1); key <= 101; key++ {
+		if got, ok := b.Get(key); !ok || string(got) != fmt.Sprintf("value %d", key) {
+			t.Errorf("memory.Get(%v) = %q, %v after restore", key, got, ok)
+		}
+	}
+	for _, key := range []uint64{102, 103} {
+		if _, ok := b.Get(key); ok {
+			t.Errorf("memory.LoadSnapshot() restored expired key %v", key)
+		}
+	}
+}
+
+func TestReadSnapshot(t *testing.T) {
+	a := newTestAdapter(t, AdapterWithCapacity(4), AdapterWithAlgorithm(LRU))
+	a.Set(1, []byte("value 1"), time.Time{})
+	a.Set(2, []byte("value 2"), time.Time{})
+	var buf bytes.Buffer
+	if err := a.WriteSnapshot(&buf); err != nil {
+		t.Fatalf("memory.WriteSnapshot() error = %v", err)
+	}
+	b := buf.Bytes()
+
+	tests := []struct {
+		name     string
+		snapshot []byte
+		want     int
+		wantErr  error
+	}{
+		{"restores responses", b, 2, nil},
+		{"empty snapshot", nil, 0, ErrSnapshotVersion},
+		{"other version", append([]byte("hcms\x02"), b[5:]...), 0, ErrSnapshotVersion},
+		{"not a snapshot", []byte("hello, world"), 0, ErrSnapshotVersion},
+		{"truncated snapshot", b[:len(b)-4], 1, io.ErrUnexpectedEOF},
+		{"snapshot without end", b[:len(b)-1], 2, io.ErrUnexpectedEOF},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestAdapter(t, AdapterWithCapacity(4), AdapterWithAlgorithm(LRU))
+			n, err := c.ReadSnapshot(bytes.NewReader(tt.snapshot))
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("memory.ReadSnapshot() error = %v, want %v", err, tt.wantErr)
+			}
+			if n != tt.want || c.Len() != tt.want {
+				t.Errorf("memory.ReadSnapshot() = %v, length = %v, want %v", n, c.Len(), tt.want)
+			}
+		})
+	}
+}
+
+func TestSnapshotInterval(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cache.snapshot")
+	a := newTestAdapter(t, AdapterWithCapacity(4), AdapterWithAlgorithm(LRU), AdapterWithSnapshot(path, time.Millisecond))
+	defer a.Close()
+	a.Set(1, []byte("value"), time.Time{})
+
+	deadline := time.Now().Add(time.Second)
+	for a.Stats().Snapshots == 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	a.Close()
+	b := newTestAdapter(t, AdapterWithCapacity(4), AdapterWithAlgorithm(LRU))
+	if n, err := b.LoadSnapshot(path); n != 1 || err != nil {
+		t.Errorf("memory.LoadSnapshot() = %v, %v, want 1 response", n, err)
+	}
+}
+
+func TestRange(t *testing.T) {
+	a := newTestAdapter(t, AdapterWithCapacity(4), AdapterWithAlgorithm(LRU), AdapterWithShards(2))
+	a.Set(1, []byte("value 1"), time.Time{})
+	a.Set(2, []byte("value 2"), time.Now().Add(time.Minute))
+	a.Set(3, []byte("value 3"), time.Now().Add(-time.Minute))
+
+	got := map[uint64]string{}
+	err := a.Range(context.Background(), func(key uint64, entry cache.EntryReader, size int64) bool {
+		b := make([]byte, size)
+		if _, err := entry.ReadAt(b, 0); err != nil {
+			t.Errorf("memory.Range() entry read error = %v", err)
+		}
+		got[key] = string(b)
+		return true
+	})
+	if err != nil {
+		t.Fatalf("memory.Range() error = %v", err)
+	}
+	if want := map[uint64]string{1: "value 1", 2: "value 2"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("memory.Range() = %v, want %v", got, want)
+	}
+
+	n := 0
+	a.Range(context.Background(), func(uint64, cache.EntryReader, int64) bool {
+		n++
+		return false
+	})
+	if n != 1 {
+		t.Errorf("memory.Range() listed %v responses after f returned false, want 1", n)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := a.Range(ctx, func(uint64, cache.EntryReader, int64) bool { return true }); !errors.Is(err, context.Canceled) {
+		t.Errorf("memory.Range() with a canceled context error = %v, want %v", err, context.Canceled)
+	}
 }
 
 func TestNewAdapter(t *testing.T) {
 	tests := []struct {
-		name    string
-		opts    []AdapterOptions
-		want    cache.Adapter
-		wantErr bool
+		name       string
+		opts       []AdapterOptions
+		wantShards int
+		wantErr    bool
 	}{
 		{
 			"returns new Adapter",
@@ -278,12 +631,17 @@ func TestNewAdapter(t *testing.T) {
 				AdapterWithCapacity(4),
 				AdapterWithAlgorithm(LRU),
 			},
-			&Adapter{
-				mutex:     sync.RWMutex{},
-				capacity:  4,
-				algorithm: LRU,
-				store:     make(map[uint64][]byte),
+			defaultShards,
+			false,
+		},
+		{
+			"returns new Adapter with shards",
+			[]AdapterOptions{
+				AdapterWithCapacity(4),
+				AdapterWithAlgorithm(LFU),
+				AdapterWithShards(2),
 			},
+			2,
 			false,
 		},
 		{
@@ -291,7 +649,7 @@ func TestNewAdapter(t *testing.T) {
 			[]AdapterOptions{
 				AdapterWithAlgorithm(LRU),
 			},
-			nil,
+			0,
 			true,
 		},
 		{
@@ -299,7 +657,7 @@ func TestNewAdapter(t *testing.T) {
 			[]AdapterOptions{
 				AdapterWithCapacity(4),
 			},
-			nil,
+			0,
 			true,
 		},
 		{
@@ -307,7 +665,56 @@ func TestNewAdapter(t *testing.T) {
 			[]AdapterOptions{
 				AdapterWithCapacity(1),
 			},
-			nil,
+			0,
+			true,
+		},
+		{
+			"returns error",
+			[]AdapterOptions{
+				AdapterWithCapacity(4),
+				AdapterWithAlgorithm("FIFO"),
+			},
+			0,
+			true,
+		},
+		{
+			"returns error",
+			[]AdapterOptions{
+				AdapterWithCapacity(4),
+				AdapterWithAlgorithm(LRU),
+				AdapterWithShards(0),
+			},
+			0,
+			true,
+		},
+		{
+			"returns error",
+			[]AdapterOptions{
+				AdapterWithCapacity(4),
+				AdapterWithAlgorithm(LRU),
+				AdapterWithSweepInterval(0),
+			},
+			0,
+			true,
+		},
+		{
+			"returns error",
+			[]AdapterOptions{
+				AdapterWithCapacity(4),
+				AdapterWithAlgorithm(LRU),
+				AdapterWithSnapshot("", time.Minute),
+			},
+			0,
+			true,
+		},
+		{
+			"returns error",
+			[]AdapterOptions{
+				AdapterWithCapacity(4),
+				AdapterWithAlgorithm(LRU),
+				AdapterWithSnapshot("cache.snapshot", 0),
+			},
+			0,
 			true,
 		},
 	}
@@ -318,23 +725,18 @@ func TestNewAdapter(t *testing.T) {
 				t.Errorf("NewAdapter() error = %v, wantErr %v", err, tt.wantErr)
 				return
 			}
-			if !reflect.DeepEqual(got, tt.want) {
-				t.Errorf("NewAdapter() = %v, want %v", got, tt.want)
+			if err != nil {
+				return
+			}
+			if n := len(got.(*Adapter).shards); n != tt.wantShards {
+				t.Errorf("NewAdapter() shards = %v, want %v", n, tt.wantShards)
 			}
 		})
 	}
 }
 
 func TestStorageEvict(t *testing.T) {
-	a := &Adapter{
-		mutex:     sync.RWMutex{},
-		capacity:  64,
-		algorithm: LRU,
-		store:     map[uint64][]byte{},
-		storage: storageControl{
-			max: 14,
-		},
-	}
+	a := newTestAdapter(t, AdapterWithCapacity(64), AdapterWithAlgorithm(LRU), AdapterWithStorageCapacity(14))
 
 	reqs := map[uint64][]byte{
 		14974843192121052621: []byte("value 1"),
@@ -346,10 +748,21 @@ func TestStorageEvict(t *testing.T) {
 	for k, v := range reqs {
 		a.Set(k, v, time.Time{})
 		cnt++
-		if l := len(a.store); l > 2 {
+		if l := a.Len(); l > 2 {
 			t.Fatalf("value not evicted after breaching storage limit: %d > 2", l)
-		} else if cnt < 3 && len(a.store) != cnt {
+		} else if cnt < 3 && a.Len() != cnt {
 			t.Fatalf("value prematurely evicted: %d != %d", l, cnt)
 		}
 	}
+
+	a.Set(1, []byte("value too large"), time.Time{})
+	if _, ok := a.Get(1); ok {
+		t.Error("value larger than the storage capacity was cached")
+	}
+	if cur := a.storage.cur.Load(); cur != 14 {
+		t.Errorf("storage is %d bytes, want 14", cur)
+	}
+	if got := a.Stats().Evicted; got != 1 {
+		t.Errorf("memory.Stats() evicted = %v, want 1", got)
+	}
 }
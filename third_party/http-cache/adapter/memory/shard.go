@@ -0,0 +1,277 @@
+/*
+MIT License
+
+Copyright (c) 2018 Victor Springer
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package memory
+
+import (
+	"container/heap"
+	"sync"
+	"time"
+)
+
+// entry is a cached response along with its access metadata, linked into
+// the eviction order of its shard.
+type entry struct {
+	key        uint64
+	value      []byte
+	expiration time.Time
+	// expiryIndex is the position of the entry in the expiry heap of its
+	// shard, or -1 if it never expires.
+	expiryIndex int
+
+	prev, next *entry
+	// bucket is the frequency bucket of the entry for LFU and MFU.
+	bucket *bucket
+	// segment is the part of the cache the entry is in for W-TinyLFU.
+	segment segment
+	// hits, priority and index are the access count, the priority and
+	// the position in the priority queue of the entry for GDSF.
+	hits     int
+	priority float64
+	index    int
+}
+
+// list is an intrusive doubly linked list of entries, most recently used
+// first.
+type list struct {
+	root entry
+	len  int
+}
+
+func (l *list) init() *list {
+	l.root.next, l.root.prev = &l.root, &l.root
+	l.len = 0
+	return l
+}
+
+func (l *list) empty() bool {
+	return l.root.next == &l.root
+}
+
+func (l *list) pushFront(e *entry) {
+	e.prev, e.next = &l.root, l.root.next
+	l.root.next.prev = e
+	l.root.next = e
+	l.len++
+}
+
+func (l *list) remove(e *entry) {
+	e.prev.next, e.next.prev = e.next, e.prev
+	e.prev, e.next = nil, nil
+	l.len--
+}
+
+func (l *list) moveToFront(e *entry) {
+	l.remove(e)
+	l.pushFront(e)
+}
+
+// front and back return the first and the last entry but the one with the
+// given key, or nil.
+func (l *list) front(keep uint64) *entry {
+	for e := l.root.next; e != &l.root; e = e.next {
+		if e.key != keep {
+			return e
+		}
+	}
+	return nil
+}
+
+func (l *list) back(keep uint64) *entry {
+	for e := l.root.prev; e != &l.root; e = e.prev {
+		if e.key != keep {
+			return e
+		}
+	}
+	return nil
+}
+
+// policy orders the entries of a shard for eviction. Its methods are called
+// with the lock of the shard held.
+type policy interface {
+	// insert adds a new entry.
+	insert(e *entry)
+	// remove removes an entry, either released or evicted.
+	remove(e *entry)
+	// touch records an access to an entry.
+	touch(e *entry)
+	// miss records an access to a key which is not cached.
+	miss(key uint64)
+	// victim returns the entry to evict, or nil if there is none. The one
+	// with the given key, which is being set, is only returned by policies
+	// deciding whether to admit entries at all.
+	victim(keep uint64) *entry
+}
+
+// shard is a part of the adapter with its own lock and eviction policy.
+type shard struct {
+	mu     sync.Mutex
+	items  map[uint64]*entry
+	expiry expiryHeap
+	policy
+}
+
+// newShard returns a shard evicting entries as per a given algorithm, sized
+// for about capacity entries.
+func newShard(alg Algorithm, capacity int) *shard {
+	s := &shard{items: make(map[uint64]*entry)}
+	switch alg {
+	case MRU:
+		s.policy = newRecency(true)
+	case LFU, MFU:
+		s.policy = newFrequency(alg == MFU)
+	case WTinyLFU:
+		s.policy = newTinyLFU(capacity)
+	case GDSF:
+		s.policy = &gdsf{}
+	default:
+		s.policy = newRecency(false)
+	}
+	return s
+}
+
+func (s *shard) insert(e *entry) {
+	s.items[e.key] = e
+	e.expiryIndex = -1
+	s.setExpiration(e, e.expiration)
+	s.policy.insert(e)
+}
+
+func (s *shard) remove(e *entry) {
+	delete(s.items, e.key)
+	if e.expiryIndex >= 0 {
+		heap.Remove(&s.expiry, e.expiryIndex)
+	}
+	s.policy.remove(e)
+}
+
+// recency orders entries by their last access, for LRU and MRU.
+type recency struct {
+	mru     bool
+	entries list
+}
+
+func newRecency(mru bool) *recency {
+	r := &recency{mru: mru}
+	r.entries.init()
+	return r
+}
+
+func (r *recency) insert(e *entry) { r.entries.pushFront(e) }
+func (r *recency) remove(e *entry) { r.entries.remove(e) }
+func (r *recency) touch(e *entry)  { r.entries.moveToFront(e) }
+func (r *recency) miss(uint64)     {}
+
+func (r *recency) victim(keep uint64) *entry {
+	if r.mru {
+		return r.entries.front(keep)
+	}
+	return r.entries.back(keep)
+}
+
+// bucket holds the entries accessed a given number of times. Buckets are
+// linked in ascending order of frequency, and removed once empty.
+type bucket struct {
+	frequency  int
+	entries    list
+	prev, next *bucket
+}
+
+// frequency orders entries by their number of accesses then by their last
+// access, for LFU and MFU, so that accesses and evictions take constant
+// time.
+type frequency struct {
+	mfu     bool
+	buckets bucket
+}
+
+func newFrequency(mfu bool) *frequency {
+	f := &frequency{mfu: mfu}
+	f.buckets.next, f.buckets.prev = &f.buckets, &f.buckets
+	return f
+}
+
+func (f *frequency) insert(e *entry) {
+	b := f.buckets.next
+	if b == &f.buckets || b.frequency != 1 {
+		b = f.insertBucket(1, &f.buckets)
+	}
+	e.bucket = b
+	b.entries.pushFront(e)
+}
+
+func (f *frequency) remove(e *entry) {
+	b := e.bucket
+	b.entries.remove(e)
+	e.bucket = nil
+	if b.entries.empty() {
+		f.removeBucket(b)
+	}
+}
+
+func (f *frequency) touch(e *entry) {
+	b := e.bucket
+	next := b.next
+	if next == &f.buckets || next.frequency != b.frequency+1 {
+		next = f.insertBucket(b.frequency+1, b)
+	}
+	b.entries.remove(e)
+	if b.entries.empty() {
+		f.removeBucket(b)
+	}
+	e.bucket = next
+	next.entries.pushFront(e)
+}
+
+func (f *frequency) miss(uint64) {}
+
+func (f *frequency) victim(keep uint64) *entry {
+	if f.mfu {
+		for b := f.buckets.prev; b != &f.buckets; b = b.prev {
+			if e := b.entries.back(keep); e != nil {
+				return e
+			}
+		}
+		return nil
+	}
+	for b := f.buckets.next; b != &f.buckets; b = b.next {
+		if e := b.entries.back(keep); e != nil {
+			return e
+		}
+	}
+	return nil
+}
+
+// insertBucket links a new bucket for a given frequency after another one.
+func (f *frequency) insertBucket(frequency int, after *bucket) *bucket {
+	b := &bucket{frequency: frequency, prev: after, next: after.next}
+	b.entries.init()
+	after.next.prev = b
+	after.next = b
+	return b
+}
+
+func (f *frequency) removeBucket(b *bucket) {
+	b.prev.next, b.next.prev = b.next, b.prev
+}
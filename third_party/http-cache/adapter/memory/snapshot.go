@@ -0,0 +1,216 @@
+package memory
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// A snapshot is made of a header, the cached responses, each preceded by a
+// marker byte, and an end marker, so that a truncated snapshot is detected:
+//
+//	magic       "hcms"
+//	version     uint8
+//	responses   marker 1, key uint64, expiration int64 (Unix nanoseconds,
+//	            0 if none), length uint32, response
+//	end         marker 0
+//
+// Integers are big-endian.
+const (
+	snapshotMagic   = "hcms"
+	snapshotVersion = 1
+)
+
+// ErrSnapshotVersion is returned when reading a snapshot that is not one, or
+// that was written by another version of the adapter.
+var ErrSnapshotVersion = errors.New("memory adapter snapshot version is not supported")
+
+// snapshotEntry is a cached response copied from a shard.
+type snapshotEntry struct {
+	key        uint64
+	value      []byte
+	expiration time.Time
+}
+
+// WriteSnapshot writes the unexpired cached responses to w, so that they can
+// be restored by ReadSnapshot, e.g. after a restart. Shards are copied one at
+// a time, so that responses set meanwhile may or may not be included.
+func (a *Adapter) WriteSnapshot(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	bw.WriteString(snapshotMagic)
+	bw.WriteByte(snapshotVersion)
+
+	var entries []snapshotEntry
+	head := make([]byte, 21)
+	for _, s := range a.shards {
+		now := time.Now()
+		entries = entries[:0]
+		s.mu.Lock()
+		for _, e := range s.items {
+			if e.expiration.IsZero() || e.expiration.After(now) {
+				entries = append(entries, snapshotEntry{e.key, e.value, e.expiration})
+			}
+		}
+		s.mu.Unlock()
+
+		for _, e := range entries {
+			var exp int64
+			if !e.expiration.IsZero() {
+				exp = e.expiration.UnixNano()
+			}
+			head[0] = 1
+			binary.BigEndian.PutUint64(head[1:], e.key)
+			binary.BigEndian.PutUint64(head[9:], uint64(exp))
+			binary.BigEndian.PutUint32(head[17:], uint32(len(e.value)))
+			bw.Write(head)
+			if _, err := bw.Write(e.value); err != nil {
+				return err
+			}
+		}
+	}
+	bw.WriteByte(0)
+	return bw.Flush()
+}
+
+// ReadSnapshot sets the cached responses read from r, as written by
+// WriteSnapshot, skipping the ones expired meanwhile. It returns the number
+// of responses restored, and an error if the snapshot is of another version
+// or truncated, in which case the responses read so far are kept.
+func (a *Adapter) ReadSnapshot(r io.Reader) (int, error) {
+	br := bufio.NewReader(r)
+	header := make([]byte, len(snapshotMagic)+1)
+	if _, err := io.ReadFull(br, header); err != nil {
+		return 0, fmt.Errorf("%w: %v", ErrSnapshotVersion, err)
+	}
+	if string(header[:len(snapshotMagic)]) != snapshotMagic || header[len(snapshotMagic)] != snapshotVersion {
+		return 0, ErrSnapshotVersion
+	}
+
+	n := 0
+	head := make([]byte, 21)
+	for {
+		marker, err := br.ReadByte()
+		if err != nil {
+			return n, noEOF(err)
+		}
+		switch marker {
+		case 0:
+			return n, nil
+		case 1:
+		default:
+			return n, fmt.Errorf("memory adapter snapshot has an invalid marker %d", marker)
+		}
+		if _, err := io.ReadFull(br, head[1:]); err != nil {
+			return n, noEOF(err)
+		}
+		key := binary.BigEndian.Uint64(head[1:])
+		exp := int64(binary.BigEndian.Uint64(head[9:]))
+		size := binary.BigEndian.Uint32(head[17:])
+		if !a.storage.canCache(int(size)) {
+			// Too large for this adapter, e.g. restarted with less capacity.
+			if _, err := io.CopyN(io.Discard, br, int64(size)); err != nil {
+				return n, noEOF(err)
+			}
+			continue
+		}
+		value := make([]byte, size)
+		if _, err := io.ReadFull(br, value); err != nil {
+			return n, noEOF(err)
+		}
+
+		var expiration time.Time
+		if exp != 0 {
+			expiration = time.Unix(0, exp)
+			if !expiration.After(time.Now()) {
+				continue
+			}
+		}
+		a.Set(key, value, expiration)
+		n++
+	}
+}
+
+// SaveSnapshot writes a snapshot of the cached responses to a file, which is
+// replaced at once, so that it is never left partly written.
+func (a *Adapter) SaveSnapshot(path string) error {
+	if err := a.saveSnapshot(path); err != nil {
+		a.snapshotsFailed.Add(1)
+		return err
+	}
+	a.snapshots.Add(1)
+	return nil
+}
+
+func (a *Adapter) saveSnapshot(path string) error {
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	if err := a.WriteSnapshot(f); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+// LoadSnapshot restores the cached responses of a snapshot file written by
+// SaveSnapshot, see ReadSnapshot.
+func (a *Adapter) LoadSnapshot(path string) (int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	return a.ReadSnapshot(f)
+}
+
+func (a *Adapter) snapshotEvery(path string, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			a.SaveSnapshot(path)
+		case <-a.stop:
+			return
+		}
+	}
+}
+
+// noEOF reports the end of a snapshot before its end marker as truncation.
+func noEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// AdapterWithSnapshot sets a file a snapshot of the cached responses is saved
+// to in the background, at a given interval, see SaveSnapshot. Optional
+// setting. If not set, snapshots are only saved on demand.
+func AdapterWithSnapshot(path string, interval time.Duration) AdapterOptions {
+	return func(a *Adapter) error {
+		if path == "" {
+			return errors.New("memory adapter requires a snapshot file")
+		}
+		if interval <= 0 {
+			return errors.New("memory adapter requires a snapshot interval greater than 0")
+		}
+
+		a.snapshotPath = path
+		a.snapshotInterval = interval
+
+		return nil
+	}
+}
@@ -0,0 +1,163 @@
+package memory
+
+import (
+	"container/heap"
+	"errors"
+	"time"
+)
+
+// sweepBatch is the maximum number of expired entries released from a shard
+// per lock acquisition.
+const sweepBatch = 64
+
+// Stats are the counters of a memory adapter.
+type Stats struct {
+	// Items and Bytes are the number and the size of cached responses.
+	Items int64 `json:"items"`
+	Bytes int64 `json:"bytes"`
+
+	// Expired is the number of cached responses released by the sweeper
+	// once expired.
+	Expired int64 `json:"expired_total"`
+
+	// Evicted is the number of cached responses evicted to stay within the
+	// capacity.
+	Evicted int64 `json:"evicted_total"`
+
+	// Released is the number of cached responses released by the client.
+	Released int64 `json:"released_total"`
+
+	// Snapshots and SnapshotsFailed are the number of snapshots saved and
+	// failed to be saved.
+	Snapshots       int64 `json:"snapshots_total"`
+	SnapshotsFailed int64 `json:"snapshots_failed_total"`
+}
+
+// Stats returns a snapshot of the adapter counters.
+func (a *Adapter) Stats() Stats {
+	return Stats{
+		Items:    a.items.Load(),
+		Bytes:    a.storage.cur.Load(),
+		Expired:  a.expired.Load(),
+		Evicted:  a.evicted.Load(),
+		Released: a.released.Load(),
+
+		Snapshots:       a.snapshots.Load(),
+		SnapshotsFailed: a.snapshotsFailed.Load(),
+	}
+}
+
+// OnExpire implements the cache ExpiringAdapter interface OnExpire method.
+func (a *Adapter) OnExpire(f func(key uint64)) {
+	a.onExpire.Store(f)
+}
+
+// Close stops the sweeper and the background snapshots of the adapter, if
+// any.
+func (a *Adapter) Close() {
+	a.closeOnce.Do(func() {
+		if a.stop != nil {
+			close(a.stop)
+		}
+	})
+}
+
+func (a *Adapter) sweepEvery(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			a.sweep(now)
+		case <-a.stop:
+			return
+		}
+	}
+}
+
+// sweep releases the entries expired by now, shard by shard and in batches,
+// so that the lock of a shard is never held for long.
+func (a *Adapter) sweep(now time.Time) {
+	onExpire, _ := a.onExpire.Load().(func(key uint64))
+	keys := make([]uint64, 0, sweepBatch)
+	for _, s := range a.shards {
+		for {
+			keys = keys[:0]
+			s.mu.Lock()
+			for len(keys) < sweepBatch && len(s.expiry) > 0 && !s.expiry[0].expiration.After(now) {
+				e := s.expiry[0]
+				s.remove(e)
+				a.items.Add(-1)
+				a.storage.add(-len(e.value))
+				keys = append(keys, e.key)
+			}
+			s.mu.Unlock()
+
+			a.expired.Add(int64(len(keys)))
+			if onExpire != nil {
+				for _, key := range keys {
+					onExpire(key)
+				}
+			}
+			if len(keys) < sweepBatch {
+				break
+			}
+		}
+	}
+}
+
+// AdapterWithSweepInterval sets how often expired responses are released in
+// the background. Optional setting. If not set, expired responses are kept
+// until released by the client or evicted.
+func AdapterWithSweepInterval(interval time.Duration) AdapterOptions {
+	return func(a *Adapter) error {
+		if interval <= 0 {
+			return errors.New("memory adapter requires a sweep interval greater than 0")
+		}
+
+		a.sweepInterval = interval
+
+		return nil
+	}
+}
+
+// expiryHeap is a binary min-heap of the entries of a shard with an
+// expiration, by expiration, implementing heap.Interface.
+type expiryHeap []*entry
+
+func (h expiryHeap) Len() int           { return len(h) }
+func (h expiryHeap) Less(i, j int) bool { return h[i].expiration.Before(h[j].expiration) }
+
+func (h expiryHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].expiryIndex, h[j].expiryIndex = i, j
+}
+
+func (h *expiryHeap) Push(x interface{}) {
+	e := x.(*entry)
+	e.expiryIndex = len(*h)
+	*h = append(*h, e)
+}
+
+func (h *expiryHeap) Pop() interface{} {
+	old := *h
+	e := old[len(old)-1]
+	old[len(old)-1] = nil
+	*h = old[:len(old)-1]
+	e.expiryIndex = -1
+	return e
+}
+
+// setExpiration sets the expiration of an entry, keeping track of the ones
+// that expire at all.
+func (s *shard) setExpiration(e *entry, expiration time.Time) {
+	e.expiration = expiration
+	switch {
+	case e.expiryIndex >= 0 && expiration.IsZero():
+		heap.Remove(&s.expiry, e.expiryIndex)
+	case e.expiryIndex >= 0:
+		heap.Fix(&s.expiry, e.expiryIndex)
+	case !expiration.IsZero():
+		heap.Push(&s.expiry, e)
+	}
+}
@@ -0,0 +1,184 @@
+package memory
+
+// segment is the part of a W-TinyLFU shard an entry is in.
+type segment uint8
+
+const (
+	window segment = iota
+	candidate
+	probation
+	protected
+)
+
+// tinyLFU implements W-TinyLFU. New entries go to a small LRU window, and the
+// ones pushed out of it become candidates for the main part of the shard, a
+// segmented LRU. On eviction, a candidate is only admitted if it has been
+// accessed more often than the entry it would replace, as estimated by a
+// sketch also counting accesses to uncached keys, so one-hit wonders and
+// scans do not flush frequently used entries.
+type tinyLFU struct {
+	sketch     sketch
+	window     list
+	candidates list
+	probation  list
+	protected  list
+}
+
+func newTinyLFU(capacity int) *tinyLFU {
+	t := &tinyLFU{sketch: newSketch(capacity)}
+	t.window.init()
+	t.candidates.init()
+	t.probation.init()
+	t.protected.init()
+	return t
+}
+
+func (t *tinyLFU) segmentList(s segment) *list {
+	switch s {
+	case candidate:
+		return &t.candidates
+	case probation:
+		return &t.probation
+	case protected:
+		return &t.protected
+	default:
+		return &t.window
+	}
+}
+
+// windowSize is the number of entries kept in the window, 1% of the shard.
+func (t *tinyLFU) windowSize() int {
+	n := (t.window.len + t.candidates.len + t.probation.len + t.protected.len) / 100
+	if n < 1 {
+		return 1
+	}
+	return n
+}
+
+func (t *tinyLFU) insert(e *entry) {
+	e.segment = window
+	t.window.pushFront(e)
+	for t.window.len > t.windowSize() {
+		c := t.window.root.prev
+		t.window.remove(c)
+		c.segment = candidate
+		t.candidates.pushFront(c)
+	}
+}
+
+func (t *tinyLFU) remove(e *entry) {
+	t.segmentList(e.segment).remove(e)
+}
+
+func (t *tinyLFU) touch(e *entry) {
+	t.sketch.increment(e.key)
+	switch e.segment {
+	case window, protected:
+		t.segmentList(e.segment).moveToFront(e)
+	default:
+		t.segmentList(e.segment).remove(e)
+		e.segment = protected
+		t.protected.pushFront(e)
+		// The protected segment is limited to 80% of the main part of the
+		// shard, the least recently used entries beyond go back to
+		// probation.
+		for t.protected.len > (t.probation.len+t.protected.len)*4/5 {
+			p := t.protected.root.prev
+			t.protected.remove(p)
+			p.segment = probation
+			t.probation.pushFront(p)
+		}
+	}
+}
+
+func (t *tinyLFU) miss(key uint64) {
+	t.sketch.increment(key)
+}
+
+func (t *tinyLFU) victim(keep uint64) *entry {
+	for {
+		c := t.candidates.back(keep)
+		v := t.probation.back(keep)
+		if v == nil {
+			v = t.protected.back(keep)
+		}
+		switch {
+		case c == nil && v == nil:
+			return t.window.back(keep)
+		case c == nil:
+			return v
+		case v == nil:
+			// The main part is empty, the candidate has nothing to replace.
+			t.admit(c)
+		case t.sketch.estimate(c.key) > t.sketch.estimate(v.key):
+			t.admit(c)
+			return v
+		default:
+			return c
+		}
+	}
+}
+
+func (t *tinyLFU) admit(c *entry) {
+	t.candidates.remove(c)
+	c.segment = probation
+	t.probation.pushFront(c)
+}
+
+// sketch is a count-min sketch estimating how often keys have been accessed
+// recently. Counters saturate at 15 and are halved periodically, so that
+// estimates follow changes in popularity.
+type sketch struct {
+	rows      [4][]uint8
+	mask      uint64
+	additions int
+	resetAt   int
+}
+
+// sketchSeeds are the odd multipliers deriving the counter of a key in each
+// row.
+var sketchSeeds = [4]uint64{0x9e3779b97f4a7c15, 0xbf58476d1ce4e5b9, 0x94d049bb133111eb, 0xc2b2ae3d27d4eb4f}
+
+func newSketch(capacity int) sketch {
+	width := 256
+	for width < capacity {
+		width <<= 1
+	}
+	s := sketch{mask: uint64(width - 1), resetAt: 10 * width}
+	for i := range s.rows {
+		s.rows[i] = make([]uint8, width)
+	}
+	return s
+}
+
+func (s *sketch) index(key uint64, row int) uint64 {
+	h := key * sketchSeeds[row]
+	return (h ^ h>>32) & s.mask
+}
+
+func (s *sketch) increment(key uint64) {
+	for i := range s.rows {
+		if c := &s.rows[i][s.index(key, i)]; *c < 15 {
+			*c++
+		}
+	}
+	s.additions++
+	if s.additions >= s.resetAt {
+		for i := range s.rows {
+			for j := range s.rows[i] {
+				s.rows[i][j] >>= 1
+			}
+		}
+		s.additions /= 2
+	}
+}
+
+func (s *sketch) estimate(key uint64) uint8 {
+	m := uint8(15)
+	for i := range s.rows {
+		if c := s.rows[i][s.index(key, i)]; c < m {
+			m = c
+		}
+	}
+	return m
+}
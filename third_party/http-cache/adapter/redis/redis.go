@@ -25,59 +25,410 @@ SOFTWARE.
 package redis
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
-	redisCache "github.com/go-redis/cache"
-	"github.com/go-redis/redis"
+	"github.com/redis/go-redis/v9"
 	cache "github.com/victorspringer/http-cache"
-	"github.com/vmihailenco/msgpack"
 )
 
-// Adapter is the memory adapter data structure.
+// defaultTimeout is the time limit of a Redis command, unless set otherwise.
+const defaultTimeout = time.Second
+
+// rangeReadAhead is the number of bytes of a response read along with its
+// size while listing, enough for the metadata of most responses, so that
+// their bodies are not transferred.
+const rangeReadAhead = 4 << 10
+
+// Adapter is the Redis adapter data structure. Cached responses are stored
+// as they are, under their key and a prefix, and expire in Redis along with
+// them, so that several instances can share a cache. Standalone, Sentinel and
+// Cluster deployments are supported. It implements cache.AdapterV2, whose
+// commands are limited by the context as well as the adapter timeout.
 type Adapter struct {
-	store *redisCache.Codec
+	client  redis.UniversalClient
+	options redis.UniversalOptions
+	prefix  string
+	timeout time.Duration
+
+	failed atomic.Int64
 }
 
-// RingOptions exports go-redis RingOptions type.
-type RingOptions redis.RingOptions
+// AdapterOptions is used to set Adapter settings.
+type AdapterOptions func(a *Adapter) error
+
+// Stats are the counters of a Redis adapter.
+type Stats struct {
+	// Failed is the number of Redis commands that have failed, e.g. timed
+	// out, other than for a missing response.
+	Failed int64 `json:"failed_total"`
+
+	// Conns and IdleConns are the number of open and idle connections.
+	Conns     uint32 `json:"conns"`
+	IdleConns uint32 `json:"idle_conns"`
+}
 
 // Get implements the cache Adapter interface Get method.
 func (a *Adapter) Get(key uint64) ([]byte, bool) {
-	var c []byte
-	if err := a.store.Get(cache.KeyAsString(key), &c); err == nil {
-		return c, true
-	}
+	ctx, cancel := context.WithTimeout(context.Background(), a.timeout)
+	defer cancel()
 
-	return nil, false
+	b, ok, _ := a.GetContext(ctx, key)
+	return b, ok
 }
 
-// Set implements the cache Adapter interface Set method.
+// GetContext implements the cache AdapterV2 interface GetContext method.
+func (a *Adapter) GetContext(ctx context.Context, key uint64) ([]byte, bool, error) {
+	b, err := a.client.Get(ctx, a.key(key)).Bytes()
+	switch {
+	case errors.Is(err, redis.Nil):
+		return nil, false, nil
+	case err != nil:
+		a.failed.Add(1)
+		return nil, false, err
+	}
+	return b, true, nil
+}
+
+// Set implements the cache Adapter interface Set method. Responses expire in
+// Redis at their expiration, if any.
 func (a *Adapter) Set(key uint64, response []byte, expiration time.Time) {
-	a.store.Set(&redisCache.Item{
-		Key:        cache.KeyAsString(key),
-		Object:     response,
-		Expiration: expiration.Sub(time.Now()),
-	})
+	ctx, cancel := context.WithTimeout(context.Background(), a.timeout)
+	defer cancel()
+
+	a.SetContext(ctx, key, response, expiration)
+}
+
+// SetContext implements the cache AdapterV2 interface SetContext method.
+// Responses expire in Redis at their expiration, if any.
+func (a *Adapter) SetContext(ctx context.Context, key uint64, response []byte, expiration time.Time) error {
+	var ttl time.Duration
+	if !expiration.IsZero() {
+		ttl = time.Until(expiration)
+		if ttl <= 0 {
+			return a.ReleaseContext(ctx, key)
+		}
+	}
+
+	if err := a.client.Set(ctx, a.key(key), response, ttl).Err(); err != nil {
+		a.failed.Add(1)
+		return err
+	}
+	return nil
 }
 
 // Release implements the cache Adapter interface Release method.
 func (a *Adapter) Release(key uint64) {
-	a.store.Delete(cache.KeyAsString(key))
-}
-
-// NewAdapter initializes Redis adapter.
-func NewAdapter(opt *RingOptions) cache.Adapter {
-	ropt := redis.RingOptions(*opt)
-	return &Adapter{
-		&redisCache.Codec{
-			Redis: redis.NewRing(&ropt),
-			Marshal: func(v interface{}) ([]byte, error) {
-				return msgpack.Marshal(v)
-
-			},
-			Unmarshal: func(b []byte, v interface{}) error {
-				return msgpack.Unmarshal(b, v)
-			},
-		},
+	ctx, cancel := context.WithTimeout(context.Background(), a.timeout)
+	defer cancel()
+
+	a.ReleaseContext(ctx, key)
+}
+
+// ReleaseContext implements the cache AdapterV2 interface ReleaseContext
+// method.
+func (a *Adapter) ReleaseContext(ctx context.Context, key uint64) error {
+	if err := a.client.Del(ctx, a.key(key)).Err(); err != nil {
+		a.failed.Add(1)
+		return err
+	}
+	return nil
+}
+
+// Stats returns a snapshot of the adapter counters.
+func (a *Adapter) Stats() Stats {
+	pool := a.client.PoolStats()
+	return Stats{
+		Failed:    a.failed.Load(),
+		Conns:     pool.TotalConns,
+		IdleConns: pool.IdleConns,
+	}
+}
+
+// Close closes the connections of the adapter.
+func (a *Adapter) Close() error {
+	return a.client.Close()
+}
+
+// Range implements the cache EnumeratingAdapter interface Range method. The
+// keys under the prefix are scanned first, on every master of a Cluster, then
+// the responses are opened one at a time. Only their first bytes are read
+// along with their size, the rest with GETRANGE if needed, each command
+// limited by the adapter timeout.
+func (a *Adapter) Range(ctx context.Context, f func(key uint64, entry cache.EntryReader, size int64) bool) error {
+	var (
+		mu   sync.Mutex
+		keys []uint64
+	)
+	scan := func(ctx context.Context, c redis.Cmdable) error {
+		iter := c.Scan(ctx, 0, scanPattern(a.prefix), 1000).Iterator()
+		for iter.Next(ctx) {
+			key, err := strconv.ParseUint(strings.TrimPrefix(iter.Val(), a.prefix), 36, 64)
+			if err != nil {
+				// Not a response, e.g. of another application.
+				continue
+			}
+			mu.Lock()
+			keys = append(keys, key)
+			mu.Unlock()
+		}
+		return iter.Err()
+	}
+	var err error
+	if cc, ok := a.client.(*redis.ClusterClient); ok {
+		err = cc.ForEachMaster(ctx, func(ctx context.Context, c *redis.Client) error {
+			return scan(ctx, c)
+		})
+	} else {
+		err = scan(ctx, a.client)
+	}
+	if err != nil {
+		a.failed.Add(1)
+		return err
+	}
+
+	for _, key := range keys {
+		entry, err := a.openRange(ctx, key)
+		if err != nil {
+			return err
+		}
+		if entry != nil && !f(key, entry, entry.size) {
+			return nil
+		}
+	}
+	return nil
+}
+
+// openRange reads the size and the first bytes of a response in a single
+// round trip, or returns nil if it is not cached.
+func (a *Adapter) openRange(ctx context.Context, key uint64) (*rangeEntry, error) {
+	gctx, cancel := context.WithTimeout(ctx, a.timeout)
+	defer cancel()
+
+	k := a.key(key)
+	pipe := a.client.Pipeline()
+	size := pipe.StrLen(gctx, k)
+	head := pipe.GetRange(gctx, k, 0, rangeReadAhead-1)
+	if _, err := pipe.Exec(gctx); err != nil {
+		a.failed.Add(1)
+		return nil, err
+	}
+	if size.Val() == 0 {
+		return nil, nil
+	}
+	b, _ := head.Bytes()
+	return &rangeEntry{a: a, ctx: ctx, key: k, head: b, size: size.Val()}, nil
+}
+
+// rangeEntry is a response listed by Range, of which the bytes beyond the
+// ones read ahead are read on demand.
+type rangeEntry struct {
+	a    *Adapter
+	ctx  context.Context
+	key  string
+	head []byte
+	size int64
+}
+
+func (e *rangeEntry) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("redis adapter read at a negative offset")
+	}
+	if off >= e.size {
+		return 0, io.EOF
+	}
+	end := off + int64(len(p))
+	if end <= int64(len(e.head)) {
+		return copy(p, e.head[off:end]), nil
+	}
+
+	ctx, cancel := context.WithTimeout(e.ctx, e.a.timeout)
+	defer cancel()
+
+	b, err := e.a.client.GetRange(ctx, e.key, off, end-1).Bytes()
+	if err != nil {
+		e.a.failed.Add(1)
+		return 0, err
+	}
+	n := copy(p, b)
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (e *rangeEntry) Close() error {
+	return nil
+}
+
+// scanPattern returns the SCAN pattern matching the keys under a prefix.
+func scanPattern(prefix string) string {
+	var sb strings.Builder
+	for _, r := range prefix {
+		if strings.ContainsRune(`*?[]\`, r) {
+			sb.WriteByte('\\')
+		}
+		sb.WriteRune(r)
+	}
+	sb.WriteByte('*')
+	return sb.String()
+}
+
+func (a *Adapter) key(key uint64) string {
+	return a.prefix + cache.KeyAsString(key)
+}
+
+// NewAdapter initializes Redis adapter. A Sentinel client is used if a master
+// name is set, a Cluster client if several addresses are set or cluster mode
+// is, and a standalone client otherwise.
+func NewAdapter(opts ...AdapterOptions) (cache.Adapter, error) {
+	a := &Adapter{timeout: defaultTimeout}
+
+	for _, opt := range opts {
+		if err := opt(a); err != nil {
+			return nil, err
+		}
+	}
+
+	if a.client == nil {
+		if len(a.options.Addrs) == 0 {
+			return nil, errors.New("redis adapter addresses are not set")
+		}
+		a.options.ReadTimeout = a.timeout
+		a.options.WriteTimeout = a.timeout
+		a.client = redis.NewUniversalClient(&a.options)
+	}
+
+	return a, nil
+}
+
+// AdapterWithClient sets the Redis client used by the adapter, instead of
+// the one created from the connection settings, which are then ignored.
+func AdapterWithClient(client redis.UniversalClient) AdapterOptions {
+	return func(a *Adapter) error {
+		if client == nil {
+			return errors.New("redis adapter requires a client")
+		}
+
+		a.client = client
+
+		return nil
+	}
+}
+
+// AdapterWithAddrs sets the addresses, as host:port, of the Redis server,
+// of the Sentinels or of the Cluster nodes.
+func AdapterWithAddrs(addrs ...string) AdapterOptions {
+	return func(a *Adapter) error {
+		if len(addrs) == 0 {
+			return errors.New("redis adapter requires at least one address")
+		}
+
+		a.options.Addrs = addrs
+
+		return nil
+	}
+}
+
+// AdapterWithMasterName sets the name of the master monitored by the
+// Sentinels at the addresses. Optional setting.
+func AdapterWithMasterName(name string) AdapterOptions {
+	return func(a *Adapter) error {
+		if name == "" {
+			return errors.New("redis adapter requires a master name")
+		}
+
+		a.options.MasterName = name
+
+		return nil
+	}
+}
+
+// AdapterWithCluster sets that the addresses are of Cluster nodes, even if
+// there is only one, e.g. a configuration endpoint. Optional setting.
+func AdapterWithCluster() AdapterOptions {
+	return func(a *Adapter) error {
+		a.options.IsClusterMode = true
+
+		return nil
+	}
+}
+
+// AdapterWithAuth sets the credentials of the Redis servers, also used for
+// the Sentinels. The username may be empty for password-only
+// authentication. Optional setting.
+func AdapterWithAuth(username, password string) AdapterOptions {
+	return func(a *Adapter) error {
+		if password == "" {
+			return errors.New("redis adapter requires a password")
+		}
+
+		a.options.Username = username
+		a.options.Password = password
+		a.options.SentinelUsername = username
+		a.options.SentinelPassword = password
+
+		return nil
+	}
+}
+
+// AdapterWithDB sets the database of standalone and Sentinel servers.
+// Optional setting. If not set, database 0 is used.
+func AdapterWithDB(db int) AdapterOptions {
+	return func(a *Adapter) error {
+		if db < 0 {
+			return errors.New("redis adapter requires a database greater than or equal to 0")
+		}
+
+		a.options.DB = db
+
+		return nil
+	}
+}
+
+// AdapterWithTLS sets the TLS configuration used to connect to the Redis
+// servers. Optional setting. If not set, connections are not encrypted.
+func AdapterWithTLS(config *tls.Config) AdapterOptions {
+	return func(a *Adapter) error {
+		if config == nil {
+			return errors.New("redis adapter requires a TLS configuration")
+		}
+
+		a.options.TLSConfig = config
+
+		return nil
+	}
+}
+
+// AdapterWithKeyPrefix sets the prefix of the Redis keys of the cached
+// responses, e.g. to share a database with other applications. Optional
+// setting.
+func AdapterWithKeyPrefix(prefix string) AdapterOptions {
+	return func(a *Adapter) error {
+		a.prefix = prefix
+
+		return nil
+	}
+}
+
+// AdapterWithTimeout sets the time limit of a Redis command, beyond which
+// responses are treated as not cached. Optional setting. If not set, it is 1
+// second.
+func AdapterWithTimeout(timeout time.Duration) AdapterOptions {
+	return func(a *Adapter) error {
+		if timeout <= 0 {
+			return errors.New("redis adapter requires a timeout greater than 0")
+		}
+
+		a.timeout = timeout
+
+		return nil
 	}
 }
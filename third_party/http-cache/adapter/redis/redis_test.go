@@ -1,26 +1,38 @@
 package redis
 
 import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
 	"reflect"
 	"testing"
 	"time"
 
+	"github.com/alicebob/miniredis/v2"
 	"github.com/victorspringer/http-cache"
 )
 
-var a cache.Adapter
+func newTestAdapter(t *testing.T, mr *miniredis.Miniredis, opts ...AdapterOptions) *Adapter {
+	t.Helper()
+	a, err := NewAdapter(append([]AdapterOptions{AdapterWithAddrs(mr.Addr())}, opts...)...)
+	if err != nil {
+		t.Fatalf("NewAdapter() error = %v", err)
+	}
+	t.Cleanup(func() { a.(*Adapter).Close() })
+	return a.(*Adapter)
+}
 
 func TestSet(t *testing.T) {
-	a = NewAdapter(&RingOptions{
-		Addrs: map[string]string{
-			"server": ":6379",
-		},
-	})
+	mr := miniredis.RunT(t)
+	a := newTestAdapter(t, mr)
 
 	tests := []struct {
-		name     string
-		key      uint64
-		response []byte
+		name       string
+		key        uint64
+		response   []byte
+		expiration time.Time
+		wantTTL    time.Duration
 	}{
 		{
 			"sets a response cache",
@@ -29,32 +41,53 @@ func TestSet(t *testing.T) {
 				Value:      []byte("value 1"),
 				Expiration: time.Now().Add(1 * time.Minute),
 			}.Bytes(),
+			time.Now().Add(1 * time.Minute),
+			1 * time.Minute,
 		},
 		{
-			"sets a response cache",
+			"sets a response cache without expiration",
 			2,
 			cache.Response{
-				Value:      []byte("value 2"),
-				Expiration: time.Now().Add(1 * time.Minute),
+				Value: []byte("value 2"),
 			}.Bytes(),
+			time.Time{},
+			0,
 		},
 		{
-			"sets a response cache",
+			"does not set an expired response cache",
 			3,
 			cache.Response{
 				Value:      []byte("value 3"),
-				Expiration: time.Now().Add(1 * time.Minute),
+				Expiration: time.Now().Add(-1 * time.Minute),
 			}.Bytes(),
+			time.Now().Add(-1 * time.Minute),
+			0,
 		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			a.Set(tt.key, tt.response, time.Now().Add(1*time.Minute))
+			a.Set(tt.key, tt.response, tt.expiration)
+			name := cache.KeyAsString(tt.key)
+			if got := mr.TTL(name); got < tt.wantTTL-time.Second || got > tt.wantTTL {
+				t.Errorf("redis.Set() TTL = %v, want %v", got, tt.wantTTL)
+			}
+			if got := tt.expiration.IsZero() || tt.expiration.After(time.Now()); mr.Exists(name) != got {
+				t.Errorf("redis.Set() exists = %v, want %v", mr.Exists(name), got)
+			}
 		})
 	}
 }
 
 func TestGet(t *testing.T) {
+	mr := miniredis.RunT(t)
+	a := newTestAdapter(t, mr)
+	for key, value := range map[uint64]string{1: "value 1", 2: "value 2", 3: "value 3"} {
+		a.Set(key, cache.Response{Value: []byte(value)}.Bytes(), time.Now().Add(1*time.Minute))
+	}
+	mr.FastForward(2 * time.Minute)
+	a.Set(1, cache.Response{Value: []byte("value 1")}.Bytes(), time.Now().Add(1*time.Minute))
+	a.Set(2, cache.Response{Value: []byte("value 2")}.Bytes(), time.Time{})
+
 	tests := []struct {
 		name string
 		key  uint64
@@ -73,6 +106,12 @@ func TestGet(t *testing.T) {
 			[]byte("value 2"),
 			true,
 		},
+		{
+			"key has expired",
+			3,
+			nil,
+			false,
+		},
 		{
 			"key does not exist",
 			4,
@@ -84,18 +123,27 @@ func TestGet(t *testing.T) {
 		t.Run(tt.name, func(t *testing.T) {
 			b, ok := a.Get(tt.key)
 			if ok != tt.ok {
-				t.Errorf("memory.Get() ok = %v, tt.ok %v", ok, tt.ok)
+				t.Errorf("redis.Get() ok = %v, tt.ok %v", ok, tt.ok)
 				return
 			}
 			got := cache.BytesToResponse(b).Value
 			if !reflect.DeepEqual(got, tt.want) {
-				t.Errorf("memory.Get() = %v, want %v", string(got), string(tt.want))
+				t.Errorf("redis.Get() = %v, want %v", string(got), string(tt.want))
 			}
 		})
 	}
+	if s := a.Stats(); s.Failed != 0 {
+		t.Errorf("redis.Stats() = %+v, want no failure", s)
+	}
 }
 
 func TestRelease(t *testing.T) {
+	mr := miniredis.RunT(t)
+	a := newTestAdapter(t, mr)
+	for key := uint64(1); key <= 3; key++ {
+		a.Set(key, cache.Response{Value: []byte("value")}.Bytes(), time.Now().Add(1*time.Minute))
+	}
+
 	tests := []struct {
 		name string
 		key  uint64
@@ -121,7 +169,241 @@ func TestRelease(t *testing.T) {
 		t.Run(tt.name, func(t *testing.T) {
 			a.Release(tt.key)
 			if _, ok := a.Get(tt.key); ok {
-				t.Errorf("memory.Release() error; key %v should not be found", tt.key)
+				t.Errorf("redis.Release() error; key %v should not be found", tt.key)
+			}
+		})
+	}
+}
+
+func TestKeyPrefix(t *testing.T) {
+	mr := miniredis.RunT(t)
+	a := newTestAdapter(t, mr, AdapterWithKeyPrefix("a:"))
+	b := newTestAdapter(t, mr, AdapterWithKeyPrefix("a:"))
+	c := newTestAdapter(t, mr, AdapterWithKeyPrefix("c:"))
+
+	a.Set(1, []byte("value 1"), time.Time{})
+
+	if !mr.Exists("a:" + cache.KeyAsString(1)) {
+		t.Errorf("redis.Set() did not prefix key, keys = %v", mr.Keys())
+	}
+	if _, ok := b.Get(1); !ok {
+		t.Error("redis.Get() missed a response set by another adapter with the same prefix")
+	}
+	if _, ok := c.Get(1); ok {
+		t.Error("redis.Get() found a response set by another adapter with another prefix")
+	}
+}
+
+func TestFailed(t *testing.T) {
+	mr := miniredis.RunT(t)
+	a := newTestAdapter(t, mr, AdapterWithTimeout(100*time.Millisecond))
+	mr.Close()
+
+	a.Set(1, []byte("value 1"), time.Time{})
+	if _, ok := a.Get(1); ok {
+		t.Error("redis.Get() ok = true with the server down")
+	}
+	if s := a.Stats(); s.Failed != 2 {
+		t.Errorf("redis.Stats() failed = %v, want 2", s.Failed)
+	}
+}
+
+func TestContext(t *testing.T) {
+	mr := miniredis.RunT(t)
+	a := newTestAdapter(t, mr)
+	ctx := context.Background()
+
+	if err := a.SetContext(ctx, 1, []byte("value 1"), time.Time{}); err != nil {
+		t.Fatalf("redis.SetContext() error = %v", err)
+	}
+	if b, ok, err := a.GetContext(ctx, 1); !ok || err != nil || string(b) != "value 1" {
+		t.Errorf("redis.GetContext() = %q, %v, %v, want value 1", b, ok, err)
+	}
+	if _, ok, err := a.GetContext(ctx, 2); ok || err != nil {
+		t.Errorf("redis.GetContext() of a missing key = %v, %v, want no error", ok, err)
+	}
+
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	if _, ok, err := a.GetContext(canceled, 1); ok || !errors.Is(err, context.Canceled) {
+		t.Errorf("redis.GetContext() with a canceled context = %v, %v, want %v", ok, err, context.Canceled)
+	}
+	if err := a.ReleaseContext(canceled, 1); !errors.Is(err, context.Canceled) {
+		t.Errorf("redis.ReleaseContext() with a canceled context error = %v, want %v", err, context.Canceled)
+	}
+	if !mr.Exists(cache.KeyAsString(1)) {
+		t.Error("redis.ReleaseContext() released a key with a canceled context")
+	}
+
+	if err := a.ReleaseContext(ctx, 1); err != nil {
+		t.Errorf("redis.ReleaseContext() error = %v", err)
+	}
+	if mr.Exists(cache.KeyAsString(1)) {
+		t.Error("redis.ReleaseContext() did not release key")
+	}
+}
+
+func TestRange(t *testing.T) {
+	mr := miniredis.RunT(t)
+	a := newTestAdapter(t, mr, AdapterWithKeyPrefix("a*:"))
+	b := newTestAdapter(t, mr, AdapterWithKeyPrefix("ab:"))
+	a.Set(1, []byte("value 1"), time.Time{})
+	a.Set(2, []byte("value 2"), time.Now().Add(time.Minute))
+	b.Set(3, []byte("value 3"), time.Time{})
+	mr.Set("a*:lock:1", "other")
+
+	got := map[uint64]string{}
+	err := a.Range(context.Background(), func(key uint64, entry cache.EntryReader, size int64) bool {
+		buf := make([]byte, size)
+		if _, err := entry.ReadAt(buf, 0); err != nil {
+			t.Errorf("redis.Range() entry read error = %v", err)
+		}
+		got[key] = string(buf)
+		return true
+	})
+	if err != nil {
+		t.Fatalf("redis.Range() error = %v", err)
+	}
+	if want := map[uint64]string{1: "value 1", 2: "value 2"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("redis.Range() = %v, want %v", got, want)
+	}
+
+	mr.Close()
+	if err := a.Range(context.Background(), func(uint64, cache.EntryReader, int64) bool { return true }); err == nil {
+		t.Error("redis.Range() error = nil with the server down")
+	}
+}
+
+func TestRangeReadAhead(t *testing.T) {
+	mr := miniredis.RunT(t)
+	a := newTestAdapter(t, mr)
+	response := cache.Response{
+		Key:        "http://example.com/large.bin",
+		StatusCode: 200,
+		Value:      bytes.Repeat([]byte("0123456789"), rangeReadAhead),
+		Expiration: time.Now().Add(time.Minute),
+	}
+	value := response.Bytes()
+	a.Set(1, value, response.Expiration)
+
+	err := a.Range(context.Background(), func(key uint64, entry cache.EntryReader, size int64) bool {
+		if size != int64(len(value)) {
+			t.Errorf("redis.Range() size = %v, want %v", size, len(value))
+		}
+		for _, off := range []int64{0, rangeReadAhead - 10, 3 * rangeReadAhead} {
+			buf := make([]byte, 20)
+			if _, err := entry.ReadAt(buf, off); err != nil {
+				t.Errorf("redis.Range() entry read at %v error = %v", off, err)
+			}
+			if want := value[off : off+20]; !bytes.Equal(buf, want) {
+				t.Errorf("redis.Range() entry read at %v = %q, want %q", off, buf, want)
+			}
+		}
+		buf := make([]byte, 20)
+		if n, err := entry.ReadAt(buf, size-10); n != 10 || err == nil {
+			t.Errorf("redis.Range() entry read past the end = %v, %v, want 10, EOF", n, err)
+		}
+		return true
+	})
+	if err != nil {
+		t.Fatalf("redis.Range() error = %v", err)
+	}
+
+	client, err := cache.NewClient(cache.ClientWithAdapter(a), cache.ClientWithTTL(time.Minute))
+	if err != nil {
+		t.Fatalf("cache.NewClient() error = %v", err)
+	}
+	var keys []string
+	if err := client.Entries(context.Background(), func(e cache.Entry) bool {
+		keys = append(keys, e.Key)
+		return true
+	}); err != nil {
+		t.Fatalf("Client.Entries() error = %v", err)
+	}
+	if want := []string{response.Key}; !reflect.DeepEqual(keys, want) {
+		t.Errorf("Client.Entries() keys = %v, want %v", keys, want)
+	}
+}
+
+func TestNewAdapter(t *testing.T) {
+	tests := []struct {
+		name    string
+		opts    []AdapterOptions
+		wantErr bool
+	}{
+		{
+			"returns new Adapter",
+			[]AdapterOptions{
+				AdapterWithAddrs("localhost:6379"),
+				AdapterWithAuth("", "secret"),
+				AdapterWithDB(1),
+				AdapterWithTLS(&tls.Config{MinVersion: tls.VersionTLS12}),
+				AdapterWithKeyPrefix("cache:"),
+				AdapterWithTimeout(time.Second),
+			},
+			false,
+		},
+		{
+			"returns new Sentinel Adapter",
+			[]AdapterOptions{
+				AdapterWithAddrs("localhost:26379", "localhost:26380"),
+				AdapterWithMasterName("mymaster"),
+			},
+			false,
+		},
+		{
+			"returns new Cluster Adapter",
+			[]AdapterOptions{
+				AdapterWithAddrs("localhost:7000"),
+				AdapterWithCluster(),
+			},
+			false,
+		},
+		{
+			"returns error",
+			[]AdapterOptions{},
+			true,
+		},
+		{
+			"returns error",
+			[]AdapterOptions{
+				AdapterWithAddrs(),
+			},
+			true,
+		},
+		{
+			"returns error",
+			[]AdapterOptions{
+				AdapterWithAddrs("localhost:6379"),
+				AdapterWithTimeout(0),
+			},
+			true,
+		},
+		{
+			"returns error",
+			[]AdapterOptions{
+				AdapterWithAddrs("localhost:6379"),
+				AdapterWithDB(-1),
+			},
+			true,
+		},
+		{
+			"returns error",
+			[]AdapterOptions{
+				AdapterWithClient(nil),
+			},
+			true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a, err := NewAdapter(tt.opts...)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("NewAdapter() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if a != nil {
+				a.(*Adapter).Close()
 			}
 		})
 	}
@@ -0,0 +1,53 @@
+package tiered
+
+import "sync"
+
+// maxTracked is the number of keys whose hits are counted by AdmitAfterHits
+// before the counts are reset, so that they follow changes in popularity.
+const maxTracked = 1 << 16
+
+// AdmissionPolicy decides which cached responses found in L2 are promoted to
+// L1.
+type AdmissionPolicy interface {
+	// Admit returns true or false, whether the cached response of a given
+	// size for a given key, just found in L2, is promoted.
+	Admit(key uint64, size int64) bool
+}
+
+// AdmitAlways returns a policy promoting every cached response found in L2.
+func AdmitAlways() AdmissionPolicy {
+	return admitAlways{}
+}
+
+type admitAlways struct{}
+
+func (admitAlways) Admit(uint64, int64) bool { return true }
+
+// AdmitAfterHits returns a policy promoting cached responses found in L2 a
+// given number of times, so that responses requested once do not push more
+// popular ones out of L1.
+func AdmitAfterHits(n int) AdmissionPolicy {
+	return &admitAfterHits{n: n, hits: make(map[uint64]int)}
+}
+
+type admitAfterHits struct {
+	n    int
+	mu   sync.Mutex
+	hits map[uint64]int
+}
+
+func (p *admitAfterHits) Admit(key uint64, _ int64) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	hits := p.hits[key] + 1
+	if hits >= p.n {
+		delete(p.hits, key)
+		return true
+	}
+	if len(p.hits) >= maxTracked {
+		p.hits = make(map[uint64]int)
+	}
+	p.hits[key] = hits
+	return false
+}
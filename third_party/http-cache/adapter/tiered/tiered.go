@@ -0,0 +1,370 @@
+package tiered
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	cache "github.com/victorspringer/http-cache"
+)
+
+// defaultDemoteTimeout is how long demoting a response to L2 may take by
+// default.
+const defaultDemoteTimeout = time.Second
+
+// Adapter is the tiered adapter data structure. Cached responses are held by
+// a fast L1 adapter, e.g. memory, and the ones it evicts are demoted to a
+// larger L2 adapter, e.g. disk, from which they are promoted back to L1 when
+// the admission policy admits them. A response is held by one tier at a
+// time, so that the capacity of both adds up.
+//
+// It implements cache.AdapterV2, and so do its L2 operations if L2 does,
+// while L1 is expected never to fail or block.
+type Adapter struct {
+	l1, l2        cache.Adapter
+	l2v2          cache.AdapterV2
+	admission     AdmissionPolicy
+	maxL1Size     int
+	demoteTimeout time.Duration
+
+	l1Hits   atomic.Int64
+	l2Hits   atomic.Int64
+	misses   atomic.Int64
+	promoted atomic.Int64
+	demoted  atomic.Int64
+}
+
+// AdapterOptions is used to set Adapter settings.
+type AdapterOptions func(a *Adapter) error
+
+// Stats are the counters of a tiered adapter.
+type Stats struct {
+	// L1Hits and L2Hits are the number of cached responses found in each
+	// tier, and Misses the number of responses found in neither.
+	L1Hits int64 `json:"l1_hits_total"`
+	L2Hits int64 `json:"l2_hits_total"`
+	Misses int64 `json:"misses_total"`
+
+	// Promoted is the number of cached responses moved from L2 to L1, and
+	// Demoted from L1 to L2.
+	Promoted int64 `json:"promoted_total"`
+	Demoted  int64 `json:"demoted_total"`
+}
+
+// Get implements the cache Adapter interface Get method.
+func (a *Adapter) Get(key uint64) ([]byte, bool) {
+	b, ok, _ := a.GetContext(context.Background(), key)
+	return b, ok
+}
+
+// GetContext implements the cache AdapterV2 interface GetContext method.
+func (a *Adapter) GetContext(ctx context.Context, key uint64) ([]byte, bool, error) {
+	if b, ok := a.l1.Get(key); ok {
+		a.l1Hits.Add(1)
+		return b, true, nil
+	}
+	b, ok, err := a.l2v2.GetContext(ctx, key)
+	if !ok {
+		a.misses.Add(1)
+		return nil, false, err
+	}
+	a.l2Hits.Add(1)
+	if a.admits(key, int64(len(b))) {
+		a.promote(ctx, key, b)
+	}
+	return b, true, nil
+}
+
+// Open implements the cache StreamingAdapter interface Open method. Cached
+// responses are streamed from L2 if it is a StreamingAdapter, unless they are
+// promoted.
+func (a *Adapter) Open(key uint64) (cache.EntryReader, int64, bool) {
+	f, size, ok, _ := a.OpenContext(context.Background(), key)
+	return f, size, ok
+}
+
+// OpenContext implements the cache StreamingAdapterV2 interface OpenContext
+// method, see Open.
+func (a *Adapter) OpenContext(ctx context.Context, key uint64) (cache.EntryReader, int64, bool, error) {
+	if b, ok := a.l1.Get(key); ok {
+		a.l1Hits.Add(1)
+		return entryReader{bytes.NewReader(b), b}, int64(len(b)), true, nil
+	}
+	f, size, ok, err := a.openL2(ctx, key)
+	if !ok {
+		a.misses.Add(1)
+		return nil, 0, false, err
+	}
+	a.l2Hits.Add(1)
+	if !a.admits(key, size) {
+		return f, size, true, nil
+	}
+
+	r, ok := f.(entryReader)
+	if !ok {
+		r = entryReader{b: make([]byte, size)}
+		_, err := f.ReadAt(r.b, 0)
+		f.Close()
+		if err != nil {
+			return nil, 0, false, err
+		}
+		r.Reader = bytes.NewReader(r.b)
+	}
+	a.promote(ctx, key, r.b)
+	return r, size, true, nil
+}
+
+// Set implements the cache Adapter interface Set method. Responses too large
+// for L1 are set in L2 straight away.
+func (a *Adapter) Set(key uint64, response []byte, expiration time.Time) {
+	a.SetContext(context.Background(), key, response, expiration)
+}
+
+// SetContext implements the cache AdapterV2 interface SetContext method, see
+// Set.
+func (a *Adapter) SetContext(ctx context.Context, key uint64, response []byte, expiration time.Time) error {
+	if a.maxL1Size > 0 && len(response) > a.maxL1Size {
+		err := a.l2v2.SetContext(ctx, key, response, expiration)
+		a.l1.Release(key)
+		return err
+	}
+	// L2 is released first, as L1 may evict the response straight away,
+	// demoting it.
+	err := a.l2v2.ReleaseContext(ctx, key)
+	a.l1.Set(key, response, expiration)
+	return err
+}
+
+// Release implements the cache Adapter interface Release method.
+func (a *Adapter) Release(key uint64) {
+	a.ReleaseContext(context.Background(), key)
+}
+
+// ReleaseContext implements the cache AdapterV2 interface ReleaseContext
+// method.
+func (a *Adapter) ReleaseContext(ctx context.Context, key uint64) error {
+	a.l1.Release(key)
+	return a.l2v2.ReleaseContext(ctx, key)
+}
+
+// OnExpire implements the cache ExpiringAdapter interface OnExpire method,
+// for the responses expired in either tier.
+func (a *Adapter) OnExpire(f func(key uint64)) {
+	for _, t := range []cache.Adapter{a.l1, a.l2} {
+		if t, ok := t.(cache.ExpiringAdapter); ok {
+			t.OnExpire(f)
+		}
+	}
+}
+
+// Tiers returns the L1 and L2 adapters.
+func (a *Adapter) Tiers() (l1, l2 cache.Adapter) {
+	return a.l1, a.l2
+}
+
+// Range implements the cache EnumeratingAdapter interface Range method,
+// listing the responses held by L1, then the ones held by L2 only. It returns
+// an error wrapping cache.ErrNotEnumerating if a tier does not list its
+// responses.
+func (a *Adapter) Range(ctx context.Context, f func(key uint64, entry cache.EntryReader, size int64) bool) error {
+	l1, ok1 := a.l1.(cache.EnumeratingAdapter)
+	l2, ok2 := a.l2.(cache.EnumeratingAdapter)
+	if !ok1 || !ok2 {
+		return fmt.Errorf("tiered adapter tier: %w", cache.ErrNotEnumerating)
+	}
+
+	seen := make(map[uint64]struct{})
+	more := true
+	err := l1.Range(ctx, func(key uint64, entry cache.EntryReader, size int64) bool {
+		seen[key] = struct{}{}
+		more = f(key, entry, size)
+		return more
+	})
+	if err != nil || !more {
+		return err
+	}
+	return l2.Range(ctx, func(key uint64, entry cache.EntryReader, size int64) bool {
+		if _, ok := seen[key]; ok {
+			return true
+		}
+		return f(key, entry, size)
+	})
+}
+
+// Stats returns a snapshot of the adapter counters.
+func (a *Adapter) Stats() Stats {
+	return Stats{
+		L1Hits:   a.l1Hits.Load(),
+		L2Hits:   a.l2Hits.Load(),
+		Misses:   a.misses.Load(),
+		Promoted: a.promoted.Load(),
+		Demoted:  a.demoted.Load(),
+	}
+}
+
+// admits returns true or false, whether a cached response of a given size
+// found in L2 should be promoted to L1.
+func (a *Adapter) admits(key uint64, size int64) bool {
+	if a.maxL1Size > 0 && size > int64(a.maxL1Size) {
+		return false
+	}
+	return a.admission.Admit(key, size)
+}
+
+// openL2 opens a cached response held by L2, streaming it if L2 is a
+// StreamingAdapter.
+func (a *Adapter) openL2(ctx context.Context, key uint64) (cache.EntryReader, int64, bool, error) {
+	switch l2 := a.l2.(type) {
+	case cache.StreamingAdapterV2:
+		return l2.OpenContext(ctx, key)
+	case cache.StreamingAdapter:
+		if err := ctx.Err(); err != nil {
+			return nil, 0, false, err
+		}
+		f, size, ok := l2.Open(key)
+		return f, size, ok, nil
+	}
+	b, ok, err := a.l2v2.GetContext(ctx, key)
+	if !ok {
+		return nil, 0, false, err
+	}
+	return entryReader{bytes.NewReader(b), b}, int64(len(b)), true, nil
+}
+
+// promote moves a cached response found in L2 to L1. Responses which cannot
+// be decoded are left to the client to release, and responses which cannot be
+// released from L2 are left there.
+func (a *Adapter) promote(ctx context.Context, key uint64, b []byte) {
+	response, err := cache.DecodeResponse(b)
+	if err != nil {
+		return
+	}
+	if err := a.l2v2.ReleaseContext(ctx, key); err != nil {
+		return
+	}
+	a.l1.Set(key, b, response.RetainUntil())
+	a.promoted.Add(1)
+}
+
+// demote moves a response evicted from L1 to L2, within the demote timeout
+// as it holds up the request that caused the eviction. The response is
+// dropped if L2 fails to cache it in time.
+func (a *Adapter) demote(key uint64, response []byte, expiration time.Time) {
+	if !expiration.IsZero() && !expiration.After(time.Now()) {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), a.demoteTimeout)
+	defer cancel()
+	if err := a.l2v2.SetContext(ctx, key, response, expiration); err != nil {
+		return
+	}
+	a.demoted.Add(1)
+}
+
+// entryReader reads a cached response held in memory.
+type entryReader struct {
+	*bytes.Reader
+	b []byte
+}
+
+func (r entryReader) Bytes() []byte { return r.b }
+func (r entryReader) Close() error  { return nil }
+
+// NewAdapter initializes tiered adapter.
+func NewAdapter(opts ...AdapterOptions) (cache.Adapter, error) {
+	a := &Adapter{admission: AdmitAlways(), demoteTimeout: defaultDemoteTimeout}
+
+	for _, opt := range opts {
+		if err := opt(a); err != nil {
+			return nil, err
+		}
+	}
+
+	if a.l1 == nil {
+		return nil, errors.New("tiered adapter L1 is not set")
+	}
+	if a.l2 == nil {
+		return nil, errors.New("tiered adapter L2 is not set")
+	}
+	l1, ok := a.l1.(cache.EvictingAdapter)
+	if !ok {
+		return nil, errors.New("tiered adapter L1 does not report evictions")
+	}
+	l1.OnEvict(a.demote)
+	a.l2v2 = cache.UpgradeAdapter(a.l2)
+
+	return a, nil
+}
+
+// AdapterWithL1 sets the adapter responses are cached in first, which must
+// implement cache.EvictingAdapter.
+func AdapterWithL1(l1 cache.Adapter) AdapterOptions {
+	return func(a *Adapter) error {
+		if l1 == nil {
+			return errors.New("tiered adapter requires an L1 adapter")
+		}
+
+		a.l1 = l1
+
+		return nil
+	}
+}
+
+// AdapterWithL2 sets the adapter responses evicted from L1 are demoted to.
+func AdapterWithL2(l2 cache.Adapter) AdapterOptions {
+	return func(a *Adapter) error {
+		if l2 == nil {
+			return errors.New("tiered adapter requires an L2 adapter")
+		}
+
+		a.l2 = l2
+
+		return nil
+	}
+}
+
+// AdapterWithAdmission sets the policy deciding which cached responses found
+// in L2 are promoted to L1. Optional setting. If not set, all of them are.
+func AdapterWithAdmission(p AdmissionPolicy) AdapterOptions {
+	return func(a *Adapter) error {
+		if p == nil {
+			return errors.New("tiered adapter requires an admission policy")
+		}
+
+		a.admission = p
+
+		return nil
+	}
+}
+
+// AdapterWithMaxL1Size sets the size in bytes above which responses are only
+// cached in L2, e.g. so that large ones are streamed from disk. Optional
+// setting. If not set, responses of any size are cached in L1 first.
+func AdapterWithMaxL1Size(size int) AdapterOptions {
+	return func(a *Adapter) error {
+		if size <= 0 {
+			return errors.New("tiered adapter requires a maximum L1 size greater than 0")
+		}
+
+		a.maxL1Size = size
+
+		return nil
+	}
+}
+
+// AdapterWithDemoteTimeout sets how long demoting a response evicted from L1
+// to L2 may take. Optional setting. If not set, it is 1 second.
+func AdapterWithDemoteTimeout(timeout time.Duration) AdapterOptions {
+	return func(a *Adapter) error {
+		if timeout <= 0 {
+			return errors.New("tiered adapter requires a demote timeout greater than 0")
+		}
+
+		a.demoteTimeout = timeout
+
+		return nil
+	}
+}
@@ -0,0 +1,324 @@
+package tiered
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	cache "github.com/victorspringer/http-cache"
+	"github.com/victorspringer/http-cache/adapter/disk"
+	"github.com/victorspringer/http-cache/adapter/memory"
+)
+
+func newTestAdapter(t *testing.T, opts ...AdapterOptions) (*Adapter, *memory.Adapter, *disk.Adapter) {
+	t.Helper()
+	l1, err := memory.NewAdapter(memory.AdapterWithCapacity(2), memory.AdapterWithAlgorithm(memory.LRU), memory.AdapterWithShards(1))
+	if err != nil {
+		t.Fatalf("memory.NewAdapter() error = %v", err)
+	}
+	l2, err := disk.NewAdapter(disk.AdapterWithDirectory(t.TempDir()), disk.AdapterWithCapacity(1<<20))
+	if err != nil {
+		t.Fatalf("disk.NewAdapter() error = %v", err)
+	}
+	a, err := NewAdapter(append([]AdapterOptions{AdapterWithL1(l1), AdapterWithL2(l2)}, opts...)...)
+	if err != nil {
+		t.Fatalf("NewAdapter() error = %v", err)
+	}
+	return a.(*Adapter), l1.(*memory.Adapter), l2.(*disk.Adapter)
+}
+
+func response(value string) []byte {
+	return cache.Response{Value: []byte(value), Expiration: time.Now().Add(time.Minute)}.Bytes()
+}
+
+func TestGet(t *testing.T) {
+	a, l1, l2 := newTestAdapter(t)
+	for key := uint64(1); key <= 3; key++ {
+		a.Set(key, response("value"), time.Now().Add(time.Minute))
+	}
+
+	tests := []struct {
+		name   string
+		key    uint64
+		ok     bool
+		wantL1 bool
+		wantL2 bool
+	}{
+		{"demotes evicted response", 1, true, true, false},
+		{"keeps response in L1", 3, true, true, false},
+		{"demotes response evicted by promotion", 2, true, true, false},
+		{"not found", 4, false, false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, ok := a.Get(tt.key); ok != tt.ok {
+				t.Fatalf("tiered.Get(%v) ok = %v, want %v", tt.key, ok, tt.ok)
+			}
+			if _, ok := l1.Get(tt.key); ok != tt.wantL1 {
+				t.Errorf("key %v in L1 = %v, want %v", tt.key, ok, tt.wantL1)
+			}
+			if _, ok := l2.Get(tt.key); ok != tt.wantL2 {
+				t.Errorf("key %v in L2 = %v, want %v", tt.key, ok, tt.wantL2)
+			}
+		})
+	}
+
+	want := Stats{L1Hits: 1, L2Hits: 2, Misses: 1, Promoted: 2, Demoted: 3}
+	if got := a.Stats(); got != want {
+		t.Errorf("tiered.Stats() = %+v, want %+v", got, want)
+	}
+}
+
+func TestAdmission(t *testing.T) {
+	a, l1, _ := newTestAdapter(t, AdapterWithAdmission(AdmitAfterHits(2)))
+	for key := uint64(1); key <= 3; key++ {
+		a.Set(key, response("value"), time.Now().Add(time.Minute))
+	}
+
+	for i, want := range []bool{false, true} {
+		if _, ok := a.Get(1); !ok {
+			t.Fatalf("hit %d: tiered.Get() ok = false", i+1)
+		}
+		if _, ok := l1.Get(1); ok != want {
+			t.Errorf("hit %d: key in L1 = %v, want %v", i+1, ok, want)
+		}
+	}
+}
+
+func TestMaxL1Size(t *testing.T) {
+	a, l1, l2 := newTestAdapter(t, AdapterWithMaxL1Size(64))
+	large := cache.Response{Value: make([]byte, 128), Expiration: time.Now().Add(time.Minute)}.Bytes()
+	a.Set(1, large, time.Now().Add(time.Minute))
+
+	if _, ok := l1.Get(1); ok {
+		t.Error("large response cached in L1")
+	}
+	if _, ok := l2.Get(1); !ok {
+		t.Error("large response not cached in L2")
+	}
+
+	f, size, ok := a.Open(1)
+	if !ok {
+		t.Fatal("tiered.Open() ok = false")
+	}
+	defer f.Close()
+	if size != int64(len(large)) {
+		t.Errorf("tiered.Open() size = %v, want %v", size, len(large))
+	}
+	if _, ok := f.(entryReader); ok {
+		t.Error("tiered.Open() promoted large response")
+	}
+}
+
+func TestRelease(t *testing.T) {
+	a, l1, l2 := newTestAdapter(t)
+	for key := uint64(1); key <= 3; key++ {
+		a.Set(key, response("value"), time.Now().Add(time.Minute))
+	}
+
+	for _, key := range []uint64{1, 3} {
+		a.Release(key)
+		if _, ok := l1.Get(key); ok {
+			t.Errorf("tiered.Release() error; key %v found in L1", key)
+		}
+		if _, ok := l2.Get(key); ok {
+			t.Errorf("tiered.Release() error; key %v found in L2", key)
+		}
+	}
+}
+
+func TestRange(t *testing.T) {
+	a, l1, l2 := newTestAdapter(t)
+	for key := uint64(1); key <= 3; key++ {
+		a.Set(key, response(fmt.Sprintf("value %d", key)), time.Now().Add(time.Minute))
+	}
+	// A response both in L1 and L2, e.g. after a failed L2 release.
+	b, _ := l1.Get(3)
+	l2.Set(3, b, time.Now().Add(time.Minute))
+
+	got := map[uint64]string{}
+	err := a.Range(context.Background(), func(key uint64, entry cache.EntryReader, size int64) bool {
+		if _, ok := got[key]; ok {
+			t.Errorf("tiered.Range() listed key %v twice", key)
+		}
+		b := make([]byte, size)
+		if _, err := entry.ReadAt(b, 0); err != nil {
+			t.Errorf("tiered.Range() entry read error = %v", err)
+		}
+		got[key] = string(cache.BytesToResponse(b).Value)
+		return true
+	})
+	if err != nil {
+		t.Fatalf("tiered.Range() error = %v", err)
+	}
+	if want := map[uint64]string{1: "value 1", 2: "value 2", 3: "value 3"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("tiered.Range() = %v, want %v", got, want)
+	}
+
+	c, err := NewAdapter(AdapterWithL1(l1), AdapterWithL2(adapterOnly{l2}))
+	if err != nil {
+		t.Fatalf("NewAdapter() error = %v", err)
+	}
+	err = c.(*Adapter).Range(context.Background(), func(uint64, cache.EntryReader, int64) bool { return true })
+	if !errors.Is(err, cache.ErrNotEnumerating) {
+		t.Errorf("tiered.Range() error = %v, want %v", err, cache.ErrNotEnumerating)
+	}
+}
+
+// adapterOnly hides the optional interfaces of an adapter.
+type adapterOnly struct {
+	cache.Adapter
+}
+
+func TestContext(t *testing.T) {
+	a, _, _ := newTestAdapter(t)
+	for key := uint64(1); key <= 3; key++ {
+		a.Set(key, response("value"), time.Now().Add(time.Minute))
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if _, ok, err := a.GetContext(ctx, 3); !ok || err != nil {
+		t.Errorf("tiered.GetContext() from L1 with a canceled context = %v, %v, want no error", ok, err)
+	}
+	if _, _, ok, err := a.OpenContext(ctx, 1); ok || !errors.Is(err, context.Canceled) {
+		t.Errorf("tiered.OpenContext() from L2 with a canceled context = %v, %v, want %v", ok, err, context.Canceled)
+	}
+	if err := a.SetContext(ctx, 4, response("value"), time.Now().Add(time.Minute)); !errors.Is(err, context.Canceled) {
+		t.Errorf("tiered.SetContext() with a canceled context error = %v, want %v", err, context.Canceled)
+	}
+	if _, ok := a.Get(1); !ok {
+		t.Error("tiered.Get() missed a response left in L2")
+	}
+}
+
+// blockingAdapter is an L2 adapter whose sets block until their context is
+// done.
+type blockingAdapter struct {
+	adapterOnly
+}
+
+func (a blockingAdapter) GetContext(ctx context.Context, key uint64) ([]byte, bool, error) {
+	return nil, false, nil
+}
+
+func (a blockingAdapter) SetContext(ctx context.Context, key uint64, response []byte, expiration time.Time) error {
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func (a blockingAdapter) ReleaseContext(ctx context.Context, key uint64) error {
+	return nil
+}
+
+func TestDemoteTimeout(t *testing.T) {
+	l1, _ := memory.NewAdapter(memory.AdapterWithCapacity(2), memory.AdapterWithAlgorithm(memory.LRU), memory.AdapterWithShards(1))
+	l2, _ := disk.NewAdapter(disk.AdapterWithDirectory(t.TempDir()), disk.AdapterWithCapacity(1<<20))
+	a, err := NewAdapter(
+		AdapterWithL1(l1),
+		AdapterWithL2(blockingAdapter{adapterOnly{l2}}),
+		AdapterWithDemoteTimeout(10*time.Millisecond),
+	)
+	if err != nil {
+		t.Fatalf("NewAdapter() error = %v", err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for key := uint64(1); key <= 3; key++ {
+			a.Set(key, response("value"), time.Now().Add(time.Minute))
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("tiered.Set() blocked on demoting to L2")
+	}
+	if got := a.(*Adapter).Stats().Demoted; got != 0 {
+		t.Errorf("tiered.Stats() Demoted = %v, want 0", got)
+	}
+}
+
+func TestAdmitAfterHits(t *testing.T) {
+	p := AdmitAfterHits(3)
+	for i, want := range []bool{false, false, true, false} {
+		if got := p.Admit(1, 0); got != want {
+			t.Errorf("hit %d: Admit() = %v, want %v", i+1, got, want)
+		}
+	}
+}
+
+func TestNewAdapter(t *testing.T) {
+	l1, _ := memory.NewAdapter(memory.AdapterWithCapacity(2), memory.AdapterWithAlgorithm(memory.LRU))
+	l2, _ := disk.NewAdapter(disk.AdapterWithDirectory(t.TempDir()), disk.AdapterWithCapacity(1<<20))
+
+	tests := []struct {
+		name    string
+		opts    []AdapterOptions
+		wantErr bool
+	}{
+		{
+			"returns new Adapter",
+			[]AdapterOptions{
+				AdapterWithL1(l1),
+				AdapterWithL2(l2),
+				AdapterWithAdmission(AdmitAfterHits(2)),
+				AdapterWithMaxL1Size(1 << 20),
+				AdapterWithDemoteTimeout(time.Second),
+			},
+			false,
+		},
+		{
+			"returns error",
+			[]AdapterOptions{
+				AdapterWithL2(l2),
+			},
+			true,
+		},
+		{
+			"returns error",
+			[]AdapterOptions{
+				AdapterWithL1(l1),
+			},
+			true,
+		},
+		{
+			"returns error",
+			[]AdapterOptions{
+				AdapterWithL1(l2),
+				AdapterWithL2(l1),
+			},
+			true,
+		},
+		{
+			"returns error",
+			[]AdapterOptions{
+				AdapterWithL1(l1),
+				AdapterWithL2(l2),
+				AdapterWithMaxL1Size(0),
+			},
+			true,
+		},
+		{
+			"returns error",
+			[]AdapterOptions{
+				AdapterWithL1(l1),
+				AdapterWithL2(l2),
+				AdapterWithDemoteTimeout(0),
+			},
+			true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewAdapter(tt.opts...)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("NewAdapter() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
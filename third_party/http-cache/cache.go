@@ -26,7 +26,7 @@ package cache
 
 import (
 	"bytes"
-	"encoding/gob"
+	"context"
 	"errors"
 	"fmt"
 	"hash/fnv"
@@ -36,6 +36,8 @@ import (
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -50,28 +52,106 @@ type Response struct {
 	// Expiration is the cached response expiration date.
 	Expiration time.Time
 
-	// LastAccess is the last date a cached response was accessed.
-	// Used by LRU and MRU algorithms.
+	// LastAccess is the last date a cached response was stored.
+	//
+	// Deprecated: adapters track accesses on their own, so that cache hits
+	// do not have to rewrite the cached response.
 	LastAccess time.Time
 
-	// Frequency is the count of times a cached response is accessed.
-	// Used for LFU and MFU algorithms.
+	// Frequency is the count of times a cached response is stored.
+	//
+	// Deprecated: adapters track accesses on their own, so that cache hits
+	// do not have to rewrite the cached response.
 	Frequency int
+
+	// StaleWhileRevalidate is for how long after expiration the cached
+	// response may be served while it is refreshed in the background.
+	StaleWhileRevalidate time.Duration
+
+	// StaleIfError is for how long after expiration the cached response
+	// may be served in place of an origin error.
+	StaleIfError time.Duration
+
+	// ETag is the entity tag of the cached response, used to revalidate it
+	// with the origin once it has expired.
+	ETag string
+
+	// StatusCode is the cached response status code. Zero means 200 OK.
+	StatusCode int
+
+	// Date is when the cached response was fetched from, or last
+	// revalidated with, the origin. Used to report its age.
+	Date time.Time
+
+	// Key is the canonical cache key of the response, checked on lookup to
+	// detect hash collisions. Responses without one are trusted.
+	Key string
+
+	// Vary, if set, marks a placeholder for a response varying on these
+	// request headers, which is cached under a key including their values.
+	Vary []string
+
+	// body and closer are the reader of the value of a response streamed
+	// from a StreamingAdapter, in place of Value, and what it reads from.
+	body   io.ReadSeeker
+	closer io.Closer
 }
 
 // Client data structure for HTTP cache middleware.
 type Client struct {
-	adapter            Adapter
+	adapter            AdapterV2
 	ttl                time.Duration
+	maxTTL             time.Duration
 	refreshKey         string
 	methods            []string
 	writeExpiresHeader bool
+	coalesceTimeout    time.Duration
+	flightsMu          sync.Mutex
+	flights            map[uint64]*flight
+
+	staleWhileRevalidate time.Duration
+	staleIfError         time.Duration
+	revalidatingMu       sync.Mutex
+	revalidating         map[uint64]struct{}
+
+	negativeAdapter AdapterV2
+	negativeTTL     time.Duration
+
+	adapterTimeout      time.Duration
+	adapterErrorHandler func(err error)
+
+	rules     []rule
+	keyPolicy KeyPolicy
+	keyHash   KeyHash
+	// collisions counts the lookups that found the entry of another
+	// request under their key.
+	collisions atomic.Int64
+	// corrupted counts the cached entries dropped as unreadable.
+	corrupted atomic.Int64
+	// expirations counts the cached responses released by adapters once
+	// expired.
+	expirations atomic.Int64
+	// adapterErrors counts the failed adapter operations.
+	adapterErrors atomic.Int64
+	// hits counts the requests served from the cache, misses the ones
+	// forwarded to the origin.
+	hits   atomic.Int64
+	misses atomic.Int64
+
+	debugEnabled bool
+	debugToken   string
+
+	// tagHeader is the response header listing the tags of a response,
+	// indexed by tags, if tags are enabled.
+	tagHeader string
+	tags      *tagIndex
 }
 
 // ClientOption is used to set Client settings.
 type ClientOption func(c *Client) error
 
-// Adapter interface for HTTP cache middleware client.
+// Adapter interface for HTTP cache middleware client. See AdapterV2 for
+// adapters which may fail or block.
 type Adapter interface {
 	// Get retrieves the cached response by a given key. It also
 	// returns true or false, whether it exists or not.
@@ -84,80 +164,321 @@ type Adapter interface {
 	Release(key uint64)
 }
 
+// ExpiringAdapter is an Adapter which releases expired responses on its own
+// and reports them. Optional interface, the client registers itself with
+// adapters implementing it.
+type ExpiringAdapter interface {
+	Adapter
+
+	// OnExpire sets a function called with the key of every cached response
+	// released once expired.
+	OnExpire(f func(key uint64))
+}
+
+// EvictingAdapter is an Adapter which reports the responses it evicts to stay
+// within its capacity. Optional interface, used to demote them to another
+// adapter.
+type EvictingAdapter interface {
+	Adapter
+
+	// OnEvict sets a function called with every cached response evicted,
+	// along with its expiration, once the adapter no longer holds it.
+	OnEvict(f func(key uint64, response []byte, expiration time.Time))
+}
+
 // Middleware is the HTTP cache middleware handler.
 func (c *Client) Middleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		dbg := c.debug(r)
+		if dbg != nil {
+			r = r.WithContext(context.WithValue(r.Context(), debugContextKey{}, true))
+		}
 		if c.cacheableMethod(r.Method) {
+			ctx := r.Context()
 			sortURLParams(r.URL)
-			key := generateKey(r.URL.String())
+			canonical := c.canonicalKey(r.URL, r.Host, r.Header)
+			key := c.hashKey(canonical)
 			if r.Method == http.MethodPost && r.Body != nil {
 				body, err := io.ReadAll(r.Body)
 				defer r.Body.Close()
 				if err != nil {
+					dbg.setHeaders(w.Header(), cacheBypass, nil)
 					next.ServeHTTP(w, r)
 					return
 				}
 				reader := io.NopCloser(bytes.NewBuffer(body))
-				key = generateKeyWithBody(r.URL.String(), body)
+				canonical += string(body)
+				key = c.hashKey(canonical)
 				r.Body = reader
 			}
 
 			params := r.URL.Query()
-			if _, ok := params[c.refreshKey]; ok {
+			_, refresh := params[c.refreshKey]
+			if refresh {
 				delete(params, c.refreshKey)
 
 				r.URL.RawQuery = params.Encode()
-				key = generateKey(r.URL.String())
+				canonical = c.canonicalKey(r.URL, r.Host, r.Header)
+				key = c.hashKey(canonical)
 
-				c.adapter.Release(key)
-			} else {
-				b, ok := c.adapter.Get(key)
-				response := BytesToResponse(b)
+				c.release(ctx, key)
+			}
+			// primary is the key of the request regardless of the Vary header
+			// of the response, key the one of the matching variant.
+			primary := key
+			if dbg != nil {
+				dbg.key = key
+			}
+
+			// expired is the expired cached response, if any, which the
+			// origin is asked to revalidate instead of sending it again.
+			var expired *Response
+			staleIfError := false
+			if !refresh {
+				now := time.Now()
+				response, adapter, ok := c.lookup(ctx, key, canonical, now)
+				if ok && len(response.Vary) > 0 {
+					key, response, adapter, ok = c.variant(ctx, response, canonical, r.Header, now)
+				}
+				if dbg != nil {
+					dbg.lookup = time.Since(dbg.start)
+					dbg.key = key
+				}
 				if ok {
-					if response.Expiration.After(time.Now()) {
-						response.LastAccess = time.Now()
-						response.Frequency++
-						c.adapter.Set(key, response.Bytes(), response.Expiration)
-
-						//w.WriteHeader(http.StatusNotModified)
-						for k, v := range response.Header {
-							w.Header().Set(k, strings.Join(v, ","))
-						}
-						if c.writeExpiresHeader {
-							w.Header().Set("Expires", response.Expiration.UTC().Format(http.TimeFormat))
-						}
-						w.Write(response.Value)
+					if response.Expiration.After(now) {
+						c.hits.Add(1)
+						dbg.setHeaders(w.Header(), cacheHit, &response)
+						c.writeResponse(w, r, response)
+						response.close()
 						return
 					}
 
-					c.adapter.Release(key)
+					switch {
+					case response.Expiration.Add(response.StaleWhileRevalidate).After(now):
+						c.hits.Add(1)
+						dbg.setHeaders(w.Header(), cacheStale, &response)
+						c.writeResponse(w, r, response)
+						c.revalidate(next, r, primary, key, canonical, response)
+						return
+					case response.Expiration.Add(response.StaleIfError).After(now):
+						expired, staleIfError = &response, true
+					case response.revalidatable():
+						expired = &response
+					default:
+						c.releaseFrom(ctx, adapter, key)
+					}
 				}
 			}
 
-			rw := &responseWriter{ResponseWriter: w}
-			next.ServeHTTP(rw, r)
-
-			statusCode := rw.statusCode
-			now := time.Now()
-			expires := now.Add(c.ttl)
-			if statusCode < 400 {
-				response := Response{
-					Value:      rw.body.Bytes(),
-					Header:     rw.Header(),
-					Expiration: expires,
-					LastAccess: now,
-					Frequency:  1,
+			if r.Header.Get("Range") != "" {
+				// Partial responses are not cached, let the origin serve them.
+				dbg.setHeaders(w.Header(), cacheBypass, nil)
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			c.misses.Add(1)
+			req := originRequest(r, expired)
+			rw := &responseWriter{
+				ResponseWriter: w,
+				client:         c,
+				path:           r.URL.Path,
+				canonical:      canonical,
+				reqHeader:      r.Header,
+				cached:         expired,
+				staleIfError:   staleIfError,
+				debug:          dbg,
+			}
+			completed := false
+			if c.coalesceTimeout > 0 && !refresh {
+				f, leader := c.joinFlight(key, r.Header, &rw.body)
+				if !leader {
+					dbg.setHeaders(w.Header(), cacheMiss, nil)
+					if !f.serve(w, r, c.coalesceTimeout) {
+						next.ServeHTTP(w, r)
+					}
+					return
 				}
-				c.adapter.Set(key, response.Bytes(), response.Expiration)
+				defer func() { c.leaveFlight(key, f, completed) }()
+				rw.flight = f
+			}
+			next.ServeHTTP(rw, req)
+
+			if rw.servingCached {
+				// The origin has either confirmed that the expired response
+				// is still valid or failed, respond with it instead.
+				response, status := *expired, cacheStale
+				if rw.statusCode == http.StatusNotModified {
+					response, status = c.extend(ctx, key, r.URL.Path, response, rw.Header()), cacheHit
+				}
+				rw.servingCached, rw.wroteHeader = false, false
+				for k := range rw.Header() {
+					rw.Header().Del(k)
+				}
+				dbg.setHeaders(rw.Header(), status, &response)
+				rw.debug = nil
+				c.writeResponse(rw, originRequest(r, nil), response)
+			} else {
+				c.store(ctx, primary, rw)
 			}
+			completed = true
 
 			return
 		}
 
+		dbg.setHeaders(w.Header(), cacheBypass, nil)
 		next.ServeHTTP(w, r)
 	})
 }
 
+// lookup retrieves the cached response for a given key along with the
+// adapter holding it, on behalf of a request with a given context. An entry
+// stored for another canonical key with the same hash is a miss, and so is a
+// failed adapter, while a corrupt entry is dropped. The body of a response
+// fresh at a given time may be streamed, and the response must be closed.
+func (c *Client) lookup(ctx context.Context, key uint64, canonical string, now time.Time) (Response, AdapterV2, bool) {
+	for _, a := range []AdapterV2{c.adapter, c.negativeAdapter} {
+		if a == nil {
+			continue
+		}
+		actx, cancel := c.adapterContext(ctx)
+		response, ok, err := get(actx, a, key, now)
+		cancel()
+		if !ok {
+			c.adapterFailed(err)
+			continue
+		}
+		if err != nil {
+			// Unreadable, e.g. truncated or written by another version.
+			c.corrupted.Add(1)
+			c.releaseFrom(ctx, a, key)
+			continue
+		}
+		if response.Key != "" && response.Key != canonical {
+			// Hash collision with another request, which keeps its entry.
+			response.close()
+			c.collisions.Add(1)
+			return Response{}, nil, false
+		}
+		return response, a, true
+	}
+	return Response{}, nil, false
+}
+
+// release frees the cached response for a given key from all adapters, on
+// behalf of a request with a given context.
+func (c *Client) release(ctx context.Context, key uint64) {
+	c.releaseFrom(ctx, c.adapter, key)
+	if c.negativeAdapter != nil {
+		c.releaseFrom(ctx, c.negativeAdapter, key)
+	}
+	c.tags.remove(key)
+}
+
+// store caches the response captured by rw if it is cacheable, or releases
+// the previously cached response for that key otherwise, on behalf of a
+// request with a given context.
+func (c *Client) store(ctx context.Context, key uint64, rw *responseWriter) {
+	statusCode := rw.statusCode
+	if statusCode == 0 {
+		statusCode = http.StatusOK
+	}
+
+	now := time.Now()
+	response := Response{
+		Value:      rw.body.Bytes(),
+		Header:     withoutDebugHeaders(rw.Header()),
+		LastAccess: now,
+		Frequency:  1,
+		StatusCode: statusCode,
+		Date:       now,
+		Key:        rw.canonical,
+	}
+	if len(rw.tags) > 0 {
+		// Kept with the response, so that it can be indexed again.
+		response.Header.Set(c.tagHeader, strings.Join(rw.tags, " "))
+	}
+
+	ttl, cacheable := c.ttlFor(rw.rule, rw.freshness)
+	switch {
+	case !cacheable:
+		c.release(ctx, key)
+	case c.negativeAdapter != nil && negativeStatus(statusCode):
+		c.releaseFrom(ctx, c.adapter, key)
+		response.Expiration = now.Add(c.negativeTTL)
+		c.set(ctx, c.negativeAdapter, key, response.Bytes(), response.Expiration)
+		c.tags.set(key, rw.tags)
+	case statusCode >= 400 || statusCode == http.StatusNotModified || statusCode == http.StatusPartialContent:
+		c.release(ctx, key)
+	default:
+		response.Expiration = now.Add(ttl)
+		response.ETag = rw.Header().Get("Etag")
+		response.StaleWhileRevalidate, response.StaleIfError = c.staleWindows(response.Header)
+		if names := varyHeaders(response.Header); c.keyPolicy.Vary && len(names) > 0 {
+			if names[0] == "*" {
+				c.release(ctx, key)
+				return
+			}
+			key, response.Key = c.storeVariant(ctx, key, names, response, rw.reqHeader)
+		}
+		c.set(ctx, c.adapter, key, response.Bytes(), response.RetainUntil())
+		c.tags.set(key, rw.tags)
+	}
+}
+
+// extend renews an expired response that the origin has confirmed to be
+// still valid, taking the freshness and validators from the header of the
+// origin's 304 response, if present.
+func (c *Client) extend(ctx context.Context, key uint64, path string, response Response, header http.Header) Response {
+	response.Header = response.Header.Clone()
+	for _, k := range []string{"Cache-Control", "Expires", "Date", "Etag", "Last-Modified"} {
+		if v := header.Values(k); len(v) > 0 {
+			response.Header[http.CanonicalHeaderKey(k)] = v
+		}
+	}
+	response.ETag = response.Header.Get("Etag")
+
+	f := originFreshness(response.Header)
+	ttl, cacheable := c.ttlFor(c.applyRule(path, response.Header), f)
+	if !cacheable {
+		c.release(ctx, key)
+		return response
+	}
+	now := time.Now()
+	response.Expiration = now.Add(ttl)
+	response.Date = now
+	response.LastAccess = now
+	response.Frequency++
+	response.StaleWhileRevalidate, response.StaleIfError = c.staleWindows(response.Header)
+	c.set(ctx, c.adapter, key, response.Bytes(), response.RetainUntil())
+	return response
+}
+
+// writeResponse writes a cached response to w, honoring the conditional and
+// range headers of r for successful responses.
+func (c *Client) writeResponse(w http.ResponseWriter, r *http.Request, response Response) {
+	for k, v := range response.Header {
+		if c.tags != nil && k == c.tagHeader {
+			continue
+		}
+		w.Header().Set(k, strings.Join(v, ","))
+	}
+	if c.writeExpiresHeader {
+		w.Header().Set("Expires", response.Expiration.UTC().Format(http.TimeFormat))
+	}
+	body := response.body
+	if body == nil {
+		body = bytes.NewReader(response.Value)
+	}
+	if response.StatusCode != 0 && response.StatusCode != http.StatusOK {
+		w.WriteHeader(response.StatusCode)
+		io.Copy(w, body)
+		return
+	}
+	modTime, _ := http.ParseTime(response.Header.Get("Last-Modified"))
+	http.ServeContent(w, r, "", modTime, body)
+}
+
 func (c *Client) cacheableMethod(method string) bool {
 	for _, m := range c.methods {
 		if method == m {
@@ -167,22 +488,15 @@ func (c *Client) cacheableMethod(method string) bool {
 	return false
 }
 
-// BytesToResponse converts bytes array into Response data structure.
-func BytesToResponse(b []byte) Response {
-	var r Response
-	dec := gob.NewDecoder(bytes.NewReader(b))
-	dec.Decode(&r)
-
-	return r
-}
-
-// Bytes converts Response data structure into bytes array.
-func (r Response) Bytes() []byte {
-	var b bytes.Buffer
-	enc := gob.NewEncoder(&b)
-	enc.Encode(&r)
-
-	return b.Bytes()
+// Purge frees the cached response, including a cached negative response and
+// all the variants of a response, for a given request URL as seen by the
+// middleware (usually just path and query, plus host if the key policy
+// includes it). Responses keyed by request headers are only freed for
+// requests without them.
+func (c *Client) Purge(URL *url.URL) {
+	u := *URL
+	sortURLParams(&u)
+	c.release(context.Background(), c.hashKey(c.canonicalKey(&u, u.Host, http.Header{})))
 }
 
 func sortURLParams(URL *url.URL) {
@@ -207,14 +521,6 @@ func generateKey(URL string) uint64 {
 	return hash.Sum64()
 }
 
-func generateKeyWithBody(URL string, body []byte) uint64 {
-	hash := fnv.New64a()
-	body = append([]byte(URL), body...)
-	hash.Write(body)
-
-	return hash.Sum64()
-}
-
 // NewClient initializes the cache HTTP middleware client with the given
 // options.
 func NewClient(opts ...ClientOption) (*Client, error) {
@@ -235,20 +541,50 @@ func NewClient(opts ...ClientOption) (*Client, error) {
 	if c.methods == nil {
 		c.methods = []string{http.MethodGet}
 	}
+	for _, a := range []AdapterV2{c.adapter, c.negativeAdapter} {
+		if a, ok := unwrapAdapter(a).(ExpiringAdapter); ok {
+			a.OnExpire(c.expire)
+		}
+	}
 
 	return c, nil
 }
 
+// expire records that an adapter has released an expired response.
+func (c *Client) expire(key uint64) {
+	c.expirations.Add(1)
+	c.tags.remove(key)
+}
+
+// Expirations returns the number of cached responses that adapters have
+// released once expired.
+func (c *Client) Expirations() int64 {
+	return c.expirations.Load()
+}
+
+// Hits returns the number of requests served from the cache, including stale
+// responses served while they are revalidated.
+func (c *Client) Hits() int64 {
+	return c.hits.Load()
+}
+
+// Misses returns the number of cacheable requests forwarded to the origin,
+// including revalidations.
+func (c *Client) Misses() int64 {
+	return c.misses.Load()
+}
+
 // ClientWithAdapter sets the adapter type for the HTTP cache
 // middleware client.
 func ClientWithAdapter(a Adapter) ClientOption {
 	return func(c *Client) error {
-		c.adapter = a
+		c.adapter = UpgradeAdapter(a)
 		return nil
 	}
 }
 
-// ClientWithTTL sets how long each response is going to be cached.
+// ClientWithTTL sets how long each response is going to be cached, unless
+// set otherwise by a rule or by the origin.
 func ClientWithTTL(ttl time.Duration) ClientOption {
 	return func(c *Client) error {
 		if int64(ttl) < 1 {
@@ -261,6 +597,21 @@ func ClientWithTTL(ttl time.Duration) ClientOption {
 	}
 }
 
+// ClientWithMaxTTL sets the maximum time a response is cached for when its
+// lifetime is set by the origin with the Cache-Control or Expires headers.
+// Optional setting. If not set, the origin lifetime is used as is.
+func ClientWithMaxTTL(ttl time.Duration) ClientOption {
+	return func(c *Client) error {
+		if int64(ttl) < 0 {
+			return fmt.Errorf("cache client max ttl %v is invalid", ttl)
+		}
+
+		c.maxTTL = ttl
+
+		return nil
+	}
+}
+
 // ClientWithRefreshKey sets the parameter key used to free a request
 // cached response. Optional setting.
 func ClientWithRefreshKey(refreshKey string) ClientOption {
@@ -284,6 +635,55 @@ func ClientWithMethods(methods []string) ClientOption {
 	}
 }
 
+// ClientWithCoalescing enables collapsing of concurrent cache misses for
+// the same key into a single call to the next handler. The other requests
+// stream the response while it is being fetched, and fall back to calling
+// the next handler themselves if it has not started responding within the
+// given timeout. Optional setting. If not set, coalescing is disabled.
+func ClientWithCoalescing(timeout time.Duration) ClientOption {
+	return func(c *Client) error {
+		if int64(timeout) < 1 {
+			return fmt.Errorf("cache client coalescing timeout %v is invalid", timeout)
+		}
+
+		c.coalesceTimeout = timeout
+
+		return nil
+	}
+}
+
+// ClientWithStaleWhileRevalidate sets for how long after expiration a cached
+// response may still be served while it is refreshed in the background.
+// Optional setting. The stale-while-revalidate Cache-Control extension of
+// the origin response takes precedence.
+func ClientWithStaleWhileRevalidate(window time.Duration) ClientOption {
+	return func(c *Client) error {
+		if window < 0 {
+			return fmt.Errorf("cache client stale-while-revalidate window %v is invalid", window)
+		}
+
+		c.staleWhileRevalidate = window
+
+		return nil
+	}
+}
+
+// ClientWithStaleIfError sets for how long after expiration a cached response
+// may still be served when the origin responds with a server error. Optional
+// setting. The stale-if-error Cache-Control extension of the origin response
+// takes precedence.
+func ClientWithStaleIfError(window time.Duration) ClientOption {
+	return func(c *Client) error {
+		if window < 0 {
+			return fmt.Errorf("cache client stale-if-error window %v is invalid", window)
+		}
+
+		c.staleIfError = window
+
+		return nil
+	}
+}
+
 // ClientWithExpiresHeader enables middleware to add an Expires header to responses.
 // Optional setting. If not set, default is false.
 func ClientWithExpiresHeader() ClientOption {
@@ -297,14 +697,75 @@ type responseWriter struct {
 	http.ResponseWriter
 	statusCode int
 	body       bytes.Buffer
+	flight     *flight
+	clientErr  error
+
+	// client and path select the rule applied to the response, once its
+	// header is known.
+	client      *Client
+	path        string
+	canonical   string
+	reqHeader   http.Header
+	rule        *rule
+	tags        []string
+	freshness   freshness
+	wroteHeader bool
+	debug       *debugInfo
+
+	// cached is the expired response being revalidated. If the origin
+	// responds that it is not modified, or fails while staleIfError is set,
+	// servingCached is set and the origin response is dropped.
+	cached        *Response
+	staleIfError  bool
+	servingCached bool
 }
 
 func (w *responseWriter) WriteHeader(statusCode int) {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
 	w.statusCode = statusCode
+	if w.cached != nil {
+		w.cached = nil
+		if statusCode == http.StatusNotModified || (statusCode >= 500 && w.staleIfError) {
+			w.servingCached = true
+			return
+		}
+	}
+	if w.client != nil {
+		w.freshness = originFreshness(w.Header())
+		w.rule = w.client.applyRule(w.path, w.Header())
+		if w.client.tags != nil {
+			w.tags = w.client.responseTags(w.Header(), w.rule)
+			w.Header().Del(w.client.tagHeader)
+		}
+	}
+	if w.flight != nil {
+		w.flight.start(statusCode, w.Header())
+	}
+	w.debug.setHeaders(w.Header(), cacheMiss, nil)
 	w.ResponseWriter.WriteHeader(statusCode)
 }
 
 func (w *responseWriter) Write(b []byte) (int, error) {
-	w.body.Write(b)
-	return w.ResponseWriter.Write(b)
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.servingCached {
+		return len(b), nil
+	}
+	if w.flight == nil {
+		w.body.Write(b)
+		return w.ResponseWriter.Write(b)
+	}
+
+	// Other requests are streaming this response, so keep on reading it
+	// from the next handler even if our own client has gone away. The flight
+	// appends to w.body, which it shares.
+	w.flight.write(b)
+	if w.clientErr == nil {
+		_, w.clientErr = w.ResponseWriter.Write(b)
+	}
+	return len(b), nil
 }
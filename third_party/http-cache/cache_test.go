@@ -2,13 +2,18 @@ package cache
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"path"
 	"reflect"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -41,6 +46,77 @@ func (a *adapterMock) Release(key uint64) {
 	delete(a.store, key)
 }
 
+// expiringAdapterMock is an adapterMock reporting expirations on expire.
+type expiringAdapterMock struct {
+	adapterMock
+	onExpire func(key uint64)
+}
+
+func (a *expiringAdapterMock) OnExpire(f func(key uint64)) {
+	a.onExpire = f
+}
+
+func (a *expiringAdapterMock) expire(key uint64) {
+	a.Release(key)
+	a.onExpire(key)
+}
+
+// streamingAdapterMock is an adapterMock opening cached responses as
+// readers, tracking how they are read and closed.
+type streamingAdapterMock struct {
+	adapterMock
+	open    int32
+	maxRead int32
+}
+
+func (a *streamingAdapterMock) Open(key uint64) (EntryReader, int64, bool) {
+	b, ok := a.Get(key)
+	if !ok {
+		return nil, 0, false
+	}
+	atomic.AddInt32(&a.open, 1)
+	return &entryReaderMock{Reader: bytes.NewReader(b), adapter: a}, int64(len(b)), true
+}
+
+// blockingAdapterMock is an AdapterV2 whose operations block until their
+// context is done.
+type blockingAdapterMock struct{}
+
+func (blockingAdapterMock) GetContext(ctx context.Context, key uint64) ([]byte, bool, error) {
+	<-ctx.Done()
+	return nil, false, ctx.Err()
+}
+
+func (blockingAdapterMock) SetContext(ctx context.Context, key uint64, response []byte, expiration time.Time) error {
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func (blockingAdapterMock) ReleaseContext(ctx context.Context, key uint64) error {
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+type entryReaderMock struct {
+	*bytes.Reader
+	adapter *streamingAdapterMock
+}
+
+func (r *entryReaderMock) ReadAt(p []byte, off int64) (int, error) {
+	for {
+		n := atomic.LoadInt32(&r.adapter.maxRead)
+		if int32(len(p)) <= n || atomic.CompareAndSwapInt32(&r.adapter.maxRead, n, int32(len(p))) {
+			break
+		}
+	}
+	return r.Reader.ReadAt(p, off)
+}
+
+func (r *entryReaderMock) Close() error {
+	atomic.AddInt32(&r.adapter.open, -1)
+	return nil
+}
+
 func (errReader) Read(p []byte) (n int, err error) {
 	return 0, errors.New("readAll error")
 }
@@ -186,38 +262,1363 @@ func TestMiddleware(t *testing.T) {
 			200,
 		},
 	}
-	for _, tt := range tests {
-		t.Run(tt.name, func(t *testing.T) {
-			counter++
-			var r *http.Request
-			var err error
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			counter++
+			var r *http.Request
+			var err error
+
+			if counter != 12 {
+				reader := bytes.NewReader(tt.body)
+				r, err = http.NewRequest(tt.method, tt.url, reader)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+			} else {
+				r, err = http.NewRequest(tt.method, tt.url, errReader(0))
+				if err != nil {
+					t.Error(err)
+					return
+				}
+			}
+
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+
+			if !reflect.DeepEqual(w.Code, tt.wantCode) {
+				t.Errorf("*Client.Middleware() = %v, want %v", w.Code, tt.wantCode)
+				return
+			}
+			if !reflect.DeepEqual(w.Body.String(), tt.wantBody) {
+				t.Errorf("*Client.Middleware() = %v, want %v", w.Body.String(), tt.wantBody)
+			}
+		})
+	}
+}
+
+func TestMiddlewareCoalescing(t *testing.T) {
+	t.Run("concurrent misses share a single origin request", func(t *testing.T) {
+		var calls int32
+		release := make(chan struct{})
+		httpTestHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&calls, 1)
+			w.Header().Set("X-Test", "yes")
+			w.Write([]byte("part 1,"))
+			<-release
+			w.Write([]byte("part 2"))
+		})
+
+		client, _ := NewClient(
+			ClientWithAdapter(&adapterMock{store: map[uint64][]byte{}}),
+			ClientWithTTL(1*time.Minute),
+			ClientWithCoalescing(1*time.Minute),
+		)
+		handler := client.Middleware(httpTestHandler)
+
+		const n = 10
+		recorders := make([]*httptest.ResponseRecorder, n)
+		var wg sync.WaitGroup
+		for i := 0; i < n; i++ {
+			recorders[i] = httptest.NewRecorder()
+			wg.Add(1)
+			go func(w *httptest.ResponseRecorder) {
+				defer wg.Done()
+				r, _ := http.NewRequest("GET", "http://foo.bar/coalesced", nil)
+				handler.ServeHTTP(w, r)
+			}(recorders[i])
+		}
+		for atomic.LoadInt32(&calls) == 0 {
+			time.Sleep(time.Millisecond)
+		}
+		time.Sleep(10 * time.Millisecond)
+		close(release)
+		wg.Wait()
+
+		if got := atomic.LoadInt32(&calls); got != 1 {
+			t.Errorf("*Client.Middleware() origin calls = %v, want 1", got)
+		}
+		for _, w := range recorders {
+			if w.Body.String() != "part 1,part 2" {
+				t.Errorf("*Client.Middleware() = %v, want %v", w.Body.String(), "part 1,part 2")
+			}
+			if w.Header().Get("X-Test") != "yes" {
+				t.Errorf("*Client.Middleware() header X-Test = %v, want yes", w.Header().Get("X-Test"))
+			}
+		}
+	})
+
+	t.Run("waiter falls back to direct fetch on timeout", func(t *testing.T) {
+		var calls int32
+		release := make(chan struct{})
+		httpTestHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if atomic.AddInt32(&calls, 1) == 1 {
+				<-release
+			}
+			w.Write([]byte("value"))
+		})
+
+		client, _ := NewClient(
+			ClientWithAdapter(&adapterMock{store: map[uint64][]byte{}}),
+			ClientWithTTL(1*time.Minute),
+			ClientWithCoalescing(10*time.Millisecond),
+		)
+		handler := client.Middleware(httpTestHandler)
+
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			r, _ := http.NewRequest("GET", "http://foo.bar/slow", nil)
+			handler.ServeHTTP(httptest.NewRecorder(), r)
+		}()
+		for atomic.LoadInt32(&calls) == 0 {
+			time.Sleep(time.Millisecond)
+		}
+
+		w := httptest.NewRecorder()
+		r, _ := http.NewRequest("GET", "http://foo.bar/slow", nil)
+		handler.ServeHTTP(w, r)
+		close(release)
+		<-done
+
+		if got := atomic.LoadInt32(&calls); got != 2 {
+			t.Errorf("*Client.Middleware() origin calls = %v, want 2", got)
+		}
+		if w.Body.String() != "value" {
+			t.Errorf("*Client.Middleware() = %v, want %v", w.Body.String(), "value")
+		}
+	})
+
+	t.Run("waiter falls back to direct fetch if leader panics", func(t *testing.T) {
+		f := newFlight(http.Header{}, &bytes.Buffer{})
+		f.finish(false)
+
+		r, _ := http.NewRequest("GET", "http://foo.bar/", nil)
+		if f.serve(httptest.NewRecorder(), r, 1*time.Minute) {
+			t.Error("flight.serve() = true, want false")
+		}
+	})
+
+	t.Run("waiter aborts if leader panics after responding", func(t *testing.T) {
+		f := newFlight(http.Header{}, &bytes.Buffer{})
+		f.start(http.StatusOK, http.Header{})
+		f.write([]byte("part 1,"))
+
+		r, _ := http.NewRequest("GET", "http://foo.bar/", nil)
+		w := &writeNotifier{ResponseRecorder: httptest.NewRecorder(), wrote: make(chan struct{})}
+		recovered := make(chan any)
+		go func() {
+			defer func() { recovered <- recover() }()
+			f.serve(w, r, 1*time.Minute)
+		}()
+		<-w.wrote
+		f.finish(false)
+
+		if got := <-recovered; got != http.ErrAbortHandler {
+			t.Errorf("flight.serve() panic = %v, want %v", got, http.ErrAbortHandler)
+		}
+	})
+
+	t.Run("waiter returns when its request is canceled", func(t *testing.T) {
+		f := newFlight(http.Header{}, &bytes.Buffer{})
+		f.start(http.StatusOK, http.Header{})
+
+		ctx, cancel := context.WithCancel(context.Background())
+		r, _ := http.NewRequestWithContext(ctx, "GET", "http://foo.bar/", nil)
+		done := make(chan bool)
+		go func() { done <- f.serve(httptest.NewRecorder(), r, 1*time.Minute) }()
+		cancel()
+
+		select {
+		case got := <-done:
+			if !got {
+				t.Error("flight.serve() = false, want true")
+			}
+		case <-time.After(5 * time.Second):
+			t.Error("flight.serve() did not return after the request was canceled")
+		}
+	})
+}
+
+// writeNotifier is a response recorder that closes wrote on its first write.
+type writeNotifier struct {
+	*httptest.ResponseRecorder
+	wrote chan struct{}
+	once  sync.Once
+}
+
+func (w *writeNotifier) Write(b []byte) (int, error) {
+	n, err := w.ResponseRecorder.Write(b)
+	w.once.Do(func() { close(w.wrote) })
+	return n, err
+}
+
+func TestMiddlewareStale(t *testing.T) {
+	newStaleAdapter := func(url string) *adapterMock {
+		return &adapterMock{
+			store: map[uint64][]byte{
+				generateKey(url): Response{
+					Value:                []byte("stale value"),
+					Expiration:           time.Now().Add(-1 * time.Minute),
+					StaleWhileRevalidate: 2 * time.Minute,
+					StaleIfError:         2 * time.Minute,
+				}.Bytes(),
+			},
+		}
+	}
+
+	t.Run("serves stale response while revalidating", func(t *testing.T) {
+		url := "http://foo.bar/swr"
+		adapter := newStaleAdapter(url)
+		revalidated := make(chan struct{})
+		httpTestHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			defer close(revalidated)
+			w.Write([]byte("new value"))
+		})
+		client, _ := NewClient(ClientWithAdapter(adapter), ClientWithTTL(1*time.Minute))
+		handler := client.Middleware(httpTestHandler)
+
+		w := httptest.NewRecorder()
+		r, _ := http.NewRequest("GET", url, nil)
+		handler.ServeHTTP(w, r)
+		if w.Body.String() != "stale value" {
+			t.Errorf("*Client.Middleware() = %v, want %v", w.Body.String(), "stale value")
+		}
+
+		<-revalidated
+		for {
+			b, _ := adapter.Get(generateKey(url))
+			if string(BytesToResponse(b).Value) == "new value" {
+				break
+			}
+			time.Sleep(time.Millisecond)
+		}
+	})
+
+	t.Run("serves stale response if origin fails", func(t *testing.T) {
+		url := "http://foo.bar/sie"
+		adapter := newStaleAdapter(url)
+		httpTestHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, "origin is down", http.StatusBadGateway)
+		})
+		client, _ := NewClient(ClientWithAdapter(adapter), ClientWithTTL(1*time.Minute))
+		handler := client.Middleware(httpTestHandler)
+
+		// Only stale-if-error applies past the stale-while-revalidate window.
+		b, _ := adapter.Get(generateKey(url))
+		response := BytesToResponse(b)
+		response.StaleWhileRevalidate = 0
+		adapter.Set(generateKey(url), response.Bytes(), response.RetainUntil())
+
+		w := httptest.NewRecorder()
+		r, _ := http.NewRequest("GET", url, nil)
+		handler.ServeHTTP(w, r)
+		if w.Code != http.StatusOK {
+			t.Errorf("*Client.Middleware() code = %v, want %v", w.Code, http.StatusOK)
+		}
+		if w.Body.String() != "stale value" {
+			t.Errorf("*Client.Middleware() = %v, want %v", w.Body.String(), "stale value")
+		}
+	})
+
+	t.Run("replaces stale response if origin succeeds", func(t *testing.T) {
+		url := "http://foo.bar/sie-ok"
+		adapter := newStaleAdapter(url)
+		httpTestHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("new value"))
+		})
+		client, _ := NewClient(ClientWithAdapter(adapter), ClientWithTTL(1*time.Minute))
+		handler := client.Middleware(httpTestHandler)
+
+		b, _ := adapter.Get(generateKey(url))
+		response := BytesToResponse(b)
+		response.StaleWhileRevalidate = 0
+		adapter.Set(generateKey(url), response.Bytes(), response.RetainUntil())
+
+		w := httptest.NewRecorder()
+		r, _ := http.NewRequest("GET", url, nil)
+		handler.ServeHTTP(w, r)
+		if w.Body.String() != "new value" {
+			t.Errorf("*Client.Middleware() = %v, want %v", w.Body.String(), "new value")
+		}
+	})
+
+	t.Run("honors cache-control extensions", func(t *testing.T) {
+		client, _ := NewClient(
+			ClientWithAdapter(&adapterMock{store: map[uint64][]byte{}}),
+			ClientWithTTL(1*time.Minute),
+			ClientWithStaleWhileRevalidate(1*time.Minute),
+			ClientWithStaleIfError(1*time.Minute),
+		)
+
+		h := http.Header{}
+		h.Set("Cache-Control", "max-age=60, stale-while-revalidate=30, stale-if-error=\"86400\"")
+		swr, sie := client.staleWindows(h)
+		if swr != 30*time.Second || sie != 24*time.Hour {
+			t.Errorf("*Client.staleWindows() = %v, %v, want %v, %v", swr, sie, 30*time.Second, 24*time.Hour)
+		}
+
+		swr, sie = client.staleWindows(http.Header{})
+		if swr != 1*time.Minute || sie != 1*time.Minute {
+			t.Errorf("*Client.staleWindows() = %v, %v, want %v, %v", swr, sie, 1*time.Minute, 1*time.Minute)
+		}
+	})
+}
+
+func TestMiddlewareRevalidation(t *testing.T) {
+	const etag = `"v1"`
+	url := "http://foo.bar/revalidate"
+	newExpiredAdapter := func() *adapterMock {
+		return &adapterMock{
+			store: map[uint64][]byte{
+				generateKey(url): Response{
+					Value:      []byte("cached value"),
+					Header:     http.Header{"Etag": []string{etag}},
+					Expiration: time.Now().Add(-1 * time.Minute),
+					ETag:       etag,
+				}.Bytes(),
+			},
+		}
+	}
+	origin := func(calls *int32) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(calls, 1)
+			if r.Header.Get("If-None-Match") == etag {
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+			w.Header().Set("Etag", `"v2"`)
+			w.Write([]byte("new value"))
+		})
+	}
+
+	t.Run("extends expired response not modified at origin", func(t *testing.T) {
+		var calls int32
+		adapter := newExpiredAdapter()
+		client, _ := NewClient(ClientWithAdapter(adapter), ClientWithTTL(1*time.Minute))
+		handler := client.Middleware(origin(&calls))
+
+		for i := 0; i < 2; i++ {
+			w := httptest.NewRecorder()
+			r, _ := http.NewRequest("GET", url, nil)
+			handler.ServeHTTP(w, r)
+			if w.Code != http.StatusOK || w.Body.String() != "cached value" {
+				t.Errorf("*Client.Middleware() = %v %v, want %v %v", w.Code, w.Body.String(), http.StatusOK, "cached value")
+			}
+		}
+		if got := atomic.LoadInt32(&calls); got != 1 {
+			t.Errorf("*Client.Middleware() origin calls = %v, want 1", got)
+		}
+		b, _ := adapter.Get(generateKey(url))
+		if !BytesToResponse(b).Expiration.After(time.Now()) {
+			t.Error("*Client.Middleware() did not extend expiration")
+		}
+	})
+
+	t.Run("replaces expired response modified at origin", func(t *testing.T) {
+		var calls int32
+		adapter := newExpiredAdapter()
+		b, _ := adapter.Get(generateKey(url))
+		response := BytesToResponse(b)
+		response.ETag = `"v0"`
+		adapter.Set(generateKey(url), response.Bytes(), response.Expiration)
+		client, _ := NewClient(ClientWithAdapter(adapter), ClientWithTTL(1*time.Minute))
+		handler := client.Middleware(origin(&calls))
+
+		w := httptest.NewRecorder()
+		r, _ := http.NewRequest("GET", url, nil)
+		handler.ServeHTTP(w, r)
+		if w.Body.String() != "new value" {
+			t.Errorf("*Client.Middleware() = %v, want %v", w.Body.String(), "new value")
+		}
+		b, _ = adapter.Get(generateKey(url))
+		if got := BytesToResponse(b).ETag; got != `"v2"` {
+			t.Errorf("*Client.Middleware() cached ETag = %v, want %v", got, `"v2"`)
+		}
+	})
+
+	t.Run("releases expired response gone at origin", func(t *testing.T) {
+		adapter := newExpiredAdapter()
+		client, _ := NewClient(ClientWithAdapter(adapter), ClientWithTTL(1*time.Minute))
+		handler := client.Middleware(http.NotFoundHandler())
+
+		w := httptest.NewRecorder()
+		r, _ := http.NewRequest("GET", url, nil)
+		handler.ServeHTTP(w, r)
+		if w.Code != http.StatusNotFound {
+			t.Errorf("*Client.Middleware() code = %v, want %v", w.Code, http.StatusNotFound)
+		}
+		if _, ok := adapter.Get(generateKey(url)); ok {
+			t.Error("*Client.Middleware() did not release response")
+		}
+	})
+
+	t.Run("answers client validators from the cache", func(t *testing.T) {
+		var calls int32
+		client, _ := NewClient(
+			ClientWithAdapter(&adapterMock{store: map[uint64][]byte{}}),
+			ClientWithTTL(1*time.Minute),
+		)
+		handler := client.Middleware(origin(&calls))
+
+		// The client's validator must not leak to the origin on a miss,
+		// otherwise an empty 304 response would be cached.
+		w := httptest.NewRecorder()
+		r, _ := http.NewRequest("GET", url, nil)
+		r.Header.Set("If-None-Match", etag)
+		handler.ServeHTTP(w, r)
+		if w.Code != http.StatusOK || w.Body.String() != "new value" {
+			t.Errorf("*Client.Middleware() = %v %v, want %v %v", w.Code, w.Body.String(), http.StatusOK, "new value")
+		}
+
+		w = httptest.NewRecorder()
+		r, _ = http.NewRequest("GET", url, nil)
+		r.Header.Set("If-None-Match", `"v2"`)
+		handler.ServeHTTP(w, r)
+		if w.Code != http.StatusNotModified {
+			t.Errorf("*Client.Middleware() code = %v, want %v", w.Code, http.StatusNotModified)
+		}
+		if got := atomic.LoadInt32(&calls); got != 1 {
+			t.Errorf("*Client.Middleware() origin calls = %v, want 1", got)
+		}
+	})
+
+	t.Run("passes range requests through on a miss", func(t *testing.T) {
+		adapter := &adapterMock{store: map[uint64][]byte{}}
+		client, _ := NewClient(ClientWithAdapter(adapter), ClientWithTTL(1*time.Minute))
+		handler := client.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			http.ServeContent(w, r, "", time.Time{}, bytes.NewReader([]byte("new value")))
+		}))
+
+		w := httptest.NewRecorder()
+		r, _ := http.NewRequest("GET", url, nil)
+		r.Header.Set("Range", "bytes=0-2")
+		handler.ServeHTTP(w, r)
+		if w.Code != http.StatusPartialContent || w.Body.String() != "new" {
+			t.Errorf("*Client.Middleware() = %v %v, want %v %v", w.Code, w.Body.String(), http.StatusPartialContent, "new")
+		}
+		if len(adapter.store) != 0 {
+			t.Error("*Client.Middleware() cached a partial response")
+		}
+	})
+}
+
+func TestMiddlewareNegativeCaching(t *testing.T) {
+	var calls int32
+	httpTestHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		switch r.URL.Path {
+		case "/forbidden":
+			http.Error(w, "forbidden", http.StatusForbidden)
+		case "/broken":
+			http.Error(w, "broken", http.StatusInternalServerError)
+		default:
+			http.NotFound(w, r)
+		}
+	})
+	adapter := &adapterMock{store: map[uint64][]byte{}}
+	negativeAdapter := &adapterMock{store: map[uint64][]byte{}}
+	client, _ := NewClient(
+		ClientWithAdapter(adapter),
+		ClientWithTTL(1*time.Minute),
+		ClientWithNegativeCaching(negativeAdapter, 1*time.Minute),
+	)
+	handler := client.Middleware(httpTestHandler)
+
+	tests := []struct {
+		name      string
+		url       string
+		wantCode  int
+		wantCalls int32
+	}{
+		{"fetches missing response", "/wp-login.php", http.StatusNotFound, 1},
+		{"returns cached missing response", "/wp-login.php", http.StatusNotFound, 1},
+		{"fetches forbidden response", "/forbidden", http.StatusForbidden, 2},
+		{"returns cached forbidden response", "/forbidden", http.StatusForbidden, 2},
+		{"fetches server error", "/broken", http.StatusInternalServerError, 3},
+		{"does not cache server error", "/broken", http.StatusInternalServerError, 4},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			r, _ := http.NewRequest("GET", tt.url, nil)
+			handler.ServeHTTP(w, r)
+			if w.Code != tt.wantCode {
+				t.Errorf("*Client.Middleware() code = %v, want %v", w.Code, tt.wantCode)
+			}
+			if got := atomic.LoadInt32(&calls); got != tt.wantCalls {
+				t.Errorf("*Client.Middleware() origin calls = %v, want %v", got, tt.wantCalls)
+			}
+		})
+	}
+
+	if len(adapter.store) != 0 {
+		t.Errorf("*Client.Middleware() cached %v negative responses in the main adapter", len(adapter.store))
+	}
+	if len(negativeAdapter.store) != 2 {
+		t.Errorf("*Client.Middleware() cached %v negative responses, want 2", len(negativeAdapter.store))
+	}
+
+	u, _ := url.Parse("/wp-login.php")
+	client.Purge(u)
+	if len(negativeAdapter.store) != 1 {
+		t.Errorf("*Client.Purge() left %v negative responses, want 1", len(negativeAdapter.store))
+	}
+}
+
+func TestMiddlewareRules(t *testing.T) {
+	var calls int32
+	httpTestHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		switch path.Ext(r.URL.Path) {
+		case ".html":
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		case ".png":
+			w.Header().Set("Content-Type", "image/png")
+		}
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Write([]byte("value"))
+	})
+	adapter := &adapterMock{store: map[uint64][]byte{}}
+	client, _ := NewClient(
+		ClientWithAdapter(adapter),
+		ClientWithTTL(1*time.Minute),
+		ClientWithRules(
+			HashedAssetsRule,
+			Rule{Path: "/private/**", NoStore: true},
+			Rule{Path: "/*.html", NoCache: true},
+			Rule{ContentType: "image/", TTL: 1 * time.Hour},
+		),
+	)
+	handler := client.Middleware(httpTestHandler)
+
+	tests := []struct {
+		name             string
+		url              string
+		wantCacheControl string
+		wantCalls        int32
+		wantTTL          time.Duration
+	}{
+		{"marks hashed asset immutable", "/assets/app.3f9a1c2b.js", "public, max-age=31536000, immutable", 1, 365 * 24 * time.Hour},
+		{"returns cached hashed asset", "/assets/app.3f9a1c2b.js", "public, max-age=31536000, immutable", 1, 365 * 24 * time.Hour},
+		{"does not store private response", "/private/a/b.txt", "no-store", 2, 0},
+		{"does not return private response", "/private/a/b.txt", "no-store", 3, 0},
+		{"stores no-cache response", "/index.html", "no-cache", 4, 0},
+		{"does not return no-cache response", "/index.html", "no-cache", 5, 0},
+		{"sets ttl by content type", "/img/logo.png", "max-age=3600", 6, 1 * time.Hour},
+		{"keeps origin cache control", "/robots.txt", "max-age=60", 7, 1 * time.Minute},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			r, _ := http.NewRequest("GET", tt.url, nil)
+			handler.ServeHTTP(w, r)
+			if got := w.Header().Get("Cache-Control"); got != tt.wantCacheControl {
+				t.Errorf("*Client.Middleware() Cache-Control = %v, want %v", got, tt.wantCacheControl)
+			}
+			if got := atomic.LoadInt32(&calls); got != tt.wantCalls {
+				t.Errorf("*Client.Middleware() origin calls = %v, want %v", got, tt.wantCalls)
+			}
+			b, ok := adapter.Get(generateKey(r.URL.String()))
+			if ok != (tt.wantCacheControl != "no-store") {
+				t.Fatalf("*Client.Middleware() cached = %v", ok)
+			}
+			if ok {
+				ttl := time.Until(BytesToResponse(b).Expiration)
+				if ttl > tt.wantTTL || ttl < tt.wantTTL-time.Minute {
+					t.Errorf("*Client.Middleware() ttl = %v, want %v", ttl, tt.wantTTL)
+				}
+			}
+		})
+	}
+}
+
+func TestMiddlewareOriginFreshness(t *testing.T) {
+	httpTestHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/max-age":
+			w.Header().Set("Cache-Control", "public, max-age=120")
+		case "/s-maxage":
+			w.Header().Set("Cache-Control", "max-age=120, s-maxage=300")
+		case "/long-max-age":
+			w.Header().Set("Cache-Control", "max-age=31536000")
+		case "/expires":
+			date := time.Now().UTC()
+			w.Header().Set("Date", date.Format(http.TimeFormat))
+			w.Header().Set("Expires", date.Add(1*time.Hour).Format(http.TimeFormat))
+		case "/no-store":
+			w.Header().Set("Cache-Control", "no-store")
+		case "/private":
+			w.Header().Set("Cache-Control", "private, max-age=60")
+		case "/rule":
+			w.Header().Set("Cache-Control", "max-age=120")
+		}
+		w.Write([]byte("value"))
+	})
+	adapter := &adapterMock{store: map[uint64][]byte{}}
+	client, _ := NewClient(
+		ClientWithAdapter(adapter),
+		ClientWithTTL(1*time.Minute),
+		ClientWithMaxTTL(24*time.Hour),
+		ClientWithRules(Rule{Path: "/rule", TTL: 10 * time.Minute}),
+	)
+	handler := client.Middleware(httpTestHandler)
+
+	tests := []struct {
+		name    string
+		url     string
+		wantTTL time.Duration
+		wantOk  bool
+	}{
+		{"uses max-age", "/max-age", 2 * time.Minute, true},
+		{"prefers s-maxage", "/s-maxage", 5 * time.Minute, true},
+		{"caps at max ttl", "/long-max-age", 24 * time.Hour, true},
+		{"uses expires", "/expires", 1 * time.Hour, true},
+		{"does not cache no-store", "/no-store", 0, false},
+		{"does not cache private", "/private", 0, false},
+		{"prefers rule ttl", "/rule", 10 * time.Minute, true},
+		{"falls back to client ttl", "/default", 1 * time.Minute, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, _ := http.NewRequest("GET", tt.url, nil)
+			handler.ServeHTTP(httptest.NewRecorder(), r)
+			b, ok := adapter.Get(generateKey(r.URL.String()))
+			if ok != tt.wantOk {
+				t.Fatalf("*Client.Middleware() cached = %v, want %v", ok, tt.wantOk)
+			}
+			if ok {
+				ttl := time.Until(BytesToResponse(b).Expiration)
+				if ttl > tt.wantTTL || ttl < tt.wantTTL-time.Second {
+					t.Errorf("*Client.Middleware() ttl = %v, want %v", ttl, tt.wantTTL)
+				}
+			}
+		})
+	}
+}
+
+func TestMiddlewareDebugHeaders(t *testing.T) {
+	httpTestHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if Debugging(r.Context()) {
+			w.Header().Add("Server-Timing", ServerTiming("origin", 1*time.Millisecond, ""))
+		}
+		w.Write([]byte("value"))
+	})
+	staleURL := "http://foo.bar/stale"
+	adapter := &adapterMock{
+		store: map[uint64][]byte{
+			generateKey(staleURL): Response{
+				Value:                []byte("stale value"),
+				Expiration:           time.Now().Add(-1 * time.Minute),
+				StaleWhileRevalidate: 2 * time.Minute,
+				Date:                 time.Now().Add(-2 * time.Minute),
+			}.Bytes(),
+		},
+	}
+	client, _ := NewClient(
+		ClientWithAdapter(adapter),
+		ClientWithTTL(1*time.Minute),
+		ClientWithMethods([]string{http.MethodGet}),
+		ClientWithDebugHeaders("secret"),
+	)
+	handler := client.Middleware(httpTestHandler)
+
+	tests := []struct {
+		name         string
+		method       string
+		url          string
+		token        string
+		wantXCache   string
+		wantAge      string
+		wantTimings  []string
+		wantNoTiming bool
+	}{
+		{"omits headers without token", "GET", "http://foo.bar/a", "", "", "", nil, true},
+		{"omits headers with wrong token", "GET", "http://foo.bar/a", "wrong", "", "", nil, true},
+		{"reports miss", "GET", "http://foo.bar/b", "secret", "MISS", "", []string{"origin;dur=1.0", "cache;dur=", "total;dur="}, false},
+		{"reports hit", "GET", "http://foo.bar/b", "secret", "HIT", "0", []string{"cache;dur=", "total;dur="}, false},
+		{"does not cache headers", "GET", "http://foo.bar/b", "", "", "", nil, true},
+		{"reports stale", "GET", staleURL, "secret", "STALE", "120", []string{"cache;dur="}, false},
+		{"reports bypass", "POST", "http://foo.bar/b", "secret", "BYPASS", "", []string{"origin;dur=1.0"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			r, _ := http.NewRequest(tt.method, tt.url, nil)
+			if tt.token != "" {
+				r.Header.Set(DebugHeader, tt.token)
+			}
+			handler.ServeHTTP(w, r)
+			if got := w.Header().Get("X-Cache"); got != tt.wantXCache {
+				t.Errorf("*Client.Middleware() X-Cache = %v, want %v", got, tt.wantXCache)
+			}
+			if got := w.Header().Get("Age"); got != tt.wantAge {
+				t.Errorf("*Client.Middleware() Age = %v, want %v", got, tt.wantAge)
+			}
+			wantKey := ""
+			if tt.wantXCache != "" && tt.wantXCache != "BYPASS" {
+				wantKey = strconv.FormatUint(generateKey(tt.url), 16)
+			}
+			if got := w.Header().Get("X-Cache-Key"); got != wantKey {
+				t.Errorf("*Client.Middleware() X-Cache-Key = %v, want %v", got, wantKey)
+			}
+			timing := strings.Join(w.Header().Values("Server-Timing"), ", ")
+			if tt.wantNoTiming && timing != "" {
+				t.Errorf("*Client.Middleware() Server-Timing = %v, want none", timing)
+			}
+			for _, want := range tt.wantTimings {
+				if !strings.Contains(timing, want) {
+					t.Errorf("*Client.Middleware() Server-Timing = %v, want %v", timing, want)
+				}
+			}
+			if tt.wantXCache == "HIT" && strings.Contains(timing, "origin") {
+				t.Errorf("*Client.Middleware() Server-Timing = %v, want no origin metric", timing)
+			}
+		})
+	}
+}
+
+func TestMiddlewareKeyPolicy(t *testing.T) {
+	type request struct {
+		url    string
+		header http.Header
+	}
+	tests := []struct {
+		name      string
+		policy    KeyPolicy
+		requests  []request
+		wantCalls int32
+	}{
+		{
+			"denies query parameters",
+			KeyPolicy{QueryDeny: []string{"utm_*", "fbclid"}},
+			[]request{
+				{"http://foo.bar/a?id=1", nil},
+				{"http://foo.bar/a?utm_source=x&id=1&fbclid=y", nil},
+				{"http://foo.bar/a?id=2", nil},
+			},
+			2,
+		},
+		{
+			"allows query parameters",
+			KeyPolicy{QueryAllow: []string{"v"}},
+			[]request{
+				{"http://foo.bar/a?v=1", nil},
+				{"http://foo.bar/a?v=1&x=2", nil},
+				{"http://foo.bar/a?v=2", nil},
+			},
+			2,
+		},
+		{
+			"ignores query",
+			KeyPolicy{IgnoreQuery: true},
+			[]request{
+				{"http://foo.bar/a?v=1", nil},
+				{"http://foo.bar/a?v=2", nil},
+			},
+			1,
+		},
+		{
+			"includes host",
+			KeyPolicy{Host: true},
+			[]request{
+				{"http://foo.bar/a", nil},
+				{"http://FOO.bar/a", nil},
+				{"http://baz.bar/a", nil},
+			},
+			2,
+		},
+		{
+			"includes headers",
+			KeyPolicy{Headers: []string{"accept-language"}},
+			[]request{
+				{"http://foo.bar/a", http.Header{"Accept-Language": []string{"en"}}},
+				{"http://foo.bar/a", http.Header{"Accept-Language": []string{"en"}}},
+				{"http://foo.bar/a", http.Header{"Accept-Language": []string{"de"}}},
+			},
+			2,
+		},
+		{
+			"normalizes path",
+			KeyPolicy{NormalizePath: true},
+			[]request{
+				{"http://foo.bar/a/b", nil},
+				{"http://foo.bar/a//b", nil},
+				{"http://foo.bar/a/%62", nil},
+			},
+			1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var calls int32
+			client, err := NewClient(
+				ClientWithAdapter(&adapterMock{store: map[uint64][]byte{}}),
+				ClientWithTTL(1*time.Minute),
+				ClientWithKeyPolicy(tt.policy),
+			)
+			if err != nil {
+				t.Fatalf("NewClient() error = %v", err)
+			}
+			handler := client.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				atomic.AddInt32(&calls, 1)
+				w.Write([]byte("value"))
+			}))
+			for _, req := range tt.requests {
+				r, _ := http.NewRequest("GET", req.url, nil)
+				for k, v := range req.header {
+					r.Header[k] = v
+				}
+				handler.ServeHTTP(httptest.NewRecorder(), r)
+			}
+			if got := atomic.LoadInt32(&calls); got != tt.wantCalls {
+				t.Errorf("*Client.Middleware() origin calls = %v, want %v", got, tt.wantCalls)
+			}
+		})
+	}
+
+	t.Run("caches variants", func(t *testing.T) {
+		var calls int32
+		adapter := &adapterMock{store: map[uint64][]byte{}}
+		client, _ := NewClient(
+			ClientWithAdapter(adapter),
+			ClientWithTTL(1*time.Minute),
+			ClientWithKeyPolicy(KeyPolicy{Vary: true}),
+		)
+		handler := client.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&calls, 1)
+			if r.URL.Path == "/any" {
+				w.Header().Set("Vary", "*")
+			} else {
+				w.Header().Set("Vary", "Accept-Encoding")
+			}
+			w.Write([]byte(r.Header.Get("Accept-Encoding")))
+		}))
+		get := func(path, encoding string) string {
+			w := httptest.NewRecorder()
+			r, _ := http.NewRequest("GET", "http://foo.bar"+path, nil)
+			r.Header.Set("Accept-Encoding", encoding)
+			handler.ServeHTTP(w, r)
+			return w.Body.String()
+		}
+
+		for _, encoding := range []string{"gzip", "br", "gzip", "br"} {
+			if got := get("/a", encoding); got != encoding {
+				t.Errorf("*Client.Middleware() = %v, want %v", got, encoding)
+			}
+		}
+		if got := atomic.LoadInt32(&calls); got != 2 {
+			t.Errorf("*Client.Middleware() origin calls = %v, want 2", got)
+		}
+
+		u, _ := url.Parse("http://foo.bar/a")
+		client.Purge(u)
+		get("/a", "gzip")
+		get("/a", "br")
+		if got := atomic.LoadInt32(&calls); got != 4 {
+			t.Errorf("*Client.Middleware() origin calls after purge = %v, want 4", got)
+		}
+
+		get("/any", "gzip")
+		get("/any", "gzip")
+		if got := atomic.LoadInt32(&calls); got != 6 {
+			t.Errorf("*Client.Middleware() origin calls for Vary: * = %v, want 6", got)
+		}
+	})
+}
+
+func TestMiddlewareKeyCollision(t *testing.T) {
+	var calls int32
+	adapter := &adapterMock{store: map[uint64][]byte{}}
+	client, _ := NewClient(
+		ClientWithAdapter(adapter),
+		ClientWithTTL(1*time.Minute),
+		ClientWithKeyHash(func(string) uint64 { return 1 }),
+	)
+	handler := client.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.Write([]byte(r.URL.Path))
+	}))
+
+	tests := []struct {
+		name           string
+		url            string
+		wantCalls      int32
+		wantCollisions int64
+	}{
+		{"stores first response", "http://foo.bar/a", 1, 0},
+		{"returns first response", "http://foo.bar/a", 1, 0},
+		{"misses colliding response", "http://foo.bar/b", 2, 1},
+		{"returns colliding response", "http://foo.bar/b", 2, 1},
+		{"misses evicted response", "http://foo.bar/a", 3, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			r, _ := http.NewRequest("GET", tt.url, nil)
+			handler.ServeHTTP(w, r)
+			if want := r.URL.Path; w.Body.String() != want {
+				t.Errorf("*Client.Middleware() = %v, want %v", w.Body.String(), want)
+			}
+			if got := atomic.LoadInt32(&calls); got != tt.wantCalls {
+				t.Errorf("*Client.Middleware() origin calls = %v, want %v", got, tt.wantCalls)
+			}
+			if got := client.Collisions(); got != tt.wantCollisions {
+				t.Errorf("*Client.Collisions() = %v, want %v", got, tt.wantCollisions)
+			}
+		})
+	}
+}
+
+func TestMiddlewareCorruptEntry(t *testing.T) {
+	var calls int32
+	adapter := &adapterMock{store: map[uint64][]byte{
+		generateKey("http://foo.bar/test-1"): []byte("not an entry"),
+	}}
+	client, _ := NewClient(
+		ClientWithAdapter(adapter),
+		ClientWithTTL(1*time.Minute),
+	)
+	handler := client.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.Write([]byte("new value"))
+	}))
+
+	for i, wantCalls := range []int32{1, 1} {
+		w := httptest.NewRecorder()
+		r, _ := http.NewRequest("GET", "http://foo.bar/test-1", nil)
+		handler.ServeHTTP(w, r)
+		if w.Body.String() != "new value" {
+			t.Errorf("*Client.Middleware() = %v, want new value", w.Body.String())
+		}
+		if got := atomic.LoadInt32(&calls); got != wantCalls {
+			t.Errorf("request %d: *Client.Middleware() origin calls = %v, want %v", i, got, wantCalls)
+		}
+		if got := client.Corrupted(); got != 1 {
+			t.Errorf("request %d: *Client.Corrupted() = %v, want 1", i, got)
+		}
+	}
+}
+
+func TestMiddlewareStreaming(t *testing.T) {
+	large := bytes.Repeat([]byte("a"), 2*streamThreshold)
+	tests := []struct {
+		name       string
+		expiration time.Time
+		wantBody   string
+		wantStream bool
+	}{
+		{
+			"streams fresh large response",
+			time.Now().Add(1 * time.Minute),
+			string(large),
+			true,
+		},
+		{
+			"reads expired large response",
+			time.Now().Add(-1 * time.Minute),
+			"new value",
+			false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			adapter := &streamingAdapterMock{adapterMock: adapterMock{store: map[uint64][]byte{
+				generateKey("http://foo.bar/test-1"): Response{
+					Value:      large,
+					Expiration: tt.expiration,
+				}.Bytes(),
+			}}}
+			client, _ := NewClient(
+				ClientWithAdapter(adapter),
+				ClientWithTTL(1*time.Minute),
+			)
+			handler := client.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte("new value"))
+			}))
+
+			w := httptest.NewRecorder()
+			r, _ := http.NewRequest("GET", "http://foo.bar/test-1", nil)
+			handler.ServeHTTP(w, r)
+			if w.Body.String() != tt.wantBody {
+				t.Errorf("*Client.Middleware() body length = %v, want %v", w.Body.Len(), len(tt.wantBody))
+			}
+			if streamed := atomic.LoadInt32(&adapter.maxRead) < int32(len(large)); streamed != tt.wantStream {
+				t.Errorf("*Client.Middleware() streamed = %v, want %v", streamed, tt.wantStream)
+			}
+			if open := atomic.LoadInt32(&adapter.open); open != 0 {
+				t.Errorf("*Client.Middleware() left %v readers open", open)
+			}
+		})
+	}
+}
+
+func TestMiddlewareAdapterErrors(t *testing.T) {
+	var errs []error
+	client, err := NewClient(
+		ClientWithAdapterV2(blockingAdapterMock{}),
+		ClientWithTTL(1*time.Minute),
+		ClientWithAdapterTimeout(10*time.Millisecond),
+		ClientWithAdapterErrorHandler(func(err error) { errs = append(errs, err) }),
+	)
+	if err != nil {
+		t.Fatalf("NewClient() error = %v", err)
+	}
+	handler := client.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("new value"))
+	}))
+
+	for i := 1; i <= 2; i++ {
+		w := httptest.NewRecorder()
+		r, _ := http.NewRequest("GET", "http://foo.bar/test-1", nil)
+		start := time.Now()
+		handler.ServeHTTP(w, r)
+		if elapsed := time.Since(start); elapsed > 1*time.Second {
+			t.Errorf("request %d: *Client.Middleware() took %v", i, elapsed)
+		}
+		if w.Body.String() != "new value" {
+			t.Errorf("request %d: *Client.Middleware() = %v, want new value", i, w.Body.String())
+		}
+		// Both the lookup and the store of each request fail.
+		if got := client.AdapterErrors(); got != int64(2*i) {
+			t.Errorf("request %d: *Client.AdapterErrors() = %v, want %v", i, got, 2*i)
+		}
+	}
+	for _, err := range errs {
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("adapter error = %v, want %v", err, context.DeadlineExceeded)
+		}
+	}
+	if len(errs) != 4 {
+		t.Errorf("adapter error handler called %v times, want 4", len(errs))
+	}
+}
+
+func TestUpgradeAdapter(t *testing.T) {
+	adapter := &adapterMock{store: map[uint64][]byte{}}
+	a := UpgradeAdapter(adapter)
+	ctx := context.Background()
+
+	if err := a.SetContext(ctx, 1, []byte("value 1"), time.Time{}); err != nil {
+		t.Fatalf("SetContext() error = %v", err)
+	}
+	if b, ok, err := a.GetContext(ctx, 1); !ok || err != nil || string(b) != "value 1" {
+		t.Errorf("GetContext() = %q, %v, %v, want value 1", b, ok, err)
+	}
+
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	if _, ok, err := a.GetContext(canceled, 1); ok || !errors.Is(err, context.Canceled) {
+		t.Errorf("GetContext() with a canceled context = %v, %v, want %v", ok, err, context.Canceled)
+	}
+	if err := a.ReleaseContext(canceled, 1); !errors.Is(err, context.Canceled) {
+		t.Errorf("ReleaseContext() with a canceled context error = %v, want %v", err, context.Canceled)
+	}
+	if err := a.ReleaseContext(ctx, 1); err != nil {
+		t.Errorf("ReleaseContext() error = %v", err)
+	}
+	if _, ok := adapter.Get(1); ok {
+		t.Error("ReleaseContext() did not release key")
+	}
 
-			if counter != 12 {
-				reader := bytes.NewReader(tt.body)
-				r, err = http.NewRequest(tt.method, tt.url, reader)
-				if err != nil {
-					t.Error(err)
-					return
-				}
-			} else {
-				r, err = http.NewRequest(tt.method, tt.url, errReader(0))
-				if err != nil {
-					t.Error(err)
-					return
-				}
-			}
+	if UpgradeAdapter(nil) != nil {
+		t.Error("UpgradeAdapter(nil) != nil")
+	}
+}
 
-			w := httptest.NewRecorder()
-			handler.ServeHTTP(w, r)
+func TestClientExpirations(t *testing.T) {
+	adapter := &expiringAdapterMock{adapterMock: adapterMock{store: map[uint64][]byte{}}}
+	negativeAdapter := &expiringAdapterMock{adapterMock: adapterMock{store: map[uint64][]byte{}}}
+	client, err := NewClient(
+		ClientWithAdapter(adapter),
+		ClientWithTTL(1*time.Minute),
+		ClientWithNegativeCaching(negativeAdapter, 1*time.Minute),
+	)
+	if err != nil {
+		t.Fatalf("NewClient() error = %v", err)
+	}
+	if adapter.onExpire == nil || negativeAdapter.onExpire == nil {
+		t.Fatal("NewClient() did not register with the expiring adapters")
+	}
 
-			if !reflect.DeepEqual(w.Code, tt.wantCode) {
-				t.Errorf("*Client.Middleware() = %v, want %v", w.Code, tt.wantCode)
-				return
-			}
-			if !reflect.DeepEqual(w.Body.String(), tt.wantBody) {
-				t.Errorf("*Client.Middleware() = %v, want %v", w.Body.String(), tt.wantBody)
-			}
-		})
+	adapter.expire(1)
+	negativeAdapter.expire(2)
+	if got := client.Expirations(); got != 2 {
+		t.Errorf("*Client.Expirations() = %v, want 2", got)
+	}
+}
+
+// enumeratingAdapterMock is an adapterMock listing its cached responses.
+type enumeratingAdapterMock struct {
+	adapterMock
+}
+
+func (a *enumeratingAdapterMock) Range(ctx context.Context, f func(key uint64, entry EntryReader, size int64) bool) error {
+	a.Lock()
+	store := make(map[uint64][]byte, len(a.store))
+	for key, b := range a.store {
+		store[key] = b
+	}
+	a.Unlock()
+	for key, b := range store {
+		if !f(key, NewEntryReader(b), int64(len(b))) {
+			return nil
+		}
+	}
+	return nil
+}
+
+func TestClientEntries(t *testing.T) {
+	adapter := &enumeratingAdapterMock{adapterMock{store: map[uint64][]byte{}}}
+	negativeAdapter := &enumeratingAdapterMock{adapterMock{store: map[uint64][]byte{}}}
+	client, err := NewClient(
+		ClientWithAdapter(adapter),
+		ClientWithTTL(1*time.Minute),
+		ClientWithNegativeCaching(negativeAdapter, 1*time.Minute),
+	)
+	if err != nil {
+		t.Fatalf("NewClient() error = %v", err)
+	}
+	origin := 0
+	handler := client.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin++
+		if r.URL.Path == "/missing" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte("value " + r.URL.Path))
+	}))
+	get := func(target string) {
+		r, _ := http.NewRequest("GET", "http://foo.bar"+target, nil)
+		handler.ServeHTTP(httptest.NewRecorder(), r)
+	}
+	for _, target := range []string{"/a/1", "/a/2", "/b", "/missing", "/a/1"} {
+		get(target)
+	}
+	if hits, misses := client.Hits(), client.Misses(); hits != 1 || misses != 4 {
+		t.Errorf("*Client.Hits(), Misses() = %v, %v, want 1, 4", hits, misses)
+	}
+	adapter.Set(99, []byte("corrupt"), time.Time{})
+
+	entries := map[string]Entry{}
+	err = client.Entries(context.Background(), func(e Entry) bool {
+		entries[e.URL()] = e
+		return true
+	})
+	if err != nil {
+		t.Fatalf("*Client.Entries() error = %v", err)
+	}
+	if len(entries) != 4 {
+		t.Errorf("*Client.Entries() = %v, want 4 entries", entries)
+	}
+	if e := entries["http://foo.bar/a/1"]; e.StatusCode != http.StatusOK || e.Negative || e.Size != int64(len(adapter.store[e.Hash])) || !e.Expiration.After(time.Now()) {
+		t.Errorf("*Client.Entries() /a/1 = %+v", e)
+	}
+	if e := entries["http://foo.bar/missing"]; e.StatusCode != http.StatusNotFound || !e.Negative {
+		t.Errorf("*Client.Entries() /missing = %+v, want a negative entry", e)
+	}
+
+	n, err := client.PurgeFunc(context.Background(), func(e Entry) bool {
+		return strings.HasPrefix(e.URL(), "http://foo.bar/a/")
+	})
+	if n != 2 || err != nil {
+		t.Errorf("*Client.PurgeFunc() = %v, %v, want 2", n, err)
+	}
+	origin = 0
+	get("/a/1")
+	get("/b")
+	if origin != 1 {
+		t.Errorf("origin requests after purge = %v, want 1", origin)
+	}
+
+	client, err = NewClient(ClientWithAdapter(&adapterMock{store: map[uint64][]byte{}}), ClientWithTTL(1*time.Minute))
+	if err != nil {
+		t.Fatalf("NewClient() error = %v", err)
+	}
+	if err := client.Entries(context.Background(), func(Entry) bool { return true }); !errors.Is(err, ErrNotEnumerating) {
+		t.Errorf("*Client.Entries() error = %v, want %v", err, ErrNotEnumerating)
+	}
+}
+
+func TestClientTags(t *testing.T) {
+	adapter := &enumeratingAdapterMock{adapterMock{store: map[uint64][]byte{}}}
+	negativeAdapter := &enumeratingAdapterMock{adapterMock{store: map[uint64][]byte{}}}
+	client, err := NewClient(
+		ClientWithAdapter(adapter),
+		ClientWithTTL(1*time.Minute),
+		ClientWithNegativeCaching(negativeAdapter, 1*time.Minute),
+		ClientWithRules(Rule{Path: "/img/**", Tags: []string{"images"}}),
+		ClientWithTags(SurrogateKeyHeader, 100),
+	)
+	if err != nil {
+		t.Fatalf("NewClient() error = %v", err)
+	}
+	origin := 0
+	handler := client.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin++
+		w.Header().Set("Surrogate-Key", r.URL.Query().Get("tags"))
+		if strings.HasSuffix(r.URL.Path, "/missing") {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte("value " + r.URL.Path))
+	}))
+	get := func(target string) *httptest.ResponseRecorder {
+		r, _ := http.NewRequest("GET", "http://foo.bar"+target, nil)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+	for _, target := range []string{"/a?tags=release-1+home", "/b?tags=release-1", "/c?tags=release-2", "/img/1", "/img/missing", "/d"} {
+		if w := get(target); w.Header().Get("Surrogate-Key") != "" {
+			t.Errorf("Surrogate-Key header of %v = %q, want none", target, w.Header().Get("Surrogate-Key"))
+		}
+	}
+	if w := get("/a?tags=release-1+home"); w.Header().Get("Surrogate-Key") != "" || w.Body.String() != "value /a" {
+		t.Errorf("cached response = %v %q, want no Surrogate-Key header", w.Header(), w.Body.String())
+	}
+	if s := client.TagStats(); s != (TagStats{Tags: 4, Keys: 6}) {
+		t.Errorf("*Client.TagStats() = %+v, want 4 tags and 6 keys", s)
+	}
+
+	tags := map[string][]string{}
+	client.Entries(context.Background(), func(e Entry) bool {
+		tags[e.URL()] = e.Tags
+		return true
+	})
+	if got := tags["http://foo.bar/a?tags=release-1+home"]; !reflect.DeepEqual(got, []string{"release-1", "home"}) {
+		t.Errorf("*Client.Entries() tags of /a = %v, want [release-1 home]", got)
+	}
+
+	if n := client.PurgeTag(context.Background(), "release-1"); n != 2 {
+		t.Errorf("*Client.PurgeTag(release-1) = %v, want 2", n)
+	}
+	if n := client.PurgeTag(context.Background(), "images"); n != 2 {
+		t.Errorf("*Client.PurgeTag(images) = %v, want 2", n)
+	}
+	if n := client.PurgeTag(context.Background(), "home"); n != 0 {
+		t.Errorf("*Client.PurgeTag(home) = %v, want 0", n)
+	}
+	if s := client.TagStats(); s != (TagStats{Tags: 1, Keys: 1}) {
+		t.Errorf("*Client.TagStats() = %+v, want 1 tag and 1 key", s)
+	}
+	origin = 0
+	for _, target := range []string{"/a?tags=release-1+home", "/b?tags=release-1", "/c?tags=release-2", "/img/1", "/img/missing", "/d"} {
+		get(target)
+	}
+	if origin != 4 {
+		t.Errorf("origin requests after purge = %v, want 4", origin)
+	}
+
+	client, err = NewClient(ClientWithAdapter(adapter), ClientWithTTL(1*time.Minute), ClientWithTags(SurrogateKeyHeader, 100))
+	if err != nil {
+		t.Fatalf("NewClient() error = %v", err)
+	}
+	if n, err := client.IndexTags(context.Background()); n != 4 || err != nil {
+		t.Errorf("*Client.IndexTags() = %v, %v, want 4", n, err)
+	}
+	if n := client.PurgeTag(context.Background(), "release-2"); n != 1 {
+		t.Errorf("*Client.PurgeTag(release-2) after IndexTags() = %v, want 1", n)
+	}
+}
+
+func TestTagIndex(t *testing.T) {
+	idx := newTagIndex(4)
+	idx.set(1, []string{"a", "b"})
+	idx.set(2, []string{"b"})
+	idx.set(1, []string{"a"})
+	if s := idx.stats(); s != (TagStats{Tags: 2, Keys: 2}) {
+		t.Errorf("stats() after replacing tags = %+v, want 2 tags and 2 keys", s)
+	}
+
+	idx.set(3, []string{"c", "d"})
+	idx.set(4, []string{"d"})
+	// Over capacity: "b", the least recently tagged, is dropped.
+	if s := idx.stats(); s != (TagStats{Tags: 3, Keys: 4, Dropped: 1}) {
+		t.Errorf("stats() over capacity = %+v, want 3 tags, 4 keys and 1 dropped", s)
+	}
+	if keys := idx.take("b"); keys != nil {
+		t.Errorf("take(b) = %v, want none", keys)
+	}
+	if _, ok := idx.byKey[2]; ok {
+		t.Errorf("byKey[2] is set, want the key dropped along with its only tag")
+	}
+
+	idx.remove(3)
+	keys := idx.take("d")
+	if !reflect.DeepEqual(keys, []uint64{4}) {
+		t.Errorf("take(d) = %v, want [4]", keys)
+	}
+	if s := idx.stats(); s != (TagStats{Tags: 1, Keys: 1, Dropped: 1}) {
+		t.Errorf("stats() = %+v, want 1 tag, 1 key and 1 dropped", s)
+	}
+
+	idx.set(5, []string{"e", "e"})
+	if s := idx.stats(); s != (TagStats{Tags: 2, Keys: 2, Dropped: 1}) {
+		t.Errorf("stats() with a duplicate tag = %+v, want 2 tags, 2 keys and 1 dropped", s)
+	}
+	idx.remove(5)
+	if s := idx.stats(); s != (TagStats{Tags: 1, Keys: 1, Dropped: 1}) {
+		t.Errorf("stats() after removing a duplicate tag = %+v, want 1 tag, 1 key and 1 dropped", s)
+	}
+
+	var disabled *tagIndex
+	disabled.set(1, []string{"a"})
+	disabled.remove(1)
+	if keys := disabled.take("a"); keys != nil {
+		t.Errorf("nil take(a) = %v, want none", keys)
+	}
+}
+
+func TestHashSHA256(t *testing.T) {
+	if HashSHA256("/a") == HashSHA256("/b") {
+		t.Error("HashSHA256() returned the same hash for different keys")
+	}
+	if HashSHA256("/a") != HashSHA256("/a") {
+		t.Error("HashSHA256() is not deterministic")
+	}
+}
+
+func TestSameVariant(t *testing.T) {
+	response := http.Header{"Vary": []string{"Accept-Encoding, accept-language"}}
+	a := http.Header{"Accept-Encoding": []string{"gzip"}, "Accept-Language": []string{"en"}}
+	b := http.Header{"Accept-Encoding": []string{"gzip"}, "Accept-Language": []string{"de"}}
+	if !sameVariant(response, a, a.Clone()) {
+		t.Error("sameVariant() = false, want true")
+	}
+	if sameVariant(response, a, b) {
+		t.Error("sameVariant() = true, want false")
+	}
+	if !sameVariant(http.Header{}, a, b) {
+		t.Error("sameVariant() without Vary = false, want true")
+	}
+}
+
+func TestIsHashedAsset(t *testing.T) {
+	tests := []struct {
+		path string
+		want bool
+	}{
+		{"/assets/app.3f9a1c2b.js", true},
+		{"/assets/index-0d4e8a7f.css", true},
+		{"/main.0123456789abcdef0123.chunk.js", true},
+		{"/app.facade.js", false},
+		{"/my-document.pdf", false},
+		{"/assets/app.js", false},
+		{"/3f9a1c4d", false},
+		{"/.js", false},
+		{"/-.css", false},
+		{"/report-20240101.pdf", false},
+		{"/release-2024.10.01.tar", false},
+		{"/release-notes2026.html", false},
+		{"/banner-summer2024.jpg", false},
+		{"/assets/app.3f9a1c.js", false},
+		{"/assets/index-BxK3d9Qe.css", false},
+	}
+	for _, tt := range tests {
+		if got := isHashedAsset(tt.path); got != tt.want {
+			t.Errorf("isHashedAsset(%v) = %v, want %v", tt.path, got, tt.want)
+		}
 	}
 }
 
@@ -280,6 +1681,62 @@ func TestResponseToBytes(t *testing.T) {
 	}
 }
 
+func TestDecodeResponse(t *testing.T) {
+	now := time.Unix(1700000000, 123)
+	r := Response{
+		Value:                []byte("value 1"),
+		Header:               http.Header{"Content-Type": {"text/plain"}, "Vary": {"Accept", "Accept-Encoding"}},
+		Expiration:           now.Add(time.Minute),
+		LastAccess:           now,
+		Frequency:            2,
+		StaleWhileRevalidate: 10 * time.Second,
+		StaleIfError:         time.Hour,
+		ETag:                 `"v1"`,
+		StatusCode:           http.StatusNotFound,
+		Date:                 now,
+		Key:                  "/test-1",
+		Vary:                 []string{"Accept"},
+	}
+	b := r.Bytes()
+
+	got, err := DecodeResponse(b)
+	if err != nil {
+		t.Fatalf("DecodeResponse() error = %v", err)
+	}
+	if !reflect.DeepEqual(got, r) {
+		t.Errorf("DecodeResponse() = %+v, want %+v", got, r)
+	}
+	if &got.Value[0] != &b[len(b)-4-len(r.Value)] {
+		t.Error("DecodeResponse() copied the response value")
+	}
+	if got, err := DecodeResponse(Response{}.Bytes()); err != nil || !reflect.DeepEqual(got, Response{}) {
+		t.Errorf("DecodeResponse() = %+v, %v, want empty response", got, err)
+	}
+
+	corrupt := func(f func(b []byte) []byte) []byte {
+		return f(append([]byte(nil), b...))
+	}
+	tests := []struct {
+		name string
+		b    []byte
+	}{
+		{"empty", nil},
+		{"not an entry", []byte("value 1")},
+		{"unsupported version", corrupt(func(b []byte) []byte { b[offVersion]++; return b })},
+		{"truncated", b[:len(b)-1]},
+		{"trailing bytes", append(corrupt(func(b []byte) []byte { return b }), 0)},
+		{"modified value", corrupt(func(b []byte) []byte { b[len(b)-5]++; return b })},
+		{"modified header", corrupt(func(b []byte) []byte { b[offStatus]++; return b })},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := DecodeResponse(tt.b); !errors.Is(err, ErrCorruptEntry) {
+				t.Errorf("DecodeResponse() error = %v, want %v", err, ErrCorruptEntry)
+			}
+		})
+	}
+}
+
 func TestSortURLParams(t *testing.T) {
 	u, _ := url.Parse("http://test.com?zaz=bar&foo=zaz&boo=foo&boo=baz")
 	tests := []struct {
@@ -382,8 +1839,8 @@ func TestGenerateKeyWithBody(t *testing.T) {
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			if got := generateKeyWithBody(tt.URL, tt.body); got != tt.want {
-				t.Errorf("generateKeyWithBody() = %v, want %v", got, tt.want)
+			if got := generateKey(tt.URL + string(tt.body)); got != tt.want {
+				t.Errorf("generateKey() = %v, want %v", got, tt.want)
 			}
 		})
 	}
@@ -406,7 +1863,7 @@ func TestNewClient(t *testing.T) {
 				ClientWithMethods([]string{http.MethodGet, http.MethodPost}),
 			},
 			&Client{
-				adapter:    adapter,
+				adapter:    UpgradeAdapter(adapter),
 				ttl:        1 * time.Millisecond,
 				refreshKey: "",
 				methods:    []string{http.MethodGet, http.MethodPost},
@@ -421,7 +1878,7 @@ func TestNewClient(t *testing.T) {
 				ClientWithRefreshKey("rk"),
 			},
 			&Client{
-				adapter:    adapter,
+				adapter:    UpgradeAdapter(adapter),
 				ttl:        1 * time.Millisecond,
 				refreshKey: "rk",
 				methods:    []string{http.MethodGet},
@@ -465,6 +1922,126 @@ func TestNewClient(t *testing.T) {
 			nil,
 			true,
 		},
+		{
+			"returns error",
+			[]ClientOption{
+				ClientWithAdapter(adapter),
+				ClientWithTTL(1 * time.Millisecond),
+				ClientWithStaleWhileRevalidate(-1 * time.Millisecond),
+			},
+			nil,
+			true,
+		},
+		{
+			"returns error",
+			[]ClientOption{
+				ClientWithAdapter(adapter),
+				ClientWithTTL(1 * time.Millisecond),
+				ClientWithAdapterTimeout(0),
+			},
+			nil,
+			true,
+		},
+		{
+			"returns error",
+			[]ClientOption{
+				ClientWithAdapter(adapter),
+				ClientWithTTL(1 * time.Millisecond),
+				ClientWithStaleIfError(-1 * time.Millisecond),
+			},
+			nil,
+			true,
+		},
+		{
+			"returns error",
+			[]ClientOption{
+				ClientWithAdapter(adapter),
+				ClientWithTTL(1 * time.Millisecond),
+				ClientWithNegativeCaching(nil, 1*time.Millisecond),
+			},
+			nil,
+			true,
+		},
+		{
+			"returns error",
+			[]ClientOption{
+				ClientWithAdapter(adapter),
+				ClientWithTTL(1 * time.Millisecond),
+				ClientWithNegativeCaching(adapter, 0),
+			},
+			nil,
+			true,
+		},
+		{
+			"returns error",
+			[]ClientOption{
+				ClientWithAdapter(adapter),
+				ClientWithTTL(1 * time.Millisecond),
+				ClientWithRules(Rule{MinSize: 10, MaxSize: 1}),
+			},
+			nil,
+			true,
+		},
+		{
+			"returns error",
+			[]ClientOption{
+				ClientWithAdapter(adapter),
+				ClientWithTTL(1 * time.Millisecond),
+				ClientWithRules(Rule{Tags: []string{"two tags"}}),
+			},
+			nil,
+			true,
+		},
+		{
+			"returns error",
+			[]ClientOption{
+				ClientWithAdapter(adapter),
+				ClientWithTTL(1 * time.Millisecond),
+				ClientWithTags("", 1),
+			},
+			nil,
+			true,
+		},
+		{
+			"returns error",
+			[]ClientOption{
+				ClientWithAdapter(adapter),
+				ClientWithTTL(1 * time.Millisecond),
+				ClientWithTags(SurrogateKeyHeader, 0),
+			},
+			nil,
+			true,
+		},
+		{
+			"returns error",
+			[]ClientOption{
+				ClientWithAdapter(adapter),
+				ClientWithTTL(1 * time.Millisecond),
+				ClientWithMaxTTL(-1 * time.Millisecond),
+			},
+			nil,
+			true,
+		},
+		{
+			"returns error",
+			[]ClientOption{
+				ClientWithAdapter(adapter),
+				ClientWithTTL(1 * time.Millisecond),
+				ClientWithKeyPolicy(KeyPolicy{QueryAllow: []string{"a"}, QueryDeny: []string{"b"}}),
+			},
+			nil,
+			true,
+		},
+		{
+			"returns error",
+			[]ClientOption{
+				ClientWithAdapter(adapter),
+				ClientWithTTL(1 * time.Millisecond),
+				ClientWithKeyHash(nil),
+			},
+			nil,
+			true,
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
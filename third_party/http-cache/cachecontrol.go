@@ -0,0 +1,136 @@
+/*
+MIT License
+
+Copyright (c) 2018 Victor Springer
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package cache
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cacheControl holds the directives of a Cache-Control header, keyed by
+// their lowercased names. Directives without an argument map to "".
+type cacheControl map[string]string
+
+func parseCacheControl(h http.Header) cacheControl {
+	cc := cacheControl{}
+	for _, line := range h.Values("Cache-Control") {
+		for _, part := range strings.Split(line, ",") {
+			part = strings.TrimSpace(part)
+			if part == "" {
+				continue
+			}
+			name, value := part, ""
+			if i := strings.IndexByte(part, '='); i >= 0 {
+				name, value = part[:i], strings.Trim(strings.TrimSpace(part[i+1:]), `"`)
+			}
+			cc[strings.ToLower(strings.TrimSpace(name))] = value
+		}
+	}
+	return cc
+}
+
+// seconds returns the value of a delta-seconds directive, e.g. max-age.
+func (cc cacheControl) seconds(name string) (time.Duration, bool) {
+	v, ok := cc[name]
+	if !ok {
+		return 0, false
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || n < 0 {
+		return 0, false
+	}
+	if n > int64(math.MaxInt64/time.Second) {
+		n = int64(math.MaxInt64 / time.Second)
+	}
+	return time.Duration(n) * time.Second, true
+}
+
+// freshness is how long the origin allows a response to be cached for, as
+// per its Cache-Control or Expires header.
+type freshness struct {
+	ttl     time.Duration
+	set     bool
+	noStore bool
+}
+
+// originFreshness reads the freshness of a response from its header. Only
+// the directives meaningful to a shared cache are taken into account.
+func originFreshness(h http.Header) freshness {
+	cc := parseCacheControl(h)
+	for _, name := range []string{"no-store", "private"} {
+		if _, ok := cc[name]; ok {
+			return freshness{noStore: true}
+		}
+	}
+	if _, ok := cc["no-cache"]; ok {
+		return freshness{set: true}
+	}
+	for _, name := range []string{"s-maxage", "max-age"} {
+		if ttl, ok := cc.seconds(name); ok {
+			return freshness{ttl: ttl, set: true}
+		}
+	}
+	if v := h.Get("Expires"); v != "" {
+		// An invalid date, e.g. "0", means already expired.
+		expires, err := http.ParseTime(v)
+		if err != nil {
+			return freshness{set: true}
+		}
+		date, err := http.ParseTime(h.Get("Date"))
+		if err != nil {
+			date = time.Now()
+		}
+		ttl := expires.Sub(date)
+		if ttl < 0 {
+			ttl = 0
+		}
+		return freshness{ttl: ttl, set: true}
+	}
+	return freshness{}
+}
+
+// ttlFor returns for how long a response is fresh, or false if it must not
+// be cached. A matching rule takes precedence over the origin, which takes
+// precedence over the client TTL.
+func (c *Client) ttlFor(r *rule, f freshness) (time.Duration, bool) {
+	switch {
+	case r != nil && r.NoStore:
+		return 0, false
+	case r != nil && r.NoCache:
+		return 0, true
+	case r != nil && r.TTL > 0:
+		return r.TTL, true
+	case f.noStore:
+		return 0, false
+	case f.set && c.maxTTL > 0 && f.ttl > c.maxTTL:
+		return c.maxTTL, true
+	case f.set:
+		return f.ttl, true
+	}
+	return c.ttl, true
+}
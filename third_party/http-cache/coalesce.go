@@ -0,0 +1,189 @@
+/*
+MIT License
+
+Copyright (c) 2018 Victor Springer
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package cache
+
+import (
+	"bytes"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// flight is an in-progress origin fetch for a single cache key. The request
+// that started it (the leader) feeds the response into the flight while
+// concurrent requests for the same key (the waiters) stream it from there.
+type flight struct {
+	mu         sync.Mutex
+	started    chan struct{}
+	changed    chan struct{}
+	request    http.Header
+	header     http.Header
+	statusCode int
+	// body is the buffer of the leader's response, appended to only.
+	body    *bytes.Buffer
+	done    bool
+	aborted bool
+}
+
+func newFlight(request http.Header, body *bytes.Buffer) *flight {
+	return &flight{
+		started: make(chan struct{}),
+		changed: make(chan struct{}),
+		request: request,
+		body:    body,
+	}
+}
+
+// joinFlight returns the flight for a given key, creating it for a request
+// with the given header and response body buffer if there is none. It also
+// returns true if the caller has become the leader.
+func (c *Client) joinFlight(key uint64, request http.Header, body *bytes.Buffer) (*flight, bool) {
+	c.flightsMu.Lock()
+	defer c.flightsMu.Unlock()
+
+	if f, ok := c.flights[key]; ok {
+		return f, false
+	}
+	if c.flights == nil {
+		c.flights = make(map[uint64]*flight)
+	}
+	f := newFlight(request, body)
+	c.flights[key] = f
+	return f, true
+}
+
+// leaveFlight marks the flight as finished and forgets it, so that subsequent
+// requests are served from the cache instead. If the leader did not complete
+// (e.g. the next handler panicked), the waiters are told to fetch on their
+// own, or are aborted if they have started responding.
+func (c *Client) leaveFlight(key uint64, f *flight, completed bool) {
+	f.finish(completed)
+
+	c.flightsMu.Lock()
+	delete(c.flights, key)
+	c.flightsMu.Unlock()
+}
+
+// start publishes the response status and header to the waiters.
+func (f *flight) start(statusCode int, header http.Header) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.header != nil {
+		return
+	}
+	f.statusCode = statusCode
+	f.header = withoutDebugHeaders(header)
+	close(f.started)
+}
+
+// write appends a chunk to the response body and wakes up the waiters.
+func (f *flight) write(b []byte) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.body.Write(b)
+	f.notify()
+}
+
+func (f *flight) finish(completed bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.header == nil {
+		f.statusCode = http.StatusOK
+		f.header = http.Header{}
+		close(f.started)
+	}
+	f.aborted = !completed
+	f.done = true
+	f.notify()
+}
+
+// notify wakes up the waiters. It must be called with f.mu held.
+func (f *flight) notify() {
+	close(f.changed)
+	f.changed = make(chan struct{})
+}
+
+// serve streams the leader's response to w as it is being downloaded. It
+// returns false, without writing anything, if the leader has not started
+// responding within the given timeout, has given up without a response, or
+// has got a variant of the response that does not match r. If the leader
+// gives up after the response has started, serve panics with
+// http.ErrAbortHandler so that the client does not take a truncated body for
+// a complete one. It returns true as soon as the context of r is done.
+func (f *flight) serve(w http.ResponseWriter, r *http.Request, timeout time.Duration) bool {
+	ctx := r.Context()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case <-f.started:
+	case <-timer.C:
+		return false
+	case <-ctx.Done():
+		return true
+	}
+
+	f.mu.Lock()
+	if f.aborted || !sameVariant(f.header, f.request, r.Header) {
+		f.mu.Unlock()
+		return false
+	}
+	for k, v := range f.header {
+		w.Header()[k] = v
+	}
+	statusCode := f.statusCode
+	f.mu.Unlock()
+	w.WriteHeader(statusCode)
+
+	offset := 0
+	for {
+		f.mu.Lock()
+		// The leader only appends to the body, so the chunk stays valid.
+		chunk, done, aborted, changed := f.body.Bytes()[offset:], f.done, f.aborted, f.changed
+		f.mu.Unlock()
+
+		if len(chunk) > 0 {
+			if _, err := w.Write(chunk); err != nil {
+				return true
+			}
+			offset += len(chunk)
+			continue
+		}
+		if done {
+			if aborted {
+				panic(http.ErrAbortHandler)
+			}
+			return true
+		}
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return true
+		}
+	}
+}
@@ -0,0 +1,129 @@
+/*
+MIT License
+
+Copyright (c) 2018 Victor Springer
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package cache
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// DebugHeader is the request header carrying the debug token.
+const DebugHeader = "X-Cache-Debug"
+
+// Cache statuses reported in the X-Cache debug header.
+const (
+	cacheHit    = "HIT"
+	cacheMiss   = "MISS"
+	cacheStale  = "STALE"
+	cacheBypass = "BYPASS"
+)
+
+// debugHeaders are the headers that only make sense for a single response,
+// which are never cached nor shared with coalesced requests.
+var debugHeaders = []string{"X-Cache", "X-Cache-Key", "Age", "Server-Timing"}
+
+type debugContextKey struct{}
+
+// Debugging reports whether the debug headers are enabled for the request
+// with the given context, so that the origin can add its own Server-Timing
+// metrics.
+func Debugging(ctx context.Context) bool {
+	v, _ := ctx.Value(debugContextKey{}).(bool)
+	return v
+}
+
+// debugInfo collects the data reported in the debug headers of a response.
+type debugInfo struct {
+	start  time.Time
+	lookup time.Duration
+	key    uint64
+}
+
+// debug returns the debug info for a request, or nil if the debug headers
+// are not enabled for it.
+func (c *Client) debug(r *http.Request) *debugInfo {
+	if !c.debugEnabled {
+		return nil
+	}
+	if c.debugToken != "" &&
+		subtle.ConstantTimeCompare([]byte(r.Header.Get(DebugHeader)), []byte(c.debugToken)) != 1 {
+		return nil
+	}
+	return &debugInfo{start: time.Now()}
+}
+
+// setHeaders sets the debug headers for a response with the given cache
+// status. The cached response, if any, is used to report its age. The total
+// time is up to when the response header is sent.
+func (d *debugInfo) setHeaders(h http.Header, status string, cached *Response) {
+	if d == nil {
+		return
+	}
+	h.Set("X-Cache", status)
+	if status == cacheBypass {
+		return
+	}
+	h.Set("X-Cache-Key", strconv.FormatUint(d.key, 16))
+	if cached != nil && !cached.Date.IsZero() {
+		h.Set("Age", strconv.FormatInt(int64(time.Since(cached.Date)/time.Second), 10))
+	}
+	h.Add("Server-Timing", ServerTiming("cache", d.lookup, "cache lookup"))
+	h.Add("Server-Timing", ServerTiming("total", time.Since(d.start), ""))
+}
+
+// ServerTiming formats a Server-Timing metric, with its duration in
+// milliseconds, e.g. for the origin to add to its response when Debugging.
+func ServerTiming(name string, d time.Duration, desc string) string {
+	metric := name + ";dur=" + strconv.FormatFloat(float64(d)/float64(time.Millisecond), 'f', 1, 64)
+	if desc != "" {
+		metric += fmt.Sprintf(";desc=%q", desc)
+	}
+	return metric
+}
+
+// withoutDebugHeaders returns a copy of a header without the debug headers.
+func withoutDebugHeaders(h http.Header) http.Header {
+	h = h.Clone()
+	for _, k := range debugHeaders {
+		h.Del(k)
+	}
+	return h
+}
+
+// ClientWithDebugHeaders adds the X-Cache, X-Cache-Key, Age and Server-Timing
+// headers to responses. If token is not empty, they are only added to the
+// responses to requests with a matching X-Cache-Debug header. Optional
+// setting. If not set, debug headers are never added.
+func ClientWithDebugHeaders(token string) ClientOption {
+	return func(c *Client) error {
+		c.debugEnabled = true
+		c.debugToken = token
+		return nil
+	}
+}
@@ -0,0 +1,310 @@
+package cache
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"math"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// Cached responses are stored by adapters as entries with a fixed header
+// followed by variable sections and a checksum, integers in big-endian:
+//
+//	magic                  "hc"
+//	version                uint8
+//	status code            uint16
+//	expiration             int64, Unix nanoseconds, 0 for the zero time
+//	date                   int64
+//	last access            int64
+//	stale-while-revalidate int64, nanoseconds
+//	stale-if-error         int64
+//	frequency              uint32
+//	section lengths        uint32 each for the ETag, key, Vary, header and body
+//	ETag, key
+//	Vary                   uvarint count, then uvarint length and name each
+//	header                 uvarint field and value counts, then per field
+//	                       uvarint length and name, uvarint value count and
+//	                       uvarint length and value each
+//	body
+//	checksum               uint32, CRC-32C of all of the above
+//
+// Entries are decoded without copying the body, so adapters may keep them in
+// memory as they are.
+const (
+	entryMagic   = "hc"
+	entryVersion = 1
+
+	offVersion    = 2
+	offStatus     = 3
+	offExpiration = 5
+	offDate       = 13
+	offLastAccess = 21
+	offSWR        = 29
+	offSIE        = 37
+	offFrequency  = 45
+	offLengths    = 49
+	entryHeader   = offLengths + 5*4
+	entryTrailer  = 4
+)
+
+// ErrCorruptEntry is returned when decoding bytes that are not a valid cache
+// entry, e.g. truncated ones or ones written by another version.
+var ErrCorruptEntry = errors.New("corrupt cache entry")
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// Bytes converts Response data structure into bytes array.
+func (r Response) Bytes() []byte {
+	names := make([]string, 0, len(r.Header))
+	values := 0
+	for name, v := range r.Header {
+		names = append(names, name)
+		values += len(v)
+	}
+	sort.Strings(names)
+
+	varyLen := uvarintLen(uint64(len(r.Vary)))
+	for _, name := range r.Vary {
+		varyLen += stringLen(name)
+	}
+	headerLen := uvarintLen(uint64(len(names))) + uvarintLen(uint64(values))
+	for _, name := range names {
+		headerLen += stringLen(name) + uvarintLen(uint64(len(r.Header[name])))
+		for _, v := range r.Header[name] {
+			headerLen += stringLen(v)
+		}
+	}
+
+	size := entryHeader + len(r.ETag) + len(r.Key) + varyLen + headerLen + len(r.Value) + entryTrailer
+	b := make([]byte, entryHeader, size)
+	copy(b, entryMagic)
+	b[offVersion] = entryVersion
+	binary.BigEndian.PutUint16(b[offStatus:], uint16(r.StatusCode))
+	binary.BigEndian.PutUint64(b[offExpiration:], uint64(unixNano(r.Expiration)))
+	binary.BigEndian.PutUint64(b[offDate:], uint64(unixNano(r.Date)))
+	binary.BigEndian.PutUint64(b[offLastAccess:], uint64(unixNano(r.LastAccess)))
+	binary.BigEndian.PutUint64(b[offSWR:], uint64(r.StaleWhileRevalidate))
+	binary.BigEndian.PutUint64(b[offSIE:], uint64(r.StaleIfError))
+	binary.BigEndian.PutUint32(b[offFrequency:], uint32(r.Frequency))
+	for i, n := range []int{len(r.ETag), len(r.Key), varyLen, headerLen, len(r.Value)} {
+		binary.BigEndian.PutUint32(b[offLengths+4*i:], uint32(n))
+	}
+
+	b = append(b, r.ETag...)
+	b = append(b, r.Key...)
+	b = binary.AppendUvarint(b, uint64(len(r.Vary)))
+	for _, name := range r.Vary {
+		b = appendString(b, name)
+	}
+	b = binary.AppendUvarint(b, uint64(len(names)))
+	b = binary.AppendUvarint(b, uint64(values))
+	for _, name := range names {
+		b = appendString(b, name)
+		b = binary.AppendUvarint(b, uint64(len(r.Header[name])))
+		for _, v := range r.Header[name] {
+			b = appendString(b, v)
+		}
+	}
+	b = append(b, r.Value...)
+
+	return binary.BigEndian.AppendUint32(b, crc32.Checksum(b, crcTable))
+}
+
+// BytesToResponse converts bytes array into Response data structure. It
+// returns an empty Response if b is not a valid cache entry, use
+// DecodeResponse to tell.
+func BytesToResponse(b []byte) Response {
+	r, _ := DecodeResponse(b)
+	return r
+}
+
+// DecodeResponse converts a cache entry into Response data structure, or
+// returns an error wrapping ErrCorruptEntry if b is not a valid one. The
+// Value of the response shares its memory with b, which must not be modified
+// afterwards.
+func DecodeResponse(b []byte) (Response, error) {
+	lengths, err := entryLengths(b, int64(len(b)))
+	if err != nil {
+		return Response{}, err
+	}
+	body := len(b) - entryTrailer
+	if crc32.Checksum(b[:body], crcTable) != binary.BigEndian.Uint32(b[body:]) {
+		return Response{}, fmt.Errorf("%w: checksum mismatch", ErrCorruptEntry)
+	}
+
+	r, err := decodeMetadata(b, lengths)
+	if err != nil {
+		return Response{}, err
+	}
+	if n := lengths[4]; n > 0 {
+		r.Value = b[body-n : body : body]
+	}
+	return r, nil
+}
+
+// entryLengths checks the fixed header of an entry of a given size, and
+// returns the lengths of its ETag, key, Vary, header and body sections.
+func entryLengths(b []byte, size int64) ([5]int, error) {
+	var lengths [5]int
+	if len(b) < entryHeader || size < entryHeader+entryTrailer || string(b[:offVersion]) != entryMagic {
+		return lengths, fmt.Errorf("%w: bad header", ErrCorruptEntry)
+	}
+	if v := b[offVersion]; v != entryVersion {
+		return lengths, fmt.Errorf("%w: unsupported version %d", ErrCorruptEntry, v)
+	}
+
+	want := int64(entryHeader + entryTrailer)
+	for i := range lengths {
+		lengths[i] = int(binary.BigEndian.Uint32(b[offLengths+4*i:]))
+		want += int64(lengths[i])
+	}
+	if want != size {
+		return lengths, fmt.Errorf("%w: %d bytes, want %d", ErrCorruptEntry, size, want)
+	}
+	return lengths, nil
+}
+
+// metadataLen returns the size of the fixed header and the metadata sections
+// of an entry, which precede its body.
+func metadataLen(lengths [5]int) int {
+	return entryHeader + lengths[0] + lengths[1] + lengths[2] + lengths[3]
+}
+
+// decodeMetadata decodes an entry but its body from b, holding at least its
+// fixed header and metadata sections.
+func decodeMetadata(b []byte, lengths [5]int) (Response, error) {
+	r := Response{
+		StatusCode:           int(binary.BigEndian.Uint16(b[offStatus:])),
+		Expiration:           fromUnixNano(int64(binary.BigEndian.Uint64(b[offExpiration:]))),
+		Date:                 fromUnixNano(int64(binary.BigEndian.Uint64(b[offDate:]))),
+		LastAccess:           fromUnixNano(int64(binary.BigEndian.Uint64(b[offLastAccess:]))),
+		StaleWhileRevalidate: time.Duration(binary.BigEndian.Uint64(b[offSWR:])),
+		StaleIfError:         time.Duration(binary.BigEndian.Uint64(b[offSIE:])),
+		Frequency:            int(binary.BigEndian.Uint32(b[offFrequency:])),
+	}
+
+	// All strings are sliced from a single copy of the metadata sections.
+	meta := b[entryHeader:metadataLen(lengths)]
+	d := entryDecoder{b: meta, s: string(meta)}
+	r.ETag = d.next(lengths[0])
+	r.Key = d.next(lengths[1])
+
+	if n := d.uvarint(); n > len(d.b) {
+		d.err = errors.New("bad vary count")
+	} else if n > 0 {
+		r.Vary = make([]string, n)
+		for i := 0; i < n && d.err == nil; i++ {
+			r.Vary[i] = d.string()
+		}
+	}
+
+	fields, values := d.uvarint(), d.uvarint()
+	if d.err == nil && (fields > len(d.b) || values > len(d.b)) {
+		d.err = errors.New("bad header counts")
+	}
+	if d.err == nil && fields > 0 {
+		r.Header = make(http.Header, fields)
+		all := make([]string, values)
+		for i := 0; i < fields && d.err == nil; i++ {
+			name := d.string()
+			n := d.uvarint()
+			if n > len(all) {
+				d.err = errors.New("bad header value count")
+				break
+			}
+			v := all[:n:n]
+			all = all[n:]
+			for j := range v {
+				v[j] = d.string()
+			}
+			r.Header[name] = v
+		}
+	}
+	if d.err == nil && len(d.b) != 0 {
+		d.err = errors.New("trailing metadata")
+	}
+	if d.err != nil {
+		return Response{}, fmt.Errorf("%w: %v", ErrCorruptEntry, d.err)
+	}
+	return r, nil
+}
+
+// Corrupted returns the number of cached entries that have been dropped as
+// unreadable.
+func (c *Client) Corrupted() int64 {
+	return c.corrupted.Load()
+}
+
+// entryDecoder reads the metadata sections of an entry from b, taking the
+// strings from s, a copy of b.
+type entryDecoder struct {
+	b   []byte
+	s   string
+	off int
+	err error
+}
+
+func (d *entryDecoder) next(n int) string {
+	if d.err != nil {
+		return ""
+	}
+	if n > len(d.b) {
+		d.err = errors.New("truncated metadata")
+		return ""
+	}
+	v := d.s[d.off : d.off+n]
+	d.b, d.off = d.b[n:], d.off+n
+	return v
+}
+
+func (d *entryDecoder) uvarint() int {
+	if d.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(d.b)
+	if n <= 0 || v > math.MaxInt32 {
+		d.err = errors.New("bad length")
+		return 0
+	}
+	d.b, d.off = d.b[n:], d.off+n
+	return int(v)
+}
+
+func (d *entryDecoder) string() string {
+	return d.next(d.uvarint())
+}
+
+func appendString(b []byte, s string) []byte {
+	b = binary.AppendUvarint(b, uint64(len(s)))
+	return append(b, s...)
+}
+
+func stringLen(s string) int {
+	return uvarintLen(uint64(len(s))) + len(s)
+}
+
+func uvarintLen(v uint64) int {
+	n := 1
+	for ; v >= 0x80; v >>= 7 {
+		n++
+	}
+	return n
+}
+
+func unixNano(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixNano()
+}
+
+func fromUnixNano(n int64) time.Time {
+	if n == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, n)
+}
@@ -0,0 +1,142 @@
+package cache
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"strings"
+	"time"
+)
+
+// ErrNotEnumerating is returned when listing the cached responses of an
+// adapter which does not implement EnumeratingAdapter.
+var ErrNotEnumerating = errors.New("cache adapter does not list its responses")
+
+// EnumeratingAdapter is an Adapter which can list its cached responses.
+// Optional interface, required to list and purge responses by their URL.
+type EnumeratingAdapter interface {
+	Adapter
+
+	// Range calls f with the key, the entry and the size of every cached
+	// response, in no particular order, until f returns false. Entries are
+	// only valid until f returns, and are not counted as accessed. Responses
+	// set or released meanwhile may or may not be listed.
+	Range(ctx context.Context, f func(key uint64, entry EntryReader, size int64) bool) error
+}
+
+// NewEntryReader returns an EntryReader of an entry held in memory, e.g. for
+// adapters implementing EnumeratingAdapter.
+func NewEntryReader(b []byte) EntryReader {
+	return &entryReader{Reader: bytes.NewReader(b), b: b}
+}
+
+// entryReader is an EntryReader of an entry held in memory, which is decoded
+// without copying it.
+type entryReader struct {
+	*bytes.Reader
+	b []byte
+}
+
+func (r *entryReader) Bytes() []byte {
+	return r.b
+}
+
+func (r *entryReader) Close() error {
+	return nil
+}
+
+// Entry describes a cached response, as listed by Client.Entries.
+type Entry struct {
+	// Key is the canonical cache key of the response: its URL, followed by
+	// the values of the request headers it is keyed by, one per line.
+	Key string
+
+	// Hash is the key the response is stored under by the adapter.
+	Hash uint64
+
+	// StatusCode, Expiration and Date are those of the cached response.
+	StatusCode int
+	Expiration time.Time
+	Date       time.Time
+
+	// Size is the size of the cached entry, including its metadata.
+	Size int64
+
+	// Vary lists the request headers the response varies on, if the entry
+	// is a marker recording them rather than a response.
+	Vary []string
+
+	// Negative tells whether the response is held by the negative cache.
+	Negative bool
+
+	// Tags lists the tags of the response, if tags are enabled.
+	Tags []string
+
+	adapter AdapterV2
+}
+
+// URL returns the URL of the cached response, the first line of its key.
+func (e Entry) URL() string {
+	u, _, _ := strings.Cut(e.Key, "\n")
+	return u
+}
+
+// Entries calls f with every response cached by the adapters of the client,
+// in no particular order, until f returns false. Entries of the client are
+// read but not counted as accessed, corrupt ones are skipped. It returns
+// ErrNotEnumerating if an adapter does not implement EnumeratingAdapter.
+func (c *Client) Entries(ctx context.Context, f func(e Entry) bool) error {
+	more := true
+	for _, a := range []AdapterV2{c.adapter, c.negativeAdapter} {
+		if a == nil || !more {
+			continue
+		}
+		ea, ok := unwrapAdapter(a).(EnumeratingAdapter)
+		if !ok {
+			return ErrNotEnumerating
+		}
+		err := ea.Range(ctx, func(key uint64, entry EntryReader, size int64) bool {
+			response, _, err := readMetadata(entry, size)
+			if err != nil {
+				return true
+			}
+			var tags []string
+			if c.tags != nil {
+				tags = strings.Fields(response.Header.Get(c.tagHeader))
+			}
+			more = f(Entry{
+				Key:        response.Key,
+				Hash:       key,
+				StatusCode: response.StatusCode,
+				Expiration: response.Expiration,
+				Date:       response.Date,
+				Size:       size,
+				Vary:       response.Vary,
+				Negative:   a == c.negativeAdapter,
+				Tags:       tags,
+				adapter:    a,
+			})
+			return more
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// PurgeFunc frees the cached responses for which match returns true, and
+// returns how many were, see Entries.
+func (c *Client) PurgeFunc(ctx context.Context, match func(e Entry) bool) (int, error) {
+	var purge []Entry
+	err := c.Entries(ctx, func(e Entry) bool {
+		if match(e) {
+			purge = append(purge, e)
+		}
+		return true
+	})
+	for _, e := range purge {
+		c.releaseFrom(ctx, e.adapter, e.Hash)
+	}
+	return len(purge), err
+}
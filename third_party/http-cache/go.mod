@@ -1,22 +1,17 @@
 module github.com/victorspringer/http-cache
 
-go 1.18
+go 1.21
 
 require (
+	github.com/alicebob/miniredis/v2 v2.37.0
 	github.com/allegro/bigcache v1.2.1
-	github.com/go-redis/cache v6.4.0+incompatible
-	github.com/go-redis/redis v6.15.9+incompatible
-	github.com/vmihailenco/msgpack v4.0.4+incompatible
+	github.com/bradfitz/gomemcache v0.0.0-20230905024940-24af94b03874
+	github.com/redis/go-redis/v9 v9.17.2
 )
 
 require (
-	github.com/golang/protobuf v1.5.2 // indirect
-	github.com/google/go-cmp v0.5.9 // indirect
-	github.com/onsi/ginkgo v1.16.5 // indirect
-	github.com/onsi/gomega v1.24.1 // indirect
+	github.com/cespare/xxhash/v2 v2.3.0 // indirect
+	github.com/dgryski/go-rendezvous v0.0.0-20200823014737-9f7001d12a5f // indirect
 	github.com/stretchr/testify v1.8.1 // indirect
-	golang.org/x/net v0.2.0 // indirect
-	google.golang.org/appengine v1.6.7 // indirect
-	google.golang.org/protobuf v1.28.0 // indirect
-	gopkg.in/check.v1 v1.0.0-20201130134442-10cb98267c6c // indirect
+	github.com/yuin/gopher-lua v1.1.1 // indirect
 )
@@ -0,0 +1,74 @@
+// Package hashring implements a consistent hash ring, which spreads keys over
+// nodes, such as cache servers or replicas, so that adding or removing a node
+// only moves the keys it holds.
+package hashring
+
+import (
+	"hash/fnv"
+	"sort"
+	"strconv"
+)
+
+// pointsPerNode is the number of points of each node on the ring.
+const pointsPerNode = 160
+
+// Ring is a consistent hash ring. Each node is placed at many points of the
+// ring, and a key goes to the node of the first point after its hash, so that
+// adding or removing a node only moves the keys of its own points. Rings are
+// immutable and safe for concurrent use.
+type Ring struct {
+	nodes  []string
+	points []point
+}
+
+type point struct {
+	hash uint32
+	node int
+}
+
+// New returns a ring of nodes. The points of a node are derived from its name
+// only, so that rings of the same nodes place keys alike, whatever their
+// order.
+func New(nodes ...string) *Ring {
+	r := &Ring{nodes: nodes}
+	for i, node := range nodes {
+		for j := 0; j < pointsPerNode; j++ {
+			r.points = append(r.points, point{hashKey(node + "-" + strconv.Itoa(j)), i})
+		}
+	}
+	sort.Slice(r.points, func(i, j int) bool { return r.points[i].hash < r.points[j].hash })
+	return r
+}
+
+// Nodes returns the nodes of the ring, as given to New.
+func (r *Ring) Nodes() []string {
+	return r.nodes
+}
+
+// Locate returns the index, among the nodes of the ring, of the node a key
+// goes to, or false if the ring has no nodes.
+func (r *Ring) Locate(key string) (int, bool) {
+	if len(r.points) == 0 {
+		return 0, false
+	}
+	h := hashKey(key)
+	i := sort.Search(len(r.points), func(i int) bool { return r.points[i].hash >= h })
+	if i == len(r.points) {
+		i = 0
+	}
+	return r.points[i].node, true
+}
+
+// hashKey hashes a key with FNV-1a, mixed so that similar keys, such as the
+// points of a node, spread evenly over the ring.
+func hashKey(key string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	x := h.Sum32()
+	x ^= x >> 16
+	x *= 0x85ebca6b
+	x ^= x >> 13
+	x *= 0xc2b2ae35
+	x ^= x >> 16
+	return x
+}
@@ -0,0 +1,50 @@
+package hashring
+
+import (
+	"strconv"
+	"testing"
+)
+
+func TestRing(t *testing.T) {
+	all := New("10.0.0.1:11211", "10.0.0.2:11211", "10.0.0.3:11211")
+	fewer := New("10.0.0.1:11211", "10.0.0.2:11211")
+
+	moved, counts := 0, map[string]int{}
+	for i := 0; i < 3000; i++ {
+		key := "/assets/" + strconv.Itoa(i) + ".js"
+		x, _ := all.Locate(key)
+		y, _ := fewer.Locate(key)
+		before, after := all.Nodes()[x], fewer.Nodes()[y]
+		counts[before]++
+		if before != "10.0.0.3:11211" && before != after {
+			moved++
+		}
+	}
+	if moved != 0 {
+		t.Errorf("removing a node moved %v keys of the other nodes", moved)
+	}
+	for node, n := range counts {
+		if n < 700 || n > 1300 {
+			t.Errorf("node %v located for %v keys out of 3000", node, n)
+		}
+	}
+}
+
+func TestRingOrder(t *testing.T) {
+	a := New("a", "b", "c")
+	b := New("c", "a", "b")
+	for i := 0; i < 100; i++ {
+		key := strconv.Itoa(i)
+		x, _ := a.Locate(key)
+		y, _ := b.Locate(key)
+		if a.Nodes()[x] != b.Nodes()[y] {
+			t.Errorf("Ring.Locate(%v) = %v, want %v with the nodes reordered", key, b.Nodes()[y], a.Nodes()[x])
+		}
+	}
+}
+
+func TestRingEmpty(t *testing.T) {
+	if _, ok := New().Locate("key"); ok {
+		t.Error("Ring.Locate() = true on an empty ring")
+	}
+}
@@ -0,0 +1,268 @@
+/*
+MIT License
+
+Copyright (c) 2018 Victor Springer
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package cache
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// KeyPolicy sets which parts of a request make up its cache key. The zero
+// value keys requests by their URL, with the query parameters sorted.
+type KeyPolicy struct {
+	// IgnoreQuery leaves all the query parameters out of the key.
+	IgnoreQuery bool
+
+	// QueryAllow lists the only query parameters kept in the key.
+	QueryAllow []string
+
+	// QueryDeny lists query parameters left out of the key. Names ending
+	// with "*" are prefixes, e.g. "utm_*".
+	QueryDeny []string
+
+	// Host includes the request host in the key.
+	Host bool
+
+	// Headers lists request headers whose values are included in the key.
+	Headers []string
+
+	// Vary includes the values of the request headers listed in the Vary
+	// header of the response in the key. Responses varying on "*" are not
+	// cached.
+	Vary bool
+
+	// NormalizePath percent-decodes the path and collapses its duplicate
+	// slashes, so that e.g. "/a//%62" and "/a/b" share the same key.
+	NormalizePath bool
+}
+
+func (p *KeyPolicy) keepParam(name string) bool {
+	if len(p.QueryAllow) > 0 {
+		for _, allowed := range p.QueryAllow {
+			if name == allowed {
+				return true
+			}
+		}
+		return false
+	}
+	for _, denied := range p.QueryDeny {
+		if name == denied || (strings.HasSuffix(denied, "*") && strings.HasPrefix(name, strings.TrimSuffix(denied, "*"))) {
+			return false
+		}
+	}
+	return true
+}
+
+// canonicalKey returns the cache key of a request before it is hashed. The
+// URL query parameters are expected to be sorted already.
+func (c *Client) canonicalKey(u *url.URL, host string, header http.Header) string {
+	p := &c.keyPolicy
+	k := *u
+	if p.NormalizePath {
+		k.Path = normalizePath(k.Path)
+		k.RawPath = ""
+	}
+	switch {
+	case p.IgnoreQuery:
+		k.RawQuery = ""
+	case len(p.QueryAllow) > 0 || len(p.QueryDeny) > 0:
+		params := k.Query()
+		for name := range params {
+			if !p.keepParam(name) {
+				delete(params, name)
+			}
+		}
+		k.RawQuery = params.Encode()
+	}
+	if p.Host {
+		k.Host = strings.ToLower(host)
+	}
+	return headerKey(k.String(), p.Headers, header)
+}
+
+// headerKey appends the values of the given request headers to a key.
+func headerKey(key string, names []string, header http.Header) string {
+	if len(names) == 0 {
+		return key
+	}
+	var sb strings.Builder
+	sb.WriteString(key)
+	for _, name := range names {
+		sb.WriteString("\n")
+		sb.WriteString(http.CanonicalHeaderKey(name))
+		sb.WriteString(": ")
+		sb.WriteString(strings.Join(header.Values(name), ","))
+	}
+	return sb.String()
+}
+
+func normalizePath(p string) string {
+	var sb strings.Builder
+	for i := 0; i < len(p); i++ {
+		if p[i] == '/' && i > 0 && p[i-1] == '/' {
+			continue
+		}
+		sb.WriteByte(p[i])
+	}
+	return sb.String()
+}
+
+// varyHeaders returns the canonical names of the request headers listed in
+// the Vary header of a response, sorted.
+func varyHeaders(h http.Header) []string {
+	var names []string
+	for _, line := range h.Values("Vary") {
+		for _, name := range strings.Split(line, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				names = append(names, http.CanonicalHeaderKey(name))
+			}
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// variant resolves a Vary marker found under a primary key to the key and
+// the cached response of the variant matching the request, if any. Variants
+// older than their marker were purged along with it.
+func (c *Client) variant(ctx context.Context, marker Response, canonical string, header http.Header, now time.Time) (uint64, Response, AdapterV2, bool) {
+	canonical = headerKey(canonical, marker.Vary, header)
+	key := c.hashKey(canonical)
+	response, adapter, ok := c.lookup(ctx, key, canonical, now)
+	if ok && response.Date.Before(marker.Date) {
+		response.close()
+		c.releaseFrom(ctx, adapter, key)
+		return key, Response{}, nil, false
+	}
+	return key, response, adapter, ok
+}
+
+// storeVariant records under the primary key which request headers a
+// response varies on, and returns the key to store the response under, both
+// hashed and canonical.
+func (c *Client) storeVariant(ctx context.Context, key uint64, names []string, response Response, header http.Header) (uint64, string) {
+	marker := Response{Vary: names, Date: response.Date, Key: response.Key}
+	actx, cancel := c.adapterContext(context.WithoutCancel(ctx))
+	b, ok, err := c.adapter.GetContext(actx, key)
+	cancel()
+	c.adapterFailed(err)
+	if ok {
+		if existing, err := DecodeResponse(b); err == nil && existing.Key == response.Key && equalStrings(existing.Vary, names) {
+			marker = existing
+		}
+	}
+	if retainUntil := response.RetainUntil(); retainUntil.After(marker.Expiration) {
+		marker.Expiration = retainUntil
+	}
+	c.set(ctx, c.adapter, key, marker.Bytes(), marker.Expiration)
+	canonical := headerKey(response.Key, names, header)
+	return c.hashKey(canonical), canonical
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// sameVariant reports whether two requests get the same variant of a
+// response, as per its Vary header.
+func sameVariant(response, a, b http.Header) bool {
+	for _, name := range varyHeaders(response) {
+		if name == "*" || strings.Join(a.Values(name), ",") != strings.Join(b.Values(name), ",") {
+			return false
+		}
+	}
+	return true
+}
+
+// KeyHash reduces a canonical cache key to the key used by adapters.
+type KeyHash func(key string) uint64
+
+// HashFNV64a is the default KeyHash. It is fast, but collisions are easy to
+// craft, in which case the colliding requests miss the cache.
+func HashFNV64a(key string) uint64 {
+	return generateKey(key)
+}
+
+// HashSHA256 is a KeyHash, truncated to 64 bits, that makes collisions hard
+// to craft.
+func HashSHA256(key string) uint64 {
+	sum := sha256.Sum256([]byte(key))
+	return binary.BigEndian.Uint64(sum[:8])
+}
+
+func (c *Client) hashKey(canonical string) uint64 {
+	if c.keyHash == nil {
+		return generateKey(canonical)
+	}
+	return c.keyHash(canonical)
+}
+
+// Collisions returns the number of lookups that have found the entry of
+// another request under their hashed key.
+func (c *Client) Collisions() int64 {
+	return c.collisions.Load()
+}
+
+// ClientWithKeyHash sets the function reducing canonical cache keys to the
+// keys used by adapters. Optional setting. If not set, HashFNV64a is used.
+func ClientWithKeyHash(h KeyHash) ClientOption {
+	return func(c *Client) error {
+		if h == nil {
+			return errors.New("cache client key hash is not set")
+		}
+		c.keyHash = h
+		return nil
+	}
+}
+
+// ClientWithKeyPolicy sets which parts of a request make up its cache key.
+// Optional setting. If not set, requests are keyed by their URL.
+func ClientWithKeyPolicy(p KeyPolicy) ClientOption {
+	return func(c *Client) error {
+		if p.IgnoreQuery && (len(p.QueryAllow) > 0 || len(p.QueryDeny) > 0) {
+			return errors.New("cache client key policy cannot both ignore and filter query parameters")
+		}
+		if len(p.QueryAllow) > 0 && len(p.QueryDeny) > 0 {
+			return errors.New("cache client key policy cannot have both allowed and denied query parameters")
+		}
+		c.keyPolicy = p
+		return nil
+	}
+}
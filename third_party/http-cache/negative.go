@@ -0,0 +1,58 @@
+/*
+MIT License
+
+Copyright (c) 2018 Victor Springer
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package cache
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// negativeStatus reports whether responses with a given status code are
+// negatively cached, i.e. they state that there is nothing at the URL.
+func negativeStatus(statusCode int) bool {
+	return statusCode == http.StatusNotFound || statusCode == http.StatusForbidden
+}
+
+// ClientWithNegativeCaching enables caching of 404 Not Found and 403
+// Forbidden responses for the given ttl. They are kept in their own adapter,
+// so that they can never evict regular responses. Optional setting. If not
+// set, such responses are not cached.
+func ClientWithNegativeCaching(a Adapter, ttl time.Duration) ClientOption {
+	return func(c *Client) error {
+		if a == nil {
+			return errors.New("cache client negative adapter is not set")
+		}
+		if int64(ttl) < 1 {
+			return fmt.Errorf("cache client negative ttl %v is invalid", ttl)
+		}
+
+		c.negativeAdapter = UpgradeAdapter(a)
+		c.negativeTTL = ttl
+
+		return nil
+	}
+}
@@ -0,0 +1,49 @@
+/*
+MIT License
+
+Copyright (c) 2018 Victor Springer
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/package cache
+
+import "net/http"
+
+// revalidatable reports whether the origin can be asked if the response has
+// changed, rather than sending it again.
+func (r Response) revalidatable() bool {
+	return r.ETag != "" || r.Header.Get("Last-Modified") != ""
+}
+
+// originRequest returns the request to send to the next handler to fill the
+// cache. The client's own validators are dropped, so that the response can be
+// shared with other clients, and those of the expired response are added.
+func originRequest(r *http.Request, expired *Response) *http.Request {
+	req := r.Clone(r.Context())
+	req.Header.Del("If-None-Match")
+	req.Header.Del("If-Modified-Since")
+	if expired == nil {
+		return req
+	}
+	if expired.ETag != "" {
+		req.Header.Set("If-None-Match", expired.ETag)
+	} else if lastModified := expired.Header.Get("Last-Modified"); lastModified != "" {
+		req.Header.Set("If-Modified-Since", lastModified)
+	}
+	return req
+}
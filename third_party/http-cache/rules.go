@@ -0,0 +1,245 @@
+/*
+MIT License
+
+Copyright (c) 2018 Victor Springer
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package cache
+
+import (
+	"fmt"
+	"net/http"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// Rule sets how the responses it matches are cached. Every condition that is
+// set must match; rules are evaluated in order and the first match applies.
+type Rule struct {
+	// Path is a glob the request path must match, where "*" matches any
+	// sequence of characters but "/", "**" matches any sequence of
+	// characters and "?" matches any single character but "/".
+	Path string
+
+	// PathRegexp is a regular expression the request path must match.
+	PathRegexp *regexp.Regexp
+
+	// PathFunc is a predicate the request path must satisfy.
+	PathFunc func(path string) bool
+
+	// ContentType is a prefix the response Content-Type must start with,
+	// e.g. "image/" or "text/html".
+	ContentType string
+
+	// MinSize and MaxSize are the bounds, in bytes, of the response
+	// Content-Length. A zero MaxSize means no upper bound.
+	MinSize int64
+	MaxSize int64
+
+	// TTL is how long the response is cached for instead of the client
+	// TTL.
+	TTL time.Duration
+
+	// NoCache caches the response, but revalidates it with the origin
+	// before every use.
+	NoCache bool
+
+	// NoStore prevents the response from being cached.
+	NoStore bool
+
+	// CacheControl is the Cache-Control header sent to clients. If empty,
+	// it is derived from NoStore, NoCache and TTL, in that order, or the
+	// origin header is left as is.
+	CacheControl string
+
+	// Tags are added to the tags of the response, see ClientWithTags.
+	Tags []string
+}
+
+// rule is a Rule with its path glob compiled.
+type rule struct {
+	Rule
+	glob *regexp.Regexp
+}
+
+// HashedAssetsRule is a preset rule that marks files with a content hash in
+// their names, such as app.3f9a1c2b.js or index-0d4e8a7f.css, as immutable.
+var HashedAssetsRule = Rule{
+	PathFunc:     isHashedAsset,
+	TTL:          365 * 24 * time.Hour,
+	CacheControl: "public, max-age=31536000, immutable",
+}
+
+var hashedAssetPart = regexp.MustCompile(`^[0-9a-f]{8,}$`)
+
+// isHashedAsset reports whether the file name has a dot- or dash-separated
+// part, after the first one, that looks like a content hash: at least 8
+// lowercase hex characters, with both letters and digits among them. Parts
+// made of digits only, such as dates or versions in report-20240101.pdf, are
+// not hashes, and neither are words with digits such as banner-summer2024.jpg.
+// The rarer hashes made of digits only or encoded in base32 or base64 are
+// cached like any other file.
+func isHashedAsset(p string) bool {
+	name := path.Base(p)
+	ext := path.Ext(name)
+	if ext == "" {
+		return false
+	}
+	parts := strings.FieldsFunc(strings.TrimSuffix(name, ext), func(r rune) bool {
+		return r == '.' || r == '-'
+	})
+	if len(parts) < 2 {
+		return false
+	}
+	for _, part := range parts[1:] {
+		if hashedAssetPart.MatchString(part) && strings.ContainsAny(part, "0123456789") &&
+			strings.IndexFunc(part, unicode.IsLetter) >= 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func compileRule(r Rule) (rule, error) {
+	compiled := rule{Rule: r}
+	if r.Path != "" {
+		re, err := regexp.Compile(globToRegexp(r.Path))
+		if err != nil {
+			return rule{}, fmt.Errorf("invalid path glob %q: %w", r.Path, err)
+		}
+		compiled.glob = re
+	}
+	if r.MinSize < 0 || r.MaxSize < 0 || (r.MaxSize > 0 && r.MaxSize < r.MinSize) {
+		return rule{}, fmt.Errorf("invalid size bounds %d-%d", r.MinSize, r.MaxSize)
+	}
+	if r.TTL < 0 {
+		return rule{}, fmt.Errorf("invalid ttl %v", r.TTL)
+	}
+	for _, tag := range r.Tags {
+		if tag == "" || strings.IndexFunc(tag, unicode.IsSpace) >= 0 {
+			return rule{}, fmt.Errorf("invalid tag %q", tag)
+		}
+	}
+	return compiled, nil
+}
+
+func globToRegexp(glob string) string {
+	var sb strings.Builder
+	sb.WriteString("^")
+	for i := 0; i < len(glob); i++ {
+		switch c := glob[i]; {
+		case c == '*' && i+1 < len(glob) && glob[i+1] == '*':
+			sb.WriteString(".*")
+			i++
+		case c == '*':
+			sb.WriteString("[^/]*")
+		case c == '?':
+			sb.WriteString("[^/]")
+		default:
+			sb.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	sb.WriteString("$")
+	return sb.String()
+}
+
+// matches reports whether the rule applies to a response. A negative size
+// means that it is unknown, which fails any size bound.
+func (r *rule) matches(p, contentType string, size int64) bool {
+	if r.glob != nil && !r.glob.MatchString(p) {
+		return false
+	}
+	if r.PathRegexp != nil && !r.PathRegexp.MatchString(p) {
+		return false
+	}
+	if r.PathFunc != nil && !r.PathFunc(p) {
+		return false
+	}
+	if r.ContentType != "" && !strings.HasPrefix(contentType, r.ContentType) {
+		return false
+	}
+	if r.MinSize == 0 && r.MaxSize == 0 {
+		return true
+	}
+	return size >= 0 && size >= r.MinSize && (r.MaxSize == 0 || size <= r.MaxSize)
+}
+
+func (r *rule) cacheControl() string {
+	switch {
+	case r.CacheControl != "":
+		return r.CacheControl
+	case r.NoStore:
+		return "no-store"
+	case r.NoCache:
+		return "no-cache"
+	case r.TTL > 0:
+		return "max-age=" + strconv.FormatInt(int64(r.TTL/time.Second), 10)
+	}
+	return ""
+}
+
+// ruleFor returns the first rule matching a response, or nil.
+func (c *Client) ruleFor(p string, header http.Header, size int64) *rule {
+	contentType := header.Get("Content-Type")
+	for i := range c.rules {
+		if c.rules[i].matches(p, contentType, size) {
+			return &c.rules[i]
+		}
+	}
+	return nil
+}
+
+// applyRule finds the rule for a response about to be sent and sets the
+// Cache-Control header accordingly.
+func (c *Client) applyRule(p string, header http.Header) *rule {
+	size := int64(-1)
+	if v, err := strconv.ParseInt(header.Get("Content-Length"), 10, 64); err == nil {
+		size = v
+	}
+	r := c.ruleFor(p, header, size)
+	if r != nil {
+		if cc := r.cacheControl(); cc != "" {
+			header.Set("Cache-Control", cc)
+		}
+	}
+	return r
+}
+
+// ClientWithRules sets the rules deciding how responses are cached and which
+// Cache-Control header is sent to clients. Optional setting. If not set, all
+// responses are cached for the client TTL.
+func ClientWithRules(rules ...Rule) ClientOption {
+	return func(c *Client) error {
+		c.rules = make([]rule, 0, len(rules))
+		for i, r := range rules {
+			compiled, err := compileRule(r)
+			if err != nil {
+				return fmt.Errorf("cache client rule %d: %w", i, err)
+			}
+			c.rules = append(c.rules, compiled)
+		}
+		return nil
+	}
+}
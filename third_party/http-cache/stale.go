@@ -0,0 +1,130 @@
+/*
+MIT License
+
+Copyright (c) 2018 Victor Springer
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package cache
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// revalidateTimeout bounds a background revalidation, so that a hung origin
+// does not keep its goroutine forever.
+const revalidateTimeout = 30 * time.Second
+
+// staleWindows returns the stale-while-revalidate and stale-if-error windows
+// for a response, preferring the Cache-Control extensions set by the origin
+// over the client defaults.
+func (c *Client) staleWindows(h http.Header) (time.Duration, time.Duration) {
+	cc := parseCacheControl(h)
+	swr, ok := cc.seconds("stale-while-revalidate")
+	if !ok {
+		swr = c.staleWhileRevalidate
+	}
+	sie, ok := cc.seconds("stale-if-error")
+	if !ok {
+		sie = c.staleIfError
+	}
+	return swr, sie
+}
+
+// RetainUntil returns until when an adapter should keep a response, which is
+// past its expiration if it may be served stale.
+func (r Response) RetainUntil() time.Time {
+	window := r.StaleWhileRevalidate
+	if r.StaleIfError > window {
+		window = r.StaleIfError
+	}
+	return r.Expiration.Add(window)
+}
+
+// revalidate refreshes the cached response for a given key, the variant of
+// a primary key, in the background, unless a refresh for that key is already
+// in progress.
+func (c *Client) revalidate(next http.Handler, r *http.Request, primary, key uint64, canonical string, response Response) {
+	c.revalidatingMu.Lock()
+	if c.revalidating == nil {
+		c.revalidating = make(map[uint64]struct{})
+	}
+	if _, ok := c.revalidating[key]; ok {
+		c.revalidatingMu.Unlock()
+		return
+	}
+	c.revalidating[key] = struct{}{}
+	c.revalidatingMu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(r.Context()), revalidateTimeout)
+	req := originRequest(r.WithContext(ctx), &response)
+	go func() {
+		defer func() {
+			// A panicking origin must not take the process down from a
+			// background goroutine; the stale response is kept instead.
+			if v := recover(); v != nil {
+				slog.Error("cache revalidation panicked", "key", canonical, "panic", v)
+			}
+			cancel()
+
+			c.revalidatingMu.Lock()
+			delete(c.revalidating, key)
+			c.revalidatingMu.Unlock()
+		}()
+
+		rw := &responseWriter{
+			ResponseWriter: &discardResponseWriter{header: http.Header{}},
+			client:         c,
+			path:           r.URL.Path,
+			canonical:      canonical,
+			reqHeader:      r.Header,
+			cached:         &response,
+		}
+		next.ServeHTTP(rw, req)
+
+		switch {
+		case rw.servingCached:
+			c.extend(req.Context(), key, r.URL.Path, response, rw.Header())
+		case rw.statusCode >= 500:
+			// Keep serving the stale response until the origin recovers.
+		default:
+			c.store(req.Context(), primary, rw)
+		}
+	}()
+}
+
+// discardResponseWriter is the response writer for background requests that
+// have no client to respond to.
+type discardResponseWriter struct {
+	header http.Header
+}
+
+func (w *discardResponseWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *discardResponseWriter) Write(b []byte) (int, error) {
+	return len(b), nil
+}
+
+func (w *discardResponseWriter) WriteHeader(int) {}
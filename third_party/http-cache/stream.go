@@ -0,0 +1,138 @@
+package cache
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"time"
+)
+
+// streamThreshold is the size above which fresh cached responses are served
+// from streaming adapters as they are read, rather than read into memory
+// first.
+const streamThreshold = 1 << 20
+
+// StreamingAdapter is an Adapter which can also open cached responses for
+// reading, e.g. as files, so that large ones are served without reading them
+// into memory. Optional interface, used by the client instead of Get if
+// implemented.
+type StreamingAdapter interface {
+	Adapter
+
+	// Open returns a reader of the cached response for a given key, which
+	// the caller closes, along with its size. It also returns true or
+	// false, whether it exists or not.
+	Open(key uint64) (EntryReader, int64, bool)
+}
+
+// StreamingAdapterV2 is the version of StreamingAdapter taking a context and
+// returning errors, see AdapterV2. Optional interface, used by the client
+// instead of StreamingAdapter if implemented.
+type StreamingAdapterV2 interface {
+	AdapterV2
+
+	// OpenContext returns a reader of the cached response for a given key,
+	// which the caller closes, along with its size. It also returns true or
+	// false, whether it exists or not, and an error if it could not be
+	// opened. The reader outlives the context.
+	OpenContext(ctx context.Context, key uint64) (EntryReader, int64, bool, error)
+}
+
+// EntryReader reads a cached response opened by a StreamingAdapter. Readers
+// of responses held in memory may also implement Bytes() []byte, returning
+// the whole response, which is then decoded without copying it.
+type EntryReader interface {
+	io.ReaderAt
+	io.Closer
+}
+
+// get retrieves the cached response for a given key from an adapter. It also
+// returns true or false, whether it exists or not, and an error if it exists
+// but is corrupt, or if it could not be retrieved, in which case it does not.
+func get(ctx context.Context, a AdapterV2, key uint64, now time.Time) (Response, bool, error) {
+	var (
+		f    EntryReader
+		size int64
+		ok   bool
+		err  error
+	)
+	switch sa := unwrapAdapter(a).(type) {
+	case StreamingAdapterV2:
+		f, size, ok, err = sa.OpenContext(ctx, key)
+	case StreamingAdapter:
+		if err = ctx.Err(); err == nil {
+			f, size, ok = sa.Open(key)
+		}
+	default:
+		b, ok, err := a.GetContext(ctx, key)
+		if !ok {
+			return Response{}, false, err
+		}
+		response, err := DecodeResponse(b)
+		return response, true, err
+	}
+	if !ok {
+		return Response{}, false, err
+	}
+
+	response, err := openResponse(f, size, now)
+	if response.closer == nil {
+		f.Close()
+	}
+	return response, true, err
+}
+
+// openResponse decodes a cached response of a given size from f. The body of
+// a large response fresh at a given time is left to be read from f, which is
+// then closed with the response, while other responses are read into memory,
+// which also verifies their checksum. Streamed bodies are served as they are
+// read, so their checksum is not verified.
+func openResponse(f EntryReader, size int64, now time.Time) (Response, error) {
+	if m, ok := f.(interface{ Bytes() []byte }); ok {
+		return DecodeResponse(m.Bytes())
+	}
+	if size > streamThreshold {
+		response, lengths, err := readMetadata(f, size)
+		if err != nil {
+			return Response{}, err
+		}
+		if response.Expiration.After(now) {
+			response.body = io.NewSectionReader(f, int64(metadataLen(lengths)), int64(lengths[4]))
+			response.closer = f
+			return response, nil
+		}
+	}
+
+	b := make([]byte, size)
+	if _, err := f.ReadAt(b, 0); err != nil {
+		return Response{}, fmt.Errorf("%w: %v", ErrCorruptEntry, err)
+	}
+	return DecodeResponse(b)
+}
+
+// readMetadata decodes a cached response of a given size from f but its body,
+// and returns the lengths of its sections.
+func readMetadata(f EntryReader, size int64) (Response, [5]int, error) {
+	head := make([]byte, entryHeader)
+	if _, err := f.ReadAt(head, 0); err != nil {
+		return Response{}, [5]int{}, fmt.Errorf("%w: %v", ErrCorruptEntry, err)
+	}
+	lengths, err := entryLengths(head, size)
+	if err != nil {
+		return Response{}, lengths, err
+	}
+	meta := make([]byte, metadataLen(lengths))
+	if _, err := f.ReadAt(meta, 0); err != nil {
+		return Response{}, lengths, fmt.Errorf("%w: %v", ErrCorruptEntry, err)
+	}
+	response, err := decodeMetadata(meta, lengths)
+	return response, lengths, err
+}
+
+// close closes the reader the body of a streamed response is read from, if
+// any.
+func (r Response) close() {
+	if r.closer != nil {
+		r.closer.Close()
+	}
+}
@@ -0,0 +1,252 @@
+package cache
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// SurrogateKeyHeader is the response header conventionally listing the tags
+// of a response, separated by spaces.
+const SurrogateKeyHeader = "Surrogate-Key"
+
+// TagStats are the usage of the tag index of a client.
+type TagStats struct {
+	// Tags is the number of tags indexed.
+	Tags int
+
+	// Keys is the number of cached responses indexed, counted once per
+	// tag.
+	Keys int
+
+	// Dropped is the number of tags dropped from the index to stay within
+	// its capacity.
+	Dropped int64
+}
+
+// tagIndex maps tags to the keys of the cached responses tagged with them.
+// It holds at most maxKeys keys, counted once per tag, beyond which the least
+// recently tagged tags are dropped as a whole, so that their responses can no
+// longer be purged by tag. Keys of responses released by adapters on their
+// own may linger until their tag is purged or dropped.
+type tagIndex struct {
+	mu      sync.Mutex
+	maxKeys int
+	keys    int
+	dropped int64
+	tags    map[string]*list.Element
+	lru     *list.List
+	byKey   map[uint64][]string
+}
+
+// tagKeys are the keys tagged with a tag, as held by tagIndex.lru.
+type tagKeys struct {
+	tag  string
+	keys map[uint64]struct{}
+}
+
+func newTagIndex(maxKeys int) *tagIndex {
+	return &tagIndex{
+		maxKeys: maxKeys,
+		tags:    map[string]*list.Element{},
+		lru:     list.New(),
+		byKey:   map[uint64][]string{},
+	}
+}
+
+// set replaces the tags of the response cached for a given key. Duplicate
+// tags are indexed once.
+func (t *tagIndex) set(key uint64, tags []string) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.removeLocked(key)
+	if len(tags) == 0 {
+		return
+	}
+	unique := make([]string, 0, len(tags))
+	for _, tag := range tags {
+		e, ok := t.tags[tag]
+		if ok {
+			if _, dup := e.Value.(*tagKeys).keys[key]; dup {
+				continue
+			}
+			t.lru.MoveToFront(e)
+		} else {
+			e = t.lru.PushFront(&tagKeys{tag: tag, keys: map[uint64]struct{}{}})
+			t.tags[tag] = e
+		}
+		e.Value.(*tagKeys).keys[key] = struct{}{}
+		t.keys++
+		unique = append(unique, tag)
+	}
+	t.byKey[key] = unique
+	for t.keys > t.maxKeys {
+		t.dropLocked(t.lru.Back())
+	}
+}
+
+// remove drops the key of a released response from the index.
+func (t *tagIndex) remove(key uint64) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.removeLocked(key)
+}
+
+func (t *tagIndex) removeLocked(key uint64) {
+	for _, tag := range t.byKey[key] {
+		e := t.tags[tag]
+		if e == nil {
+			continue
+		}
+		tk := e.Value.(*tagKeys)
+		delete(tk.keys, key)
+		t.keys--
+		if len(tk.keys) == 0 {
+			t.lru.Remove(e)
+			delete(t.tags, tag)
+		}
+	}
+	delete(t.byKey, key)
+}
+
+// dropLocked drops a tag and its keys from the index.
+func (t *tagIndex) dropLocked(e *list.Element) {
+	tk := t.lru.Remove(e).(*tagKeys)
+	delete(t.tags, tk.tag)
+	t.keys -= len(tk.keys)
+	t.dropped++
+	for key := range tk.keys {
+		tags := t.byKey[key]
+		for i, tag := range tags {
+			if tag == tk.tag {
+				tags = append(tags[:i:i], tags[i+1:]...)
+				break
+			}
+		}
+		if len(tags) == 0 {
+			delete(t.byKey, key)
+		} else {
+			t.byKey[key] = tags
+		}
+	}
+}
+
+// take removes the keys tagged with a tag from the index and returns them.
+func (t *tagIndex) take(tag string) []uint64 {
+	if t == nil {
+		return nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	e, ok := t.tags[tag]
+	if !ok {
+		return nil
+	}
+	keys := make([]uint64, 0, len(e.Value.(*tagKeys).keys))
+	for key := range e.Value.(*tagKeys).keys {
+		keys = append(keys, key)
+	}
+	for _, key := range keys {
+		t.removeLocked(key)
+	}
+	return keys
+}
+
+func (t *tagIndex) stats() TagStats {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return TagStats{Tags: len(t.tags), Keys: t.keys, Dropped: t.dropped}
+}
+
+// responseTags returns the tags of a response: those listed by its tag
+// header, followed by those of its rule, without duplicates.
+func (c *Client) responseTags(header http.Header, r *rule) []string {
+	var tags []string
+	seen := map[string]bool{}
+	add := func(tag string) {
+		if !seen[tag] {
+			seen[tag] = true
+			tags = append(tags, tag)
+		}
+	}
+	for _, v := range header.Values(c.tagHeader) {
+		for _, tag := range strings.Fields(v) {
+			add(tag)
+		}
+	}
+	if r != nil {
+		for _, tag := range r.Tags {
+			add(tag)
+		}
+	}
+	return tags
+}
+
+// PurgeTag frees the cached responses tagged with a given tag, including
+// negative responses, and returns how many were. Only the responses cached
+// by the client since it started, or indexed by IndexTags, are known.
+func (c *Client) PurgeTag(ctx context.Context, tag string) int {
+	keys := c.tags.take(tag)
+	for _, key := range keys {
+		c.release(ctx, key)
+	}
+	return len(keys)
+}
+
+// IndexTags adds the tags of the responses already cached by the adapters of
+// the client to its tag index, e.g. those of a persistent cache on startup,
+// and returns how many responses were tagged, see Entries.
+func (c *Client) IndexTags(ctx context.Context) (int, error) {
+	if c.tags == nil {
+		return 0, errors.New("cache client tags are not enabled")
+	}
+	n := 0
+	err := c.Entries(ctx, func(e Entry) bool {
+		if len(e.Tags) > 0 {
+			c.tags.set(e.Hash, e.Tags)
+			n++
+		}
+		return true
+	})
+	return n, err
+}
+
+// TagStats returns the usage of the tag index, which is empty if tags are not
+// enabled.
+func (c *Client) TagStats() TagStats {
+	if c.tags == nil {
+		return TagStats{}
+	}
+	return c.tags.stats()
+}
+
+// ClientWithTags enables tagging cached responses, so that they can be purged
+// by tag with PurgeTag. Responses are tagged by the space-separated values of
+// a response header, which is kept from clients, and by the Tags of their
+// rule. The tag index holds up to maxKeys keys, counted once per tag.
+// Optional setting. If not set, responses are not tagged.
+func ClientWithTags(header string, maxKeys int) ClientOption {
+	return func(c *Client) error {
+		if header == "" {
+			return errors.New("cache client tag header is not set")
+		}
+		if maxKeys < 1 {
+			return fmt.Errorf("cache client tag index max keys %d is invalid", maxKeys)
+		}
+
+		c.tagHeader = http.CanonicalHeaderKey(header)
+		c.tags = newTagIndex(maxKeys)
+
+		return nil
+	}
+}
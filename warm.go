@@ -0,0 +1,345 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+const warmUserAgent = "go-serve-s3-warmer"
+
+// warmAPI is the subset of the S3 client used to find the paths to warm.
+type warmAPI interface {
+	objectGetter
+	s3.ListObjectsV2APIClient
+}
+
+// warmSources are where the paths to warm are read from: a local file and an
+// S3 manifest object, one path, object key or URL per line, and the keys of
+// the S3 objects under a prefix.
+type warmSources struct {
+	file     string
+	manifest string
+	prefix   string
+	client   warmAPI
+	bucket   string
+}
+
+// paths returns the paths to warm, without duplicates and up to maxPaths, in
+// the order of their sources. A source that cannot be read is reported in the
+// returned error, and the paths of the others are still returned.
+func (s warmSources) paths(ctx context.Context, maxPaths int) ([]string, error) {
+	set := &warmPaths{max: maxPaths, seen: map[string]bool{}}
+	var errs []error
+	if s.file != "" {
+		if err := s.readFile(set); err != nil {
+			errs = append(errs, fmt.Errorf("read warm file %s: %w", s.file, err))
+		}
+	}
+	if s.manifest != "" && !set.full() {
+		if err := s.readManifest(ctx, set); err != nil {
+			errs = append(errs, fmt.Errorf("read warm manifest %s: %w", s.manifest, err))
+		}
+	}
+	if s.prefix != "" && !set.full() {
+		if err := s.listPrefix(ctx, set); err != nil {
+			errs = append(errs, fmt.Errorf("list warm prefix %s: %w", s.prefix, err))
+		}
+	}
+	return set.list, errors.Join(errs...)
+}
+
+func (s warmSources) readFile(set *warmPaths) error {
+	f, err := os.Open(s.file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return set.read(f)
+}
+
+func (s warmSources) readManifest(ctx context.Context, set *warmPaths) error {
+	out, err := s.client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(strings.TrimPrefix(s.manifest, "/")),
+	})
+	if err != nil {
+		return err
+	}
+	defer out.Body.Close()
+	return set.read(out.Body)
+}
+
+func (s warmSources) listPrefix(ctx context.Context, set *warmPaths) error {
+	p := s3.NewListObjectsV2Paginator(s.client, &s3.ListObjectsV2Input{
+		Bucket: aws.String(s.bucket),
+		Prefix: aws.String(strings.TrimPrefix(s.prefix, "/")),
+	})
+	for p.HasMorePages() && !set.full() {
+		page, err := p.NextPage(ctx)
+		if err != nil {
+			return err
+		}
+		for _, obj := range page.Contents {
+			key := aws.ToString(obj.Key)
+			if key == "" || strings.HasSuffix(key, "/") {
+				continue
+			}
+			set.add(warmTarget(key))
+		}
+	}
+	return nil
+}
+
+// warmPaths is the list of paths to warm being collected.
+type warmPaths struct {
+	max  int
+	list []string
+	seen map[string]bool
+}
+
+func (p *warmPaths) full() bool {
+	return len(p.list) >= p.max
+}
+
+func (p *warmPaths) add(target string) {
+	if p.full() || p.seen[target] {
+		return
+	}
+	p.seen[target] = true
+	p.list = append(p.list, target)
+}
+
+// read adds the paths of a list, one per line. Blank lines and lines starting
+// with # are skipped.
+func (p *warmPaths) read(r io.Reader) error {
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan() && !p.full(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if strings.Contains(line, "://") {
+			u, err := url.Parse(line)
+			if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+				return fmt.Errorf("line %d: invalid url %q", n, line)
+			}
+			p.add(u.String())
+			continue
+		}
+		p.add(warmTarget(line))
+	}
+	return scanner.Err()
+}
+
+// warmTarget returns the request target of a path or object key.
+func warmTarget(name string) string {
+	return (&url.URL{Path: "/" + strings.TrimPrefix(name, "/")}).String()
+}
+
+// warmer preloads the cache by requesting a list of paths through the handler
+// chain with bounded concurrency, after which the handler reports ready.
+// Paths may also be absolute URLs, to set the Host of the requests.
+type warmer struct {
+	next        http.Handler
+	sources     warmSources
+	concurrency int
+	maxPaths    int
+
+	cancel   context.CancelFunc
+	finished chan struct{}
+
+	ready    atomic.Bool
+	done     atomic.Bool
+	paths    atomic.Int64
+	warmed   atomic.Int64
+	failed   atomic.Int64
+	bytes    atomic.Int64
+	duration atomic.Int64 // nanoseconds
+}
+
+func newWarmer(next http.Handler, sources warmSources, concurrency, maxPaths int) (*warmer, error) {
+	if concurrency < 1 {
+		return nil, fmt.Errorf("warmer concurrency %d is invalid", concurrency)
+	}
+	if maxPaths < 1 {
+		return nil, fmt.Errorf("warmer max paths %d is invalid", maxPaths)
+	}
+	if (sources.manifest != "" || sources.prefix != "") && sources.client == nil {
+		return nil, errors.New("warmer s3 client is not set")
+	}
+	return &warmer{
+		next:        next,
+		sources:     sources,
+		concurrency: concurrency,
+		maxPaths:    maxPaths,
+	}, nil
+}
+
+// Start warms the cache in the background. Until it is done, the warmer is
+// not ready, unless readyTimeout elapses first. If readyTimeout is 0,
+// readiness is not gated on warming.
+func (w *warmer) Start(readyTimeout time.Duration) {
+	ctx, cancel := context.WithCancel(context.Background())
+	w.cancel = cancel
+	w.finished = make(chan struct{})
+
+	stopTimer := func() bool { return false }
+	if readyTimeout > 0 {
+		timer := time.AfterFunc(readyTimeout, func() {
+			if !w.ready.Swap(true) {
+				slog.Warn("cache warming readiness timed out", "timeout", readyTimeout)
+			}
+		})
+		stopTimer = timer.Stop
+	} else {
+		w.ready.Store(true)
+	}
+
+	go func() {
+		defer close(w.finished)
+		w.run(ctx)
+		stopTimer()
+		w.ready.Store(true)
+	}()
+}
+
+// Stop cancels warming, if still running, and waits for it to return.
+func (w *warmer) Stop() {
+	if w.cancel == nil {
+		return
+	}
+	w.cancel()
+	<-w.finished
+}
+
+// Ready reports whether warming is done or no longer gates readiness.
+func (w *warmer) Ready() bool {
+	return w.ready.Load()
+}
+
+func (w *warmer) run(ctx context.Context) {
+	start := time.Now()
+	defer func() {
+		w.duration.Store(int64(time.Since(start)))
+		w.done.Store(true)
+		slog.Info("cache warming finished",
+			"paths", w.paths.Load(),
+			"warmed", w.warmed.Load(),
+			"failed", w.failed.Load(),
+			"bytes", w.bytes.Load(),
+			"duration", time.Since(start))
+	}()
+
+	paths, err := w.sources.paths(ctx, w.maxPaths)
+	if err != nil {
+		slog.Warn("cache warming paths not read", "err", err)
+	}
+	w.paths.Store(int64(len(paths)))
+	slog.Info("cache warming started", "paths", len(paths), "concurrency", w.concurrency)
+
+	targets := make(chan string)
+	var wg sync.WaitGroup
+	for range min(w.concurrency, len(paths)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for target := range targets {
+				w.warm(ctx, target)
+			}
+		}()
+	}
+	defer wg.Wait()
+	defer close(targets)
+	for _, target := range paths {
+		select {
+		case targets <- target:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// warm requests a path through the handler chain, discarding the response.
+func (w *warmer) warm(ctx context.Context, target string) {
+	r, err := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+	if err != nil {
+		w.failed.Add(1)
+		slog.Warn("cache warming request failed", "path", target, "err", err)
+		return
+	}
+	if r.URL.IsAbs() {
+		// Requested the way the server receives it, so that it is cached
+		// under the same key.
+		r.Host = r.URL.Host
+		r.URL = &url.URL{Path: r.URL.Path, RawPath: r.URL.RawPath, RawQuery: r.URL.RawQuery}
+	}
+	r.RequestURI = r.URL.RequestURI()
+	r.Header.Set("User-Agent", warmUserAgent)
+	rw := &warmResponseWriter{header: http.Header{}}
+	w.next.ServeHTTP(rw, r)
+	if rw.status == 0 {
+		rw.status = http.StatusOK
+	}
+	if rw.status >= http.StatusBadRequest {
+		w.failed.Add(1)
+		slog.Warn("cache warming request failed", "path", target, "status", rw.status)
+		return
+	}
+	w.warmed.Add(1)
+	w.bytes.Add(rw.written)
+}
+
+// Stats returns a snapshot of the warmer counters suitable for expvar.
+func (w *warmer) Stats() any {
+	return map[string]any{
+		"concurrency":      w.concurrency,
+		"max_paths":        w.maxPaths,
+		"paths_total":      w.paths.Load(),
+		"warmed_total":     w.warmed.Load(),
+		"failed_total":     w.failed.Load(),
+		"bytes_total":      w.bytes.Load(),
+		"duration_seconds": time.Duration(w.duration.Load()).Seconds(),
+		"done":             w.done.Load(),
+		"ready":            w.ready.Load(),
+	}
+}
+
+// warmResponseWriter discards a response, only recording its status and
+// size.
+type warmResponseWriter struct {
+	header  http.Header
+	status  int
+	written int64
+}
+
+func (rw *warmResponseWriter) Header() http.Header {
+	return rw.header
+}
+
+func (rw *warmResponseWriter) WriteHeader(status int) {
+	if rw.status == 0 {
+		rw.status = status
+	}
+}
+
+func (rw *warmResponseWriter) Write(b []byte) (int, error) {
+	if rw.status == 0 {
+		rw.status = http.StatusOK
+	}
+	rw.written += int64(len(b))
+	return len(b), nil
+}
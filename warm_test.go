@@ -0,0 +1,272 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	cache "github.com/victorspringer/http-cache"
+)
+
+// fakeWarmAPI serves a manifest object and lists keys one page per call.
+type fakeWarmAPI struct {
+	manifest string
+	pages    [][]string
+}
+
+func (f *fakeWarmAPI) GetObject(_ context.Context, params *s3.GetObjectInput, _ ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
+	if aws.ToString(params.Key) != "warm/manifest.txt" {
+		return nil, &types.NoSuchKey{}
+	}
+	return &s3.GetObjectOutput{Body: io.NopCloser(strings.NewReader(f.manifest))}, nil
+}
+
+func (f *fakeWarmAPI) ListObjectsV2(_ context.Context, params *s3.ListObjectsV2Input, _ ...func(*s3.Options)) (*s3.ListObjectsV2Output, error) {
+	if aws.ToString(params.Prefix) != "assets/" {
+		return nil, errors.New("unexpected prefix")
+	}
+	page := 0
+	if params.ContinuationToken != nil {
+		page = len(aws.ToString(params.ContinuationToken))
+	}
+	out := &s3.ListObjectsV2Output{}
+	for _, key := range f.pages[page] {
+		out.Contents = append(out.Contents, types.Object{Key: aws.String(key)})
+	}
+	if page+1 < len(f.pages) {
+		out.IsTruncated = aws.Bool(true)
+		out.NextContinuationToken = aws.String(strings.Repeat("x", page+1))
+	}
+	return out, nil
+}
+
+func TestWarmSources(t *testing.T) {
+	t.Parallel()
+	file := filepath.Join(t.TempDir(), "warm.txt")
+	require.NoError(t, os.WriteFile(file, []byte("# hottest files\n/index.html\n\n  app.js  \nhttps://cdn.example.com/logo.png\n/index.html\n"), 0o600))
+	client := &fakeWarmAPI{
+		manifest: "/app.js\nimg/a b.png\n",
+		pages:    [][]string{{"assets/", "assets/1.css", "assets/2.css"}, {"assets/3.css"}},
+	}
+
+	t.Run("reads all sources without duplicates", func(t *testing.T) {
+		t.Parallel()
+		s := warmSources{file: file, manifest: "/warm/manifest.txt", prefix: "/assets/", client: client, bucket: "bucket"}
+		paths, err := s.paths(context.Background(), 100)
+		require.NoError(t, err)
+		assert.Equal(t, []string{
+			"/index.html",
+			"/app.js",
+			"https://cdn.example.com/logo.png",
+			"/img/a%20b.png",
+			"/assets/1.css",
+			"/assets/2.css",
+			"/assets/3.css",
+		}, paths)
+	})
+
+	t.Run("stops at max paths", func(t *testing.T) {
+		t.Parallel()
+		s := warmSources{manifest: "warm/manifest.txt", prefix: "assets/", client: client, bucket: "bucket"}
+		paths, err := s.paths(context.Background(), 3)
+		require.NoError(t, err)
+		assert.Equal(t, []string{"/app.js", "/img/a%20b.png", "/assets/1.css"}, paths)
+	})
+
+	t.Run("keeps the paths of readable sources", func(t *testing.T) {
+		t.Parallel()
+		s := warmSources{file: filepath.Join(t.TempDir(), "missing.txt"), manifest: "missing.txt", prefix: "assets/", client: client, bucket: "bucket"}
+		paths, err := s.paths(context.Background(), 100)
+		require.ErrorIs(t, err, os.ErrNotExist)
+		var noSuchKey *types.NoSuchKey
+		require.ErrorAs(t, err, &noSuchKey)
+		assert.Equal(t, []string{"/assets/1.css", "/assets/2.css", "/assets/3.css"}, paths)
+	})
+
+	t.Run("rejects invalid urls", func(t *testing.T) {
+		t.Parallel()
+		invalid := filepath.Join(t.TempDir(), "warm.txt")
+		require.NoError(t, os.WriteFile(invalid, []byte("/ok\nftp://example.com/a\n"), 0o600))
+		paths, err := warmSources{file: invalid}.paths(context.Background(), 100)
+		require.ErrorContains(t, err, "line 2")
+		assert.Equal(t, []string{"/ok"}, paths)
+	})
+}
+
+func TestNewWarmer_Errors(t *testing.T) {
+	t.Parallel()
+	next := http.NotFoundHandler()
+	_, err := newWarmer(next, warmSources{file: "warm.txt"}, 0, 1)
+	require.Error(t, err)
+	_, err = newWarmer(next, warmSources{file: "warm.txt"}, 1, 0)
+	require.Error(t, err)
+	_, err = newWarmer(next, warmSources{prefix: "assets/"}, 1, 1)
+	require.Error(t, err)
+}
+
+func TestWarmer(t *testing.T) {
+	t.Run("warms paths with bounded concurrency", func(t *testing.T) {
+		t.Parallel()
+		var mu sync.Mutex
+		var requested []string
+		var inFlight, maxInFlight int
+		next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			requested = append(requested, r.Host+r.URL.Path)
+			inFlight++
+			maxInFlight = max(maxInFlight, inFlight)
+			mu.Unlock()
+			time.Sleep(5 * time.Millisecond)
+			mu.Lock()
+			inFlight--
+			mu.Unlock()
+			assert.Equal(t, warmUserAgent, r.UserAgent())
+			if r.URL.Path == "/missing.txt" {
+				http.NotFound(w, r)
+				return
+			}
+			_, _ = io.WriteString(w, "body")
+		})
+		client := &fakeWarmAPI{pages: [][]string{{"assets/1.css", "assets/2.css", "assets/3.css", "assets/4.css", "assets/5.css"}}}
+		file := filepath.Join(t.TempDir(), "warm.txt")
+		require.NoError(t, os.WriteFile(file, []byte("/missing.txt\nhttp://example.com/a.txt\n"), 0o600))
+
+		w, err := newWarmer(next, warmSources{file: file, prefix: "assets/", client: client, bucket: "bucket"}, 2, 100)
+		require.NoError(t, err)
+		w.Start(time.Minute)
+		require.Eventually(t, w.Ready, time.Second, time.Millisecond)
+		w.Stop()
+
+		assert.ElementsMatch(t, []string{
+			"/missing.txt", "example.com/a.txt",
+			"/assets/1.css", "/assets/2.css", "/assets/3.css", "/assets/4.css", "/assets/5.css",
+		}, requested)
+		assert.Equal(t, 2, maxInFlight)
+		stats := w.Stats().(map[string]any)
+		assert.Equal(t, int64(7), stats["paths_total"])
+		assert.Equal(t, int64(6), stats["warmed_total"])
+		assert.Equal(t, int64(1), stats["failed_total"])
+		assert.Equal(t, int64(24), stats["bytes_total"])
+		assert.Equal(t, true, stats["done"])
+		assert.Equal(t, true, stats["ready"])
+	})
+
+	t.Run("is ready after the readiness timeout", func(t *testing.T) {
+		t.Parallel()
+		release := make(chan struct{})
+		next := http.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) {
+			select {
+			case <-release:
+			case <-r.Context().Done():
+			}
+		})
+		file := filepath.Join(t.TempDir(), "warm.txt")
+		require.NoError(t, os.WriteFile(file, []byte("/slow.txt\n"), 0o600))
+
+		w, err := newWarmer(next, warmSources{file: file}, 1, 100)
+		require.NoError(t, err)
+		w.Start(20 * time.Millisecond)
+		assert.False(t, w.Ready())
+		require.Eventually(t, w.Ready, time.Second, time.Millisecond)
+		assert.Equal(t, false, w.Stats().(map[string]any)["done"])
+
+		close(release)
+		w.Stop()
+		assert.Equal(t, true, w.Stats().(map[string]any)["done"])
+	})
+
+	t.Run("is ready at once if readiness is not gated", func(t *testing.T) {
+		t.Parallel()
+		w, err := newWarmer(http.NotFoundHandler(), warmSources{file: filepath.Join(t.TempDir(), "missing.txt")}, 1, 100)
+		require.NoError(t, err)
+		w.Start(0)
+		assert.True(t, w.Ready())
+		w.Stop()
+		assert.Equal(t, int64(0), w.Stats().(map[string]any)["paths_total"])
+	})
+
+	t.Run("stops warming", func(t *testing.T) {
+		t.Parallel()
+		next := http.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) {
+			<-r.Context().Done()
+		})
+		file := filepath.Join(t.TempDir(), "warm.txt")
+		require.NoError(t, os.WriteFile(file, []byte("/a.txt\n/b.txt\n/c.txt\n"), 0o600))
+
+		w, err := newWarmer(next, warmSources{file: file}, 1, 100)
+		require.NoError(t, err)
+		w.Start(time.Minute)
+		w.Stop()
+		assert.True(t, w.Ready())
+		assert.Equal(t, true, w.Stats().(map[string]any)["done"])
+	})
+}
+
+func TestWarmer_CacheKeys(t *testing.T) {
+	t.Parallel()
+	var originRequests atomic.Int64
+	origin := http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		originRequests.Add(1)
+		_, _ = io.WriteString(w, "body")
+	})
+	client, err := cache.NewClient(
+		cache.ClientWithAdapter(newTestMemoryAdapter(t)),
+		cache.ClientWithTTL(time.Minute),
+		cache.ClientWithKeyPolicy(cache.KeyPolicy{Host: true}),
+	)
+	require.NoError(t, err)
+	handler := client.Middleware(origin)
+	file := filepath.Join(t.TempDir(), "warm.txt")
+	require.NoError(t, os.WriteFile(file, []byte("/a.txt\nhttp://example.com/b.txt?v=1\n"), 0o600))
+
+	w, err := newWarmer(handler, warmSources{file: file}, 1, 100)
+	require.NoError(t, err)
+	w.Start(time.Minute)
+	require.Eventually(t, w.Ready, time.Second, time.Millisecond)
+	w.Stop()
+	require.Equal(t, int64(2), originRequests.Load())
+
+	// Sent to example.com, as httptest.NewRequest sets it as the Host.
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/b.txt?v=1", nil))
+	assert.Equal(t, "body", rec.Body.String())
+	assert.Equal(t, int64(2), originRequests.Load(), "warmed responses served from the cache")
+}
+
+func TestReadyHandler(t *testing.T) {
+	t.Parallel()
+	h := &Handler{}
+	assert.HTTPStatusCode(t, h.readyHandler, http.MethodGet, "/ready", nil, http.StatusOK)
+
+	h.warmer = &warmer{}
+	assert.HTTPStatusCode(t, h.readyHandler, http.MethodGet, "/ready", nil, http.StatusServiceUnavailable)
+	h.warmer.ready.Store(true)
+	assert.HTTPStatusCode(t, h.readyHandler, http.MethodGet, "/ready", nil, http.StatusOK)
+}
+
+func TestWarmResponseWriter(t *testing.T) {
+	t.Parallel()
+	rw := &warmResponseWriter{header: http.Header{}}
+	http.Error(rw, "Not Found", http.StatusNotFound)
+	assert.Equal(t, http.StatusNotFound, rw.status)
+	assert.Equal(t, int64(len("Not Found\n")), rw.written)
+
+	rw = &warmResponseWriter{header: http.Header{}}
+	_, _ = rw.Write([]byte("body"))
+	rw.WriteHeader(http.StatusInternalServerError)
+	assert.Equal(t, http.StatusOK, rw.status)
+}